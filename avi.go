@@ -0,0 +1,421 @@
+package gocam
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// AVI layout constants. Files start with a RIFF 'AVI ' segment holding the
+// headers, the first frames and an idx1 index for players that predate
+// OpenDML. Once a segment reaches aviRIFFLimit the file continues with
+// RIFF 'AVIX' segments; every segment carries an OpenDML standard index
+// (ix00), referenced from the super index (indx) in the stream header.
+const (
+	aviRIFFLimit     = 1 << 30
+	aviSuperEntries  = 256 // segments, so about 256 GiB per file
+	aviKeyFrame      = 0x10
+	aviHasIndex      = 0x10
+	aviIndexOfChunks = 0x01
+	aviMaxFrameSize  = 1<<31 - 1
+)
+
+// AVIOptions configures an AVIWriter.
+type AVIOptions struct {
+	// Quality is the JPEG quality (1-100) of frames encoded from Data;
+	// zero means DefaultJPEGQuality. Frames carrying the camera's image in
+	// Frame.JPEG are stored as they are.
+	Quality int
+	// FPS fixes the frame rate. When zero, the rate is computed from the
+	// frame timestamps when the file is closed.
+	FPS float64
+}
+
+// AVIWriter writes frames as a Motion-JPEG AVI file that plays in common
+// video players. Frames are stored at a constant rate; by default it is the
+// average rate of their timestamps. The first frame fixes the size:
+// frames carrying a camera JPEG of that size are passed through, others are
+// encoded from Data, and frames of another size are rejected.
+//
+// Close must be called to write the indexes and final headers; a file that
+// is not closed holds the frames but no usable index.
+type AVIWriter struct {
+	w    io.WriteSeeker
+	opts AVIOptions
+
+	width, height int
+	pos           int64 // current end of the file
+	err           error // first write error; the file is unusable after it
+
+	riffStart int64 // offset of the current RIFF header
+	moviStart int64 // offset of the current movi LIST header
+	riffLimit int64
+
+	idx1        []aviIndexEntry // first segment, relative to its movi fourcc
+	segment     []aviIndexEntry // current segment, relative to riffStart
+	super       []aviSuperEntry
+	frames      int
+	firstFrames int   // frames in the first segment, once it is closed
+	firstEnd    int64 // end of the first segment, once it is closed
+	maxChunk    int
+	first, last time.Time
+
+	scratch []byte
+}
+
+type aviIndexEntry struct {
+	offset uint32
+	size   uint32
+}
+
+type aviSuperEntry struct {
+	offset   uint64
+	size     uint32
+	duration uint32
+}
+
+// NewAVIWriter returns a writer producing an AVI file on w, which must be
+// positioned at its start. opts may be nil.
+func NewAVIWriter(w io.WriteSeeker, opts *AVIOptions) *AVIWriter {
+	aw := &AVIWriter{w: w, riffLimit: aviRIFFLimit, firstFrames: -1}
+	if opts != nil {
+		aw.opts = *opts
+	}
+	return aw
+}
+
+// WriteFrame appends a frame.
+func (aw *AVIWriter) WriteFrame(frame Frame) error {
+	if aw.err != nil {
+		return aw.err
+	}
+	jpg, err := aw.payload(frame)
+	if err != nil {
+		return err
+	}
+	if len(jpg) > aviMaxFrameSize {
+		return errors.New("gocam: AVI frame too large")
+	}
+	if aw.pos == 0 {
+		aw.fail(aw.writeAt(0, aw.header(0)))
+		aw.startMovi()
+		if aw.err != nil {
+			return aw.err
+		}
+	}
+
+	// Leave room for the indexes of the segment.
+	size := aw.pos + int64(8+len(jpg)+len(jpg)&1) + aviStdIndexSize(len(aw.segment)+1) - aw.riffStart
+	if aw.firstFrames < 0 {
+		size += 8 + 16*int64(len(aw.idx1)+1)
+	}
+	if size > aw.riffLimit && len(aw.segment) > 0 {
+		aw.fail(aw.closeSegment())
+		aw.startRIFF("AVIX")
+		aw.startMovi()
+		if aw.err != nil {
+			return aw.err
+		}
+	}
+
+	if aw.firstFrames < 0 {
+		aw.idx1 = append(aw.idx1, aviIndexEntry{offset: uint32(aw.pos - aw.moviStart - 8), size: uint32(len(jpg))})
+	}
+	aw.segment = append(aw.segment, aviIndexEntry{offset: uint32(aw.pos + 8 - aw.riffStart), size: uint32(len(jpg))})
+
+	buf := append(aw.scratch[:0], "00dc"...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(jpg)))
+	aw.scratch = buf
+	if aw.fail(aw.write(buf)) != nil || aw.fail(aw.write(jpg)) != nil {
+		return aw.err
+	}
+	if len(jpg)&1 != 0 {
+		if aw.fail(aw.write([]byte{0})) != nil {
+			return aw.err
+		}
+	}
+
+	aw.frames++
+	if len(jpg) > aw.maxChunk {
+		aw.maxChunk = len(jpg)
+	}
+	if !frame.Timestamp.IsZero() {
+		if aw.first.IsZero() {
+			aw.first = frame.Timestamp
+		}
+		aw.last = frame.Timestamp
+	}
+	return nil
+}
+
+// payload returns the JPEG image stored for frame.
+func (aw *AVIWriter) payload(frame Frame) ([]byte, error) {
+	if frame.JPEG != nil {
+		if w, h, ok := jpegSize(frame.JPEG); ok && (aw.width == 0 || w == aw.width && h == aw.height) {
+			aw.width, aw.height = w, h
+			return frame.JPEG, nil
+		}
+	}
+	if err := checkFrame(frame); err != nil {
+		return nil, err
+	}
+	if aw.width != 0 && (frame.Width != aw.width || frame.Height != aw.height) {
+		return nil, fmt.Errorf("gocam: AVI frame size changed from %dx%d to %dx%d", aw.width, aw.height, frame.Width, frame.Height)
+	}
+	var buf jpegBuffer
+	if err := EncodeJPEG(&buf, frame, aw.opts.Quality); err != nil {
+		return nil, err
+	}
+	aw.width, aw.height = frame.Width, frame.Height
+	return buf, nil
+}
+
+// jpegBuffer collects an encoded image.
+type jpegBuffer []byte
+
+func (b *jpegBuffer) Write(p []byte) (int, error) {
+	*b = append(*b, p...)
+	return len(p), nil
+}
+
+// Close finishes the file: it writes the indexes and the final headers. It
+// does not close the underlying writer. Closing a writer that received no
+// frames writes nothing.
+func (aw *AVIWriter) Close() error {
+	if aw.err == errAVIClosed {
+		return nil
+	}
+	if aw.err != nil || aw.pos == 0 {
+		return aw.err
+	}
+	if aw.fail(aw.closeSegment()) != nil {
+		return aw.err
+	}
+	if aw.fail(aw.writeAt(0, aw.header(uint32(aw.firstEnd-8)))) != nil {
+		return aw.err
+	}
+	aw.err = errAVIClosed
+	return nil
+}
+
+var errAVIClosed = errors.New("gocam: AVI writer closed")
+
+// FPS returns the frame rate written to the headers: the configured one, or
+// the average rate of the timestamps seen so far.
+func (aw *AVIWriter) FPS() float64 {
+	if aw.opts.FPS > 0 {
+		return aw.opts.FPS
+	}
+	if aw.frames > 1 && aw.last.After(aw.first) {
+		return float64(aw.frames-1) * float64(time.Second) / float64(aw.last.Sub(aw.first))
+	}
+	return defaultY4MFPS
+}
+
+func (aw *AVIWriter) fail(err error) error {
+	if err != nil && aw.err == nil {
+		aw.err = err
+	}
+	return err
+}
+
+func (aw *AVIWriter) write(p []byte) error {
+	if _, err := aw.w.Write(p); err != nil {
+		return err
+	}
+	aw.pos += int64(len(p))
+	return nil
+}
+
+// writeAt overwrites earlier bytes and returns to the end of the file.
+func (aw *AVIWriter) writeAt(off int64, p []byte) error {
+	if _, err := aw.w.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := aw.w.Write(p); err != nil {
+		return err
+	}
+	if end := off + int64(len(p)); end > aw.pos {
+		aw.pos = end
+	}
+	_, err := aw.w.Seek(aw.pos, io.SeekStart)
+	return err
+}
+
+func (aw *AVIWriter) putUint32At(off int64, v uint32) error {
+	return aw.writeAt(off, binary.LittleEndian.AppendUint32(nil, v))
+}
+
+// startRIFF begins a RIFF segment whose size is patched when it closes.
+func (aw *AVIWriter) startRIFF(form string) {
+	aw.riffStart = aw.pos
+	aw.fail(aw.write([]byte("RIFF\x00\x00\x00\x00" + form)))
+}
+
+func (aw *AVIWriter) startMovi() {
+	aw.moviStart = aw.pos
+	aw.segment = aw.segment[:0]
+	aw.fail(aw.write([]byte("LIST\x00\x00\x00\x00movi")))
+}
+
+// aviStdIndexSize is the size of an ix00 chunk with n entries.
+func aviStdIndexSize(n int) int64 {
+	return 8 + 24 + 8*int64(n)
+}
+
+// closeSegment ends the current movi list with its standard index, adds
+// idx1 to the first segment and patches the list and RIFF sizes.
+func (aw *AVIWriter) closeSegment() error {
+	if len(aw.super) == aviSuperEntries {
+		return errors.New("gocam: AVI file exceeds the OpenDML index")
+	}
+	le := binary.LittleEndian
+
+	ixStart := aw.pos
+	ix := make([]byte, 0, aviStdIndexSize(len(aw.segment)))
+	ix = append(ix, "ix00"...)
+	ix = le.AppendUint32(ix, uint32(aviStdIndexSize(len(aw.segment))-8))
+	ix = le.AppendUint16(ix, 2) // wLongsPerEntry
+	ix = append(ix, 0, aviIndexOfChunks)
+	ix = le.AppendUint32(ix, uint32(len(aw.segment)))
+	ix = append(ix, "00dc"...)
+	ix = le.AppendUint64(ix, uint64(aw.riffStart)) // qwBaseOffset
+	ix = le.AppendUint32(ix, 0)
+	for _, e := range aw.segment {
+		ix = le.AppendUint32(ix, e.offset)
+		ix = le.AppendUint32(ix, e.size) // bit 31 clear: key frame
+	}
+	if err := aw.write(ix); err != nil {
+		return err
+	}
+	aw.super = append(aw.super, aviSuperEntry{offset: uint64(ixStart), size: uint32(len(ix)), duration: uint32(len(aw.segment))})
+	if err := aw.putUint32At(aw.moviStart+4, uint32(aw.pos-aw.moviStart-8)); err != nil {
+		return err
+	}
+
+	if aw.firstFrames < 0 {
+		aw.firstFrames = len(aw.idx1)
+		idx := make([]byte, 0, 8+16*len(aw.idx1))
+		idx = append(idx, "idx1"...)
+		idx = le.AppendUint32(idx, uint32(16*len(aw.idx1)))
+		for _, e := range aw.idx1 {
+			idx = append(idx, "00dc"...)
+			idx = le.AppendUint32(idx, aviKeyFrame)
+			idx = le.AppendUint32(idx, e.offset)
+			idx = le.AppendUint32(idx, e.size)
+		}
+		aw.idx1 = nil
+		if err := aw.write(idx); err != nil {
+			return err
+		}
+		aw.firstEnd = aw.pos
+	}
+	return aw.putUint32At(aw.riffStart+4, uint32(aw.pos-aw.riffStart-8))
+}
+
+// header returns the RIFF header and hdrl list up to the first movi list.
+// Its length does not depend on the contents, so Close rewrites it in
+// place.
+func (aw *AVIWriter) header(riffSize uint32) []byte {
+	le := binary.LittleEndian
+	fps := aw.FPS()
+	rate, scale := rateFraction(fps)
+	firstFrames := aw.firstFrames
+	if firstFrames < 0 {
+		firstFrames = aw.frames
+	}
+
+	var b []byte
+	chunk := func(id string) (start int) {
+		b = append(b, id...)
+		b = append(b, 0, 0, 0, 0)
+		return len(b)
+	}
+	list := func(id, form string) (start int) {
+		start = chunk(id)
+		b = append(b, form...)
+		return start
+	}
+	end := func(start int) {
+		le.PutUint32(b[start-4:], uint32(len(b)-start))
+	}
+
+	b = append(b, "RIFF"...)
+	b = le.AppendUint32(b, riffSize)
+	b = append(b, "AVI "...)
+
+	hdrl := list("LIST", "hdrl")
+	avih := chunk("avih")
+	b = le.AppendUint32(b, uint32(math.Round(1e6/fps)))                                // dwMicroSecPerFrame
+	b = le.AppendUint32(b, uint32(math.Min(float64(aw.maxChunk)*fps, math.MaxUint32))) // dwMaxBytesPerSec
+	b = le.AppendUint32(b, 0)                                                          // dwPaddingGranularity
+	b = le.AppendUint32(b, aviHasIndex)                                                // dwFlags
+	b = le.AppendUint32(b, uint32(firstFrames))                                        // dwTotalFrames
+	b = le.AppendUint32(b, 0)                                                          // dwInitialFrames
+	b = le.AppendUint32(b, 1)                                                          // dwStreams
+	b = le.AppendUint32(b, uint32(aw.maxChunk+8))                                      // dwSuggestedBufferSize
+	b = le.AppendUint32(b, uint32(aw.width))
+	b = le.AppendUint32(b, uint32(aw.height))
+	b = append(b, make([]byte, 16)...) // dwReserved
+	end(avih)
+
+	strl := list("LIST", "strl")
+	strh := chunk("strh")
+	b = append(b, "vidsMJPG"...)
+	b = le.AppendUint32(b, 0)                     // dwFlags
+	b = le.AppendUint32(b, 0)                     // wPriority, wLanguage
+	b = le.AppendUint32(b, 0)                     // dwInitialFrames
+	b = le.AppendUint32(b, uint32(scale))         // dwScale
+	b = le.AppendUint32(b, uint32(rate))          // dwRate
+	b = le.AppendUint32(b, 0)                     // dwStart
+	b = le.AppendUint32(b, uint32(aw.frames))     // dwLength
+	b = le.AppendUint32(b, uint32(aw.maxChunk+8)) // dwSuggestedBufferSize
+	b = le.AppendUint32(b, math.MaxUint32)        // dwQuality: default
+	b = le.AppendUint32(b, 0)                     // dwSampleSize
+	b = le.AppendUint16(b, 0)                     // rcFrame
+	b = le.AppendUint16(b, 0)
+	b = le.AppendUint16(b, uint16(aw.width))
+	b = le.AppendUint16(b, uint16(aw.height))
+	end(strh)
+
+	strf := chunk("strf") // BITMAPINFOHEADER
+	b = le.AppendUint32(b, 40)
+	b = le.AppendUint32(b, uint32(aw.width))
+	b = le.AppendUint32(b, uint32(aw.height))
+	b = le.AppendUint16(b, 1)  // biPlanes
+	b = le.AppendUint16(b, 24) // biBitCount
+	b = append(b, "MJPG"...)
+	b = le.AppendUint32(b, uint32(aw.width*aw.height*3))
+	b = append(b, make([]byte, 16)...)
+	end(strf)
+
+	indx := chunk("indx")     // OpenDML super index
+	b = le.AppendUint16(b, 4) // wLongsPerEntry
+	b = append(b, 0, 0)       // bIndexSubType, bIndexType: index of indexes
+	b = le.AppendUint32(b, uint32(len(aw.super)))
+	b = append(b, "00dc"...)
+	b = append(b, make([]byte, 12)...)
+	for i := 0; i < aviSuperEntries; i++ {
+		var e aviSuperEntry
+		if i < len(aw.super) {
+			e = aw.super[i]
+		}
+		b = le.AppendUint64(b, e.offset)
+		b = le.AppendUint32(b, e.size)
+		b = le.AppendUint32(b, e.duration)
+	}
+	end(indx)
+	end(strl)
+
+	odml := list("LIST", "odml")
+	dmlh := chunk("dmlh")
+	b = le.AppendUint32(b, uint32(aw.frames)) // dwTotalFrames
+	b = append(b, make([]byte, 244)...)
+	end(dmlh)
+	end(odml)
+	end(hdrl)
+	return b
+}
@@ -0,0 +1,285 @@
+package gocam
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// riffChunk is a parsed RIFF chunk; lists carry their form type and
+// children.
+type riffChunk struct {
+	id, form string
+	offset   int // of the chunk header
+	data     []byte
+	children []riffChunk
+}
+
+func parseRIFF(t *testing.T, b []byte, base int) []riffChunk {
+	t.Helper()
+	var chunks []riffChunk
+	for len(b) >= 8 {
+		id := string(b[:4])
+		n := int(binary.LittleEndian.Uint32(b[4:]))
+		if 8+n > len(b) {
+			t.Fatalf("chunk %q at %d: size %d exceeds its parent", id, base, n)
+		}
+		c := riffChunk{id: id, offset: base, data: b[8 : 8+n]}
+		if id == "RIFF" || id == "LIST" {
+			c.form = string(c.data[:4])
+			c.children = parseRIFF(t, c.data[4:], base+12)
+		}
+		chunks = append(chunks, c)
+		n += n & 1
+		b, base = b[8+n:], base+8+n
+	}
+	if len(b) != 0 {
+		t.Fatalf("%d trailing bytes at %d", len(b), base)
+	}
+	return chunks
+}
+
+// find returns the first chunk with the given id (or list form) below cs.
+func find(cs []riffChunk, id string) *riffChunk {
+	for i := range cs {
+		if cs[i].id == id || cs[i].form == id {
+			return &cs[i]
+		}
+		if c := find(cs[i].children, id); c != nil {
+			return c
+		}
+	}
+	return nil
+}
+
+// aviFrames returns the frames listed by every ix00 index of the file,
+// checking each against the chunk it points to.
+func aviFrames(t *testing.T, file []byte, riffs []riffChunk) [][]byte {
+	t.Helper()
+	le := binary.LittleEndian
+	var frames [][]byte
+	for _, riff := range riffs {
+		ix := find(riff.children, "ix00")
+		if ix == nil {
+			t.Fatalf("RIFF %s at %d has no ix00", riff.form, riff.offset)
+		}
+		base := int(le.Uint64(ix.data[12:]))
+		if base != riff.offset {
+			t.Fatalf("ix00 base %d, want %d", base, riff.offset)
+		}
+		n := int(le.Uint32(ix.data[4:]))
+		for i := 0; i < n; i++ {
+			off := base + int(le.Uint32(ix.data[24+i*8:]))
+			size := int(le.Uint32(ix.data[28+i*8:]))
+			if string(file[off-8:off-4]) != "00dc" || int(le.Uint32(file[off-4:])) != size {
+				t.Fatalf("ix00 entry %d does not point at a frame", i)
+			}
+			frames = append(frames, file[off:off+size])
+		}
+	}
+	return frames
+}
+
+func writeAVI(t *testing.T, aw *AVIWriter, frames []Frame) {
+	t.Helper()
+	for i, f := range frames {
+		if err := aw.WriteFrame(f); err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAVIWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clip.avi")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// One frame arrives with the camera's JPEG, which must be stored as is.
+	var camera bytes.Buffer
+	if err := EncodeJPEG(&camera, colorFrame(32, 16), 50); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	frames := make([]Frame, 5)
+	for i := range frames {
+		frames[i] = colorFrame(32, 16)
+		frames[i].Timestamp = start.Add(time.Duration(i) * 100 * time.Millisecond)
+	}
+	frames[2].JPEG = camera.Bytes()
+	writeAVI(t, NewAVIWriter(f, nil), frames)
+
+	file, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	riffs := parseRIFF(t, file, 0)
+	if len(riffs) != 1 || riffs[0].id != "RIFF" || riffs[0].form != "AVI " {
+		t.Fatalf("file is not a single RIFF AVI")
+	}
+	le := binary.LittleEndian
+	avih := find(riffs, "avih").data
+	if us, total, w, h := le.Uint32(avih), le.Uint32(avih[16:]), le.Uint32(avih[32:]), le.Uint32(avih[36:]); us != 100000 || total != 5 || w != 32 || h != 16 {
+		t.Errorf("avih: %d us per frame, %d frames, %dx%d", us, total, w, h)
+	}
+	strh := find(riffs, "strh").data
+	if string(strh[:8]) != "vidsMJPG" || le.Uint32(strh[20:]) != 1 || le.Uint32(strh[24:]) != 10 || le.Uint32(strh[32:]) != 5 {
+		t.Errorf("strh: %q scale %d rate %d length %d", strh[:8], le.Uint32(strh[20:]), le.Uint32(strh[24:]), le.Uint32(strh[32:]))
+	}
+	if dmlh := find(riffs, "dmlh").data; le.Uint32(dmlh) != 5 {
+		t.Errorf("dmlh: %d frames", le.Uint32(dmlh))
+	}
+
+	// idx1 offsets are relative to the movi fourcc.
+	movi := find(riffs, "movi")
+	idx1 := find(riffs, "idx1").data
+	if len(idx1) != 16*5 {
+		t.Fatalf("idx1 has %d bytes", len(idx1))
+	}
+	for i := 0; i < 5; i++ {
+		e := idx1[i*16:]
+		off := movi.offset + 8 + int(le.Uint32(e[8:]))
+		if string(e[:4]) != "00dc" || le.Uint32(e[4:])&aviKeyFrame == 0 || string(file[off:off+4]) != "00dc" {
+			t.Fatalf("idx1 entry %d is wrong", i)
+		}
+	}
+
+	stored := aviFrames(t, file, riffs)
+	if len(stored) != 5 {
+		t.Fatalf("%d frames indexed", len(stored))
+	}
+	if !bytes.Equal(stored[2], camera.Bytes()) {
+		t.Error("camera JPEG was re-encoded")
+	}
+	for i, jpg := range stored {
+		img, err := jpeg.Decode(bytes.NewReader(jpg))
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if b := img.Bounds(); b.Dx() != 32 || b.Dy() != 16 {
+			t.Fatalf("frame %d is %v", i, b)
+		}
+	}
+}
+
+func TestAVIWriterOpenDML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "long.avi")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	aw := NewAVIWriter(f, &AVIOptions{FPS: 30000.0 / 1001})
+	aw.riffLimit = 16 << 10 // a few frames per segment instead of 1 GiB
+	frames := make([]Frame, 40)
+	for i := range frames {
+		frames[i] = pixelFrame(40, 30)
+		frames[i].Data[0] = byte(i)
+	}
+	writeAVI(t, aw, frames)
+
+	file, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	riffs := parseRIFF(t, file, 0)
+	if len(riffs) < 3 || riffs[0].form != "AVI " {
+		t.Fatalf("%d RIFF segments, want several", len(riffs))
+	}
+	for _, r := range riffs[1:] {
+		if r.form != "AVIX" {
+			t.Fatalf("continuation segment %q", r.form)
+		}
+		if len(r.data)+8 > int(aw.riffLimit) {
+			t.Fatalf("segment of %d bytes exceeds the limit", len(r.data)+8)
+		}
+	}
+
+	le := binary.LittleEndian
+	indx := find(riffs, "indx").data
+	if n := int(le.Uint32(indx[4:])); n != len(riffs) {
+		t.Fatalf("super index has %d entries for %d segments", n, len(riffs))
+	}
+	total := 0
+	for i := range riffs {
+		e := indx[24+i*16:]
+		off, dur := int(le.Uint64(e)), int(le.Uint32(e[12:]))
+		if string(file[off:off+4]) != "ix00" {
+			t.Fatalf("super index entry %d does not point at ix00", i)
+		}
+		total += dur
+	}
+	if total != len(frames) {
+		t.Errorf("super index covers %d frames, want %d", total, len(frames))
+	}
+
+	first := len(find(riffs[:1], "idx1").data) / 16
+	if avih := find(riffs, "avih").data; int(le.Uint32(avih[16:])) != first {
+		t.Errorf("avih counts %d frames, first segment holds %d", le.Uint32(avih[16:]), first)
+	}
+	if dmlh := find(riffs, "dmlh").data; int(le.Uint32(dmlh)) != len(frames) {
+		t.Errorf("dmlh counts %d frames", le.Uint32(dmlh))
+	}
+	if strh := find(riffs, "strh").data; le.Uint32(strh[20:]) != 1001 || le.Uint32(strh[24:]) != 30000 {
+		t.Errorf("rate %d/%d", le.Uint32(strh[24:]), le.Uint32(strh[20:]))
+	}
+
+	stored := aviFrames(t, file, riffs)
+	if len(stored) != len(frames) {
+		t.Fatalf("%d frames indexed, want %d", len(stored), len(frames))
+	}
+}
+
+func TestAVIWriterRejectsSizeChange(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "x.avi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	aw := NewAVIWriter(f, nil)
+	if err := aw.WriteFrame(colorFrame(16, 16)); err != nil {
+		t.Fatal(err)
+	}
+	if err := aw.WriteFrame(colorFrame(8, 8)); err == nil {
+		t.Error("frame of another size accepted")
+	}
+}
+
+func TestRecordAVIFinalizesOnCancel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rec.avi")
+	ctx, cancel := context.WithCancel(context.Background())
+	frames := make(chan Frame)
+	done := make(chan error, 1)
+	go func() { done <- RecordAVI(ctx, frames, path, nil) }()
+
+	for i := 0; i < 3; i++ {
+		frames <- colorFrame(16, 8)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	riffs := parseRIFF(t, file, 0)
+	if got := len(aviFrames(t, file, riffs)); got != 3 {
+		t.Fatalf("%d frames indexed, want 3", got)
+	}
+	if find(riffs, "idx1") == nil {
+		t.Error("no idx1 index")
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"syscall"
 	"time"
 	"unsafe"
@@ -16,19 +17,32 @@ import (
 
 const (
 	v4l2BufTypeVideoCapture = 1
-	v4l2FieldAny            = 0
+	v4l2BufTypeVideoOutput  = 2
 	v4l2MemoryMMap          = 1
+	v4l2MemoryUserPtr       = 2
 )
 
 const (
-	v4l2PixFmtRGB24 = 0x33424752 // 'RGB3'
-	v4l2PixFmtYUYV  = 0x56595559 // 'YUYV'
-	v4l2PixFmtNV12  = 0x3231564E // 'NV12'
-	v4l2PixFmtYUV24 = 0x33565559 // 'YUV3' (packed 4:4:4, 8 bits per component)
+	v4l2FieldAny          = 0
+	v4l2FieldNone         = 1
+	v4l2FieldTop          = 2
+	v4l2FieldBottom       = 3
+	v4l2FieldInterlaced   = 4
+	v4l2FieldSeqTB        = 5
+	v4l2FieldSeqBT        = 6
+	v4l2FieldAlternate    = 7
+	v4l2FieldInterlacedTB = 8
+	v4l2FieldInterlacedBT = 9
 )
 
+// v4l2Std525_60 covers the 60 Hz video standards (NTSC, PAL-M, PAL-60), which
+// transmit the bottom field first.
+const v4l2Std525_60 = 0x0000F900
+
 const (
 	v4l2CapVideoCapture = 0x00000001
+	v4l2CapVideoOutput  = 0x00000002
+	v4l2CapReadWrite    = 0x01000000
 	v4l2CapStreaming    = 0x04000000
 	v4l2CapDeviceCaps   = 0x80000000
 )
@@ -38,6 +52,15 @@ const (
 	cifHeight = 288
 )
 
+// platformScheme is the URI scheme of the V4L2 backend, e.g.
+// "v4l2:///dev/video2". Plain paths select it as well.
+const platformScheme = "v4l2"
+
+const (
+	defaultV4L2Device = "/dev/video0"
+	v4l2BufferCount   = 4
+)
+
 type v4l2Capability struct {
 	Driver       [16]byte
 	Card         [32]byte
@@ -76,6 +99,27 @@ type v4l2RequestBuffers struct {
 	Reserved [2]uint32
 }
 
+type v4l2Fract struct {
+	Numerator   uint32
+	Denominator uint32
+}
+
+// v4l2CaptureParm is struct v4l2_captureparm, the capture member of the
+// v4l2_streamparm union.
+type v4l2CaptureParm struct {
+	Capability   uint32
+	CaptureMode  uint32
+	TimePerFrame v4l2Fract
+	ExtendedMode uint32
+	ReadBuffers  uint32
+	Reserved     [4]uint32
+}
+
+type v4l2StreamParm struct {
+	Type uint32
+	parm [200]byte
+}
+
 type v4l2Timecode struct {
 	Type     uint32
 	Flags    uint32
@@ -96,13 +140,19 @@ type v4l2Buffer struct {
 	Timecode  v4l2Timecode
 	Sequence  uint32
 	Memory    uint32
-	Offset    uint32
+	Offset    uint32 // union m: offset / userptr / fd
 	_         uint32 // union padding
 	Length    uint32
 	Reserved2 uint32
 	Reserved  uint32
 }
 
+// setUserPtr stores p in the m.userptr member of the buffer union, which
+// overlays Offset and the padding that follows it.
+func (b *v4l2Buffer) setUserPtr(p uintptr) {
+	*(*uintptr)(unsafe.Pointer(&b.Offset)) = p
+}
+
 const (
 	iocNRBits   = 8
 	iocTypeBits = 8
@@ -125,7 +175,7 @@ func ioc(dir, typ, nr, size uintptr) uintptr {
 	return (dir << iocDirShift) | (typ << iocTypeShift) | (nr << iocNRShift) | (size << iocSizeShift)
 }
 
-func io(typ, nr uintptr) uintptr {
+func ioNone(typ, nr uintptr) uintptr {
 	return ioc(iocNone, typ, nr, 0)
 }
 
@@ -150,11 +200,17 @@ var (
 	vidiocDQBuf     = iowr(uintptr('V'), 17, unsafe.Sizeof(v4l2Buffer{}))
 	vidiocStreamOn  = iow(uintptr('V'), 18, unsafe.Sizeof(uint32(0)))
 	vidiocStreamOff = iow(uintptr('V'), 19, unsafe.Sizeof(uint32(0)))
+	vidiocGParm     = iowr(uintptr('V'), 21, unsafe.Sizeof(v4l2StreamParm{}))
+	vidiocGStd      = ior(uintptr('V'), 23, unsafe.Sizeof(uint64(0)))
 )
 
 type mappedBuffer struct {
-	data   []byte
-	length uint32
+	data     []byte
+	length   uint32
+	mapped   bool // data comes from mmap and must be unmapped
+	user     bool // data is anonymous memory lent to the driver (USERPTR)
+	dmabufFD int  // exported or imported DMABUF descriptor
+	exported bool // dmabufFD was created by VIDIOC_EXPBUF and is ours to close
 }
 
 var camLog = log.New(os.Stdout, "", log.LstdFlags|log.Lmicroseconds)
@@ -169,18 +225,37 @@ func v4l2CString(b []byte) string {
 	return string(b)
 }
 
+// v4l2FormatName returns the short name used for a pixel format in errors.
+func v4l2FormatName(pixFmt uint32) string {
+	switch pixFmt {
+	case v4l2PixFmtYUV24:
+		return "YUV24"
+	case v4l2PixFmtNV12:
+		return "NV12"
+	case v4l2PixFmtYUYV:
+		return "YUYV"
+	case v4l2PixFmtRGB24:
+		return "RGB24"
+	case v4l2PixFmtI420:
+		return "I420"
+	case v4l2PixFmtMJPEG:
+		return "MJPEG"
+	}
+	return fmt.Sprintf("0x%x", pixFmt)
+}
+
 // logCameraConfig prints a human-readable description of the current camera configuration.
-func logCameraConfig(caps *v4l2Capability, pixelFormat uint32, width, height, stride int) {
+func logCameraConfig(dev *v4l2Device, width, height int) {
 	if width <= 0 || height <= 0 {
 		return
 	}
 
-	driver := v4l2CString(caps.Driver[:])
-	card := v4l2CString(caps.Card[:])
-	bus := v4l2CString(caps.BusInfo[:])
+	driver := v4l2CString(dev.caps.Driver[:])
+	card := v4l2CString(dev.caps.Card[:])
+	bus := v4l2CString(dev.caps.BusInfo[:])
 
 	formatIn := "UNKNOWN"
-	switch pixelFormat {
+	switch dev.pixelFormat {
 	case v4l2PixFmtYUV24:
 		formatIn = "YUV24 (YCbCr 4:4:4)"
 	case v4l2PixFmtNV12:
@@ -189,13 +264,15 @@ func logCameraConfig(caps *v4l2Capability, pixelFormat uint32, width, height, st
 		formatIn = "YUYV (YCbCr 4:2:2)"
 	case v4l2PixFmtRGB24:
 		formatIn = "RGB24"
+	case v4l2PixFmtMJPEG:
+		formatIn = "MJPEG (decoded)"
 	}
 
 	bufPixels := width * height
 	bufBytes := bufPixels * 3
 
 	camLog.Println("[gocam] [V4L2]")
-	camLog.Printf("[gocam]   /dev/video0 (Capture)\n")
+	camLog.Printf("[gocam]   %s (Capture)\n", dev.path)
 	if card != "" || driver != "" || bus != "" {
 		camLog.Printf("[gocam]     Card:       %s\n", card)
 		camLog.Printf("[gocam]     Driver:     %s\n", driver)
@@ -203,250 +280,767 @@ func logCameraConfig(caps *v4l2Capability, pixelFormat uint32, width, height, st
 	}
 	camLog.Printf("[gocam]     Format:      %s -> YCbCr 4:4:4 (uint8)\n", formatIn)
 	camLog.Printf("[gocam]     Resolution:  %d x %d\n", width, height)
-	camLog.Printf("[gocam]     Stride:      %d bytes\n", stride)
+	if dev.fps > 0 {
+		camLog.Printf("[gocam]     Frame rate:  %g fps\n", dev.fps)
+	}
+	camLog.Printf("[gocam]     Stride:      %d bytes\n", dev.stride)
+	if dev.field != v4l2FieldNone && dev.field != v4l2FieldAny {
+		camLog.Printf("[gocam]     Field:       %s\n", v4l2FieldName(dev.field))
+	}
 	camLog.Printf("[gocam]     Buffer:      %d*3 (%d bytes)\n", bufPixels, bufBytes)
+	ioDesc := dev.io.String()
+	if dev.released != nil {
+		ioDesc += " (DMABUF export)"
+	}
+	camLog.Printf("[gocam]     I/O:         %s\n", ioDesc)
+	if len(dev.buffers) > 0 {
+		camLog.Printf("[gocam]     Buffers:     %d\n", len(dev.buffers))
+	}
 	camLog.Println("[gocam]     Conversion:")
 	camLog.Println("[gocam]       Pre Format Conversion:  NO (device native)")
 	camLog.Println("[gocam]       Post Format Conversion: YES (to packed YCbCr444)")
 	camLog.Println("[gocam]       Resampling:             NO")
 }
 
-// StartStream opens /dev/video0, configures a V4L2 capture stream, and
-// returns a channel of frames encoded as tightly packed YCbCr 4:4:4 (YUV24) buffers.
-func StartStream(ctx context.Context) (<-chan Frame, error) {
-	fd, err := syscall.Open("/dev/video0", syscall.O_RDWR|syscall.O_NONBLOCK, 0)
-	if err != nil {
-		return nil, fmt.Errorf("gocam: cannot open /dev/video0: %w", err)
-	}
-
-	var (
-		buffers       []mappedBuffer
-		streamStarted bool
-	)
+// v4l2Device is an open V4L2 capture or output device together with the
+// negotiated format and the buffers used for the selected I/O method.
+type v4l2Device struct {
+	fd      int
+	path    string
+	bufType uint32 // v4l2BufTypeVideoCapture or v4l2BufTypeVideoOutput
+	caps    v4l2Capability
+	io      IOMethod
+
+	pixelFormat uint32
+	width       int
+	height      int
+	stride      int
+	sizeImage   int
+	field       uint32  // negotiated V4L2 field order
+	preferMJPEG bool    // negotiate MJPEG first (WithMJPEG)
+	std         uint64  // current video standard, for V4L2_FIELD_INTERLACED
+	fps         float64 // nominal frame rate, 0 when the driver does not say
+
+	controls  []v4l2QueryCtrl // enumerated by subscribeEvents
+	restore   []v4l2Control   // control values to reset on close
+	buffers   []mappedBuffer  // streaming I/O (mmap, userptr and dmabuf)
+	queued    int             // buffers currently owned by the driver
+	readBuf   []byte          // read() I/O
+	importFDs []int           // caller-owned descriptors for DMABUF import
+	released  chan v4l2Buffer // buffers of released frames when exporting
+	exports   int             // exported frames not yet seen in released
+	streaming bool
+}
 
-	cleanup := func() {
-		if streamStarted {
-			bufType := uint32(v4l2BufTypeVideoCapture)
-			_ = ioctl(fd, vidiocStreamOff, unsafe.Pointer(&bufType))
-		}
-		for _, mb := range buffers {
-			if mb.data != nil {
-				_ = syscall.Munmap(mb.data)
-			}
-		}
-		_ = syscall.Close(fd)
+// openV4L2Device opens path for the given buffer type and queries its
+// capabilities.
+func openV4L2Device(path string, bufType uint32) (*v4l2Device, error) {
+	fd, err := v4l2Sys.open(path)
+	if err != nil {
+		return nil, fmt.Errorf("gocam: cannot open %s: %w", path, err)
 	}
 
-	var caps v4l2Capability
-	if err := ioctl(fd, vidiocQuerycap, unsafe.Pointer(&caps)); err != nil {
-		cleanup()
+	dev := &v4l2Device{fd: fd, path: path, bufType: bufType}
+	if err := ioctl(fd, vidiocQuerycap, unsafe.Pointer(&dev.caps)); err != nil {
+		dev.close()
 		return nil, fmt.Errorf("gocam: VIDIOC_QUERYCAP failed: %w", err)
 	}
+	return dev, nil
+}
 
-	capsToCheck := caps.Capabilities
-	if capsToCheck&v4l2CapDeviceCaps != 0 {
-		capsToCheck = caps.DeviceCaps
+// capabilities returns the capabilities of the opened device node, which may
+// be narrower than those of the physical device as a whole.
+func (d *v4l2Device) capabilities() uint32 {
+	if d.caps.Capabilities&v4l2CapDeviceCaps != 0 {
+		return d.caps.DeviceCaps
 	}
-	if capsToCheck&v4l2CapVideoCapture == 0 {
-		cleanup()
-		return nil, fmt.Errorf("gocam: device does not support video capture")
-	}
-	if capsToCheck&v4l2CapStreaming == 0 {
-		cleanup()
-		return nil, fmt.Errorf("gocam: device does not support streaming I/O")
+	return d.caps.Capabilities
+}
+
+// selectIO resolves the requested I/O method against the capability flags.
+// IOAuto prefers streaming and falls back to read() for devices that only
+// advertise V4L2_CAP_READWRITE.
+func (d *v4l2Device) selectIO(requested IOMethod) error {
+	caps := d.capabilities()
+	if d.bufType == v4l2BufTypeVideoOutput {
+		if caps&v4l2CapVideoOutput == 0 {
+			return fmt.Errorf("gocam: device does not support video output")
+		}
+	} else if caps&v4l2CapVideoCapture == 0 {
+		return fmt.Errorf("gocam: device does not support video capture")
 	}
 
-	const (
-		defaultWidth  = cifWidth
-		defaultHeight = cifHeight
-	)
+	streaming := caps&v4l2CapStreaming != 0
+	readWrite := caps&v4l2CapReadWrite != 0
+
+	switch requested {
+	case IOAuto:
+		switch {
+		case streaming:
+			d.io = IOMMap
+		case readWrite:
+			d.io = IORead
+		default:
+			return fmt.Errorf("gocam: device supports neither streaming nor read() I/O")
+		}
+	case IOMMap, IOUserPtr, IODMABuf:
+		if !streaming {
+			return fmt.Errorf("gocam: device does not support streaming I/O")
+		}
+		d.io = requested
+	case IORead:
+		if !readWrite {
+			return fmt.Errorf("gocam: device does not support read() I/O")
+		}
+		d.io = IORead
+	default:
+		return fmt.Errorf("gocam: unknown I/O method %d", int(requested))
+	}
+	return nil
+}
 
-	width := uint32(defaultWidth)
-	height := uint32(defaultHeight)
+// v4l2FormatCandidates lists the pixel formats tried during negotiation, in
+// order of preference.
+var v4l2FormatCandidates = []uint32{
+	v4l2PixFmtYUV24,
+	v4l2PixFmtNV12,
+	v4l2PixFmtYUYV,
+	v4l2PixFmtRGB24,
+	v4l2PixFmtMJPEG,
+}
 
-	pixelFormat := uint32(v4l2PixFmtYUV24)
+// formatCandidates returns the negotiation order for the device:
+// v4l2FormatCandidates, with MJPEG moved to the front when preferred.
+func (d *v4l2Device) formatCandidates() []uint32 {
+	if !d.preferMJPEG {
+		return v4l2FormatCandidates
+	}
+	candidates := []uint32{v4l2PixFmtMJPEG}
+	for _, f := range v4l2FormatCandidates {
+		if f != v4l2PixFmtMJPEG {
+			candidates = append(candidates, f)
+		}
+	}
+	return candidates
+}
 
-	format := v4l2Format{Type: v4l2BufTypeVideoCapture}
+// setFormat issues VIDIOC_S_FMT and returns the format the driver settled on.
+func (d *v4l2Device) setFormat(pixFmt, width, height uint32) (v4l2PixFormat, error) {
+	format := v4l2Format{Type: d.bufType}
 	pix := (*v4l2PixFormat)(unsafe.Pointer(&format.fmt[0]))
 	pix.Width = width
 	pix.Height = height
-	pix.Pixelformat = pixelFormat
+	pix.Pixelformat = pixFmt
 	pix.Field = v4l2FieldAny
-
-	if err := ioctl(fd, vidiocSFmt, unsafe.Pointer(&format)); err != nil {
-		cleanup()
-		return nil, fmt.Errorf("gocam: VIDIOC_S_FMT YUV24 failed: %w", err)
+	if d.bufType == v4l2BufTypeVideoOutput {
+		pix.Field = v4l2FieldNone // output drivers cannot choose for us
 	}
 
-	pixelFormat = pix.Pixelformat
-	width = pix.Width
-	height = pix.Height
-	stride := int(pix.Bytesperline)
-
-	if pixelFormat != v4l2PixFmtYUV24 {
-		// Fallback to NV12
-		pixelFormat = v4l2PixFmtNV12
-
-		format = v4l2Format{Type: v4l2BufTypeVideoCapture}
-		pix = (*v4l2PixFormat)(unsafe.Pointer(&format.fmt[0]))
-		pix.Width = width
-		pix.Height = height
-		pix.Pixelformat = pixelFormat
-		pix.Field = v4l2FieldAny
+	if err := ioctl(d.fd, vidiocSFmt, unsafe.Pointer(&format)); err != nil {
+		return v4l2PixFormat{}, err
+	}
+	return *pix, nil
+}
 
-		if err := ioctl(fd, vidiocSFmt, unsafe.Pointer(&format)); err != nil {
-			cleanup()
-			return nil, fmt.Errorf("gocam: VIDIOC_S_FMT fallback NV12 failed: %w", err)
+// negotiateFormat walks the format candidates until the driver accepts one.
+// Each attempt starts from the size the driver returned for the previous one.
+func (d *v4l2Device) negotiateFormat(width, height uint32) error {
+	var pix v4l2PixFormat
+	for i, want := range d.formatCandidates() {
+		var err error
+		pix, err = d.setFormat(want, width, height)
+		if err != nil {
+			if i == 0 {
+				return fmt.Errorf("gocam: VIDIOC_S_FMT %s failed: %w", v4l2FormatName(want), err)
+			}
+			return fmt.Errorf("gocam: VIDIOC_S_FMT fallback %s failed: %w", v4l2FormatName(want), err)
 		}
 
-		pixelFormat = pix.Pixelformat
 		width = pix.Width
 		height = pix.Height
-		stride = int(pix.Bytesperline)
-
-		if pixelFormat != v4l2PixFmtNV12 {
-			// Fallback to YUYV
-			pixelFormat = v4l2PixFmtYUYV
-
-			format = v4l2Format{Type: v4l2BufTypeVideoCapture}
-			pix = (*v4l2PixFormat)(unsafe.Pointer(&format.fmt[0]))
-			pix.Width = width
-			pix.Height = height
-			pix.Pixelformat = pixelFormat
-			pix.Field = v4l2FieldAny
-
-			if err := ioctl(fd, vidiocSFmt, unsafe.Pointer(&format)); err != nil {
-				cleanup()
-				return nil, fmt.Errorf("gocam: VIDIOC_S_FMT fallback YUYV failed: %w", err)
-			}
+		if pix.Pixelformat == want {
+			break
+		}
+	}
 
-			pixelFormat = pix.Pixelformat
-			width = pix.Width
-			height = pix.Height
-			stride = int(pix.Bytesperline)
-
-			if pixelFormat != v4l2PixFmtYUYV {
-				// Final fallback to RGB24
-				pixelFormat = v4l2PixFmtRGB24
-
-				format = v4l2Format{Type: v4l2BufTypeVideoCapture}
-				pix = (*v4l2PixFormat)(unsafe.Pointer(&format.fmt[0]))
-				pix.Width = width
-				pix.Height = height
-				pix.Pixelformat = pixelFormat
-				pix.Field = v4l2FieldAny
-
-				if err := ioctl(fd, vidiocSFmt, unsafe.Pointer(&format)); err != nil {
-					cleanup()
-					return nil, fmt.Errorf("gocam: VIDIOC_S_FMT fallback RGB24 failed: %w", err)
-				}
+	switch pix.Pixelformat {
+	case v4l2PixFmtYUV24, v4l2PixFmtNV12, v4l2PixFmtYUYV, v4l2PixFmtRGB24, v4l2PixFmtMJPEG:
+	default:
+		return fmt.Errorf("gocam: unsupported pixel format 0x%x", pix.Pixelformat)
+	}
 
-				pixelFormat = pix.Pixelformat
-				width = pix.Width
-				height = pix.Height
-				stride = int(pix.Bytesperline)
-				if pixelFormat != v4l2PixFmtRGB24 {
-					cleanup()
-					return nil, fmt.Errorf("gocam: unsupported pixel format 0x%x", pixelFormat)
-				}
-			}
-		}
+	d.pixelFormat = pix.Pixelformat
+	d.width = int(pix.Width)
+	d.height = int(pix.Height)
+	d.stride = int(pix.Bytesperline)
+	d.field = pix.Field
+
+	// The temporal order of V4L2_FIELD_INTERLACED depends on the video
+	// standard. Devices without standards (webcams) fail the query and are
+	// treated as top field first.
+	if d.field == v4l2FieldInterlaced {
+		_ = ioctl(d.fd, vidiocGStd, unsafe.Pointer(&d.std))
 	}
+	d.fps = d.frameRate()
 
-	if stride == 0 {
-		switch pixelFormat {
+	if d.stride == 0 {
+		switch d.pixelFormat {
 		case v4l2PixFmtRGB24:
-			stride = int(width) * 3
+			d.stride = d.width * 3
 		case v4l2PixFmtYUYV:
-			stride = int(width) * 2
+			d.stride = d.width * 2
 		case v4l2PixFmtNV12:
-			stride = int(width)
+			d.stride = d.width
 		case v4l2PixFmtYUV24:
-			stride = int(width) * 3
+			d.stride = d.width * 3
+		}
+	}
+
+	d.sizeImage = int(pix.Sizeimage)
+	if d.sizeImage == 0 {
+		d.sizeImage = d.stride * d.height
+		switch d.pixelFormat {
+		case v4l2PixFmtNV12:
+			d.sizeImage += d.stride * ((d.height + 1) / 2)
+		case v4l2PixFmtMJPEG:
+			// Compressed images vary in size; two bytes per pixel holds
+			// any sensible quality.
+			d.sizeImage = d.width * d.height * 2
+		}
+	}
+	return nil
+}
+
+// frameRate returns the frame rate the driver reports for the negotiated
+// format, or 0 if it does not support VIDIOC_G_PARM.
+func (d *v4l2Device) frameRate() float64 {
+	parm := v4l2StreamParm{Type: d.bufType}
+	if err := ioctl(d.fd, vidiocGParm, unsafe.Pointer(&parm)); err != nil {
+		return 0
+	}
+	// The output member of the union starts with the same fields.
+	tpf := (*v4l2CaptureParm)(unsafe.Pointer(&parm.parm[0])).TimePerFrame
+	if tpf.Numerator == 0 || tpf.Denominator == 0 {
+		return 0
+	}
+	return float64(tpf.Denominator) / float64(tpf.Numerator)
+}
+
+// fieldOrder maps the negotiated field (or, for V4L2_FIELD_ALTERNATE, the
+// field of the dequeued buffer) to the layout of the converted frame.
+func (d *v4l2Device) fieldOrder(bufField uint32) FieldOrder {
+	field := d.field
+	if field == v4l2FieldAlternate {
+		field = bufField
+	}
+	switch field {
+	case v4l2FieldTop:
+		return FieldTop
+	case v4l2FieldBottom:
+		return FieldBottom
+	case v4l2FieldInterlaced:
+		if d.std&v4l2Std525_60 != 0 {
+			return FieldInterlacedBT
+		}
+		return FieldInterlacedTB
+	case v4l2FieldInterlacedTB:
+		return FieldInterlacedTB
+	case v4l2FieldInterlacedBT:
+		return FieldInterlacedBT
+	case v4l2FieldSeqTB:
+		return FieldSeqTB
+	case v4l2FieldSeqBT:
+		return FieldSeqBT
+	}
+	return FieldProgressive
+}
+
+// v4l2FieldName returns a readable name for a V4L2 field value.
+func v4l2FieldName(field uint32) string {
+	switch field {
+	case v4l2FieldAny:
+		return "any"
+	case v4l2FieldNone:
+		return "progressive"
+	case v4l2FieldTop:
+		return "top"
+	case v4l2FieldBottom:
+		return "bottom"
+	case v4l2FieldInterlaced:
+		return "interlaced"
+	case v4l2FieldSeqTB:
+		return "seq-tb"
+	case v4l2FieldSeqBT:
+		return "seq-bt"
+	case v4l2FieldAlternate:
+		return "alternate"
+	case v4l2FieldInterlacedTB:
+		return "interlaced-tb"
+	case v4l2FieldInterlacedBT:
+		return "interlaced-bt"
+	}
+	return fmt.Sprintf("%d", field)
+}
+
+// memoryType maps the streaming I/O method to its V4L2 memory constant.
+func (d *v4l2Device) memoryType() uint32 {
+	switch d.io {
+	case IOUserPtr:
+		return v4l2MemoryUserPtr
+	case IODMABuf:
+		return v4l2MemoryDMABuf
+	}
+	return v4l2MemoryMMap
+}
+
+// allocUserBuffer returns an anonymous mapping of at least n bytes for
+// USERPTR I/O. The memory is outside the Go heap, so the garbage collector
+// neither moves nor frees it while the driver writes to it; releaseBuffers
+// unmaps it once the driver has let go.
+func allocUserBuffer(n int) ([]byte, error) {
+	page := syscall.Getpagesize()
+	size := (n + page - 1) / page * page
+	return v4l2Sys.mmap(-1, 0, size, syscall.PROT_READ|syscall.PROT_WRITE)
+}
+
+// initBuffers prepares the buffers for the selected I/O method and, for
+// streaming I/O, queues all of them to the driver.
+func (d *v4l2Device) initBuffers(count uint32) error {
+	if d.io == IORead {
+		if d.sizeImage <= 0 {
+			return fmt.Errorf("gocam: invalid image size %d", d.sizeImage)
 		}
+		d.readBuf = make([]byte, d.sizeImage)
+		return nil
 	}
 
 	req := v4l2RequestBuffers{
-		Count:  4,
-		Type:   v4l2BufTypeVideoCapture,
-		Memory: v4l2MemoryMMap,
+		Count:  count,
+		Type:   d.bufType,
+		Memory: d.memoryType(),
 	}
-	if err := ioctl(fd, vidiocReqbufs, unsafe.Pointer(&req)); err != nil {
-		cleanup()
-		return nil, fmt.Errorf("gocam: VIDIOC_REQBUFS failed: %w", err)
+	if err := ioctl(d.fd, vidiocReqbufs, unsafe.Pointer(&req)); err != nil {
+		return fmt.Errorf("gocam: VIDIOC_REQBUFS failed: %w", err)
 	}
 	if req.Count < 2 {
-		cleanup()
-		return nil, fmt.Errorf("gocam: insufficient buffers: %d", req.Count)
+		return fmt.Errorf("gocam: insufficient buffers: %d", req.Count)
+	}
+	if d.io == IODMABuf && int(req.Count) > len(d.importFDs) {
+		return fmt.Errorf("gocam: driver needs %d buffers, only %d DMABUF descriptors supplied", req.Count, len(d.importFDs))
 	}
 
-	buffers = make([]mappedBuffer, req.Count)
+	d.buffers = make([]mappedBuffer, req.Count)
 
 	for i := uint32(0); i < req.Count; i++ {
 		buf := v4l2Buffer{
-			Type:   v4l2BufTypeVideoCapture,
-			Memory: v4l2MemoryMMap,
+			Type:   d.bufType,
+			Memory: d.memoryType(),
 			Index:  i,
 		}
-		if err := ioctl(fd, vidiocQuerybuf, unsafe.Pointer(&buf)); err != nil {
-			cleanup()
-			return nil, fmt.Errorf("gocam: VIDIOC_QUERYBUF index %d failed: %w", i, err)
+
+		switch d.io {
+		case IOMMap:
+			if err := ioctl(d.fd, vidiocQuerybuf, unsafe.Pointer(&buf)); err != nil {
+				return fmt.Errorf("gocam: VIDIOC_QUERYBUF index %d failed: %w", i, err)
+			}
+
+			data, err := v4l2Sys.mmap(d.fd, int64(buf.Offset), int(buf.Length), syscall.PROT_READ|syscall.PROT_WRITE)
+			if err != nil {
+				return fmt.Errorf("gocam: mmap buffer %d failed: %w", i, err)
+			}
+			d.buffers[i] = mappedBuffer{data: data, length: buf.Length, mapped: true}
+
+		case IOUserPtr:
+			data, err := allocUserBuffer(d.sizeImage)
+			if err != nil {
+				return fmt.Errorf("gocam: allocating user buffer %d failed: %w", i, err)
+			}
+			d.buffers[i] = mappedBuffer{data: data, length: uint32(len(data)), user: true}
+			buf.setUserPtr(uintptr(unsafe.Pointer(&data[0])))
+			buf.Length = uint32(len(data))
+
+		case IODMABuf:
+			fd := d.importFDs[i]
+			data, err := mapDMABuf(fd)
+			if err != nil {
+				return fmt.Errorf("gocam: mmap DMABUF %d failed: %w", i, err)
+			}
+			d.buffers[i] = mappedBuffer{data: data, length: uint32(len(data)), mapped: true, dmabufFD: fd}
+			buf.Offset = uint32(fd) // m.fd
+			buf.Length = uint32(len(data))
 		}
 
-		data, err := syscall.Mmap(fd, int64(buf.Offset), int(buf.Length), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+		// Output buffers start out owned by the application and are queued
+		// once they hold a frame.
+		if d.bufType == v4l2BufTypeVideoOutput {
+			continue
+		}
+
+		if err := ioctl(d.fd, vidiocQBuf, unsafe.Pointer(&buf)); err != nil {
+			return fmt.Errorf("gocam: VIDIOC_QBUF index %d failed: %w", i, err)
+		}
+		d.queued++
+	}
+	return nil
+}
+
+// start begins streaming. read() and write() I/O start implicitly.
+func (d *v4l2Device) start() error {
+	if d.io == IORead {
+		return nil
+	}
+	bufType := d.bufType
+	if err := ioctl(d.fd, vidiocStreamOn, unsafe.Pointer(&bufType)); err != nil {
+		return fmt.Errorf("gocam: VIDIOC_STREAMON failed: %w", err)
+	}
+	d.streaming = true
+	return nil
+}
+
+// dequeue returns the next filled frame. The returned slice stays valid until
+// the buffer is passed back to requeue. When no frame is ready yet the error
+// is syscall.EAGAIN.
+func (d *v4l2Device) dequeue() ([]byte, v4l2Buffer, error) {
+	if d.io == IORead {
+		n, err := v4l2Sys.read(d.fd, d.readBuf)
 		if err != nil {
-			cleanup()
-			return nil, fmt.Errorf("gocam: mmap buffer %d failed: %w", i, err)
+			return nil, v4l2Buffer{}, err
+		}
+		if n <= 0 {
+			return nil, v4l2Buffer{}, syscall.EAGAIN
+		}
+		return d.readBuf[:n], v4l2Buffer{Bytesused: uint32(n)}, nil
+	}
+
+	buf := v4l2Buffer{
+		Type:   d.bufType,
+		Memory: d.memoryType(),
+	}
+	if err := ioctl(d.fd, vidiocDQBuf, unsafe.Pointer(&buf)); err != nil {
+		return nil, buf, err
+	}
+
+	if int(buf.Index) >= len(d.buffers) {
+		_ = ioctl(d.fd, vidiocQBuf, unsafe.Pointer(&buf))
+		return nil, buf, syscall.EAGAIN
+	}
+
+	d.queued--
+	if d.io == IODMABuf {
+		_ = dmabufSync(d.buffers[buf.Index].dmabufFD, dmaBufSyncStart|dmaBufSyncRead)
+	}
+
+	data := d.buffers[buf.Index].data
+	sz := int(buf.Bytesused)
+	if sz <= 0 || sz > len(data) {
+		sz = len(data)
+	}
+	return data[:sz], buf, nil
+}
+
+// requeue hands a dequeued buffer back to the driver.
+func (d *v4l2Device) requeue(buf *v4l2Buffer) error {
+	if d.io == IORead {
+		return nil
+	}
+	if d.io == IODMABuf && int(buf.Index) < len(d.buffers) {
+		_ = dmabufSync(d.buffers[buf.Index].dmabufFD, dmaBufSyncEnd|dmaBufSyncRead)
+	}
+	if err := ioctl(d.fd, vidiocQBuf, unsafe.Pointer(buf)); err != nil {
+		return err
+	}
+	d.queued++
+	return nil
+}
+
+const clockMonotonic = 1
+
+// bufferTime converts a driver timestamp to wall-clock time. Buffers
+// without a timestamp (read() I/O) are stamped with the current time.
+func bufferTime(tv syscall.Timeval) time.Time {
+	return monotonicTime(tv.Nano())
+}
+
+// monotonicTime converts a CLOCK_MONOTONIC time in nanoseconds, the clock
+// of buffer and event timestamps in all current drivers, to wall-clock time.
+// Zero and implausible times are replaced by the current time.
+func monotonicTime(ns int64) time.Time {
+	now := time.Now()
+	if ns == 0 {
+		return now
+	}
+	var mono syscall.Timespec
+	if _, _, errno := syscall.Syscall(syscall.SYS_CLOCK_GETTIME, clockMonotonic, uintptr(unsafe.Pointer(&mono)), 0); errno != 0 {
+		return now
+	}
+	age := time.Duration(mono.Nano() - ns)
+	if age < 0 || age > 10*time.Second {
+		return now
+	}
+	return now.Add(-age)
+}
+
+// releaseBuffers stops streaming and frees all buffers, leaving the device
+// open so it can be configured again.
+func (d *v4l2Device) releaseBuffers() {
+	if d.streaming {
+		bufType := d.bufType
+		_ = ioctl(d.fd, vidiocStreamOff, unsafe.Pointer(&bufType))
+		d.streaming = false
+	}
+	for _, mb := range d.buffers {
+		if mb.mapped && mb.data != nil {
+			_ = v4l2Sys.munmap(mb.data)
+		}
+		if mb.exported {
+			_ = v4l2Sys.close(mb.dmabufFD)
+		}
+	}
+	if len(d.buffers) > 0 {
+		// Make the driver drop its references before the memory goes away;
+		// this matters for USERPTR buffers, which are unmapped only after.
+		req := v4l2RequestBuffers{
+			Count:  0,
+			Type:   d.bufType,
+			Memory: d.memoryType(),
 		}
+		_ = ioctl(d.fd, vidiocReqbufs, unsafe.Pointer(&req))
+	}
+	for _, mb := range d.buffers {
+		if mb.user {
+			_ = v4l2Sys.munmap(mb.data)
+		}
+	}
+	d.buffers = nil
+	d.queued = 0
+	d.readBuf = nil
+	// Frames still holding buffers of the old set release into the old
+	// channel, where they are ignored.
+	d.released = nil
+	d.exports = 0
+}
 
-		buffers[i] = mappedBuffer{data: data, length: buf.Length}
+// close stops streaming, releases all buffers and closes the device.
+func (d *v4l2Device) close() {
+	d.releaseBuffers()
+	d.restoreControls()
+	_ = v4l2Sys.close(d.fd)
+}
 
-		if err := ioctl(fd, vidiocQBuf, unsafe.Pointer(&buf)); err != nil {
-			cleanup()
-			return nil, fmt.Errorf("gocam: VIDIOC_QBUF index %d failed: %w", i, err)
+// configure negotiates the format, allocates buffers and starts streaming.
+// It is used both for the initial setup and after a source change.
+func (d *v4l2Device) configure(bufferCount uint32, export bool) error {
+	if err := d.negotiateFormat(cifWidth, cifHeight); err != nil {
+		return err
+	}
+	if err := d.initBuffers(bufferCount); err != nil {
+		return err
+	}
+	if export {
+		if err := d.exportBuffers(); err != nil {
+			return err
 		}
 	}
+	if err := d.start(); err != nil {
+		return err
+	}
+	if d.width <= 0 || d.height <= 0 {
+		return fmt.Errorf("gocam: invalid frame size %dx%d", d.width, d.height)
+	}
+	return nil
+}
+
+// renegotiate tears the buffers down and configures the device again for the
+// format the source now delivers.
+func (d *v4l2Device) renegotiate(bufferCount uint32, export bool) error {
+	if d.released != nil && !d.awaitExports(exportReleaseTimeout) {
+		camLog.Printf("[gocam] %s: %d exported frames still held\n", d.path, d.exports)
+	}
+	d.releaseBuffers()
+	d.applyDVTimings()
+	return d.configure(bufferCount, export)
+}
+
+// platformDevice maps a device URI or path to a V4L2 device node.
+func platformDevice(uri string) (string, error) {
+	path := strings.TrimPrefix(uri, platformScheme+"://")
+	if path == "" {
+		path = defaultV4L2Device
+	}
+	return path, nil
+}
 
-	bufType := uint32(v4l2BufTypeVideoCapture)
-	if err := ioctl(fd, vidiocStreamOn, unsafe.Pointer(&bufType)); err != nil {
-		cleanup()
-		return nil, fmt.Errorf("gocam: VIDIOC_STREAMON failed: %w", err)
+// openStream opens /dev/video0 (or the node given with WithDevice),
+// configures a V4L2 capture stream, and returns a stream of frames encoded as
+// tightly packed YCbCr 4:4:4 (YUV24) buffers.
+//
+// Interlaced sources report their layout in Frame.Field unless a
+// deinterlacer is selected with WithDeinterlace.
+//
+// Streaming I/O with mmap buffers is used when the device supports it;
+// devices that only support read() are handled automatically. WithIOMethod
+// overrides the choice, and WithDMABufExport / WithDMABufImport enable
+// zero-copy DMABUF sharing.
+//
+// WithBufferCount sets the number of driver buffers; the count the driver
+// granted, queue underruns and frames lost by the driver are tracked in
+// Stream.Stats.
+//
+// The stream subscribes to source-change, end-of-stream and control events.
+// When the source changes resolution mid-stream, the format and buffers are
+// renegotiated transparently before EventSourceChange is delivered.
+func openStream(ctx context.Context, cfg streamConfig) (*Stream, error) {
+	if cfg.ioMethod == IODMABuf && len(cfg.dmabufImport) < 2 {
+		return nil, fmt.Errorf("gocam: DMABUF import needs at least 2 descriptors, got %d", len(cfg.dmabufImport))
 	}
-	streamStarted = true
 
-	frameW := int(width)
-	frameH := int(height)
-	if frameW <= 0 || frameH <= 0 {
-		cleanup()
-		return nil, fmt.Errorf("gocam: invalid frame size %dx%d", frameW, frameH)
+	path := defaultV4L2Device
+	if cfg.device != "" {
+		path = cfg.device
+	}
+	dev, err := openV4L2Device(path, v4l2BufTypeVideoCapture)
+	if err != nil {
+		return nil, err
 	}
 
-	// Logical output size:
-	// - If the source is larger than CIF in at least one dimension, we downsample to CIF.
-	// - Otherwise, keep the native size (no upscaling).
-	outW := frameW
-	outH := frameH
-	if frameW > cifWidth || frameH > cifHeight {
-		outW = cifWidth
-		outH = cifHeight
+	if err := dev.selectIO(cfg.ioMethod); err != nil {
+		dev.close()
+		return nil, err
 	}
+	if cfg.dmabufExport && dev.io != IOMMap {
+		dev.close()
+		return nil, fmt.Errorf("gocam: DMABUF export requires mmap I/O, not %s", dev.io)
+	}
+	dev.importFDs = cfg.dmabufImport
+	dev.preferMJPEG = cfg.mjpeg
 
-	logCameraConfig(&caps, pixelFormat, outW, outH, stride)
+	bufferCount := uint32(v4l2BufferCount)
+	if cfg.bufferCount > 0 {
+		bufferCount = uint32(cfg.bufferCount)
+	}
+	if dev.io == IODMABuf {
+		bufferCount = uint32(len(dev.importFDs))
+	}
+
+	stats := &streamStats{}
+	stats.buffersRequested.Store(int64(bufferCount))
+
+	dev.subscribeEvents()
+
+	if err := dev.configure(bufferCount, cfg.dmabufExport); err != nil {
+		dev.close()
+		return nil, err
+	}
+	stats.buffersGranted.Store(int64(len(dev.buffers)))
+
+	// Flips go to the driver when it has the controls; the rest of the
+	// transform runs on the converted frames.
+	transform := dev.applyTransform(cfg.transform)
+	if cfg.transform != TransformNone {
+		camLog.Printf("[gocam] %s: transform %s (software: %s)\n", dev.path, cfg.transform, transform)
+	}
+
+	var (
+		deint  *deinterlacer
+		frameW int
+		frameH int
+		outW   int
+		outH   int
+
+		seq       uint64 // frame sequence delivered to consumers
+		driverSeq uint32 // last driver sequence number
+		haveSeq   bool
+	)
+
+	// setup derives the loop geometry from the negotiated format.
+	setup := func() {
+		deint = newDeinterlacer(cfg.deinterlace)
+		haveSeq = false
+		frameW = dev.width
+		frameH = dev.height
+
+		// With V4L2_FIELD_ALTERNATE, TOP or BOTTOM every buffer carries a
+		// single field and the negotiated height is the field height;
+		// deinterlacing doubles it.
+		fullH := frameH
+		switch dev.field {
+		case v4l2FieldAlternate, v4l2FieldTop, v4l2FieldBottom:
+			if deint != nil {
+				fullH = frameH * 2
+			}
+		}
+
+		// Logical output size:
+		// - If the source is larger than CIF in at least one dimension, we downsample to CIF.
+		// - Otherwise, keep the native size (no upscaling).
+		outW = frameW
+		outH = fullH
+		if frameW > cifWidth || fullH > cifHeight {
+			outW = cifWidth
+			outH = cifHeight
+		}
+		if transform.SwapsAxes() {
+			outW, outH = outH, outW
+		}
+	}
+	setup()
+
+	logCameraConfig(dev, outW, outH)
+
+	info := SourceInfo{
+		Name:   v4l2CString(dev.caps.Card[:]),
+		Driver: v4l2CString(dev.caps.Driver[:]),
+		Width:  outW,
+		Height: outH,
+		FPS:    dev.fps,
+	}
+	controls := make([]Control, 0, len(dev.controls))
+	for _, qc := range dev.controls {
+		controls = append(controls, Control{
+			ID:      qc.ID,
+			Name:    v4l2CString(qc.Name[:]),
+			Min:     int64(qc.Minimum),
+			Max:     int64(qc.Maximum),
+			Step:    int64(qc.Step),
+			Default: int64(qc.DefaultValue),
+		})
+	}
 
 	frames := make(chan Frame, 1)
+	events := make(chan Event, eventQueueSize)
 
 	go func() {
 		defer close(frames)
-		defer cleanup()
+		defer close(events)
+		defer dev.close()
+		// A frame nobody took may hold an exported buffer.
+		defer func() {
+			select {
+			case old := <-frames:
+				old.Release()
+			default:
+			}
+		}()
 
-		const dropThreshold = 30
+		const (
+			dropThreshold = 30
+			pollTimeout   = 100 * time.Millisecond
+		)
 		misses := 0
 
+		// sendFrame keeps only the freshest frame; a frame that is replaced
+		// before the consumer saw it is released here.
 		sendFrame := func(frame Frame) {
+			stats.frames.Add(1)
 			select {
 			case frames <- frame:
 			default:
-				<-frames
+				select {
+				case old := <-frames:
+					old.Release()
+					stats.dropped.Add(1)
+				default:
+				}
 				frames <- frame
 			}
 		}
@@ -474,9 +1068,10 @@ func StartStream(ctx context.Context) (<-chan Frame, error) {
 				return false
 			}
 			frame := Frame{
-				Data:   data,
-				Width:  outW,
-				Height: outH,
+				Data:      data,
+				Width:     outW,
+				Height:    outH,
+				Timestamp: time.Now(),
 			}
 			sendFrame(frame)
 			return true
@@ -498,37 +1093,113 @@ func StartStream(ctx context.Context) (<-chan Frame, error) {
 			default:
 			}
 
-			buf := v4l2Buffer{
-				Type:   v4l2BufTypeVideoCapture,
-				Memory: v4l2MemoryMMap,
+			if dev.released != nil {
+				if err := dev.requeueReleased(); err != nil {
+					return
+				}
 			}
 
-			if err := ioctl(fd, vidiocDQBuf, unsafe.Pointer(&buf)); err != nil {
-				if errno, ok := err.(syscall.Errno); ok && (errno == syscall.EAGAIN || errno == syscall.EINTR) {
-					time.Sleep(5 * time.Millisecond)
+			revents, err := dev.poll(pollIn|pollPri, pollTimeout)
+			if err != nil && err != syscall.EINTR {
+				handleDrop(33*time.Millisecond, 10*time.Millisecond)
+				continue
+			}
+
+			if revents&pollPri != 0 {
+				evs, sourceChanged := dev.dequeueEvents()
+				if sourceChanged {
+					if dev.released != nil {
+						// The waiting frame holds a buffer of the old set.
+						select {
+						case old := <-frames:
+							old.Release()
+							stats.dropped.Add(1)
+						default:
+						}
+					}
+					if err := dev.renegotiate(bufferCount, cfg.dmabufExport); err != nil {
+						camLog.Printf("[gocam] source change: %v\n", err)
+						return
+					}
+					setup()
+					stats.buffersGranted.Store(int64(len(dev.buffers)))
+					logCameraConfig(dev, outW, outH)
+					sendEvent(events, Event{Type: EventSourceChange, Width: outW, Height: outH})
+				}
+				for _, ev := range evs {
+					sendEvent(events, ev)
+				}
+				if sourceChanged {
 					continue
 				}
-				handleDrop(33*time.Millisecond, 10*time.Millisecond)
+			}
+
+			if revents&pollIn == 0 {
 				continue
 			}
 
-			index := buf.Index
-			if int(index) >= len(buffers) {
-				_ = ioctl(fd, vidiocQBuf, unsafe.Pointer(&buf))
+			src, buf, err := dev.dequeue()
+			if err != nil {
+				if errno, ok := err.(syscall.Errno); ok && (errno == syscall.EAGAIN || errno == syscall.EINTR) {
+					continue
+				}
+				if err == syscall.EPIPE {
+					// The last buffer has been dequeued (end of stream).
+					return
+				}
+				if err == syscall.ENODEV {
+					// The device was unplugged; it will not come back.
+					camLog.Printf("[gocam] %s: device disconnected\n", dev.path)
+					return
+				}
+				handleDrop(33*time.Millisecond, 10*time.Millisecond)
 				continue
 			}
 
-			data := buffers[index].data
-			sz := int(buf.Bytesused)
-			if sz <= 0 || sz > len(data) {
-				sz = len(data)
+			// An empty driver queue means the next frame has nowhere to go.
+			if dev.io != IORead && dev.queued == 0 {
+				stats.underruns.Add(1)
 			}
-			src := data[:sz]
 
-			frameData := convertFrame(src, pixelFormat, frameW, frameH, stride)
+			// Extend the 32-bit driver sequence and account for frames the
+			// driver skipped. read() I/O carries no sequence numbers.
+			step := uint32(1)
+			if haveSeq && dev.io != IORead {
+				if gap := buf.Sequence - driverSeq; gap > 1 && gap < 1<<31 {
+					stats.lost.Add(uint64(gap - 1))
+					step = gap
+				}
+			}
+			haveSeq = true
+			driverSeq = buf.Sequence
+			seq += uint64(step)
+			timestamp := bufferTime(buf.Timestamp)
+
+			var frameData, jpg []byte
+			if dev.pixelFormat == v4l2PixFmtMJPEG {
+				// Keep the compressed image for pass-through.
+				jpg = completeJPEG(src)
+				frameData = decodeJPEG444(jpg, frameW, frameH)
+			} else {
+				frameData = convertFrame(src, dev.pixelFormat, frameW, frameH, dev.stride)
+			}
 
-			if err := ioctl(fd, vidiocQBuf, unsafe.Pointer(&buf)); err != nil {
-				return
+			// With DMABUF export the buffer stays dequeued until the frame
+			// is released; otherwise it goes straight back to the driver.
+			var (
+				exported []DMABuf
+				release  func()
+			)
+			if dev.released != nil && frameData != nil {
+				exported, release, err = dev.exportFrame(buf)
+				if err != nil {
+					release = nil
+				}
+			}
+			if release == nil {
+				if err := dev.requeue(&buf); err != nil {
+					return
+				}
 			}
 
 			if frameData == nil {
@@ -536,13 +1207,32 @@ func StartStream(ctx context.Context) (<-chan Frame, error) {
 				continue
 			}
 
+			field := dev.fieldOrder(buf.Field)
+			h := frameH
+			if deint != nil {
+				out, outFieldH, ok := deint.process(frameData, frameW, frameH, field)
+				if !ok {
+					// Waiting for the second field; not a drop.
+					if release != nil {
+						release()
+					}
+					continue
+				}
+				frameData = out
+				h = outFieldH
+				field = FieldProgressive
+				jpg = nil
+			}
+
 			// Downsample with aspect-ratio-preserving center crop if needed.
 			dataOut := frameData
 			w := frameW
-			h := frameH
-			if frameW > cifWidth || frameH > cifHeight {
-				resampled := resampleYCbCr444Fill(frameData, frameW, frameH, cifWidth, cifHeight)
+			if frameW > cifWidth || h > cifHeight {
+				resampled := resampleYCbCr444Fill(frameData, frameW, h, cifWidth, cifHeight)
 				if resampled == nil {
+					if release != nil {
+						release()
+					}
 					handleDrop(33*time.Millisecond, 5*time.Millisecond)
 					continue
 				}
@@ -552,9 +1242,18 @@ func StartStream(ctx context.Context) (<-chan Frame, error) {
 			}
 
 			frame := Frame{
-				Data:   dataOut,
-				Width:  w,
-				Height: h,
+				Data:      dataOut,
+				Width:     w,
+				Height:    h,
+				Timestamp: timestamp,
+				Sequence:  seq,
+				Field:     field,
+				JPEG:      jpg,
+				DMABufs:   exported,
+			}
+			frame = frame.Transform(transform)
+			if release != nil {
+				frame.release = newFrameRelease(release)
 			}
 
 			misses = 0
@@ -562,336 +1261,16 @@ func StartStream(ctx context.Context) (<-chan Frame, error) {
 		}
 	}()
 
-	return frames, nil
-}
-
-// convertFrame normalizes a single captured frame from various V4L2 pixel
-// formats into a tightly packed YCbCr 4:4:4 buffer (packed Y, Cb, Cr per pixel).
-func convertFrame(src []byte, pixFmt uint32, width, height, stride int) []byte {
-	if width <= 0 || height <= 0 {
-		return nil
-	}
-
-	// All output frames are packed YCbCr 4:4:4: 3 bytes per pixel.
-	dstSize := width * height * 3
-	if dstSize <= 0 {
-		return nil
-	}
-	dst := make([]byte, dstSize)
-
-	switch pixFmt {
-	case v4l2PixFmtYUV24:
-		// Source is already packed YUV444 (Y, Cb, Cr) but may have stride.
-		rowBytes := width * 3
-		if rowBytes <= 0 || len(src) < rowBytes {
-			return nil
-		}
-
-		effectiveStride := stride
-		if effectiveStride <= 0 {
-			effectiveStride = rowBytes
-		}
-		if height > 0 && effectiveStride*height > len(src) {
-			effectiveStride = len(src) / height
-			if effectiveStride < rowBytes {
-				return nil
-			}
-		}
-
-		for y := 0; y < height; y++ {
-			inStart := y * effectiveStride
-			inEnd := inStart + rowBytes
-			if inEnd > len(src) {
-				return nil
-			}
-			row := src[inStart:inEnd]
-
-			for x := 0; x < width; x++ {
-				si := x * 3
-				di := (y*width + x) * 3
-				if si+2 >= len(row) || di+2 >= len(dst) {
-					break
-				}
-				dst[di] = row[si]     // Y
-				dst[di+1] = row[si+1] // Cb
-				dst[di+2] = row[si+2] // Cr
-			}
-		}
-
-	case v4l2PixFmtNV12:
-		// NV12: Y plane (full res), then interleaved CbCr at 2x2 subsampling.
-		rowBytesY := width
-		if rowBytesY <= 0 || len(src) < rowBytesY {
-			return nil
-		}
-
-		effectiveStride := stride
-		if effectiveStride <= 0 {
-			effectiveStride = rowBytesY
-		}
-
-		totalLines := height + height/2
-		if effectiveStride*totalLines > len(src) {
-			effectiveStride = len(src) / totalLines
-			if effectiveStride < rowBytesY {
-				return nil
-			}
-		}
-
-		yPlaneSize := effectiveStride * height
-		if yPlaneSize > len(src) {
-			return nil
-		}
-
-		yPlane := src[:yPlaneSize]
-		uvPlane := src[yPlaneSize:]
-
-		for y := 0; y < height; y++ {
-			for x := 0; x < width; x++ {
-				// Luma from Y plane.
-				yIdx := y*effectiveStride + x
-				if yIdx >= len(yPlane) {
-					return nil
-				}
-				Y := yPlane[yIdx]
-
-				// Chroma from UV plane: 2x2 block.
-				uvY := y / 2
-				uvX := x / 2
-				uvIdx := uvY*effectiveStride + uvX*2
-				if uvIdx+1 >= len(uvPlane) {
-					return nil
-				}
-				Cb := uvPlane[uvIdx]
-				Cr := uvPlane[uvIdx+1]
-
-				di := (y*width + x) * 3
-				if di+2 >= len(dst) {
-					return nil
-				}
-				dst[di] = Y
-				dst[di+1] = Cb
-				dst[di+2] = Cr
-			}
-		}
-
-	case v4l2PixFmtYUYV:
-		// YUYV 4:2:2: Y0 U Y1 V for each pair of pixels.
-		rowBytes := width * 2
-		if rowBytes <= 0 || len(src) < rowBytes {
-			return nil
-		}
-
-		effectiveStride := stride
-		if effectiveStride <= 0 {
-			effectiveStride = rowBytes
-		}
-		if height > 0 && effectiveStride*height > len(src) {
-			effectiveStride = len(src) / height
-			if effectiveStride < rowBytes {
-				return nil
-			}
-		}
-
-		for y := 0; y < height; y++ {
-			inStart := y * effectiveStride
-			inEnd := inStart + rowBytes
-			if inEnd > len(src) {
-				return nil
-			}
-			row := src[inStart:inEnd]
-
-			for x := 0; x < width; x += 2 {
-				si := x * 2
-				if si+3 >= len(row) {
-					break
-				}
-
-				Y0 := row[si]
-				U := row[si+1]
-				Y1 := row[si+2]
-				V := row[si+3]
-
-				// First pixel
-				di0 := (y*width + x) * 3
-				if di0+2 < len(dst) {
-					dst[di0] = Y0
-					dst[di0+1] = U
-					dst[di0+2] = V
-				}
-
-				// Second pixel (shares U,V)
-				if x+1 < width {
-					di1 := (y*width + x + 1) * 3
-					if di1+2 < len(dst) {
-						dst[di1] = Y1
-						dst[di1+1] = U
-						dst[di1+2] = V
-					}
-				}
-			}
-		}
-
-	case v4l2PixFmtRGB24:
-		// RGB24 -> YCbCr444
-		rowBytes := width * 3
-		if rowBytes <= 0 || len(src) < rowBytes {
-			return nil
-		}
-
-		effectiveStride := stride
-		if effectiveStride <= 0 {
-			effectiveStride = rowBytes
-		}
-		if height > 0 && effectiveStride*height > len(src) {
-			effectiveStride = len(src) / height
-			if effectiveStride < rowBytes {
-				return nil
-			}
-		}
-
-		for y := 0; y < height; y++ {
-			inStart := y * effectiveStride
-			inEnd := inStart + rowBytes
-			if inEnd > len(src) {
-				return nil
-			}
-			row := src[inStart:inEnd]
-
-			for x := 0; x < width; x++ {
-				si := x * 3
-				if si+2 >= len(row) {
-					break
-				}
-
-				R := int(row[si])
-				G := int(row[si+1])
-				B := int(row[si+2])
-
-				Y := (66*R+129*G+25*B+128)>>8 + 16
-				Cb := (-38*R-74*G+112*B+128)>>8 + 128
-				Cr := (112*R-94*G-18*B+128)>>8 + 128
-
-				di := (y*width + x) * 3
-				if di+2 >= len(dst) {
-					return nil
-				}
-				dst[di] = clampToByte(Y)
-				dst[di+1] = clampToByte(Cb)
-				dst[di+2] = clampToByte(Cr)
-			}
-		}
-
-	default:
-		return nil
-	}
-
-	return dst
-}
-
-// resampleYCbCr444Fill downsamples a packed YCbCr444 buffer into dstW x dstH,
-// preserving aspect ratio with a centered crop ("fill"). If the source is
-// already smaller than or equal to dst in both dimensions, it returns the
-// original buffer (no upscaling).
-func resampleYCbCr444Fill(src []byte, srcW, srcH, dstW, dstH int) []byte {
-	if srcW <= 0 || srcH <= 0 || dstW <= 0 || dstH <= 0 {
-		return nil
-	}
-	if len(src) < srcW*srcH*3 {
-		return nil
-	}
-
-	// No upscaling: if source fits entirely within dst, keep it as-is.
-	if srcW <= dstW && srcH <= dstH {
-		return src
-	}
-
-	dst := make([]byte, dstW*dstH*3)
-
-	// Compute centered crop region in source.
-	srcAspect := float64(srcW) / float64(srcH)
-	dstAspect := float64(dstW) / float64(dstH)
-
-	cropW := srcW
-	cropH := srcH
-	srcX0 := 0
-	srcY0 := 0
-
-	if srcAspect > dstAspect {
-		// Source is wider than destination: crop left/right.
-		cropH = srcH
-		cropW = int(float64(srcH) * dstAspect)
-		if cropW > srcW {
-			cropW = srcW
-		}
-		if cropW < 1 {
-			cropW = 1
-		}
-		srcX0 = (srcW - cropW) / 2
-		srcY0 = 0
-	} else {
-		// Source is taller than destination: crop top/bottom.
-		cropW = srcW
-		cropH = int(float64(srcW) / dstAspect)
-		if cropH > srcH {
-			cropH = srcH
-		}
-		if cropH < 1 {
-			cropH = 1
-		}
-		srcX0 = 0
-		srcY0 = (srcH - cropH) / 2
-	}
-
-	for dy := 0; dy < dstH; dy++ {
-		syRel := 0
-		if dstH > 0 {
-			syRel = dy * cropH / dstH
-		}
-		sy := srcY0 + syRel
-		if sy >= srcH {
-			sy = srcH - 1
-		}
-
-		for dx := 0; dx < dstW; dx++ {
-			sxRel := 0
-			if dstW > 0 {
-				sxRel = dx * cropW / dstW
-			}
-			sx := srcX0 + sxRel
-			if sx >= srcW {
-				sx = srcW - 1
-			}
-
-			srcIndex := (sy*srcW + sx) * 3
-			dstIndex := (dy*dstW + dx) * 3
-			if srcIndex+2 >= len(src) || dstIndex+2 >= len(dst) {
-				continue
-			}
-
-			dst[dstIndex] = src[srcIndex]
-			dst[dstIndex+1] = src[srcIndex+1]
-			dst[dstIndex+2] = src[srcIndex+2]
-		}
-	}
-
-	return dst
-}
-
-func clampToByte(v int) byte {
-	if v < 0 {
-		return 0
-	}
-	if v > 255 {
-		return 255
-	}
-	return byte(v)
+	return &Stream{
+		frames:      frames,
+		events:      events,
+		stats:       stats,
+		info:        info,
+		controls:    controls,
+		transformed: true,
+	}, nil
 }
 
 func ioctl(fd int, req uintptr, arg unsafe.Pointer) error {
-	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(arg))
-	if errno != 0 {
-		return errno
-	}
-	return nil
+	return v4l2Sys.ioctl(fd, req, arg)
 }
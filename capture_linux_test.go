@@ -0,0 +1,764 @@
+//go:build linux
+// +build linux
+
+package gocam
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// openFake opens a stream on dev and closes it when the test ends.
+func openFake(t *testing.T, dev *fakeDevice, opts ...StreamOption) (*Stream, error) {
+	t.Helper()
+	dev.install(t)
+	opts = append([]StreamOption{WithDevice(fakeDevicePath)}, opts...)
+	s, err := OpenStream(context.Background(), opts...)
+	if err == nil {
+		t.Cleanup(func() {
+			s.Close()
+			for range s.Frames() {
+			}
+		})
+	}
+	return s, err
+}
+
+// nextFrame waits for a frame or fails the test.
+func nextFrame(t *testing.T, s *Stream) Frame {
+	t.Helper()
+	select {
+	case f, ok := <-s.Frames():
+		if !ok {
+			t.Fatal("frame channel closed")
+		}
+		return f
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a frame")
+	}
+	return Frame{}
+}
+
+// waitClosed waits for the frame channel to close.
+func waitClosed(t *testing.T, s *Stream) {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case _, ok := <-s.Frames():
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("frame channel not closed")
+		}
+	}
+}
+
+func TestStreamNegotiatesPreferredFormat(t *testing.T) {
+	dev := newFakeDevice(320, 240, v4l2PixFmtYUYV, v4l2PixFmtYUV24)
+	s, err := openFake(t, dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := nextFrame(t, s)
+	if f.Width != 320 || f.Height != 240 || len(f.Data) != 320*240*3 {
+		t.Fatalf("frame %dx%d with %d bytes, want 320x240", f.Width, f.Height, len(f.Data))
+	}
+	if dev.pixFmt != v4l2PixFmtYUV24 {
+		t.Errorf("negotiated %s, want YUV24", v4l2FormatName(dev.pixFmt))
+	}
+	if len(dev.sfmtTried) != 1 {
+		t.Errorf("S_FMT called for %d formats, want 1", len(dev.sfmtTried))
+	}
+	info := s.Info()
+	if info.Backend != "v4l2" || info.Name != "Fake Camera" || info.Driver != "fake" {
+		t.Errorf("unexpected info %+v", info)
+	}
+}
+
+func TestStreamFormatFallback(t *testing.T) {
+	dev := newFakeDevice(160, 120, v4l2PixFmtRGB24)
+	s, err := openFake(t, dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []uint32{v4l2PixFmtYUV24, v4l2PixFmtNV12, v4l2PixFmtYUYV, v4l2PixFmtRGB24}
+	if len(dev.sfmtTried) != len(want) {
+		t.Fatalf("S_FMT tried %d formats, want %d", len(dev.sfmtTried), len(want))
+	}
+	for i, pf := range want {
+		if dev.sfmtTried[i] != pf {
+			t.Errorf("attempt %d: %s, want %s", i, v4l2FormatName(dev.sfmtTried[i]), v4l2FormatName(pf))
+		}
+	}
+
+	f := nextFrame(t, s)
+	if f.Width != 160 || f.Height != 120 {
+		t.Fatalf("frame %dx%d, want 160x120", f.Width, f.Height)
+	}
+}
+
+func TestStreamDownscalesToCIF(t *testing.T) {
+	dev := newFakeDevice(1280, 720, v4l2PixFmtNV12)
+	s, err := openFake(t, dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := nextFrame(t, s)
+	if f.Width != cifWidth || f.Height != cifHeight {
+		t.Fatalf("frame %dx%d, want CIF", f.Width, f.Height)
+	}
+}
+
+func TestStreamFrameRate(t *testing.T) {
+	dev := newFakeDevice(320, 240, v4l2PixFmtYUV24)
+	dev.interval = [2]uint32{1, 30}
+	s, err := openFake(t, dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := s.Info()
+	if info.FPS != 30 {
+		t.Fatalf("FPS %g, want 30", info.FPS)
+	}
+	// The rate reaches the commands printed for raw output.
+	raw := RawVideoInfo{Format: RawYUV420P, Width: info.Width, Height: info.Height, FPS: info.FPS}
+	if args := strings.Join(raw.FFmpegArgs(), " "); !strings.Contains(args, "-r 30 ") {
+		t.Errorf("ffmpeg args %q lack the rate", args)
+	}
+	if src := raw.GStreamerSource(); !strings.Contains(src, "framerate=30/1 ") {
+		t.Errorf("GStreamer source %q lacks the rate", src)
+	}
+
+	s.Close()
+	waitClosed(t, s)
+
+	// Without G_PARM the rate is left to the consumer to measure.
+	s, err = openFake(t, newFakeDevice(320, 240, v4l2PixFmtYUV24))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fps := s.Info().FPS; fps != 0 {
+		t.Errorf("FPS %g without G_PARM, want 0", fps)
+	}
+}
+
+func TestStreamOpenErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(*fakeDevice)
+		opts  []StreamOption
+		want  string
+	}{
+		{
+			name:  "unsupported format",
+			setup: func(d *fakeDevice) { d.formats = []uint32{0x34363248} }, // 'H264'
+			want:  "unsupported pixel format",
+		},
+		{
+			name:  "S_FMT fails",
+			setup: func(d *fakeDevice) { d.sfmtErr = syscall.EBUSY },
+			want:  "VIDIOC_S_FMT YUV24 failed",
+		},
+		{
+			name:  "too few buffers",
+			setup: func(d *fakeDevice) { d.maxBuffers = 1 },
+			want:  "insufficient buffers",
+		},
+		{
+			name:  "STREAMON fails",
+			setup: func(d *fakeDevice) { d.streamOnErr = syscall.EIO },
+			want:  "VIDIOC_STREAMON failed",
+		},
+		{
+			name:  "no capture",
+			setup: func(d *fakeDevice) { d.caps = v4l2CapVideoOutput | v4l2CapStreaming },
+			want:  "does not support video capture",
+		},
+		{
+			name:  "no read I/O",
+			setup: func(d *fakeDevice) {},
+			opts:  []StreamOption{WithIOMethod(IORead)},
+			want:  "does not support read() I/O",
+		},
+		{
+			name:  "export without mmap",
+			setup: func(d *fakeDevice) { d.caps = v4l2CapVideoCapture | v4l2CapReadWrite },
+			opts:  []StreamOption{WithDMABufExport()},
+			want:  "DMABUF export requires mmap I/O",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dev := newFakeDevice(320, 240, v4l2PixFmtYUYV)
+			tt.setup(dev)
+			_, err := openFake(t, dev, tt.opts...)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("error %v, want %q", err, tt.want)
+			}
+			if dev.opened && !dev.isClosed() {
+				t.Error("device left open after failure")
+			}
+		})
+	}
+}
+
+func TestStreamMissingDevice(t *testing.T) {
+	newFakeDevice(320, 240, v4l2PixFmtYUYV).install(t)
+	_, err := OpenStream(context.Background(), WithDevice("/dev/video-missing"))
+	if err == nil || !strings.Contains(err.Error(), "cannot open") {
+		t.Fatalf("error %v, want open failure", err)
+	}
+}
+
+func TestStreamFewerBuffersGranted(t *testing.T) {
+	dev := newFakeDevice(320, 240, v4l2PixFmtYUYV)
+	dev.maxBuffers = 2
+	s, err := openFake(t, dev, WithBufferCount(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		nextFrame(t, s)
+	}
+	st := s.Stats()
+	if st.BuffersRequested != 8 || st.BuffersGranted != 2 {
+		t.Fatalf("buffers requested %d granted %d, want 8 and 2", st.BuffersRequested, st.BuffersGranted)
+	}
+}
+
+func TestStreamRecoversFromTransientDQBufErrors(t *testing.T) {
+	dev := newFakeDevice(320, 240, v4l2PixFmtYUYV)
+	dev.dqbufErrs = []error{syscall.EAGAIN, syscall.EIO, syscall.EINTR, syscall.EIO}
+	s, err := openFake(t, dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := nextFrame(t, s)
+	if f.Width != 320 || f.Data[0] == 0 {
+		t.Fatalf("unexpected frame after errors: %dx%d", f.Width, f.Height)
+	}
+}
+
+func TestStreamEndsOnFatalDQBufErrors(t *testing.T) {
+	for _, errno := range []syscall.Errno{syscall.EPIPE, syscall.ENODEV} {
+		t.Run(errno.Error(), func(t *testing.T) {
+			dev := newFakeDevice(320, 240, v4l2PixFmtYUYV)
+			dev.failAfter = 3
+			dev.failErr = errno
+			s, err := openFake(t, dev)
+			if err != nil {
+				t.Fatal(err)
+			}
+			waitClosed(t, s)
+
+			deadline := time.Now().Add(time.Second)
+			for !dev.isClosed() && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			if !dev.isClosed() {
+				t.Fatal("device not closed after the stream ended")
+			}
+		})
+	}
+}
+
+func TestStreamCountsLostFrames(t *testing.T) {
+	dev := newFakeDevice(64, 48, v4l2PixFmtYUYV)
+	dev.seqStep = 3
+	s, err := openFake(t, dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := nextFrame(t, s)
+	second := nextFrame(t, s)
+	if second.Sequence <= first.Sequence {
+		t.Fatalf("sequence went from %d to %d", first.Sequence, second.Sequence)
+	}
+	if s.Stats().Lost == 0 {
+		t.Fatal("sequence gaps not counted as lost frames")
+	}
+}
+
+func TestStreamReadIO(t *testing.T) {
+	dev := newFakeDevice(64, 48, v4l2PixFmtYUYV)
+	dev.caps = v4l2CapVideoCapture | v4l2CapReadWrite
+	s, err := openFake(t, dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := nextFrame(t, s)
+	if f.Width != 64 || f.Height != 48 {
+		t.Fatalf("frame %dx%d, want 64x48", f.Width, f.Height)
+	}
+	if dev.buffers != nil {
+		t.Error("read() I/O requested driver buffers")
+	}
+}
+
+func TestStreamUserPtrIO(t *testing.T) {
+	dev := newFakeDevice(8, 4, v4l2PixFmtYUV24)
+	s, err := openFake(t, dev, WithIOMethod(IOUserPtr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev.mu.Lock()
+	mapped := len(dev.anon)
+	dev.mu.Unlock()
+	if mapped != dev.granted || mapped == 0 {
+		t.Fatalf("%d anonymous mappings for %d buffers", mapped, dev.granted)
+	}
+	// Frames keep coming as the buffers are requeued, each with what the
+	// driver wrote into the user memory.
+	prev := -1
+	for i := 0; i < 3; i++ {
+		f := nextFrame(t, s)
+		if int(f.Data[0]) == prev || !bytes.Equal(f.Data, rawYUV24(f.Data[0], 8, 4)) {
+			t.Fatalf("frame %d does not hold fresh driver data", i)
+		}
+		prev = int(f.Data[0])
+		f.Release()
+	}
+
+	s.Close()
+	waitClosed(t, s)
+	deadline := time.Now().Add(time.Second)
+	for !dev.isClosed() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	if len(dev.anon) != 0 {
+		t.Errorf("%d user buffers left mapped", len(dev.anon))
+	}
+}
+
+func TestStreamCloseReleasesDevice(t *testing.T) {
+	dev := newFakeDevice(64, 48, v4l2PixFmtYUYV)
+	s, err := openFake(t, dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextFrame(t, s)
+	s.Close()
+	waitClosed(t, s)
+
+	deadline := time.Now().Add(time.Second)
+	for !dev.isClosed() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if !dev.isClosed() {
+		t.Fatal("device not closed")
+	}
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	if dev.unmapCount != dev.granted {
+		t.Errorf("unmapped %d of %d buffers", dev.unmapCount, dev.granted)
+	}
+}
+
+// rawYUV24 returns the frame the fake device delivers at w x h before any
+// transform, given the first byte of its buffer.
+func rawYUV24(first byte, w, h int) []byte {
+	data := make([]byte, w*h*3)
+	for i := range data {
+		data[i] = first + byte(i)
+	}
+	return data
+}
+
+func TestStreamTransformInSoftware(t *testing.T) {
+	dev := newFakeDevice(64, 48, v4l2PixFmtYUV24)
+	s, err := openFake(t, dev, WithTransform(Rotate90))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := nextFrame(t, s)
+	if f.Width != 48 || f.Height != 64 {
+		t.Fatalf("frame %dx%d, want 48x64", f.Width, f.Height)
+	}
+	if info := s.Info(); info.Width != 48 || info.Height != 64 {
+		t.Errorf("Info size %dx%d, want 48x64", info.Width, info.Height)
+	}
+	// The top left source pixel ends up top right.
+	want := transformYCbCr444(rawYUV24(f.Data[47*3], 64, 48), 64, 48, Rotate90)
+	if !bytes.Equal(f.Data, want) {
+		t.Errorf("frame is not the source rotated by 90 degrees")
+	}
+}
+
+func TestStreamTransformUsesFlipControls(t *testing.T) {
+	dev := newFakeDevice(64, 48, v4l2PixFmtYUV24)
+	dev.ctrls = map[uint32]int32{v4l2CidHFlip: 0, v4l2CidVFlip: 0}
+	s, err := openFake(t, dev, WithTransform(Rotate180))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := nextFrame(t, s)
+	if dev.ctrl(v4l2CidHFlip) != 1 || dev.ctrl(v4l2CidVFlip) != 1 {
+		t.Errorf("flip controls not set")
+	}
+	// The driver flips, so the frame passes through untouched.
+	if !bytes.Equal(f.Data, rawYUV24(f.Data[0], 64, 48)) {
+		t.Errorf("frame was transformed in software")
+	}
+
+	s.Close()
+	waitClosed(t, s)
+	deadline := time.Now().Add(time.Second)
+	for !dev.isClosed() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if dev.ctrl(v4l2CidHFlip) != 0 || dev.ctrl(v4l2CidVFlip) != 0 {
+		t.Errorf("flip controls not restored on close")
+	}
+}
+
+func TestStreamTransformSplitsRotation(t *testing.T) {
+	// Rotate270 is a horizontal flip plus a transpose; with only HFLIP
+	// available the transpose is left to software.
+	dev := newFakeDevice(64, 48, v4l2PixFmtYUV24)
+	dev.ctrls = map[uint32]int32{v4l2CidHFlip: 0}
+	s, err := openFake(t, dev, WithTransform(Rotate270))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := nextFrame(t, s)
+	if dev.ctrl(v4l2CidHFlip) != 1 {
+		t.Errorf("HFLIP not set")
+	}
+	if f.Width != 48 || f.Height != 64 {
+		t.Fatalf("frame %dx%d, want 48x64", f.Width, f.Height)
+	}
+	if !bytes.Equal(f.Data, transformYCbCr444(rawYUV24(f.Data[0], 64, 48), 64, 48, Transpose)) {
+		t.Errorf("frame is not the transposed source")
+	}
+}
+
+func TestStreamMJPEG(t *testing.T) {
+	var buf bytes.Buffer
+	if err := EncodeJPEG(&buf, colorFrame(64, 48), 90); err != nil {
+		t.Fatal(err)
+	}
+	// Like many USB cameras, leave out the Huffman tables.
+	dev := newFakeDevice(64, 48, v4l2PixFmtYUYV, v4l2PixFmtMJPEG)
+	dev.jpeg = stripDHT(buf.Bytes())
+	s, err := openFake(t, dev, WithMJPEG())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := nextFrame(t, s)
+	if dev.sfmtTried[0] != v4l2PixFmtMJPEG || dev.pixFmt != v4l2PixFmtMJPEG {
+		t.Fatalf("negotiated %s, want MJPEG first", v4l2FormatName(dev.pixFmt))
+	}
+	if f.Width != 64 || f.Height != 48 || len(f.Data) != 64*48*3 {
+		t.Fatalf("frame %dx%d with %d bytes", f.Width, f.Height, len(f.Data))
+	}
+	if !bytes.Equal(f.JPEG, completeJPEG(dev.jpeg)) {
+		t.Fatal("Frame.JPEG is not the delivered image")
+	}
+	if want := decodeJPEG444(buf.Bytes(), 64, 48); !bytes.Equal(f.Data, want) {
+		t.Error("Frame.Data is not the decoded image")
+	}
+}
+
+func TestStreamMJPEGTransformDropsJPEG(t *testing.T) {
+	var buf bytes.Buffer
+	if err := EncodeJPEG(&buf, colorFrame(64, 48), 90); err != nil {
+		t.Fatal(err)
+	}
+	dev := newFakeDevice(64, 48, v4l2PixFmtMJPEG)
+	dev.jpeg = buf.Bytes()
+	s, err := openFake(t, dev, WithTransform(Rotate90))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := nextFrame(t, s)
+	if f.Width != 48 || f.JPEG != nil {
+		t.Fatalf("rotated frame %dx%d kept the camera image", f.Width, f.Height)
+	}
+}
+
+// nextEvent waits for an event or fails the test.
+func nextEvent(t *testing.T, s *Stream) Event {
+	t.Helper()
+	select {
+	case ev, ok := <-s.Events():
+		if !ok {
+			t.Fatal("event channel closed")
+		}
+		return ev
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for an event")
+	}
+	return Event{}
+}
+
+func TestStreamControlEvent(t *testing.T) {
+	dev := newFakeDevice(64, 48, v4l2PixFmtYUV24)
+	dev.ctrls = map[uint32]int32{v4l2CidHFlip: 0}
+	s, err := openFake(t, dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextFrame(t, s)
+
+	raised := v4l2Event{Type: v4l2EventCtrl, ID: v4l2CidHFlip}
+	payload := (*v4l2EventCtrlPayload)(unsafe.Pointer(&raised.U[0]))
+	payload.Changes, payload.Type, payload.Value64 = 1, 2, 1
+	dev.queueEvent(raised)
+
+	ev := nextEvent(t, s)
+	if ev.Type != EventControl || ev.ControlID != v4l2CidHFlip || ev.Control != "Control 0x980914" || ev.Value != 1 {
+		t.Errorf("unexpected event %+v", ev)
+	}
+	// The driver stamps events with the monotonic clock.
+	if age := time.Since(ev.Time); age < 0 || age > time.Second {
+		t.Errorf("event time %v is %v away from now", ev.Time, age)
+	}
+}
+
+func TestStreamSourceChange(t *testing.T) {
+	dev := newFakeDevice(64, 48, v4l2PixFmtYUYV)
+	s, err := openFake(t, dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextFrame(t, s).Release()
+
+	dev.sourceChange(32, 24)
+	ev := nextEvent(t, s)
+	if ev.Type != EventSourceChange || ev.Width != 32 || ev.Height != 24 {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+	// A frame of the old size may still be waiting in the channel.
+	f := nextFrame(t, s)
+	if f.Width == 64 {
+		f = nextFrame(t, s)
+	}
+	if f.Width != 32 || f.Height != 24 || len(f.Data) != 32*24*3 {
+		t.Fatalf("frame %dx%d with %d bytes after the change, want 32x24", f.Width, f.Height, len(f.Data))
+	}
+
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+	if !dev.streaming || dev.sizeImage != 32*24*2 || dev.unmapCount < dev.granted {
+		t.Errorf("streaming %v with %d-byte buffers after unmapping %d", dev.streaming, dev.sizeImage, dev.unmapCount)
+	}
+}
+
+func TestStreamAlternateFields(t *testing.T) {
+	// Each buffer holds one 8x3 field; the fields alternate top, bottom.
+	dev := newFakeDevice(8, 3, v4l2PixFmtYUV24)
+	dev.field = v4l2FieldAlternate
+	s, err := openFake(t, dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := nextFrame(t, s)
+	if f.Width != 8 || f.Height != 3 || (f.Field != FieldTop && f.Field != FieldBottom) {
+		t.Fatalf("field %dx%d is %v, want a single 8x3 field", f.Width, f.Height, f.Field)
+	}
+}
+
+func TestStreamWeavesAlternateFields(t *testing.T) {
+	dev := newFakeDevice(8, 3, v4l2PixFmtYUV24)
+	dev.field = v4l2FieldAlternate
+	s, err := openFake(t, dev, WithDeinterlace(DeinterlaceWeave))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := s.Info(); info.Width != 8 || info.Height != 6 {
+		t.Errorf("Info size %dx%d, want 8x6", info.Width, info.Height)
+	}
+	f := nextFrame(t, s)
+	if f.Width != 8 || f.Height != 6 || f.Field != FieldProgressive {
+		t.Fatalf("frame %dx%d is %v, want progressive 8x6", f.Width, f.Height, f.Field)
+	}
+	// Buffers are filled from a counter that starts at the delivery count,
+	// so the lines of a top field start at n and those of its bottom
+	// field at n+1.
+	const row = 8 * 3
+	top, bottom := f.Data[0], f.Data[row]
+	if top%2 != 1 || bottom != top+1 {
+		t.Fatalf("woven from deliveries %d and %d, want a top field and the next bottom field", top, bottom)
+	}
+	for y := 0; y < 6; y++ {
+		first := top
+		if y%2 == 1 {
+			first = bottom
+		}
+		if want := rawYUV24(first+byte(y/2*row), 8, 1); !bytes.Equal(f.Data[y*row:(y+1)*row], want) {
+			t.Errorf("line %d does not come from field line %d", y, y/2)
+		}
+	}
+}
+
+func TestStreamSingleParityFields(t *testing.T) {
+	// A device set to V4L2_FIELD_TOP sends only top fields, so the modes
+	// that pair fields fall back to bob.
+	for _, mode := range []DeinterlaceMode{DeinterlaceNone, DeinterlaceBob, DeinterlaceWeave, DeinterlaceBlend, DeinterlaceYADIF} {
+		dev := newFakeDevice(8, 3, v4l2PixFmtYUV24)
+		dev.field = v4l2FieldTop
+		s, err := openFake(t, dev, WithDeinterlace(mode))
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantH, wantField := 6, FieldProgressive
+		if mode == DeinterlaceNone {
+			wantH, wantField = 3, FieldTop
+		}
+		if info := s.Info(); info.Width != 8 || info.Height != wantH {
+			t.Errorf("%v: Info size %dx%d, want 8x%d", mode, info.Width, info.Height, wantH)
+		}
+		for i := 0; i < 3; i++ {
+			f := nextFrame(t, s)
+			if f.Width != 8 || f.Height != wantH || f.Field != wantField {
+				t.Fatalf("%v: frame %d is %dx%d %v, want 8x%d %v", mode, i, f.Width, f.Height, f.Field, wantH, wantField)
+			}
+			if mode == DeinterlaceNone {
+				continue
+			}
+			// The field lines are kept as the even lines of the frame.
+			const row = 8 * 3
+			for y := 0; y < 3; y++ {
+				if want := rawYUV24(f.Data[0]+byte(y*row), 8, 1); !bytes.Equal(f.Data[2*y*row:(2*y+1)*row], want) {
+					t.Errorf("%v: line %d is not field line %d", mode, 2*y, y)
+				}
+			}
+		}
+		s.Close()
+		waitClosed(t, s)
+	}
+}
+
+func TestStreamDMABufExport(t *testing.T) {
+	dev := newFakeDevice(64, 48, v4l2PixFmtYUYV)
+	s, err := openFake(t, dev, WithDMABufExport())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := nextFrame(t, s)
+	if len(f.DMABufs) != 1 || f.DMABufs[0].FD < 0 || f.DMABufs[0].Width != 64 || f.DMABufs[0].PixelFormat != v4l2PixFmtYUYV {
+		t.Fatalf("exported %+v", f.DMABufs)
+	}
+	dev.mu.Lock()
+	dups := dev.dups
+	dev.mu.Unlock()
+	if dups == 0 {
+		t.Error("frame DMABUF not duplicated")
+	}
+	f.Release()
+	// Released buffers go back to the driver, so capture goes on.
+	for i := 0; i < 2*v4l2BufferCount; i++ {
+		nextFrame(t, s).Release()
+	}
+
+	// The frame left in the channel at shutdown is released too.
+	time.Sleep(20 * time.Millisecond)
+	s.Close()
+	for deadline := time.Now().Add(2 * time.Second); !dev.isClosed(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("device not closed")
+		}
+	}
+	if n := dev.dmabufsOpen(); n != 0 {
+		t.Errorf("%d exported buffers still open after Close", n)
+	}
+	if _, ok := <-s.Frames(); ok {
+		t.Error("frame delivered after Close")
+	}
+}
+
+func TestStreamCountsUnderruns(t *testing.T) {
+	dev := newFakeDevice(64, 48, v4l2PixFmtYUYV)
+	s, err := openFake(t, dev, WithDMABufExport(), WithBufferCount(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Exported buffers return to the driver only when their frames are
+	// released. Holding every frame drains the driver queue.
+	var held []Frame
+	defer func() {
+		for _, f := range held {
+			f.Release()
+		}
+	}()
+	for i := 0; i < dev.granted; i++ {
+		held = append(held, nextFrame(t, s))
+	}
+	if n := s.Stats().Underruns; n == 0 {
+		t.Errorf("no underrun counted with all %d buffers held", len(held))
+	}
+}
+
+func TestStreamDMABufImport(t *testing.T) {
+	dev := newFakeDevice(8, 4, v4l2PixFmtYUV24)
+	dev.imports = make(map[int][]byte)
+	var fds []int
+	for i := 0; i < 3; i++ {
+		fd := 100 + i
+		dev.imports[fd] = make([]byte, 8*4*3)
+		fds = append(fds, fd)
+	}
+	s, err := openFake(t, dev, WithDMABufImport(fds...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dev.granted != len(fds) {
+		t.Fatalf("%d buffers requested for %d descriptors", dev.granted, len(fds))
+	}
+	// The driver writes into the imported buffers, read back through their
+	// mappings.
+	for i := 0; i < 2*len(fds); i++ {
+		f := nextFrame(t, s)
+		if !bytes.Equal(f.Data, rawYUV24(f.Data[0], 8, 4)) {
+			t.Fatalf("frame %d does not hold the driver's data", i)
+		}
+		f.Release()
+	}
+	dev.mu.Lock()
+	syncs := dev.syncs
+	dev.mu.Unlock()
+	if syncs == 0 {
+		t.Error("CPU access to imported buffers not synchronized")
+	}
+}
+
+func TestStreamDMABufExportSourceChange(t *testing.T) {
+	dev := newFakeDevice(64, 48, v4l2PixFmtYUYV)
+	s, err := openFake(t, dev, WithDMABufExport())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A frame held across the change delays the renegotiation until it
+	// is released.
+	held := nextFrame(t, s)
+	dev.sourceChange(32, 24)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		held.Release()
+	}()
+	ev := nextEvent(t, s)
+	if ev.Type != EventSourceChange || ev.Width != 32 || ev.Height != 24 {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+	f := nextFrame(t, s)
+	for f.Width == 64 {
+		f.Release()
+		f = nextFrame(t, s)
+	}
+	if f.Width != 32 || f.Height != 24 || len(f.DMABufs) != 1 || f.DMABufs[0].Width != 32 {
+		t.Fatalf("frame %dx%d exporting %+v after the change", f.Width, f.Height, f.DMABufs)
+	}
+	f.Release()
+}
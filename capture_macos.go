@@ -444,6 +444,16 @@ import (
 
 var camLog = log.New(os.Stdout, "", log.LstdFlags|log.Lmicroseconds)
 
+// platformScheme is the URI scheme of the AVFoundation backend. It always
+// opens the default camera.
+const platformScheme = "avfoundation"
+
+// platformDevice accepts any device URI or path; the AVFoundation backend
+// only supports the default camera.
+func platformDevice(uri string) (string, error) {
+	return "default", nil
+}
+
 func logCameraConfig() {
 	camLog.Println("[gocam] [AVFoundation]")
 	camLog.Println("[gocam]   Camera (index 0) (Capture)")
@@ -485,16 +495,20 @@ func logCameraConfig() {
 	camLog.Println("[gocam]       Resampling:             NO")
 }
 
-// StartStream starts camera capture and returns a channel with frames encoded
+// openStream starts AVFoundation capture and returns a stream with frames encoded
 // as tightly packed YCbCr 4:4:4 (YUV444) buffers (3 bytes per pixel, packed Y, Cb, Cr).
 // Capture lifetime is controlled by ctx: when the context is canceled, capture stops.
-func StartStream(ctx context.Context) (<-chan Frame, error) {
+// Stream options that only apply to other backends are ignored, and no device
+// events are reported.
+func openStream(ctx context.Context, cfg streamConfig) (*Stream, error) {
 	rc := C.StartCapture()
 	if rc != 0 {
 		return nil, fmt.Errorf("cannot start capture, rc=%d", int(rc))
 	}
 
 	frames := make(chan Frame, 1)
+	events := make(chan Event, eventQueueSize)
+	stats := &streamStats{}
 
 	var loggedResolution atomic.Int64
 
@@ -516,16 +530,23 @@ func StartStream(ctx context.Context) (<-chan Frame, error) {
 
 	go func() {
 		defer close(frames)
+		defer close(events)
 		defer C.StopCapture()
 
 		const dropThreshold = 30
 		misses := 0
+		var seq uint64
 
 		sendFrame := func(frame Frame) {
+			stats.frames.Add(1)
 			select {
 			case frames <- frame:
 			default:
-				<-frames
+				select {
+				case <-frames:
+					stats.dropped.Add(1)
+				default:
+				}
 				frames <- frame
 			}
 		}
@@ -559,9 +580,10 @@ func StartStream(ctx context.Context) (<-chan Frame, error) {
 				return false
 			}
 			frame := Frame{
-				Data:   data,
-				Width:  w,
-				Height: h,
+				Data:      data,
+				Width:     w,
+				Height:    h,
+				Timestamp: time.Now(),
 			}
 			sendFrame(frame)
 			return true
@@ -608,10 +630,13 @@ func StartStream(ctx context.Context) (<-chan Frame, error) {
 				continue
 			}
 
+			seq++
 			frame := Frame{
-				Data:   data,
-				Width:  w,
-				Height: h,
+				Data:      data,
+				Width:     w,
+				Height:    h,
+				Timestamp: time.Now(),
+				Sequence:  seq,
 			}
 
 			logOnce()
@@ -621,5 +646,10 @@ func StartStream(ctx context.Context) (<-chan Frame, error) {
 		}
 	}()
 
-	return frames, nil
+	return &Stream{
+		frames: frames,
+		events: events,
+		stats:  stats,
+		info:   SourceInfo{Driver: "AVFoundation"},
+	}, nil
 }
@@ -714,6 +714,16 @@ import (
 
 var camLog = log.New(os.Stdout, "", log.LstdFlags|log.Lmicroseconds)
 
+// platformScheme is the URI scheme of the Media Foundation backend. It always
+// opens the default camera.
+const platformScheme = "mediafoundation"
+
+// platformDevice accepts any device URI or path; the Media Foundation backend
+// only supports the default camera.
+func platformDevice(uri string) (string, error) {
+	return "default", nil
+}
+
 // logCameraConfig prints a human-readable description of the current camera configuration.
 func logCameraConfig() {
 	var cw, ch C.int
@@ -779,22 +789,28 @@ func logCameraConfig() {
 	camLog.Println("[gocam]       Resampling:             NO")
 }
 
-// StartStream starts camera capture via Media Foundation on Windows
-// and returns a channel of frames encoded as packed YCbCr 4:4:4 (YUV444).
-func StartStream(ctx context.Context) (<-chan Frame, error) {
+// openStream starts camera capture via Media Foundation on Windows
+// and returns a stream of frames encoded as packed YCbCr 4:4:4 (YUV444).
+// Stream options that only apply to other backends are ignored, and no device
+// events are reported.
+func openStream(ctx context.Context, cfg streamConfig) (*Stream, error) {
 	hr := C.StartCapture()
 	if hr != 0 {
 		return nil, fmt.Errorf("gocam: cannot start capture, hr=0x%x", uint32(hr))
 	}
 
 	frames := make(chan Frame, 1)
+	events := make(chan Event, eventQueueSize)
+	stats := &streamStats{}
 
 	go func() {
 		defer close(frames)
+		defer close(events)
 		defer C.StopCapture()
 
 		const dropThreshold = 30
 		misses := 0
+		var seq uint64
 
 		getFrameSize := func() (int, int, bool) {
 			var cw, ch C.int
@@ -824,10 +840,15 @@ func StartStream(ctx context.Context) (<-chan Frame, error) {
 		}
 
 		sendFrame := func(frame Frame) {
+			stats.frames.Add(1)
 			select {
 			case frames <- frame:
 			default:
-				<-frames
+				select {
+				case <-frames:
+					stats.dropped.Add(1)
+				default:
+				}
 				frames <- frame
 			}
 		}
@@ -842,9 +863,10 @@ func StartStream(ctx context.Context) (<-chan Frame, error) {
 				return false
 			}
 			frame := Frame{
-				Data:   data,
-				Width:  w,
-				Height: h,
+				Data:      data,
+				Width:     w,
+				Height:    h,
+				Timestamp: time.Now(),
 			}
 			sendFrame(frame)
 			return true
@@ -891,10 +913,13 @@ func StartStream(ctx context.Context) (<-chan Frame, error) {
 				continue
 			}
 
+			seq++
 			frame := Frame{
-				Data:   data,
-				Width:  w,
-				Height: h,
+				Data:      data,
+				Width:     w,
+				Height:    h,
+				Timestamp: time.Now(),
+				Sequence:  seq,
 			}
 
 			misses = 0
@@ -906,5 +931,10 @@ func StartStream(ctx context.Context) (<-chan Frame, error) {
 		}
 	}()
 
-	return frames, nil
+	return &Stream{
+		frames: frames,
+		events: events,
+		stats:  stats,
+		info:   SourceInfo{Driver: "Media Foundation"},
+	}, nil
 }
@@ -1,17 +1,36 @@
+// Command gocam captures from a camera: by default it saves a snapshot, and
+// subcommands record, pipe or serve the stream or make time-lapses.
+//
+//	gocam [snapshot] [-device uri] [-o snapshot.png]
+//	gocam record [-device uri] [-t 10s] [-chroma 444|420] [-o capture.y4m]
+//	gocam record [-device uri] [-t 10s] [-quality 90] [-mjpeg] -o capture.avi
+//	gocam record [-device uri] [-t 10s] [-dither] [-w 320] -o capture.gif
+//	gocam timelapse [-device uri] [-interval 10s] [-t 0] [-average] [-fps 25] [-o timelapse.gif|.avi|frames/%05d.jpg]
+//	gocam stream [-device uri] [-t 0] [-raw] [-pix_fmt yuv420p] [-print] [-o -]
+//	gocam serve [-device uri] [-addr :8080] [-quality 90] [-fps 15] [-w 640] [-h 480]
+//	gocam rtsp [-device uri] [-addr :8554] [-quality 90] [-fps 15] [-w 640] [-h 480]
 package main
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
-	"path/filepath"
 	"syscall"
-	"time"
-
-	gocam "github.com/svanichkin/gocam"
 )
 
+// commands maps subcommand names to their entry points. Each parses its own
+// flags from args.
+var commands = map[string]func(ctx context.Context, args []string) error{
+	"snapshot":  snapshot,
+	"record":    record,
+	"stream":    streamPipe,
+	"timelapse": timelapse,
+	"serve":     serve,
+	"rtsp":      rtsp,
+}
+
 func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -24,44 +43,16 @@ func main() {
 		cancel()
 	}()
 
-	frames, err := gocam.StartStream(ctx)
-	if err != nil {
-		log.Fatalf("gocam: %v", err)
+	name, args := "snapshot", os.Args[1:]
+	if len(args) > 0 && len(args[0]) > 0 && args[0][0] != '-' {
+		name, args = args[0], args[1:]
 	}
-	log.Println("camera stream started")
-
-	var lastFrame gocam.Frame
-	const logCount = 5
-	for i := 0; i < logCount; {
-		select {
-		case <-ctx.Done():
-			log.Fatalf("gocam: context canceled: %v", ctx.Err())
-		case frame, ok := <-frames:
-			if !ok {
-				log.Fatal("gocam: frame stream closed")
-			}
-			lastFrame = frame
-			log.Printf("frame %d: %dx%d (%d bytes)", i+1, frame.Width, frame.Height, len(frame.Data))
-			i++
-		}
+	run, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "gocam: unknown command %q\n", name)
+		os.Exit(2)
 	}
-
-	cancel()
-	time.Sleep(200 * time.Millisecond)
-
-	if lastFrame.Width == 0 || lastFrame.Height == 0 {
-		log.Fatal("gocam: no frame captured for snapshot")
+	if err := run(ctx, args); err != nil {
+		log.Fatalf("gocam %s: %v", name, err)
 	}
-
-	wd, err := os.Getwd()
-	if err != nil {
-		log.Fatalf("gocam snapshot: %v", err)
-	}
-	outputPath := filepath.Join(wd, "snapshot.png")
-
-	if err := gocam.SaveFramePNG(lastFrame, outputPath); err != nil {
-		log.Fatalf("gocam snapshot: %v", err)
-	}
-
-	log.Printf("snapshot saved to %s", outputPath)
 }
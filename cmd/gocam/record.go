@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	gocam "github.com/svanichkin/gocam"
+)
+
+// record writes the stream for a fixed duration, or until interrupted, to a
+// Y4M, Motion-JPEG AVI or animated GIF file chosen by the output extension.
+func record(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("record", flag.ExitOnError)
+	device := fs.String("device", "", "device path or URI (default: platform camera)")
+	output := fs.String("o", "capture.y4m", "output file: .y4m (lossless), .avi (Motion-JPEG) or .gif")
+	duration := fs.Duration("t", 10*time.Second, "recording length")
+	chroma := fs.String("chroma", "444", "Y4M chroma layout: 444 (lossless) or 420")
+	quality := fs.Int("quality", gocam.DefaultJPEGQuality, "AVI JPEG quality (1-100)")
+	dither := fs.Bool("dither", false, "dither GIF frames")
+	width := fs.Int("w", 0, "scale GIF frames to this width, keeping the aspect ratio (0: keep)")
+	mjpeg := fs.Bool("mjpeg", false, "capture MJPEG and store the camera's images without re-encoding (AVI)")
+	fs.Parse(args)
+
+	ext := strings.ToLower(filepath.Ext(*output))
+	if ext != ".y4m" && ext != ".avi" && ext != ".gif" {
+		return fmt.Errorf("unknown output format %q; use .y4m, .avi or .gif", ext)
+	}
+	y4mOpts := &gocam.Y4MOptions{}
+	switch *chroma {
+	case "444":
+		y4mOpts.Chroma = gocam.Y4M444
+	case "420":
+		y4mOpts.Chroma = gocam.Y4M420
+	default:
+		return fmt.Errorf("unknown chroma %q", *chroma)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, *duration)
+	defer cancel()
+
+	opts := []gocam.StreamOption{gocam.WithDevice(*device)}
+	if *mjpeg {
+		opts = append(opts, gocam.WithMJPEG())
+	}
+	stream, err := gocam.OpenStream(ctx, opts...)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	info := stream.Info()
+
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var fw gocam.FrameWriter
+	var buffered *bufio.Writer
+	switch ext {
+	case ".avi":
+		// The frame rate comes from the timestamps.
+		fw = gocam.NewAVIWriter(f, &gocam.AVIOptions{Quality: *quality})
+	case ".gif":
+		buffered = bufio.NewWriterSize(f, 1<<20)
+		fw = gocam.NewGIFWriter(buffered, &gocam.GIFOptions{Dither: *dither, Width: *width})
+	default:
+		buffered = bufio.NewWriterSize(f, 1<<20)
+		y4mOpts.FPS = info.FPS
+		fw = gocam.NewY4MWriter(buffered, y4mOpts)
+	}
+	counter := &countingWriter{FrameWriter: fw}
+
+	log.Printf("recording %v from %s to %s", *duration, info.Device, *output)
+	if err := gocam.Record(ctx, stream.Frames(), counter); err != nil {
+		return err
+	}
+	if buffered != nil {
+		if err := buffered.Flush(); err != nil {
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	log.Printf("recorded %d frames (%d dropped) to %s", counter.frames, stream.Stats().Dropped, *output)
+	return nil
+}
+
+// countingWriter counts the frames written through it.
+type countingWriter struct {
+	gocam.FrameWriter
+	frames int
+}
+
+func (c *countingWriter) WriteFrame(frame gocam.Frame) error {
+	if err := c.FrameWriter.WriteFrame(frame); err != nil {
+		return err
+	}
+	c.frames++
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+
+	gocam "github.com/svanichkin/gocam"
+)
+
+// rtsp runs an RTSP server until interrupted. Clients play any path, e.g.
+// rtsp://host:8554/cam.
+func rtsp(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("rtsp", flag.ExitOnError)
+	device := fs.String("device", "", "device path or URI (default: platform camera)")
+	addr := fs.String("addr", ":8554", "listen address")
+	quality := fs.Int("quality", gocam.DefaultJPEGQuality, "JPEG quality (1-100)")
+	fps := fs.Float64("fps", 0, "maximum frame rate sent to clients (0: camera rate)")
+	width := fs.Int("w", 0, "scale frames to this width (0: keep)")
+	height := fs.Int("h", 0, "scale frames to this height (0: keep)")
+	mjpeg := fs.Bool("mjpeg", false, "capture MJPEG and send the camera's images without re-encoding when possible")
+	fs.Parse(args)
+
+	if *quality < 1 || *quality > 100 {
+		return fmt.Errorf("JPEG quality %d out of range 1-100", *quality)
+	}
+
+	opts := []gocam.StreamOption{gocam.WithDevice(*device)}
+	if *mjpeg {
+		opts = append(opts, gocam.WithMJPEG())
+	}
+	stream, err := gocam.OpenStream(ctx, opts...)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	info := stream.Info()
+
+	srv := gocam.NewRTSPServer(stream.Frames(), &gocam.RTSPOptions{
+		Quality: *quality,
+		MaxFPS:  *fps,
+		Width:   *width,
+		Height:  *height,
+	})
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	errCh := make(chan error, 1)
+	go func() { errCh <- srv.Serve(l) }()
+	log.Printf("serving %s on rtsp://%s/", info.Device, l.Addr())
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	case <-srv.Done():
+		log.Println("frame stream closed")
+	}
+	if err := srv.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
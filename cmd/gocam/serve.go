@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	gocam "github.com/svanichkin/gocam"
+)
+
+// servePage embeds the stream so a browser pointed at the server root shows
+// the camera.
+const servePage = `<!DOCTYPE html>
+<html><head><title>gocam</title></head>
+<body style="margin:0;background:#000">
+<img src="stream.mjpg" style="display:block;margin:auto;max-width:100%%;max-height:100vh" alt="%s">
+</body></html>
+`
+
+// serve runs an HTTP preview server until interrupted: the MJPEG stream at
+// /stream.mjpg, a single image at /snapshot.jpg, raw frames over WebSocket
+// at /frames and a viewer page at /.
+func serve(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	device := fs.String("device", "", "device path or URI (default: platform camera)")
+	addr := fs.String("addr", ":8080", "listen address")
+	quality := fs.Int("quality", gocam.DefaultJPEGQuality, "JPEG quality (1-100)")
+	fps := fs.Float64("fps", 0, "maximum frame rate sent to viewers (0: camera rate)")
+	width := fs.Int("w", 0, "scale frames to this width (0: keep)")
+	height := fs.Int("h", 0, "scale frames to this height (0: keep)")
+	mjpeg := fs.Bool("mjpeg", false, "capture MJPEG and send the camera's images without re-encoding")
+	origins := fs.String("origins", "", "comma-separated origins whose pages may open /frames besides this server's (*: any)")
+	fs.Parse(args)
+
+	if *quality < 1 || *quality > 100 {
+		return fmt.Errorf("JPEG quality %d out of range 1-100", *quality)
+	}
+
+	opts := []gocam.StreamOption{gocam.WithDevice(*device)}
+	if *mjpeg {
+		opts = append(opts, gocam.WithMJPEG())
+	}
+	stream, err := gocam.OpenStream(ctx, opts...)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	info := stream.Info()
+
+	// The preview and the raw frame endpoint each get every frame.
+	// The preview and the WebSocket clients each get their own copy of the
+	// stream, so neither holds back the other.
+	outs := gocam.Tee(stream.Frames(), 2)
+	preview := gocam.NewMJPEGServer(outs[0], &gocam.MJPEGOptions{
+		Quality: *quality,
+		MaxFPS:  *fps,
+		Width:   *width,
+		Height:  *height,
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("/stream.mjpg", preview)
+	mux.Handle("/snapshot.jpg", preview.SnapshotHandler())
+	wsOpts := &gocam.WSOptions{FPS: *fps}
+	for _, origin := range strings.Split(*origins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			wsOpts.AllowedOrigins = append(wsOpts.AllowedOrigins, origin)
+		}
+	}
+	mux.Handle("/frames", gocam.NewWSServer(outs[1], wsOpts))
+	mux.HandleFunc("/{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, servePage, html.EscapeString(info.Device))
+	})
+
+	srv := &http.Server{Addr: *addr, Handler: mux}
+	errCh := make(chan error, 1)
+	go func() { errCh <- srv.ListenAndServe() }()
+	log.Printf("serving %s on %s (/stream.mjpg, /snapshot.jpg, /frames)", info.Device, *addr)
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	case <-preview.Done():
+		log.Println("frame stream closed")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	return nil
+}
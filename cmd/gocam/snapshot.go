@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"path/filepath"
+	"time"
+
+	gocam "github.com/svanichkin/gocam"
+)
+
+// snapshot logs a few frames and saves the last one.
+func snapshot(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	device := fs.String("device", "", "device path or URI (default: platform camera)")
+	output := fs.String("o", "snapshot.png", "output image; the extension picks the format")
+	quality := fs.Int("quality", gocam.DefaultJPEGQuality, "JPEG quality (1-100)")
+	fs.Parse(args)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	frames, err := gocam.StartStream(ctx, gocam.WithDevice(*device))
+	if err != nil {
+		return err
+	}
+	log.Println("camera stream started")
+
+	var lastFrame gocam.Frame
+	const logCount = 5
+	for i := 0; i < logCount; {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case frame, ok := <-frames:
+			if !ok {
+				return errors.New("frame stream closed")
+			}
+			lastFrame = frame
+			log.Printf("frame %d: %dx%d (%d bytes)", i+1, frame.Width, frame.Height, len(frame.Data))
+			i++
+		}
+	}
+
+	cancel()
+	time.Sleep(200 * time.Millisecond)
+
+	if lastFrame.Width == 0 || lastFrame.Height == 0 {
+		return errors.New("no frame captured for snapshot")
+	}
+
+	outputPath, err := filepath.Abs(*output)
+	if err != nil {
+		return err
+	}
+	if err := gocam.SaveFrame(lastFrame, outputPath, &gocam.SaveOptions{JPEGQuality: *quality}); err != nil {
+		return err
+	}
+
+	log.Printf("snapshot saved to %s", outputPath)
+	return nil
+}
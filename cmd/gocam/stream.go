@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	gocam "github.com/svanichkin/gocam"
+)
+
+// streamPipe writes the stream to standard output (or a file or FIFO) for
+// ffmpeg, GStreamer and other tools: YUV4MPEG2 by default, or headerless
+// raw video with -raw. The matching reader commands are printed to
+// standard error once the frame size is known.
+func streamPipe(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("stream", flag.ExitOnError)
+	device := fs.String("device", "", "device path or URI (default: platform camera)")
+	output := fs.String("o", "-", "output file or FIFO (-: standard output)")
+	duration := fs.Duration("t", 0, "stream length (0: until interrupted)")
+	raw := fs.Bool("raw", false, "write headerless raw video instead of YUV4MPEG2")
+	pixFmt := fs.String("pix_fmt", "yuv420p", "pixel format: yuv444p, yuv420p, nv12, rgb24 or gray (YUV4MPEG2: yuv444p or yuv420p)")
+	printOnly := fs.Bool("print", false, "print the reader commands to standard output and exit")
+	fs.Parse(args)
+
+	format, err := gocam.ParseRawFormat(*pixFmt)
+	if err != nil {
+		return err
+	}
+	if !*raw && format != gocam.RawYUV444P && format != gocam.RawYUV420P {
+		return fmt.Errorf("YUV4MPEG2 carries yuv444p or yuv420p; use -raw for %v", format)
+	}
+
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+	stream, err := gocam.OpenStream(ctx, gocam.WithDevice(*device))
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	info := stream.Info()
+
+	// Raw video needs the frame rate on the reader's command line. Sources
+	// that do not report it have it measured by the RawWriter, so the
+	// commands are printed once it knows.
+	rw := gocam.NewRawWriter(io.Discard, &gocam.RawOptions{Format: format, FPS: info.FPS})
+	ready := func() bool { return !*raw || rw.Info().FPS > 0 }
+	describe := func(w io.Writer) {
+		if *raw {
+			rv := rw.Info()
+			fmt.Fprintf(w, "ffmpeg %s output.mp4\n", strings.Join(rv.FFmpegArgs(), " "))
+			fmt.Fprintf(w, "gst-launch-1.0 %s ! videoconvert ! autovideosink\n", rv.GStreamerSource())
+		} else {
+			fmt.Fprintln(w, "ffmpeg -f yuv4mpegpipe -i - output.mp4")
+			fmt.Fprintln(w, "gst-launch-1.0 fdsrc fd=0 ! y4mdec ! videoconvert ! autovideosink")
+		}
+	}
+	if *printOnly {
+		for {
+			select {
+			case frame, ok := <-stream.Frames():
+				if !ok {
+					return fmt.Errorf("stream from %s ended before the frame rate was known", info.Device)
+				}
+				err := rw.WriteFrame(frame)
+				frame.Release()
+				if err != nil {
+					return err
+				}
+				if ready() {
+					describe(os.Stdout)
+					return nil
+				}
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+
+	out := os.Stdout
+	if *output != "-" {
+		if out, err = os.Create(*output); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	buffered := bufio.NewWriterSize(out, 1<<20)
+
+	var fw gocam.FrameWriter
+	if *raw {
+		rw = gocam.NewRawWriter(buffered, &gocam.RawOptions{Format: format, FPS: info.FPS})
+		fw = rw
+	} else {
+		chroma := gocam.Y4M420
+		if format == gocam.RawYUV444P {
+			chroma = gocam.Y4M444
+		}
+		fw = gocam.NewY4MWriter(buffered, &gocam.Y4MOptions{Chroma: chroma, FPS: info.FPS})
+	}
+	pw := &pipeWriter{FrameWriter: fw, buf: buffered, ready: ready, announce: func() { describe(os.Stderr) }}
+	if err := gocam.Record(ctx, stream.Frames(), pw); err != nil {
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// pipeWriter flushes every frame through to the reader, which is usually
+// live, and calls announce once after the first frame for which ready
+// reports true.
+type pipeWriter struct {
+	gocam.FrameWriter
+	buf      *bufio.Writer
+	ready    func() bool
+	announce func()
+}
+
+func (p *pipeWriter) WriteFrame(frame gocam.Frame) error {
+	if err := p.FrameWriter.WriteFrame(frame); err != nil {
+		return err
+	}
+	if p.announce != nil && p.ready() {
+		p.announce()
+		p.announce = nil
+	}
+	return p.buf.Flush()
+}
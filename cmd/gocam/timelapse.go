@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	gocam "github.com/svanichkin/gocam"
+)
+
+// timelapse keeps one frame per interval, or their average, until the time
+// limit or an interrupt, and writes them as an animated GIF, a Motion-JPEG
+// AVI or an image sequence, chosen by the output name.
+func timelapse(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("timelapse", flag.ExitOnError)
+	device := fs.String("device", "", "device path or URI (default: platform camera)")
+	output := fs.String("o", "timelapse.gif", "output: .gif, .avi, or an image pattern such as frames/%05d.jpg")
+	interval := fs.Duration("interval", 10*time.Second, "capture time per output frame")
+	duration := fs.Duration("t", 0, "capture length (0: until interrupted)")
+	average := fs.Bool("average", false, "average the frames of each interval instead of keeping the first")
+	fps := fs.Float64("fps", gocam.DefaultTimeLapseFPS, "playback frame rate")
+	quality := fs.Int("quality", gocam.DefaultJPEGQuality, "JPEG quality (1-100) for AVI and JPEG images")
+	colors := fs.Int("colors", 256, "GIF palette size (2-256)")
+	dither := fs.Bool("dither", false, "dither GIF frames")
+	width := fs.Int("w", 0, "scale GIF frames to this width (0: keep)")
+	height := fs.Int("h", 0, "scale GIF frames to this height (0: keep)")
+	fs.Parse(args)
+
+	var open func() (gocam.FrameWriter, func() error, error)
+	switch ext := strings.ToLower(filepath.Ext(*output)); {
+	case strings.Contains(*output, "%"):
+		open = func() (gocam.FrameWriter, func() error, error) {
+			sw, err := gocam.NewImageSequenceWriter(*output, &gocam.SaveOptions{JPEGQuality: *quality})
+			return sw, func() error { return nil }, err
+		}
+	case ext == ".gif" || ext == ".avi":
+		open = func() (gocam.FrameWriter, func() error, error) {
+			f, err := os.Create(*output)
+			if err != nil {
+				return nil, nil, err
+			}
+			if ext == ".avi" {
+				return gocam.NewAVIWriter(f, &gocam.AVIOptions{Quality: *quality, FPS: *fps}), f.Close, nil
+			}
+			buffered := bufio.NewWriter(f)
+			gw := gocam.NewGIFWriter(buffered, &gocam.GIFOptions{
+				Colors: *colors,
+				Dither: *dither,
+				Width:  *width,
+				Height: *height,
+				FPS:    *fps,
+			})
+			return gw, func() error {
+				if err := buffered.Flush(); err != nil {
+					f.Close()
+					return err
+				}
+				return f.Close()
+			}, nil
+		}
+	default:
+		return fmt.Errorf("unknown output format %q; use .gif, .avi or an image pattern with %%d", *output)
+	}
+
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+	stream, err := gocam.OpenStream(ctx, gocam.WithDevice(*device))
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	fw, closeFile, err := open()
+	if err != nil {
+		return err
+	}
+	tl, err := gocam.NewTimeLapse(fw, &gocam.TimeLapseOptions{Interval: *interval, Average: *average, FPS: *fps})
+	if err != nil {
+		closeFile()
+		return err
+	}
+
+	log.Printf("time-lapse of %s every %v to %s", stream.Info().Device, *interval, *output)
+	err = gocam.Record(ctx, stream.Frames(), tl)
+	if cerr := closeFile(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("wrote %d frames to %s", tl.Frames(), *output)
+	return nil
+}
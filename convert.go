@@ -0,0 +1,318 @@
+package gocam
+
+import (
+	"image"
+	"image/color"
+	"runtime"
+	"sync"
+
+	"github.com/svanichkin/gocam/pixconv"
+)
+
+// Pixel formats understood by convertFrame, identified by their V4L2 fourcc.
+// File replay and the output path use the same codes on every platform.
+const (
+	v4l2PixFmtRGB24 = 0x33424752 // 'RGB3'
+	v4l2PixFmtYUYV  = 0x56595559 // 'YUYV'
+	v4l2PixFmtNV12  = 0x3231564E // 'NV12'
+	v4l2PixFmtYUV24 = 0x33565559 // 'YUV3' (packed 4:4:4, 8 bits per component)
+	v4l2PixFmtI420  = 0x32315559 // 'YU12' (planar 4:2:0)
+	v4l2PixFmtMJPEG = 0x47504A4D // 'MJPG' (Motion-JPEG, one JPEG image per buffer)
+)
+
+// convertFrame normalizes a single captured frame from various V4L2 pixel
+// formats into a tightly packed YCbCr 4:4:4 buffer (packed Y, Cb, Cr per pixel).
+// It returns nil when src is too short for the given geometry.
+func convertFrame(src []byte, pixFmt uint32, width, height, stride int) []byte {
+	if pixFmt == v4l2PixFmtMJPEG {
+		// Compressed; the decoder checks the size.
+		return decodeJPEG444(completeJPEG(src), width, height)
+	}
+
+	// Every format needs at least a byte per pixel, which also keeps the
+	// size computations below from overflowing.
+	if width <= 0 || height <= 0 || width > len(src) || height > len(src) {
+		return nil
+	}
+
+	img := &pixconv.Image{Width: width, Height: height}
+	switch pixFmt {
+	case v4l2PixFmtYUV24, v4l2PixFmtYUYV, v4l2PixFmtRGB24:
+		// Packed formats; YUYV carries a full macropixel for an odd last
+		// pixel.
+		img.Format = pixconv.YCbCr444
+		rowBytes := width * 3
+		switch pixFmt {
+		case v4l2PixFmtYUYV:
+			img.Format = pixconv.YUYV
+			rowBytes = (width + 1) / 2 * 4
+		case v4l2PixFmtRGB24:
+			img.Format = pixconv.RGB24
+		}
+		effectiveStride, ok := fitStride(stride, rowBytes, height, len(src))
+		if !ok {
+			return nil
+		}
+		img.Planes[0], img.Strides[0] = src, effectiveStride
+
+	case v4l2PixFmtNV12:
+		// NV12: Y plane (full res), then interleaved CbCr at 2x2 subsampling
+		// with the same stride. A CbCr row holds one pair per two pixels, so
+		// odd widths need one byte more than the luma row.
+		img.Format = pixconv.NV12
+		chromaH := (height + 1) / 2
+		effectiveStride, ok := fitStride(stride, (width+1)/2*2, height+chromaH, len(src))
+		if !ok {
+			return nil
+		}
+		ySize := effectiveStride * height
+		img.Planes[0], img.Planes[1] = src[:ySize], src[ySize:]
+		img.Strides[0], img.Strides[1] = effectiveStride, effectiveStride
+
+	case v4l2PixFmtI420:
+		// I420: Y plane, then Cb and Cr planes at 2x2 subsampling. The
+		// chroma planes use half the luma stride.
+		effectiveStride := stride
+		if effectiveStride < width {
+			effectiveStride = width
+		}
+		if effectiveStride > len(src) {
+			return nil
+		}
+		chromaStride := (effectiveStride + 1) / 2
+		chromaH := (height + 1) / 2
+		ySize := effectiveStride * height
+		cSize := chromaStride * chromaH
+		if len(src) < ySize+2*cSize {
+			return nil
+		}
+		img.Format = pixconv.I420
+		img.Planes = [3][]byte{src[:ySize], src[ySize : ySize+cSize], src[ySize+cSize : ySize+2*cSize]}
+		img.Strides = [3]int{effectiveStride, chromaStride, chromaStride}
+
+	default:
+		return nil
+	}
+
+	// All output frames are packed YCbCr 4:4:4: 3 bytes per pixel. RGB
+	// devices are converted to studio-range BT.601.
+	dst := pixconv.New(pixconv.YCbCr444, width, height)
+	if err := pixconv.Convert(dst, img, pixconv.Rec601); err != nil {
+		return nil
+	}
+	return dst.Planes[0]
+}
+
+// fitStride returns the stride of a buffer holding rows rows of at least
+// rowBytes bytes each; the last row needs no padding. A stride of zero or
+// below rowBytes means tightly packed. When src is too short for the
+// stride, which happens with drivers reporting a bogus bytesperline, the
+// stride is derived from the buffer length instead. ok is false when even
+// that does not fit.
+func fitStride(stride, rowBytes, rows, n int) (effectiveStride int, ok bool) {
+	if rowBytes <= 0 || rows <= 0 {
+		return 0, false
+	}
+	if stride < rowBytes {
+		stride = rowBytes
+	}
+	if stride <= n && stride*(rows-1)+rowBytes <= n {
+		return stride, true
+	}
+	stride = n / rows
+	if stride < rowBytes {
+		return 0, false
+	}
+	return stride, true
+}
+
+// planarToYCbCr444 interleaves planar YCbCr with chroma subsampled by subX
+// horizontally and subY vertically into a packed YCbCr444 buffer. Missing
+// planes (monochrome sources) yield neutral chroma.
+func planarToYCbCr444(yPlane, cbPlane, crPlane []byte, width, height, yStride, cStride, subX, subY int) []byte {
+	if width <= 0 || height <= 0 || len(yPlane) < yStride*(height-1)+width {
+		return nil
+	}
+	chromaW := (width + subX - 1) / subX
+	chromaH := (height + subY - 1) / subY
+	hasChroma := cbPlane != nil && crPlane != nil
+	if hasChroma && (len(cbPlane) < cStride*(chromaH-1)+chromaW || len(crPlane) < cStride*(chromaH-1)+chromaW) {
+		return nil
+	}
+
+	dst := make([]byte, width*height*3)
+	for y := 0; y < height; y++ {
+		yRow := yPlane[y*yStride : y*yStride+width]
+		out := dst[y*width*3 : (y+1)*width*3]
+		if !hasChroma {
+			for x, v := range yRow {
+				out[x*3] = v
+				out[x*3+1] = 128
+				out[x*3+2] = 128
+			}
+			continue
+		}
+		cOff := (y / subY) * cStride
+		cbRow := cbPlane[cOff : cOff+chromaW]
+		crRow := crPlane[cOff : cOff+chromaW]
+		for x, v := range yRow {
+			out[x*3] = v
+			out[x*3+1] = cbRow[x/subX]
+			out[x*3+2] = crRow[x/subX]
+		}
+	}
+	return dst
+}
+
+// imageToYCbCr444 converts a decoded image into a packed YCbCr444 buffer.
+// JPEG images (image.YCbCr) keep their samples; everything else goes through
+// RGB.
+func imageToYCbCr444(img image.Image) (data []byte, width, height int) {
+	b := img.Bounds()
+	width, height = b.Dx(), b.Dy()
+	data = make([]byte, width*height*3)
+
+	if ycc, ok := img.(*image.YCbCr); ok {
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				yi := ycc.YOffset(b.Min.X+x, b.Min.Y+y)
+				ci := ycc.COffset(b.Min.X+x, b.Min.Y+y)
+				di := (y*width + x) * 3
+				data[di] = ycc.Y[yi]
+				data[di+1] = ycc.Cb[ci]
+				data[di+2] = ycc.Cr[ci]
+			}
+		}
+		return data, width, height
+	}
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			yy, cb, cr := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(bl>>8))
+			di := (y*width + x) * 3
+			data[di] = yy
+			data[di+1] = cb
+			data[di+2] = cr
+		}
+	}
+	return data, width, height
+}
+
+// resampleYCbCr444Fill downsamples a packed YCbCr444 buffer into dstW x dstH,
+// preserving aspect ratio with a centered crop ("fill"). If the source is
+// already smaller than or equal to dst in both dimensions, it returns the
+// original buffer (no upscaling).
+func resampleYCbCr444Fill(src []byte, srcW, srcH, dstW, dstH int) []byte {
+	if srcW <= 0 || srcH <= 0 || dstW <= 0 || dstH <= 0 {
+		return nil
+	}
+	if len(src) < srcW*srcH*3 {
+		return nil
+	}
+
+	// No upscaling: if source fits entirely within dst, keep it as-is.
+	if srcW <= dstW && srcH <= dstH {
+		return src
+	}
+
+	return scaleYCbCr444Fill(src, srcW, srcH, dstW, dstH)
+}
+
+// scaleYCbCr444Fill scales a packed YCbCr444 buffer to exactly dstW x dstH
+// with nearest-neighbor sampling, cropping the source centrally to keep the
+// aspect ratio. Unlike resampleYCbCr444Fill it also scales up.
+func scaleYCbCr444Fill(src []byte, srcW, srcH, dstW, dstH int) []byte {
+	if srcW <= 0 || srcH <= 0 || dstW <= 0 || dstH <= 0 {
+		return nil
+	}
+	if len(src) < srcW*srcH*3 {
+		return nil
+	}
+
+	dst := make([]byte, dstW*dstH*3)
+
+	// Compute centered crop region in source.
+	srcAspect := float64(srcW) / float64(srcH)
+	dstAspect := float64(dstW) / float64(dstH)
+
+	cropW := srcW
+	cropH := srcH
+	srcX0 := 0
+	srcY0 := 0
+
+	if srcAspect > dstAspect {
+		// Source is wider than destination: crop left/right.
+		cropH = srcH
+		cropW = int(float64(srcH) * dstAspect)
+		if cropW > srcW {
+			cropW = srcW
+		}
+		if cropW < 1 {
+			cropW = 1
+		}
+		srcX0 = (srcW - cropW) / 2
+		srcY0 = 0
+	} else {
+		// Source is taller than destination: crop top/bottom.
+		cropW = srcW
+		cropH = int(float64(srcW) / dstAspect)
+		if cropH > srcH {
+			cropH = srcH
+		}
+		if cropH < 1 {
+			cropH = 1
+		}
+		srcX0 = 0
+		srcY0 = (srcH - cropH) / 2
+	}
+
+	// Source byte offset of every output column, shared by all rows.
+	xOff := make([]int, dstW)
+	for dx := range xOff {
+		sx := srcX0 + dx*cropW/dstW
+		if sx >= srcW {
+			sx = srcW - 1
+		}
+		xOff[dx] = sx * 3
+	}
+
+	rowBytes := srcW * 3
+	scaleRows := func(y0, y1 int) {
+		for dy := y0; dy < y1; dy++ {
+			sy := srcY0 + dy*cropH/dstH
+			if sy >= srcH {
+				sy = srcH - 1
+			}
+			row := src[sy*rowBytes : (sy+1)*rowBytes]
+			out := dst[dy*dstW*3 : (dy+1)*dstW*3]
+			for _, off := range xOff {
+				if len(out) < 3 || off+3 > len(row) {
+					break
+				}
+				p := row[off : off+3]
+				out[0], out[1], out[2] = p[0], p[1], p[2]
+				out = out[3:]
+			}
+		}
+	}
+
+	// Large frames are split into row stripes across CPUs. The work is the
+	// larger of the source area read and the output written.
+	workers := min(runtime.GOMAXPROCS(0), max(cropW*cropH, dstW*dstH)/pixconv.MinStripePixels)
+	if workers <= 1 {
+		scaleRows(0, dstH)
+		return dst
+	}
+	var wg sync.WaitGroup
+	rows := (dstH + workers - 1) / workers
+	for y0 := 0; y0 < dstH; y0 += rows {
+		wg.Add(1)
+		go func(y0, y1 int) {
+			defer wg.Done()
+			scaleRows(y0, y1)
+		}(y0, min(y0+rows, dstH))
+	}
+	wg.Wait()
+	return dst
+}
@@ -0,0 +1,338 @@
+package gocam
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files in testdata")
+
+// convertFormats lists the pixel formats accepted by convertFrame.
+var convertFormats = []struct {
+	name   string
+	pixFmt uint32
+}{
+	{"yuv24", v4l2PixFmtYUV24},
+	{"nv12", v4l2PixFmtNV12},
+	{"yuyv", v4l2PixFmtYUYV},
+	{"rgb24", v4l2PixFmtRGB24},
+	{"i420", v4l2PixFmtI420},
+}
+
+// frameSize returns the minimal buffer length of a w x h frame in pixFmt
+// with the given luma stride, i.e. without padding after the last row.
+func frameSize(pixFmt uint32, w, h, stride int) int {
+	switch pixFmt {
+	case v4l2PixFmtYUV24, v4l2PixFmtRGB24:
+		return stride*(h-1) + w*3
+	case v4l2PixFmtYUYV:
+		return stride*(h-1) + (w+1)/2*4
+	case v4l2PixFmtNV12:
+		return stride*(h+(h+1)/2-1) + (w+1)/2*2
+	case v4l2PixFmtI420:
+		cs := (stride + 1) / 2
+		return stride*h + cs*((h+1)/2)*2
+	}
+	return 0
+}
+
+// minStride returns the tightly packed luma stride of pixFmt.
+func minStride(pixFmt uint32, w int) int {
+	switch pixFmt {
+	case v4l2PixFmtYUV24, v4l2PixFmtRGB24:
+		return w * 3
+	case v4l2PixFmtYUYV:
+		return (w + 1) / 2 * 4
+	case v4l2PixFmtNV12:
+		return (w + 1) / 2 * 2
+	}
+	return w
+}
+
+// referenceConvert is a straightforward per-pixel version of convertFrame
+// that addresses every sample directly from the format definition.
+func referenceConvert(src []byte, pixFmt uint32, w, h, stride int) []byte {
+	dst := make([]byte, w*h*3)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var Y, Cb, Cr byte
+			switch pixFmt {
+			case v4l2PixFmtYUV24:
+				i := y*stride + x*3
+				Y, Cb, Cr = src[i], src[i+1], src[i+2]
+			case v4l2PixFmtYUYV:
+				base := y*stride + x/2*4
+				Y, Cb, Cr = src[base+x%2*2], src[base+1], src[base+3]
+			case v4l2PixFmtNV12:
+				c := h*stride + y/2*stride + x/2*2
+				Y, Cb, Cr = src[y*stride+x], src[c], src[c+1]
+			case v4l2PixFmtI420:
+				cs := (stride + 1) / 2
+				cb := h*stride + y/2*cs + x/2
+				Y, Cb, Cr = src[y*stride+x], src[cb], src[cb+cs*((h+1)/2)]
+			case v4l2PixFmtRGB24:
+				i := y*stride + x*3
+				r, g, b := float64(src[i]), float64(src[i+1]), float64(src[i+2])
+				Y = clampToByte(int(16 + 0.257*r + 0.504*g + 0.098*b + 0.5))
+				Cb = clampToByte(int(128 - 0.148*r - 0.291*g + 0.439*b + 0.5))
+				Cr = clampToByte(int(128 + 0.439*r - 0.368*g - 0.071*b + 0.5))
+			}
+			copy(dst[(y*w+x)*3:], []byte{Y, Cb, Cr})
+		}
+	}
+	return dst
+}
+
+func clampToByte(v int) byte {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return byte(v)
+}
+
+// testSource returns a deterministic pseudo-random source buffer.
+func testSource(n int, seed int64) []byte {
+	src := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(src)
+	return src
+}
+
+func TestConvertFrameGolden(t *testing.T) {
+	sizes := []struct{ w, h, pad int }{
+		{8, 6, 0},
+		{7, 5, 0},
+		{6, 4, 5},
+	}
+	for _, f := range convertFormats {
+		for _, sz := range sizes {
+			name := fmt.Sprintf("%s_%dx%d_pad%d", f.name, sz.w, sz.h, sz.pad)
+			t.Run(name, func(t *testing.T) {
+				stride := minStride(f.pixFmt, sz.w) + sz.pad
+				src := testSource(frameSize(f.pixFmt, sz.w, sz.h, stride), int64(f.pixFmt)+int64(sz.w))
+				got := convertFrame(src, f.pixFmt, sz.w, sz.h, stride)
+				if len(got) != sz.w*sz.h*3 {
+					t.Fatalf("convertFrame returned %d bytes, want %d", len(got), sz.w*sz.h*3)
+				}
+
+				path := filepath.Join("testdata", "convert", name+".golden")
+				if *update {
+					if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+						t.Fatal(err)
+					}
+					if err := os.WriteFile(path, got, 0o644); err != nil {
+						t.Fatal(err)
+					}
+				}
+				want, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatalf("%v (run with -update to create it)", err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("output differs from %s", path)
+				}
+			})
+		}
+	}
+}
+
+func TestConvertFrameMatchesReference(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, f := range convertFormats {
+		t.Run(f.name, func(t *testing.T) {
+			for i := 0; i < 200; i++ {
+				w, h := 1+rng.Intn(33), 1+rng.Intn(33)
+				stride := minStride(f.pixFmt, w)
+				if rng.Intn(2) == 0 {
+					stride += rng.Intn(16)
+				}
+				n := frameSize(f.pixFmt, w, h, stride)
+				if rng.Intn(2) == 0 {
+					// Drivers often pad the whole buffer to stride*rows.
+					n += rng.Intn(stride + 1)
+				}
+				src := testSource(n, rng.Int63())
+
+				got := convertFrame(src, f.pixFmt, w, h, stride)
+				want := referenceConvert(src, f.pixFmt, w, h, stride)
+				if len(got) != len(want) {
+					t.Fatalf("%dx%d stride %d: got %d bytes, want %d", w, h, stride, len(got), len(want))
+				}
+				for j := range got {
+					d := int(got[j]) - int(want[j])
+					// The integer RGB matrix may round differently.
+					if d > 1 || d < -1 || (f.pixFmt != v4l2PixFmtRGB24 && d != 0) {
+						t.Fatalf("%dx%d stride %d: pixel %d component %d = %d, want %d",
+							w, h, stride, j/3, j%3, got[j], want[j])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestConvertFrameRejectsShortBuffers(t *testing.T) {
+	for _, f := range convertFormats {
+		n := frameSize(f.pixFmt, 8, 6, minStride(f.pixFmt, 8))
+		if got := convertFrame(make([]byte, n-1), f.pixFmt, 8, 6, 0); got != nil {
+			t.Errorf("%s: convertFrame accepted a buffer one byte short", f.name)
+		}
+	}
+	if got := convertFrame(make([]byte, 64), 0x3f3f3f3f, 4, 4, 0); got != nil {
+		t.Errorf("convertFrame accepted an unknown format")
+	}
+}
+
+func TestConvertFrameStrideFallback(t *testing.T) {
+	// A driver reporting a bytesperline larger than the buffer allows is
+	// treated as tightly packed.
+	src := testSource(8*6*3, 2)
+	got := convertFrame(src, v4l2PixFmtYUV24, 8, 6, 1000)
+	if !bytes.Equal(got, src) {
+		t.Errorf("bogus stride: output differs from packed source")
+	}
+}
+
+func TestResampleYCbCr444Fill(t *testing.T) {
+	src := testSource(8*4*3, 3)
+	if got := resampleYCbCr444Fill(src, 8, 4, 16, 16); &got[0] != &src[0] {
+		t.Errorf("smaller source was copied or scaled, want it returned as-is")
+	}
+	if got := resampleYCbCr444Fill(src[:10], 8, 4, 2, 2); got != nil {
+		t.Errorf("short source accepted")
+	}
+
+	// Downscaling 8x4 to 2x2 crops the center 4x4 and samples every second
+	// pixel of it.
+	got := resampleYCbCr444Fill(src, 8, 4, 2, 2)
+	for dy := 0; dy < 2; dy++ {
+		for dx := 0; dx < 2; dx++ {
+			si := ((dy*2)*8 + 2 + dx*2) * 3
+			di := (dy*2 + dx) * 3
+			if !bytes.Equal(got[di:di+3], src[si:si+3]) {
+				t.Errorf("pixel (%d,%d) = %v, want %v", dx, dy, got[di:di+3], src[si:si+3])
+			}
+		}
+	}
+}
+
+func TestResampleYCbCr444FillProperties(t *testing.T) {
+	rng := rand.New(rand.NewSource(4))
+	for i := 0; i < 500; i++ {
+		srcW, srcH := 1+rng.Intn(40), 1+rng.Intn(40)
+		dstW, dstH := 1+rng.Intn(40), 1+rng.Intn(40)
+		// Unique pixels let every output pixel be traced back to the source.
+		src := make([]byte, srcW*srcH*3)
+		for p := 0; p < srcW*srcH; p++ {
+			src[p*3], src[p*3+1], src[p*3+2] = byte(p), byte(p>>8), 0xAA
+		}
+
+		got := resampleYCbCr444Fill(src, srcW, srcH, dstW, dstH)
+		if srcW <= dstW && srcH <= dstH {
+			if len(got) != len(src) {
+				t.Fatalf("%dx%d -> %dx%d: upscaled", srcW, srcH, dstW, dstH)
+			}
+			continue
+		}
+		if len(got) != dstW*dstH*3 {
+			t.Fatalf("%dx%d -> %dx%d: got %d bytes", srcW, srcH, dstW, dstH, len(got))
+		}
+		prevX := -1
+		for dx := 0; dx < dstW; dx++ {
+			p := int(got[dx*3]) | int(got[dx*3+1])<<8
+			if got[dx*3+2] != 0xAA || p >= srcW*srcH {
+				t.Fatalf("%dx%d -> %dx%d: pixel %d not from source", srcW, srcH, dstW, dstH, dx)
+			}
+			// Columns are sampled left to right.
+			if x := p % srcW; x < prevX {
+				t.Fatalf("%dx%d -> %dx%d: column order reversed at %d", srcW, srcH, dstW, dstH, dx)
+			} else {
+				prevX = x
+			}
+		}
+	}
+}
+
+func FuzzConvertFrame(f *testing.F) {
+	for _, fm := range convertFormats {
+		f.Add(testSource(frameSize(fm.pixFmt, 7, 5, minStride(fm.pixFmt, 7)), 5), fm.pixFmt, 7, 5, 0)
+	}
+	f.Add([]byte{1, 2, 3}, uint32(v4l2PixFmtNV12), 1, 1, -4)
+
+	f.Fuzz(func(t *testing.T, src []byte, pixFmt uint32, width, height, stride int) {
+		// Keep allocations bounded; larger sizes exercise no new paths.
+		if width > 512 || height > 512 {
+			return
+		}
+		// Limit src so that out of bounds reads panic instead of reading
+		// spare capacity.
+		src = src[:len(src):len(src)]
+		got := convertFrame(src, pixFmt, width, height, stride)
+		if got != nil && len(got) != width*height*3 {
+			t.Fatalf("convertFrame returned %d bytes for %dx%d", len(got), width, height)
+		}
+	})
+}
+
+func FuzzResampleYCbCr444Fill(f *testing.F) {
+	f.Add(testSource(8*4*3, 6), 8, 4, 2, 2)
+	f.Add(testSource(3*3*3, 7), 3, 3, 1, 7)
+
+	f.Fuzz(func(t *testing.T, src []byte, srcW, srcH, dstW, dstH int) {
+		if srcW > 512 || srcH > 512 || dstW > 512 || dstH > 512 {
+			return
+		}
+		src = src[:len(src):len(src)]
+		got := resampleYCbCr444Fill(src, srcW, srcH, dstW, dstH)
+		if got != nil && len(got) != dstW*dstH*3 && len(got) != len(src) {
+			t.Fatalf("resample returned %d bytes for %dx%d -> %dx%d", len(got), srcW, srcH, dstW, dstH)
+		}
+	})
+}
+
+var benchSizes = []struct {
+	name string
+	w, h int
+}{
+	{"480p", 640, 480},
+	{"720p", 1280, 720},
+	{"1080p", 1920, 1080},
+}
+
+func BenchmarkConvertFrame(b *testing.B) {
+	for _, f := range convertFormats {
+		for _, size := range benchSizes {
+			stride := minStride(f.pixFmt, size.w)
+			src := testSource(frameSize(f.pixFmt, size.w, size.h, stride), 1)
+			b.Run(f.name+"/"+size.name, func(b *testing.B) {
+				b.SetBytes(int64(len(src)))
+				for i := 0; i < b.N; i++ {
+					if convertFrame(src, f.pixFmt, size.w, size.h, stride) == nil {
+						b.Fatal("convertFrame failed")
+					}
+				}
+				b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N), "ns/frame")
+			})
+		}
+	}
+}
+
+func BenchmarkResampleYCbCr444Fill(b *testing.B) {
+	for _, size := range benchSizes {
+		src := testSource(size.w*size.h*3, 1)
+		b.Run(size.name, func(b *testing.B) {
+			b.SetBytes(int64(len(src)))
+			for i := 0; i < b.N; i++ {
+				resampleYCbCr444Fill(src, size.w, size.h, 352, 288)
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N), "ns/frame")
+		})
+	}
+}
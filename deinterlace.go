@@ -0,0 +1,395 @@
+package gocam
+
+// FieldOrder describes how the lines of a frame relate to video fields.
+type FieldOrder int
+
+const (
+	// FieldProgressive is a progressive (or already deinterlaced) frame.
+	FieldProgressive FieldOrder = iota
+	// FieldTop is a single top field (even lines of the full frame).
+	FieldTop
+	// FieldBottom is a single bottom field (odd lines of the full frame).
+	FieldBottom
+	// FieldInterlacedTB holds both fields interleaved line by line, with the
+	// top field captured first.
+	FieldInterlacedTB
+	// FieldInterlacedBT holds both fields interleaved line by line, with the
+	// bottom field captured first.
+	FieldInterlacedBT
+	// FieldSeqTB stores the top field in the upper half of the frame followed
+	// by the bottom field.
+	FieldSeqTB
+	// FieldSeqBT stores the bottom field in the upper half of the frame
+	// followed by the top field.
+	FieldSeqBT
+)
+
+func (f FieldOrder) String() string {
+	switch f {
+	case FieldProgressive:
+		return "progressive"
+	case FieldTop:
+		return "top"
+	case FieldBottom:
+		return "bottom"
+	case FieldInterlacedTB:
+		return "interlaced-tb"
+	case FieldInterlacedBT:
+		return "interlaced-bt"
+	case FieldSeqTB:
+		return "seq-tb"
+	case FieldSeqBT:
+		return "seq-bt"
+	}
+	return "unknown"
+}
+
+// DeinterlaceMode selects the software deinterlacer applied to interlaced
+// sources. Progressive sources are never touched.
+type DeinterlaceMode int
+
+const (
+	// DeinterlaceNone delivers fields and interlaced frames as captured.
+	DeinterlaceNone DeinterlaceMode = iota
+	// DeinterlaceBob keeps one field and interpolates the missing lines.
+	// Sources that deliver alternating fields yield one frame per field.
+	DeinterlaceBob
+	// DeinterlaceWeave interleaves both fields into one frame. Sharp for
+	// static scenes, combs on motion. Sources that send only one field
+	// parity are bobbed instead, as is Blend.
+	DeinterlaceWeave
+	// DeinterlaceBlend weaves both fields and low-pass filters vertically,
+	// trading some sharpness for the absence of combing.
+	DeinterlaceBlend
+	// DeinterlaceYADIF interpolates missing lines spatially along edges and
+	// clamps the result against temporal neighbors, in the spirit of yadif.
+	DeinterlaceYADIF
+)
+
+func (m DeinterlaceMode) String() string {
+	switch m {
+	case DeinterlaceNone:
+		return "none"
+	case DeinterlaceBob:
+		return "bob"
+	case DeinterlaceWeave:
+		return "weave"
+	case DeinterlaceBlend:
+		return "blend"
+	case DeinterlaceYADIF:
+		return "yadif"
+	}
+	return "unknown"
+}
+
+// deinterlacer turns captured packed YCbCr444 frames or fields into
+// progressive frames. It keeps the state needed to pair alternating fields
+// and to look back one frame for YADIF.
+type deinterlacer struct {
+	mode DeinterlaceMode
+
+	pending    []byte // last single field waiting for its partner
+	pendingTop bool
+	prev       []byte // previous woven frame, for YADIF
+}
+
+func newDeinterlacer(mode DeinterlaceMode) *deinterlacer {
+	if mode == DeinterlaceNone {
+		return nil
+	}
+	return &deinterlacer{mode: mode}
+}
+
+// process deinterlaces one captured buffer of width w and height h laid out
+// according to field. It returns the progressive frame and its height; ok is
+// false when no frame is due yet, e.g. while weave waits for a second field.
+func (d *deinterlacer) process(data []byte, w, h int, field FieldOrder) (out []byte, outH int, ok bool) {
+	switch field {
+	case FieldProgressive:
+		return data, h, true
+
+	case FieldTop, FieldBottom:
+		return d.processField(data, w, h, field == FieldTop)
+
+	case FieldSeqTB, FieldSeqBT:
+		data = interleaveSeqFields(data, w, h, field == FieldSeqTB)
+		if field == FieldSeqTB {
+			field = FieldInterlacedTB
+		} else {
+			field = FieldInterlacedBT
+		}
+	}
+
+	// Keep the field that was captured first; the other one is rebuilt.
+	return d.processFrame(data, w, h, field == FieldInterlacedTB), h, true
+}
+
+// processField handles sources that deliver one field per buffer.
+func (d *deinterlacer) processField(field []byte, w, h int, top bool) ([]byte, int, bool) {
+	fullH := h * 2
+
+	if d.mode == DeinterlaceBob {
+		return bobField(field, w, h, top), fullH, true
+	}
+
+	if d.pending == nil || d.pendingTop == top {
+		// A field without a partner of the other parity is bobbed, except
+		// the very first one, for which weave and blend wait. Sources set
+		// to a single parity (V4L2_FIELD_TOP or BOTTOM) never deliver a
+		// partner, so every later field takes this path too.
+		first := d.pending == nil
+		d.pending = field
+		d.pendingTop = top
+		if first && d.mode != DeinterlaceYADIF {
+			return nil, 0, false
+		}
+		return bobField(field, w, h, top), fullH, true
+	}
+
+	topField, bottomField := d.pending, field
+	if top {
+		topField, bottomField = field, d.pending
+	}
+	woven := weaveFields(topField, bottomField, w, h)
+
+	if d.mode == DeinterlaceYADIF {
+		// Slide the window so every field produces a frame.
+		d.pending = field
+		d.pendingTop = top
+	} else {
+		d.pending = nil
+	}
+	return d.processFrame(woven, w, fullH, top), fullH, true
+}
+
+// processFrame deinterlaces a woven frame, keeping the lines of the top
+// field when keepTop is set and the bottom field otherwise.
+func (d *deinterlacer) processFrame(frame []byte, w, h int, keepTop bool) []byte {
+	switch d.mode {
+	case DeinterlaceBob:
+		return bobFrame(frame, w, h, keepTop)
+	case DeinterlaceWeave:
+		return frame
+	case DeinterlaceBlend:
+		return blendFrame(frame, w, h)
+	case DeinterlaceYADIF:
+		prev := d.prev
+		if len(prev) != len(frame) {
+			prev = frame
+		}
+		out := yadifFrame(frame, prev, w, h, keepTop)
+		d.prev = frame
+		return out
+	}
+	return frame
+}
+
+// interleaveSeqFields converts a sequential-field frame (one field in the
+// upper half, the other in the lower half) into a line-interleaved frame.
+func interleaveSeqFields(src []byte, w, h int, topFirst bool) []byte {
+	rowBytes := w * 3
+	if len(src) < rowBytes*h {
+		return src
+	}
+	dst := make([]byte, rowBytes*h)
+	topLines := (h + 1) / 2
+	bottomLines := h / 2
+	for y := 0; y < h; y++ {
+		srcY := y / 2
+		switch {
+		case y%2 == 0 && !topFirst:
+			srcY += bottomLines
+		case y%2 == 1 && topFirst:
+			srcY += topLines
+		}
+		copy(dst[y*rowBytes:(y+1)*rowBytes], src[srcY*rowBytes:(srcY+1)*rowBytes])
+	}
+	return dst
+}
+
+// weaveFields interleaves a top and a bottom field of height h into a frame
+// of height 2h.
+func weaveFields(top, bottom []byte, w, h int) []byte {
+	rowBytes := w * 3
+	dst := make([]byte, rowBytes*h*2)
+	for y := 0; y < h; y++ {
+		row := y * rowBytes
+		if row+rowBytes <= len(top) {
+			copy(dst[(2*y)*rowBytes:], top[row:row+rowBytes])
+		}
+		if row+rowBytes <= len(bottom) {
+			copy(dst[(2*y+1)*rowBytes:], bottom[row:row+rowBytes])
+		}
+	}
+	return dst
+}
+
+// bobField scales a single field of height h to a frame of height 2h,
+// interpolating the lines of the missing field from their neighbors.
+func bobField(field []byte, w, h int, top bool) []byte {
+	rowBytes := w * 3
+	fullH := h * 2
+	dst := make([]byte, rowBytes*fullH)
+	for y := 0; y < h; y++ {
+		kept := 2 * y
+		if !top {
+			kept = 2*y + 1
+		}
+		if (y+1)*rowBytes <= len(field) {
+			copy(dst[kept*rowBytes:(kept+1)*rowBytes], field[y*rowBytes:(y+1)*rowBytes])
+		}
+	}
+	return bobFrame(dst, w, fullH, top)
+}
+
+// bobFrame rebuilds the lines of the dropped field by averaging the kept
+// lines above and below them.
+func bobFrame(src []byte, w, h int, keepTop bool) []byte {
+	rowBytes := w * 3
+	if len(src) < rowBytes*h {
+		return src
+	}
+	dst := make([]byte, len(src))
+	copy(dst, src)
+
+	for y := 0; y < h; y++ {
+		if (y%2 == 0) == keepTop {
+			continue
+		}
+		above := y - 1
+		below := y + 1
+		if above < 0 {
+			above = below
+		}
+		if below >= h {
+			below = above
+		}
+		if above < 0 || above >= h {
+			continue
+		}
+		a := dst[above*rowBytes : (above+1)*rowBytes]
+		b := dst[below*rowBytes : (below+1)*rowBytes]
+		row := dst[y*rowBytes : (y+1)*rowBytes]
+		for i := range row {
+			row[i] = byte((int(a[i]) + int(b[i]) + 1) >> 1)
+		}
+	}
+	return dst
+}
+
+// blendFrame applies a [1 2 1]/4 vertical filter, which merges both fields
+// and hides combing.
+func blendFrame(src []byte, w, h int) []byte {
+	rowBytes := w * 3
+	if len(src) < rowBytes*h {
+		return src
+	}
+	dst := make([]byte, len(src))
+	for y := 0; y < h; y++ {
+		above := y - 1
+		if above < 0 {
+			above = 0
+		}
+		below := y + 1
+		if below >= h {
+			below = h - 1
+		}
+		a := src[above*rowBytes : (above+1)*rowBytes]
+		c := src[y*rowBytes : (y+1)*rowBytes]
+		b := src[below*rowBytes : (below+1)*rowBytes]
+		row := dst[y*rowBytes : (y+1)*rowBytes]
+		for i := range row {
+			row[i] = byte((int(a[i]) + 2*int(c[i]) + int(b[i]) + 2) >> 2)
+		}
+	}
+	return dst
+}
+
+// yadifFrame keeps the lines of one field and predicts the others. The
+// spatial prediction follows the best of three edge directions; it is then
+// clamped to the range suggested by the same lines in the current and the
+// previous frame, which restores detail in static areas without combing in
+// moving ones.
+func yadifFrame(cur, prev []byte, w, h int, keepTop bool) []byte {
+	rowBytes := w * 3
+	if len(cur) < rowBytes*h || len(prev) < rowBytes*h {
+		return cur
+	}
+	dst := make([]byte, len(cur))
+	copy(dst, cur)
+
+	for y := 0; y < h; y++ {
+		if (y%2 == 0) == keepTop {
+			continue
+		}
+		above := y - 1
+		below := y + 1
+		if above < 0 {
+			above = below
+		}
+		if below >= h {
+			below = above
+		}
+		if above < 0 || above >= h {
+			continue
+		}
+
+		c := cur[above*rowBytes : (above+1)*rowBytes]
+		e := cur[below*rowBytes : (below+1)*rowBytes]
+		pc := prev[above*rowBytes : (above+1)*rowBytes]
+		pe := prev[below*rowBytes : (below+1)*rowBytes]
+		curLine := cur[y*rowBytes : (y+1)*rowBytes]
+		prevLine := prev[y*rowBytes : (y+1)*rowBytes]
+		row := dst[y*rowBytes : (y+1)*rowBytes]
+
+		for x := 0; x < w; x++ {
+			for ch := 0; ch < 3; ch++ {
+				i := x*3 + ch
+
+				// Temporal prediction and the amount of motion around it.
+				t0 := int(curLine[i])
+				t1 := int(prevLine[i])
+				temporal := (t0 + t1) >> 1
+				diff := absInt(t0-t1) >> 1
+				if d := (absInt(int(pc[i])-int(c[i])) + absInt(int(pe[i])-int(e[i]))) >> 1; d > diff {
+					diff = d
+				}
+
+				// Spatial prediction along the best of three directions.
+				spatial := (int(c[i]) + int(e[i])) >> 1
+				best := absInt(int(c[i]) - int(e[i]))
+				for _, dx := range [2]int{-1, 1} {
+					xa := x + dx
+					xb := x - dx
+					if xa < 0 || xa >= w || xb < 0 || xb >= w {
+						continue
+					}
+					va := int(c[xa*3+ch])
+					vb := int(e[xb*3+ch])
+					if score := absInt(va - vb); score < best {
+						best = score
+						spatial = (va + vb) >> 1
+					}
+				}
+
+				if spatial > temporal+diff {
+					spatial = temporal + diff
+				}
+				if spatial < temporal-diff {
+					spatial = temporal - diff
+				}
+				// Both bounds lie within the inputs, so no clamping to
+				// the byte range is needed.
+				row[i] = byte(spatial)
+			}
+		}
+	}
+	return dst
+}
+
+func absInt(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
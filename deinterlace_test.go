@@ -0,0 +1,135 @@
+package gocam
+
+import (
+	"bytes"
+	"testing"
+)
+
+// rowsFrame returns a packed YCbCr444 buffer of width w whose rows are
+// uniformly filled with the given values.
+func rowsFrame(w int, rows ...byte) []byte {
+	data := make([]byte, 0, w*len(rows)*3)
+	for _, v := range rows {
+		for i := 0; i < w*3; i++ {
+			data = append(data, v)
+		}
+	}
+	return data
+}
+
+func TestDeinterlaceFrames(t *testing.T) {
+	const w = 2
+	// Top field lines hold 10, 30, 50 and bottom field lines 200, 210, 220.
+	interlaced := rowsFrame(w, 10, 200, 30, 210, 50, 220)
+	tests := []struct {
+		mode  DeinterlaceMode
+		field FieldOrder
+		want  []byte
+	}{
+		{DeinterlaceWeave, FieldInterlacedTB, interlaced},
+		// Bob keeps the first field and averages its lines; the last line
+		// of the frame repeats the one above it.
+		{DeinterlaceBob, FieldInterlacedTB, rowsFrame(w, 10, 20, 30, 40, 50, 50)},
+		{DeinterlaceBob, FieldInterlacedBT, rowsFrame(w, 200, 200, 205, 210, 215, 220)},
+		// Blend filters [1 2 1] across both fields, repeating edge lines.
+		{DeinterlaceBlend, FieldInterlacedTB, rowsFrame(w, 58, 110, 118, 125, 133, 178)},
+		// Sequential fields are interleaved first.
+		{DeinterlaceWeave, FieldSeqTB, interlaced},
+		{DeinterlaceWeave, FieldSeqBT, interlaced},
+		// Progressive frames pass through.
+		{DeinterlaceBob, FieldProgressive, interlaced},
+	}
+	for _, tc := range tests {
+		src := interlaced
+		switch tc.field {
+		case FieldSeqTB:
+			src = rowsFrame(w, 10, 30, 50, 200, 210, 220)
+		case FieldSeqBT:
+			src = rowsFrame(w, 200, 210, 220, 10, 30, 50)
+		}
+		out, h, ok := newDeinterlacer(tc.mode).process(src, w, 6, tc.field)
+		if !ok || h != 6 || !bytes.Equal(out, tc.want) {
+			t.Errorf("%v %v: %v (height %d, ok %v), want %v", tc.mode, tc.field, out, h, ok, tc.want)
+		}
+	}
+	if newDeinterlacer(DeinterlaceNone) != nil {
+		t.Error("DeinterlaceNone created a deinterlacer")
+	}
+}
+
+func TestDeinterlaceYADIF(t *testing.T) {
+	const w = 3
+	d := newDeinterlacer(DeinterlaceYADIF)
+
+	// Without motion the missing field is taken over from the frame, so a
+	// static interlaced scene keeps its full detail.
+	static := rowsFrame(w, 100, 100, 100, 100)
+	if out, _, _ := d.process(static, w, 4, FieldInterlacedBT); !bytes.Equal(out, static) {
+		t.Errorf("static frame changed: %v", out)
+	}
+
+	// The kept bottom field brightens. Every rebuilt top line follows it,
+	// including the first line, which only has a neighbor below.
+	moving := rowsFrame(w, 100, 160, 100, 160)
+	if out, _, _ := d.process(moving, w, 4, FieldInterlacedBT); !bytes.Equal(out, rowsFrame(w, 160, 160, 160, 160)) {
+		t.Errorf("moving frame: %v", out)
+	}
+
+	// With the top field kept, the last line is the edge.
+	d = newDeinterlacer(DeinterlaceYADIF)
+	d.process(static, w, 4, FieldInterlacedTB)
+	moving = rowsFrame(w, 40, 100, 40, 100)
+	if out, _, _ := d.process(moving, w, 4, FieldInterlacedTB); !bytes.Equal(out, rowsFrame(w, 40, 40, 40, 40)) {
+		t.Errorf("moving frame, top field kept: %v", out)
+	}
+}
+
+func TestDeinterlaceFields(t *testing.T) {
+	const w = 2
+	top := rowsFrame(w, 10, 30, 50)
+	bottom := rowsFrame(w, 200, 210, 220)
+	woven := rowsFrame(w, 10, 200, 30, 210, 50, 220)
+
+	// Weave waits for the partner field, in either order.
+	for _, first := range []FieldOrder{FieldTop, FieldBottom} {
+		d := newDeinterlacer(DeinterlaceWeave)
+		a, b := top, bottom
+		second := FieldBottom
+		if first == FieldBottom {
+			a, b, second = bottom, top, FieldTop
+		}
+		if _, _, ok := d.process(a, w, 3, first); ok {
+			t.Errorf("%v first: frame from a single field", first)
+		}
+		out, h, ok := d.process(b, w, 3, second)
+		if !ok || h != 6 || !bytes.Equal(out, woven) {
+			t.Errorf("%v first: %v (height %d, ok %v)", first, out, h, ok)
+		}
+	}
+
+	// A repeated field replaces the pending one.
+	d := newDeinterlacer(DeinterlaceWeave)
+	d.process(rowsFrame(w, 0, 0, 0), w, 3, FieldTop)
+	d.process(top, w, 3, FieldTop)
+	if out, _, _ := d.process(bottom, w, 3, FieldBottom); !bytes.Equal(out, woven) {
+		t.Errorf("after a repeated field: %v", out)
+	}
+
+	// Bob turns every field into a frame.
+	d = newDeinterlacer(DeinterlaceBob)
+	if out, h, ok := d.process(bottom, w, 3, FieldBottom); !ok || h != 6 || !bytes.Equal(out, rowsFrame(w, 200, 200, 205, 210, 215, 220)) {
+		t.Errorf("bob of the bottom field: %v (height %d)", out, h)
+	}
+
+	// YADIF does too, sliding over the fields once it has two.
+	d = newDeinterlacer(DeinterlaceYADIF)
+	for i, f := range [][]byte{top, bottom, top} {
+		field := FieldTop
+		if i == 1 {
+			field = FieldBottom
+		}
+		if _, h, ok := d.process(f, w, 3, field); !ok || h != 6 {
+			t.Errorf("YADIF field %d: height %d, ok %v", i, h, ok)
+		}
+	}
+}
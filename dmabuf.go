@@ -0,0 +1,27 @@
+package gocam
+
+import "sync"
+
+// DMABuf describes a capture buffer exported as a DMABUF file descriptor.
+// The buffer keeps the driver's native layout, which usually differs from the
+// converted Frame.Data.
+type DMABuf struct {
+	FD          int    // DMABUF file descriptor, valid until the frame is released
+	Length      int    // size of the buffer in bytes
+	BytesUsed   int    // bytes of image data in the buffer
+	PixelFormat uint32 // V4L2 fourcc of the buffer contents
+	Width       int
+	Height      int
+	Stride      int
+}
+
+// frameRelease runs a frame's release hook at most once, however many copies
+// of the Frame value exist.
+type frameRelease struct {
+	once sync.Once
+	fn   func()
+}
+
+func newFrameRelease(fn func()) *frameRelease {
+	return &frameRelease{fn: fn}
+}
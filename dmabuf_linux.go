@@ -0,0 +1,145 @@
+//go:build linux
+// +build linux
+
+package gocam
+
+import (
+	"fmt"
+	"io"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const v4l2MemoryDMABuf = 4
+
+type v4l2ExportBuffer struct {
+	Type     uint32
+	Index    uint32
+	Plane    uint32
+	Flags    uint32
+	Fd       int32
+	Reserved [11]uint32
+}
+
+type dmaBufSync struct {
+	Flags uint64
+}
+
+const (
+	dmaBufSyncRead  = 1 << 0
+	dmaBufSyncStart = 0 << 2
+	dmaBufSyncEnd   = 1 << 2
+)
+
+// exportReleaseTimeout bounds how long renegotiation waits for consumers
+// to release exported frames.
+const exportReleaseTimeout = 2 * time.Second
+
+var (
+	vidiocExpbuf    = iowr(uintptr('V'), 16, unsafe.Sizeof(v4l2ExportBuffer{}))
+	dmaBufIoctlSync = iow(uintptr('b'), 0, unsafe.Sizeof(dmaBufSync{}))
+)
+
+// exportBuffers exports every mmap buffer as a DMABUF descriptor. The
+// descriptors live as long as the device; frames receive duplicates.
+func (d *v4l2Device) exportBuffers() error {
+	for i := range d.buffers {
+		exp := v4l2ExportBuffer{
+			Type:  d.bufType,
+			Index: uint32(i),
+			Flags: syscall.O_RDWR | syscall.O_CLOEXEC,
+		}
+		if err := ioctl(d.fd, vidiocExpbuf, unsafe.Pointer(&exp)); err != nil {
+			return fmt.Errorf("gocam: VIDIOC_EXPBUF index %d failed: %w", i, err)
+		}
+		d.buffers[i].dmabufFD = int(exp.Fd)
+		d.buffers[i].exported = true
+	}
+	d.released = make(chan v4l2Buffer, len(d.buffers))
+	return nil
+}
+
+// exportFrame duplicates the DMABUF descriptor of a dequeued buffer for a
+// frame. The returned release func closes the duplicate and hands the buffer
+// back to the capture loop for requeueing.
+func (d *v4l2Device) exportFrame(buf v4l2Buffer) ([]DMABuf, func(), error) {
+	mb := d.buffers[buf.Index]
+	fd, err := v4l2Sys.dup(mb.dmabufFD)
+	if err != nil {
+		return nil, nil, fmt.Errorf("gocam: dup DMABUF index %d failed: %w", buf.Index, err)
+	}
+
+	desc := DMABuf{
+		FD:          fd,
+		Length:      int(mb.length),
+		BytesUsed:   int(buf.Bytesused),
+		PixelFormat: d.pixelFormat,
+		Width:       d.width,
+		Height:      d.height,
+		Stride:      d.stride,
+	}
+
+	// released has room for every buffer, so this never blocks, even after
+	// the capture loop has exited.
+	released := d.released
+	release := func() {
+		_ = v4l2Sys.close(fd)
+		released <- buf
+	}
+	d.exports++
+	return []DMABuf{desc}, release, nil
+}
+
+// requeueReleased queues buffers whose exported frames have been released.
+func (d *v4l2Device) requeueReleased() error {
+	for {
+		select {
+		case buf := <-d.released:
+			d.exports--
+			if err := d.requeue(&buf); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// awaitExports waits until every exported frame has been released. The
+// driver refuses to free buffers (REQBUFS fails with EBUSY) while a DMABUF
+// of them is still open. It reports false if frames remain out after
+// timeout.
+func (d *v4l2Device) awaitExports(timeout time.Duration) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for d.exports > 0 {
+		select {
+		case <-d.released:
+			d.exports--
+		case <-deadline.C:
+			return false
+		}
+	}
+	return true
+}
+
+// mapDMABuf maps an external DMABUF descriptor so captured data can be
+// converted on the CPU.
+func mapDMABuf(fd int) ([]byte, error) {
+	size, err := v4l2Sys.seek(fd, 0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid DMABUF size %d", size)
+	}
+	return v4l2Sys.mmap(fd, 0, int(size), syscall.PROT_READ)
+}
+
+// dmabufSync brackets CPU access to a DMABUF so caches stay coherent with
+// the device.
+func dmabufSync(fd int, flags uint64) error {
+	sync := dmaBufSync{Flags: flags}
+	return ioctl(fd, dmaBufIoctlSync, unsafe.Pointer(&sync))
+}
@@ -0,0 +1,333 @@
+package gocam
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/svanichkin/gocam/pixconv"
+)
+
+// ImageFormat selects the file format written by SaveFrame and EncodeFrame.
+type ImageFormat int
+
+const (
+	// FormatAuto picks the format from the file extension.
+	FormatAuto ImageFormat = iota
+	FormatJPEG
+	FormatPNG
+	FormatBMP
+	FormatTIFF
+	// FormatPPM writes binary RGB Netpbm (P6).
+	FormatPPM
+	// FormatPGM writes binary grayscale Netpbm (P5) from the luma plane.
+	FormatPGM
+)
+
+func (f ImageFormat) String() string {
+	switch f {
+	case FormatAuto:
+		return "auto"
+	case FormatJPEG:
+		return "jpeg"
+	case FormatPNG:
+		return "png"
+	case FormatBMP:
+		return "bmp"
+	case FormatTIFF:
+		return "tiff"
+	case FormatPPM:
+		return "ppm"
+	case FormatPGM:
+		return "pgm"
+	}
+	return "unknown"
+}
+
+// ImageFormatForPath returns the format matching the extension of path, or
+// FormatAuto if the extension is not recognized.
+func ImageFormatForPath(path string) ImageFormat {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpg", ".jpeg":
+		return FormatJPEG
+	case ".png":
+		return FormatPNG
+	case ".bmp":
+		return FormatBMP
+	case ".tif", ".tiff":
+		return FormatTIFF
+	case ".ppm":
+		return FormatPPM
+	case ".pgm":
+		return FormatPGM
+	}
+	return FormatAuto
+}
+
+// DefaultJPEGQuality is used when SaveOptions.JPEGQuality is zero.
+const DefaultJPEGQuality = 90
+
+// SaveOptions configures SaveFrame and EncodeFrame. The zero value (or a
+// nil pointer) picks the format from the file name and uses default
+// settings.
+type SaveOptions struct {
+	// Format overrides the format chosen from the file extension. It is
+	// required for EncodeFrame.
+	Format ImageFormat
+	// JPEGQuality ranges from 1 to 100; zero means DefaultJPEGQuality.
+	JPEGQuality int
+	// PNGCompression is the zlib effort for PNG files.
+	PNGCompression png.CompressionLevel
+}
+
+// SaveFrame writes the frame to path in the format given by opts.Format or,
+// when that is FormatAuto, by the file extension (.jpg, .jpeg, .png, .bmp,
+// .tif, .tiff, .ppm, .pgm). A partially written file is removed on error.
+func SaveFrame(frame Frame, path string, opts *SaveOptions) error {
+	o := SaveOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.Format == FormatAuto {
+		o.Format = ImageFormatForPath(path)
+		if o.Format == FormatAuto {
+			return fmt.Errorf("gocam: unknown image format for %q", path)
+		}
+	}
+	if err := checkFrame(frame); err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = EncodeFrame(w, frame, &o)
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// SaveFramePNG encodes the provided frame into a PNG file at the given path.
+func SaveFramePNG(frame Frame, path string) error {
+	return SaveFrame(frame, path, &SaveOptions{Format: FormatPNG})
+}
+
+// EncodeFrame writes the frame to w in opts.Format, which must be set.
+func EncodeFrame(w io.Writer, frame Frame, opts *SaveOptions) error {
+	if opts == nil || opts.Format == FormatAuto {
+		return errors.New("gocam: EncodeFrame needs an image format")
+	}
+	if err := checkFrame(frame); err != nil {
+		return err
+	}
+
+	switch opts.Format {
+	case FormatJPEG:
+		quality := opts.JPEGQuality
+		if quality == 0 {
+			quality = DefaultJPEGQuality
+		}
+		if quality < 1 || quality > 100 {
+			return fmt.Errorf("gocam: JPEG quality %d out of range 1-100", quality)
+		}
+		return jpeg.Encode(w, frame.YCbCr(), &jpeg.Options{Quality: quality})
+	case FormatPNG:
+		enc := png.Encoder{CompressionLevel: opts.PNGCompression}
+		return enc.Encode(w, frame.NRGBA())
+	case FormatBMP:
+		return encodeBMP(w, frame)
+	case FormatTIFF:
+		return encodeTIFF(w, frame)
+	case FormatPPM:
+		return encodeNetpbm(w, frame, false)
+	case FormatPGM:
+		return encodeNetpbm(w, frame, true)
+	}
+	return fmt.Errorf("gocam: unsupported image format %v", opts.Format)
+}
+
+// EncodeJPEG writes the frame to w as a JPEG of the given quality (1-100,
+// or 0 for DefaultJPEGQuality).
+func EncodeJPEG(w io.Writer, frame Frame, quality int) error {
+	return EncodeFrame(w, frame, &SaveOptions{Format: FormatJPEG, JPEGQuality: quality})
+}
+
+// EncodePNG writes the frame to w as a PNG.
+func EncodePNG(w io.Writer, frame Frame, level png.CompressionLevel) error {
+	return EncodeFrame(w, frame, &SaveOptions{Format: FormatPNG, PNGCompression: level})
+}
+
+func checkFrame(frame Frame) error {
+	if frame.Width <= 0 || frame.Height <= 0 || len(frame.Data) != frame.Width*frame.Height*3 {
+		return errors.New("gocam: invalid frame data")
+	}
+	return nil
+}
+
+// YCbCr returns the frame as a 4:4:4 image.YCbCr, which image/jpeg encodes
+// without going through RGB. The samples are copied.
+func (f Frame) YCbCr() *image.YCbCr {
+	img := image.NewYCbCr(image.Rect(0, 0, f.Width, f.Height), image.YCbCrSubsampleRatio444)
+	n := f.Width * f.Height
+	if len(f.Data) < n*3 {
+		return img
+	}
+	src := f.Data[:n*3]
+	y, cb, cr := img.Y[:n], img.Cb[:n], img.Cr[:n]
+	for i := range y {
+		p := src[i*3 : i*3+3]
+		y[i], cb[i], cr[i] = p[0], p[1], p[2]
+	}
+	return img
+}
+
+// NRGBA returns the frame converted to RGB with the JFIF matrix.
+func (f Frame) NRGBA() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, f.Width, f.Height))
+	f.convertTo(pixconv.RGBA, img.Pix, img.Stride)
+	return img
+}
+
+// convertTo converts the frame into buf laid out as format with the given
+// stride. Frames with invalid data leave buf untouched.
+func (f Frame) convertTo(format pixconv.Format, buf []byte, stride int) {
+	src, err := pixconv.Wrap(pixconv.YCbCr444, f.Width, f.Height, f.Data, 0)
+	if err != nil {
+		return
+	}
+	dst, err := pixconv.Wrap(format, f.Width, f.Height, buf, stride)
+	if err != nil {
+		return
+	}
+	_ = pixconv.Convert(dst, src, pixconv.JFIF)
+}
+
+// encodeBMP writes a bottom-up 24-bit BITMAPINFOHEADER file.
+func encodeBMP(w io.Writer, frame Frame) error {
+	stride := (frame.Width*3 + 3) &^ 3
+	pix := make([]byte, stride*frame.Height)
+	frame.convertTo(pixconv.BGR24, pix, stride)
+
+	const headerSize = 14 + 40
+	var hdr [headerSize]byte
+	le := binary.LittleEndian
+	copy(hdr[0:], "BM")
+	le.PutUint32(hdr[2:], uint32(headerSize+len(pix)))
+	le.PutUint32(hdr[10:], headerSize)
+	le.PutUint32(hdr[14:], 40)
+	le.PutUint32(hdr[18:], uint32(frame.Width))
+	le.PutUint32(hdr[22:], uint32(frame.Height)) // positive: bottom-up rows
+	le.PutUint16(hdr[26:], 1)                    // planes
+	le.PutUint16(hdr[28:], 24)                   // bits per pixel
+	le.PutUint32(hdr[34:], uint32(len(pix)))
+	le.PutUint32(hdr[38:], 2835) // 72 DPI in pixels per meter
+	le.PutUint32(hdr[42:], 2835)
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	for y := frame.Height - 1; y >= 0; y-- {
+		if _, err := w.Write(pix[y*stride : (y+1)*stride]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeTIFF writes a little-endian baseline TIFF with one uncompressed RGB
+// strip.
+func encodeTIFF(w io.Writer, frame Frame) error {
+	pix := make([]byte, frame.Width*frame.Height*3)
+	frame.convertTo(pixconv.RGB24, pix, 0)
+
+	const (
+		tagCount  = 12
+		ifdOffset = 8
+		extraOff  = ifdOffset + 2 + tagCount*12 + 4
+		bitsOff   = extraOff    // 3 SHORTs
+		xResOff   = bitsOff + 6 // RATIONAL
+		yResOff   = xResOff + 8 // RATIONAL
+		pixOff    = yResOff + 8
+		typeShort = 3
+		typeLong  = 4
+		typeRatio = 5
+	)
+	buf := make([]byte, pixOff)
+	le := binary.LittleEndian
+	copy(buf, "II*\x00")
+	le.PutUint32(buf[4:], ifdOffset)
+	le.PutUint16(buf[ifdOffset:], tagCount)
+
+	// Tags in ascending order; values of up to 4 bytes are stored inline.
+	tags := [tagCount][4]uint32{
+		{256, typeLong, 1, uint32(frame.Width)},  // ImageWidth
+		{257, typeLong, 1, uint32(frame.Height)}, // ImageLength
+		{258, typeShort, 3, bitsOff},             // BitsPerSample
+		{259, typeShort, 1, 1},                   // Compression: none
+		{262, typeShort, 1, 2},                   // PhotometricInterpretation: RGB
+		{273, typeLong, 1, pixOff},               // StripOffsets
+		{277, typeShort, 1, 3},                   // SamplesPerPixel
+		{278, typeLong, 1, uint32(frame.Height)}, // RowsPerStrip
+		{279, typeLong, 1, uint32(len(pix))},     // StripByteCounts
+		{282, typeRatio, 1, xResOff},             // XResolution
+		{283, typeRatio, 1, yResOff},             // YResolution
+		{296, typeShort, 1, 2},                   // ResolutionUnit: inch
+	}
+	for i, tag := range tags {
+		e := buf[ifdOffset+2+i*12:]
+		le.PutUint16(e[0:], uint16(tag[0]))
+		le.PutUint16(e[2:], uint16(tag[1]))
+		le.PutUint32(e[4:], tag[2])
+		if tag[1] == typeShort && tag[2] == 1 {
+			le.PutUint16(e[8:], uint16(tag[3]))
+		} else {
+			le.PutUint32(e[8:], tag[3])
+		}
+	}
+	// The next IFD offset stays zero.
+	for i := 0; i < 3; i++ {
+		le.PutUint16(buf[bitsOff+i*2:], 8)
+	}
+	le.PutUint32(buf[xResOff:], 72)
+	le.PutUint32(buf[xResOff+4:], 1)
+	le.PutUint32(buf[yResOff:], 72)
+	le.PutUint32(buf[yResOff+4:], 1)
+
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+	_, err := w.Write(pix)
+	return err
+}
+
+// encodeNetpbm writes a binary PPM, or a PGM of the luma plane.
+func encodeNetpbm(w io.Writer, frame Frame, gray bool) error {
+	magic, format, channels := "P6", pixconv.RGB24, 3
+	if gray {
+		magic, format, channels = "P5", pixconv.Gray, 1
+	}
+	pix := make([]byte, frame.Width*frame.Height*channels)
+	frame.convertTo(format, pix, 0)
+
+	if _, err := fmt.Fprintf(w, "%s\n%d %d\n255\n", magic, frame.Width, frame.Height); err != nil {
+		return err
+	}
+	_, err := w.Write(pix)
+	return err
+}
@@ -0,0 +1,256 @@
+package gocam
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// colorFrame returns a frame with a smooth gradient that survives JPEG
+// compression reasonably well.
+func colorFrame(w, h int) Frame {
+	data := make([]byte, 0, w*h*3)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			data = append(data, byte(40+x*4), byte(90+y*3), byte(160-x*2))
+		}
+	}
+	return Frame{Data: data, Width: w, Height: h}
+}
+
+// frameRGB returns the RGB color of pixel (x, y) of f.
+func frameRGB(f Frame, x, y int) (r, g, b uint8) {
+	p := f.Data[(y*f.Width+x)*3:]
+	return color.YCbCrToRGB(p[0], p[1], p[2])
+}
+
+func TestImageFormatForPath(t *testing.T) {
+	tests := map[string]ImageFormat{
+		"a.jpg":     FormatJPEG,
+		"b.JPEG":    FormatJPEG,
+		"c.png":     FormatPNG,
+		"d.bmp":     FormatBMP,
+		"e.tif":     FormatTIFF,
+		"f.tiff":    FormatTIFF,
+		"g.ppm":     FormatPPM,
+		"h.pgm":     FormatPGM,
+		"i.webp":    FormatAuto,
+		"no-suffix": FormatAuto,
+	}
+	for path, want := range tests {
+		if got := ImageFormatForPath(path); got != want {
+			t.Errorf("ImageFormatForPath(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestEncodeJPEG(t *testing.T) {
+	frame := colorFrame(32, 24)
+	var buf bytes.Buffer
+	if err := EncodeJPEG(&buf, frame, 95); err != nil {
+		t.Fatal(err)
+	}
+	img, err := jpeg.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != frame.Width || b.Dy() != frame.Height {
+		t.Fatalf("decoded size %v", b)
+	}
+	ycc, ok := img.(*image.YCbCr)
+	if !ok {
+		t.Fatalf("decoded %T, want *image.YCbCr", img)
+	}
+	for _, pt := range []image.Point{{0, 0}, {16, 12}, {31, 23}} {
+		p := frame.Data[(pt.Y*frame.Width+pt.X)*3:]
+		got := ycc.YCbCrAt(pt.X, pt.Y)
+		if diff(got.Y, p[0]) > 4 || diff(got.Cb, p[1]) > 4 || diff(got.Cr, p[2]) > 4 {
+			t.Errorf("pixel %v = %v, want about %v", pt, got, p[:3])
+		}
+	}
+
+	if err := EncodeJPEG(&buf, frame, 101); err == nil {
+		t.Error("quality 101 accepted")
+	}
+}
+
+func TestEncodePNG(t *testing.T) {
+	frame := colorFrame(17, 9)
+	var buf bytes.Buffer
+	if err := EncodePNG(&buf, frame, png.BestSpeed); err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for y := 0; y < frame.Height; y++ {
+		for x := 0; x < frame.Width; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			wr, wg, wb := frameRGB(frame, x, y)
+			if diff(uint8(r>>8), wr) > 1 || diff(uint8(g>>8), wg) > 1 || diff(uint8(b>>8), wb) > 1 || a != 0xffff {
+				t.Fatalf("pixel (%d, %d) = %d %d %d %d, want %d %d %d", x, y, r>>8, g>>8, b>>8, a>>8, wr, wg, wb)
+			}
+		}
+	}
+}
+
+func TestEncodeBMP(t *testing.T) {
+	frame := colorFrame(5, 3) // 15-byte rows padded to 16
+	var buf bytes.Buffer
+	if err := EncodeFrame(&buf, frame, &SaveOptions{Format: FormatBMP}); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	le := binary.LittleEndian
+	if string(data[:2]) != "BM" || int(le.Uint32(data[2:])) != len(data) || len(data) != 54+16*3 {
+		t.Fatalf("bad header or size %d", len(data))
+	}
+	if w, h, bpp := le.Uint32(data[18:]), le.Uint32(data[22:]), le.Uint16(data[28:]); w != 5 || h != 3 || bpp != 24 {
+		t.Fatalf("header %dx%d %d bpp", w, h, bpp)
+	}
+	pix := data[le.Uint32(data[10:]):]
+	for y := 0; y < frame.Height; y++ {
+		row := pix[(frame.Height-1-y)*16:]
+		for x := 0; x < frame.Width; x++ {
+			r, g, b := frameRGB(frame, x, y)
+			p := row[x*3:]
+			if diff(p[2], r) > 1 || diff(p[1], g) > 1 || diff(p[0], b) > 1 {
+				t.Fatalf("pixel (%d, %d) = BGR %v, want RGB %d %d %d", x, y, p[:3], r, g, b)
+			}
+		}
+	}
+}
+
+func TestEncodeTIFF(t *testing.T) {
+	frame := colorFrame(4, 3)
+	var buf bytes.Buffer
+	if err := EncodeFrame(&buf, frame, &SaveOptions{Format: FormatTIFF}); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	le := binary.LittleEndian
+	if string(data[:4]) != "II*\x00" {
+		t.Fatalf("bad magic %q", data[:4])
+	}
+	ifd := data[le.Uint32(data[4:]):]
+	tags := map[uint16]uint32{}
+	last := uint16(0)
+	for i := 0; i < int(le.Uint16(ifd)); i++ {
+		e := ifd[2+i*12:]
+		tag, typ := le.Uint16(e), le.Uint16(e[2:])
+		if tag <= last {
+			t.Fatalf("tag %d after %d", tag, last)
+		}
+		last = tag
+		if typ == 3 {
+			tags[tag] = uint32(le.Uint16(e[8:]))
+		} else {
+			tags[tag] = le.Uint32(e[8:])
+		}
+	}
+	if tags[256] != 4 || tags[257] != 3 || tags[259] != 1 || tags[262] != 2 || tags[277] != 3 {
+		t.Fatalf("tags %v", tags)
+	}
+	off, n := tags[273], tags[279]
+	if n != 4*3*3 || int(off+n) != len(data) {
+		t.Fatalf("strip at %d, %d bytes, file %d bytes", off, n, len(data))
+	}
+	pix := data[off:]
+	r, g, b := frameRGB(frame, 3, 2)
+	if p := pix[(2*4+3)*3:]; diff(p[0], r) > 1 || diff(p[1], g) > 1 || diff(p[2], b) > 1 {
+		t.Fatalf("last pixel %v, want %d %d %d", p[:3], r, g, b)
+	}
+}
+
+func TestEncodeNetpbm(t *testing.T) {
+	frame := colorFrame(3, 2)
+	for _, tc := range []struct {
+		format   ImageFormat
+		magic    string
+		channels int
+	}{
+		{FormatPPM, "P6", 3},
+		{FormatPGM, "P5", 1},
+	} {
+		var buf bytes.Buffer
+		if err := EncodeFrame(&buf, frame, &SaveOptions{Format: tc.format}); err != nil {
+			t.Fatal(err)
+		}
+		header := fmt.Sprintf("%s\n3 2\n255\n", tc.magic)
+		data := buf.Bytes()
+		if !bytes.HasPrefix(data, []byte(header)) || len(data) != len(header)+6*tc.channels {
+			t.Fatalf("%v: got %q", tc.format, data)
+		}
+		if tc.format == FormatPGM {
+			for i, v := range data[len(header):] {
+				if v != frame.Data[i*3] {
+					t.Fatalf("PGM sample %d = %d, want luma %d", i, v, frame.Data[i*3])
+				}
+			}
+		}
+	}
+}
+
+func TestSaveFrame(t *testing.T) {
+	dir := t.TempDir()
+	frame := colorFrame(8, 8)
+
+	path := filepath.Join(dir, "shot.JPG")
+	if err := SaveFrame(frame, path, nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); !bytes.HasPrefix(data, []byte{0xff, 0xd8}) {
+		t.Fatal("shot.JPG is not a JPEG")
+	}
+
+	// An explicit format wins over the extension.
+	path = filepath.Join(dir, "shot.img")
+	if err := SaveFrame(frame, path, &SaveOptions{Format: FormatPNG}); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); !bytes.HasPrefix(data, []byte("\x89PNG")) {
+		t.Fatal("shot.img is not a PNG")
+	}
+
+	if err := SaveFrame(frame, filepath.Join(dir, "shot.webp"), nil); err == nil {
+		t.Error("unknown extension accepted")
+	}
+	bad := Frame{Data: frame.Data[:10], Width: 8, Height: 8}
+	path = filepath.Join(dir, "bad.png")
+	if err := SaveFrame(bad, path, nil); err == nil {
+		t.Error("short frame accepted")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("file created for a rejected frame")
+	}
+}
+
+func diff(a, b uint8) int {
+	if a > b {
+		return int(a - b)
+	}
+	return int(b - a)
+}
+
+func BenchmarkEncodeFrame(b *testing.B) {
+	frame := colorFrame(1280, 720)
+	for _, format := range []ImageFormat{FormatJPEG, FormatPNG, FormatBMP} {
+		b.Run(format.String(), func(b *testing.B) {
+			opts := &SaveOptions{Format: format, PNGCompression: png.BestSpeed}
+			for i := 0; i < b.N; i++ {
+				var buf bytes.Buffer
+				if err := EncodeFrame(&buf, frame, opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
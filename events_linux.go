@@ -0,0 +1,206 @@
+//go:build linux
+// +build linux
+
+package gocam
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	v4l2EventEOS          = 2
+	v4l2EventCtrl         = 3
+	v4l2EventSourceChange = 5
+
+	v4l2EventSrcChResolution = 1 << 0
+)
+
+const (
+	v4l2CtrlFlagDisabled = 0x0001
+	v4l2CtrlFlagNextCtrl = 0x80000000
+
+	v4l2CtrlTypeInteger64 = 5
+	v4l2CtrlTypeCtrlClass = 6
+)
+
+type v4l2EventSubscription struct {
+	Type     uint32
+	ID       uint32
+	Flags    uint32
+	Reserved [5]uint32
+}
+
+type v4l2Event struct {
+	Type      uint32
+	_         uint32 // align union u to 64 bits
+	U         [64]byte
+	Pending   uint32
+	Sequence  uint32
+	Timestamp syscall.Timespec
+	ID        uint32
+	Reserved  [8]uint32
+}
+
+type v4l2EventCtrlPayload struct {
+	Changes      uint32
+	Type         uint32
+	Value64      int64 // union with the 32-bit value
+	Flags        uint32
+	Minimum      int32
+	Maximum      int32
+	Step         int32
+	DefaultValue int32
+}
+
+type v4l2EventSrcChangePayload struct {
+	Changes uint32
+}
+
+type v4l2QueryCtrl struct {
+	ID           uint32
+	Type         uint32
+	Name         [32]byte
+	Minimum      int32
+	Maximum      int32
+	Step         int32
+	DefaultValue int32
+	Flags        uint32
+	Reserved     [2]uint32
+}
+
+type v4l2Control struct {
+	ID    uint32
+	Value int32
+}
+
+type v4l2DVTimings struct {
+	Type uint32
+	Data [128]byte // union: struct v4l2_bt_timings / reserved
+}
+
+var (
+	vidiocGCtrl          = iowr(uintptr('V'), 27, unsafe.Sizeof(v4l2Control{}))
+	vidiocSCtrl          = iowr(uintptr('V'), 28, unsafe.Sizeof(v4l2Control{}))
+	vidiocQueryctrl      = iowr(uintptr('V'), 36, unsafe.Sizeof(v4l2QueryCtrl{}))
+	vidiocSDVTimings     = iowr(uintptr('V'), 87, unsafe.Sizeof(v4l2DVTimings{}))
+	vidiocDQEvent        = ior(uintptr('V'), 89, unsafe.Sizeof(v4l2Event{}))
+	vidiocSubscribeEvent = iow(uintptr('V'), 90, unsafe.Sizeof(v4l2EventSubscription{}))
+	vidiocQueryDVTimings = ior(uintptr('V'), 99, unsafe.Sizeof(v4l2DVTimings{}))
+)
+
+// v4l2StreamEvents are subscribed once per device; control events are
+// subscribed per control.
+var v4l2StreamEvents = []uint32{v4l2EventSourceChange, v4l2EventEOS}
+
+// queryControls enumerates the device controls, skipping class headers and
+// disabled controls.
+func (d *v4l2Device) queryControls() []v4l2QueryCtrl {
+	var ctrls []v4l2QueryCtrl
+	id := uint32(0)
+	for {
+		qc := v4l2QueryCtrl{ID: id | v4l2CtrlFlagNextCtrl}
+		if err := ioctl(d.fd, vidiocQueryctrl, unsafe.Pointer(&qc)); err != nil {
+			break
+		}
+		if qc.ID <= id {
+			break // driver ignores NEXT_CTRL; avoid looping forever
+		}
+		id = qc.ID
+		if qc.Type == v4l2CtrlTypeCtrlClass || qc.Flags&v4l2CtrlFlagDisabled != 0 {
+			continue
+		}
+		ctrls = append(ctrls, qc)
+	}
+	return ctrls
+}
+
+// subscribeEvents subscribes to source-change, end-of-stream and control
+// events. Devices without event support reject the subscriptions, which is
+// not an error: they simply never raise POLLPRI.
+func (d *v4l2Device) subscribeEvents() {
+	for _, typ := range v4l2StreamEvents {
+		sub := v4l2EventSubscription{Type: typ}
+		_ = ioctl(d.fd, vidiocSubscribeEvent, unsafe.Pointer(&sub))
+	}
+
+	d.controls = d.queryControls()
+	for _, qc := range d.controls {
+		sub := v4l2EventSubscription{Type: v4l2EventCtrl, ID: qc.ID}
+		_ = ioctl(d.fd, vidiocSubscribeEvent, unsafe.Pointer(&sub))
+	}
+}
+
+// controlName returns the name of a control enumerated by subscribeEvents.
+func (d *v4l2Device) controlName(id uint32) string {
+	for _, qc := range d.controls {
+		if qc.ID == id {
+			return v4l2CString(qc.Name[:])
+		}
+	}
+	return ""
+}
+
+// dequeueEvents drains all pending device events. sourceChanged reports
+// whether one of them requires renegotiating the format.
+func (d *v4l2Device) dequeueEvents() (events []Event, sourceChanged bool) {
+	for {
+		var ev v4l2Event
+		if err := ioctl(d.fd, vidiocDQEvent, unsafe.Pointer(&ev)); err != nil {
+			return events, sourceChanged
+		}
+
+		ts := monotonicTime(ev.Timestamp.Nano())
+		switch ev.Type {
+		case v4l2EventSourceChange:
+			sc := (*v4l2EventSrcChangePayload)(unsafe.Pointer(&ev.U[0]))
+			if sc.Changes&v4l2EventSrcChResolution != 0 {
+				sourceChanged = true
+			}
+		case v4l2EventEOS:
+			events = append(events, Event{Type: EventEOS, Time: ts})
+		case v4l2EventCtrl:
+			ctrl := (*v4l2EventCtrlPayload)(unsafe.Pointer(&ev.U[0]))
+			value := ctrl.Value64
+			if ctrl.Type != v4l2CtrlTypeInteger64 {
+				value = int64(int32(value))
+			}
+			events = append(events, Event{
+				Type:      EventControl,
+				Time:      ts,
+				ControlID: ev.ID,
+				Control:   d.controlName(ev.ID),
+				Value:     value,
+			})
+		}
+
+		if ev.Pending == 0 {
+			return events, sourceChanged
+		}
+	}
+}
+
+// applyDVTimings locks the receiver to the timings it currently detects.
+// HDMI receivers need this before a new format can be set; other devices
+// reject the ioctls, which is ignored.
+func (d *v4l2Device) applyDVTimings() {
+	var timings v4l2DVTimings
+	if err := ioctl(d.fd, vidiocQueryDVTimings, unsafe.Pointer(&timings)); err != nil {
+		return
+	}
+	_ = ioctl(d.fd, vidiocSDVTimings, unsafe.Pointer(&timings))
+}
+
+const (
+	pollIn  = 0x0001
+	pollPri = 0x0002
+	pollOut = 0x0004
+)
+
+// poll waits up to timeout for any of events, e.g. a filled capture buffer
+// (POLLIN), a device event (POLLPRI) or a free output buffer (POLLOUT). It
+// returns the ready events; zero means the timeout expired.
+func (d *v4l2Device) poll(events int16, timeout time.Duration) (int16, error) {
+	return v4l2Sys.poll(d.fd, events, timeout)
+}
@@ -0,0 +1,556 @@
+//go:build linux
+// +build linux
+
+package gocam
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+const fakeDevicePath = "/dev/video-fake"
+
+// fakeDevice is a scripted V4L2 capture device. It behaves like a simple
+// driver (S_FMT falls back to a supported format, REQBUFS may grant fewer
+// buffers) and lets tests inject errors at each step.
+type fakeDevice struct {
+	mu sync.Mutex
+
+	// Script, set before the device is opened.
+	caps        uint32   // device capabilities
+	formats     []uint32 // supported pixel formats, in driver preference order
+	width       int      // size the driver settles on
+	height      int
+	maxBuffers  int     // REQBUFS grants at most this many buffers (0: no limit)
+	sfmtErr     error   // returned by VIDIOC_S_FMT
+	streamOnErr error   // returned by VIDIOC_STREAMON
+	dqbufErrs   []error // returned by successive VIDIOC_DQBUF calls before frames
+	failAfter   int     // frames delivered before DQBUF returns failErr (0: never)
+	failErr     error
+	seqStep     uint32           // driver sequence increment per frame (0: 1)
+	ctrls       map[uint32]int32 // supported boolean controls and their values
+	jpeg        []byte           // image delivered when MJPEG is negotiated
+	field       uint32           // field order the driver settles on (0: progressive)
+	bufLength   int              // buffer length QUERYBUF reports (0: the image size)
+	writeChunk  int              // bytes accepted per write() (0: all)
+	interval    [2]uint32        // time per frame VIDIOC_G_PARM reports (zero: unsupported)
+	imports     map[int][]byte   // DMABUFs for WithDMABufImport, by descriptor
+
+	// State.
+	fd         int
+	opened     bool
+	closed     bool
+	sfmtTried  []uint32
+	pixFmt     uint32
+	stride     int
+	sizeImage  int
+	buffers    [][]byte
+	memory     uint32 // memory type of the last REQBUFS
+	granted    int    // buffers of the last non-zero REQBUFS
+	queue      []uint32
+	streaming  bool
+	delivered  int
+	sequence   uint32
+	unmapCount int
+	subscribed []v4l2EventSubscription
+	events     []v4l2Event // raised by queueEvent, waiting for DQEVENT
+	written    [][]byte    // frames queued or written to an output device
+	// anon holds the anonymous mappings made for USERPTR buffers, by
+	// address, until they are unmapped.
+	anon map[uintptr][]byte
+	// bufFDs holds the imported DMABUF queued in each buffer.
+	bufFDs []int
+	// syncs counts DMA_BUF_IOCTL_SYNC calls on imported DMABUFs.
+	syncs int
+	// dups counts duplicated DMABUF descriptors.
+	dups int
+	// expbufs holds the write ends of the pipes that stand in for
+	// exported DMABUFs; a write fails with EPIPE once every descriptor
+	// of the buffer, duplicates included, has been closed.
+	expbufs []int
+}
+
+// ctrl returns the value of a control.
+func (f *fakeDevice) ctrl(id uint32) int32 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.ctrls[id]
+}
+
+// queueEvent raises ev if it has been subscribed to, stamping it with the
+// current CLOCK_MONOTONIC time as drivers do.
+func (f *fakeDevice) queueEvent(ev v4l2Event) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, sub := range f.subscribed {
+		if sub.Type == ev.Type && sub.ID == ev.ID {
+			_, _, _ = syscall.Syscall(syscall.SYS_CLOCK_GETTIME, clockMonotonic, uintptr(unsafe.Pointer(&ev.Timestamp)), 0)
+			f.events = append(f.events, ev)
+			return
+		}
+	}
+}
+
+// sourceChange switches the source to width x height and raises a
+// resolution change event. Buffers keep the old size until the format is
+// negotiated again.
+func (f *fakeDevice) sourceChange(width, height int) {
+	f.mu.Lock()
+	f.width, f.height = width, height
+	f.mu.Unlock()
+	ev := v4l2Event{Type: v4l2EventSourceChange}
+	(*v4l2EventSrcChangePayload)(unsafe.Pointer(&ev.U[0])).Changes = v4l2EventSrcChResolution
+	f.queueEvent(ev)
+}
+
+// newFakeDevice returns a streaming capture device offering formats at
+// width x height.
+func newFakeDevice(width, height int, formats ...uint32) *fakeDevice {
+	return &fakeDevice{
+		caps:    v4l2CapVideoCapture | v4l2CapStreaming,
+		formats: formats,
+		width:   width,
+		height:  height,
+		fd:      42,
+	}
+}
+
+// install makes the V4L2 backend use f until the test ends. The
+// configuration log is silenced meanwhile.
+func (f *fakeDevice) install(t *testing.T) {
+	t.Helper()
+	prev := v4l2Sys
+	v4l2Sys = f
+	camLog.SetOutput(io.Discard)
+	t.Cleanup(func() {
+		v4l2Sys = prev
+		camLog.SetOutput(os.Stdout)
+		for _, w := range f.expbufs {
+			syscall.Close(w)
+		}
+	})
+}
+
+func (f *fakeDevice) open(path string) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if path != fakeDevicePath {
+		return -1, syscall.ENOENT
+	}
+	f.opened = true
+	return f.fd, nil
+}
+
+func (f *fakeDevice) close(fd int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if fd == f.fd {
+		f.closed = true
+		return nil
+	}
+	// Anything else is an exported DMABUF or a duplicate of one.
+	return syscall.Close(fd)
+}
+
+// dmabufsOpen returns the number of exported buffers with a descriptor
+// still open.
+func (f *fakeDevice) dmabufsOpen() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.dmabufsOpenLocked()
+}
+
+func (f *fakeDevice) dmabufsOpenLocked() int {
+	n := 0
+	for _, w := range f.expbufs {
+		if _, err := syscall.Write(w, []byte{0}); err != syscall.EPIPE {
+			n++
+		}
+	}
+	return n
+}
+
+func (f *fakeDevice) isClosed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closed
+}
+
+func (f *fakeDevice) ioctl(fd int, req uintptr, arg unsafe.Pointer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.imports[fd]; ok && req == dmaBufIoctlSync {
+		f.syncs++
+		return nil
+	}
+	if fd != f.fd {
+		return syscall.EBADF
+	}
+
+	switch req {
+	case vidiocQuerycap:
+		c := (*v4l2Capability)(arg)
+		copy(c.Driver[:], "fake")
+		copy(c.Card[:], "Fake Camera")
+		c.Capabilities = f.caps | v4l2CapDeviceCaps
+		c.DeviceCaps = f.caps
+
+	case vidiocSFmt:
+		format := (*v4l2Format)(arg)
+		pix := (*v4l2PixFormat)(unsafe.Pointer(&format.fmt[0]))
+		f.sfmtTried = append(f.sfmtTried, pix.Pixelformat)
+		if f.sfmtErr != nil {
+			return f.sfmtErr
+		}
+		supported := false
+		for _, pf := range f.formats {
+			supported = supported || pf == pix.Pixelformat
+		}
+		if !supported {
+			pix.Pixelformat = f.formats[0]
+		}
+		pix.Width = uint32(f.width)
+		pix.Height = uint32(f.height)
+		pix.Field = v4l2FieldNone
+		if f.field != 0 {
+			pix.Field = f.field
+		}
+		f.pixFmt = pix.Pixelformat
+		switch f.pixFmt {
+		case v4l2PixFmtYUYV:
+			f.stride = f.width * 2
+			f.sizeImage = f.stride * f.height
+		case v4l2PixFmtNV12, v4l2PixFmtI420:
+			f.stride = f.width
+			f.sizeImage = f.width * f.height * 3 / 2
+		case v4l2PixFmtMJPEG:
+			f.stride = 0
+			f.sizeImage = f.width * f.height * 2
+		default:
+			f.stride = f.width * 3
+			f.sizeImage = f.stride * f.height
+		}
+		pix.Bytesperline = uint32(f.stride)
+		pix.Sizeimage = uint32(f.sizeImage)
+
+	case vidiocReqbufs:
+		req := (*v4l2RequestBuffers)(arg)
+		if req.Memory != v4l2MemoryMMap && req.Memory != v4l2MemoryUserPtr && req.Memory != v4l2MemoryDMABuf {
+			return syscall.EINVAL
+		}
+		// Buffers cannot be freed while exported.
+		if f.dmabufsOpenLocked() > 0 {
+			return syscall.EBUSY
+		}
+		for _, w := range f.expbufs {
+			syscall.Close(w)
+		}
+		f.expbufs = nil
+		count := int(req.Count)
+		if f.maxBuffers > 0 && count > f.maxBuffers {
+			count = f.maxBuffers
+		}
+		f.memory = req.Memory
+		f.buffers = make([][]byte, count)
+		f.bufFDs = make([]int, count)
+		for i := range f.buffers {
+			if req.Memory == v4l2MemoryMMap {
+				f.buffers[i] = make([]byte, f.sizeImage)
+			}
+		}
+		f.queue = nil
+		if count > 0 {
+			f.granted = count
+		}
+		req.Count = uint32(count)
+
+	case vidiocQuerybuf:
+		buf := (*v4l2Buffer)(arg)
+		if int(buf.Index) >= len(f.buffers) {
+			return syscall.EINVAL
+		}
+		buf.Offset = buf.Index * 4096
+		buf.Length = uint32(f.sizeImage)
+		if f.bufLength > 0 {
+			buf.Length = uint32(f.bufLength)
+		}
+
+	case vidiocExpbuf:
+		exp := (*v4l2ExportBuffer)(arg)
+		if int(exp.Index) >= len(f.buffers) {
+			return syscall.EINVAL
+		}
+		var p [2]int
+		if err := syscall.Pipe2(p[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+			return err
+		}
+		f.expbufs = append(f.expbufs, p[1])
+		exp.Fd = int32(p[0])
+
+	case vidiocQBuf:
+		buf := (*v4l2Buffer)(arg)
+		if int(buf.Index) >= len(f.buffers) || buf.Memory != f.memory {
+			return syscall.EINVAL
+		}
+		if buf.Memory == v4l2MemoryUserPtr {
+			// The driver writes straight into the application's memory.
+			data, ok := f.anon[*(*uintptr)(unsafe.Pointer(&buf.Offset))]
+			if !ok || int(buf.Length) < f.sizeImage || int(buf.Length) > len(data) {
+				return syscall.EFAULT
+			}
+			f.buffers[buf.Index] = data[:buf.Length]
+		}
+		if buf.Memory == v4l2MemoryDMABuf {
+			data, ok := f.imports[int(buf.Offset)]
+			if !ok || len(data) < f.sizeImage {
+				return syscall.EINVAL
+			}
+			f.buffers[buf.Index] = data
+			f.bufFDs[buf.Index] = int(buf.Offset)
+		}
+		f.queue = append(f.queue, buf.Index)
+		if buf.Type == v4l2BufTypeVideoOutput {
+			f.written = append(f.written, append([]byte(nil), f.buffers[buf.Index][:buf.Bytesused]...))
+		}
+
+	case vidiocDQBuf:
+		if len(f.dqbufErrs) > 0 {
+			err := f.dqbufErrs[0]
+			f.dqbufErrs = f.dqbufErrs[1:]
+			if err != nil {
+				return err
+			}
+		}
+		if f.failAfter > 0 && f.delivered >= f.failAfter {
+			return f.failErr
+		}
+		if !f.streaming || len(f.queue) == 0 {
+			return syscall.EAGAIN
+		}
+		index := f.queue[0]
+		f.queue = f.queue[1:]
+		if buf := (*v4l2Buffer)(arg); buf.Type == v4l2BufTypeVideoOutput {
+			// The frame has been shown; hand the buffer back.
+			buf.Index = index
+			return nil
+		}
+		f.delivered++
+		if f.delivered > 1 {
+			step := f.seqStep
+			if step == 0 {
+				step = 1
+			}
+			f.sequence += step
+		}
+		// Every byte differs from its neighbors so that transforms show.
+		data := f.buffers[index]
+		for i := range data {
+			data[i] = byte(f.delivered + i)
+		}
+		buf := (*v4l2Buffer)(arg)
+		buf.Index = index
+		buf.Bytesused = uint32(f.sizeImage)
+		if f.memory == v4l2MemoryUserPtr {
+			buf.setUserPtr(uintptr(unsafe.Pointer(&data[0])))
+			buf.Length = uint32(len(data))
+		}
+		if f.memory == v4l2MemoryDMABuf {
+			buf.Offset = uint32(f.bufFDs[index])
+			buf.Length = uint32(len(data))
+		}
+		if f.pixFmt == v4l2PixFmtMJPEG {
+			buf.Bytesused = uint32(copy(data, f.jpeg))
+		}
+		buf.Field = v4l2FieldNone
+		switch {
+		case f.field == v4l2FieldAlternate && f.delivered%2 == 1:
+			buf.Field = v4l2FieldTop
+		case f.field == v4l2FieldAlternate:
+			buf.Field = v4l2FieldBottom
+		case f.field != 0:
+			buf.Field = f.field
+		}
+		buf.Sequence = f.sequence
+
+	case vidiocGParm:
+		if f.interval[0] == 0 {
+			return syscall.EINVAL
+		}
+		parm := (*v4l2CaptureParm)(unsafe.Pointer(&(*v4l2StreamParm)(arg).parm[0]))
+		parm.TimePerFrame = v4l2Fract{Numerator: f.interval[0], Denominator: f.interval[1]}
+
+	case vidiocQueryctrl:
+		qc := (*v4l2QueryCtrl)(arg)
+		after := qc.ID &^ v4l2CtrlFlagNextCtrl
+		next := uint32(0)
+		for id := range f.ctrls {
+			if id > after && (next == 0 || id < next) {
+				next = id
+			}
+		}
+		if qc.ID&v4l2CtrlFlagNextCtrl == 0 || next == 0 {
+			return syscall.EINVAL
+		}
+		*qc = v4l2QueryCtrl{ID: next, Type: 2, Maximum: 1, Step: 1}
+		copy(qc.Name[:], fmt.Sprintf("Control %#x", next))
+
+	case vidiocGCtrl, vidiocSCtrl:
+		ctrl := (*v4l2Control)(arg)
+		if _, ok := f.ctrls[ctrl.ID]; !ok {
+			return syscall.EINVAL
+		}
+		if req == vidiocSCtrl {
+			f.ctrls[ctrl.ID] = ctrl.Value
+		} else {
+			ctrl.Value = f.ctrls[ctrl.ID]
+		}
+
+	case vidiocStreamOn:
+		if f.streamOnErr != nil {
+			return f.streamOnErr
+		}
+		f.streaming = true
+
+	case vidiocStreamOff:
+		f.streaming = false
+		f.queue = nil
+
+	case vidiocSubscribeEvent:
+		sub := *(*v4l2EventSubscription)(arg)
+		if sub.Type == v4l2EventCtrl {
+			if _, ok := f.ctrls[sub.ID]; !ok {
+				return syscall.EINVAL
+			}
+		}
+		f.subscribed = append(f.subscribed, sub)
+
+	case vidiocDQEvent:
+		if len(f.events) == 0 {
+			return syscall.ENOENT
+		}
+		ev := (*v4l2Event)(arg)
+		*ev = f.events[0]
+		f.events = f.events[1:]
+		ev.Pending = uint32(len(f.events))
+
+	default:
+		// G_STD and DV timings are not supported.
+		return syscall.ENOTTY
+	}
+	return nil
+}
+
+func (f *fakeDevice) mmap(fd int, offset int64, length int, prot int) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if fd == -1 {
+		data := make([]byte, length)
+		if f.anon == nil {
+			f.anon = make(map[uintptr][]byte)
+		}
+		f.anon[uintptr(unsafe.Pointer(&data[0]))] = data
+		return data, nil
+	}
+	if data, ok := f.imports[fd]; ok {
+		return data[:length], nil
+	}
+	index := int(offset / 4096)
+	if fd != f.fd || index >= len(f.buffers) {
+		return nil, syscall.EINVAL
+	}
+	return f.buffers[index][:length], nil
+}
+
+func (f *fakeDevice) munmap(data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.unmapCount++
+	delete(f.anon, uintptr(unsafe.Pointer(&data[0])))
+	return nil
+}
+
+func (f *fakeDevice) poll(fd int, events int16, timeout time.Duration) (int16, error) {
+	f.mu.Lock()
+	readIO := f.caps&v4l2CapStreaming == 0
+	ready := readIO || f.streaming && (len(f.queue) > 0 || len(f.dqbufErrs) > 0 ||
+		(f.failAfter > 0 && f.delivered >= f.failAfter))
+	pending := len(f.events) > 0
+	f.mu.Unlock()
+	var revents int16
+	if ready {
+		revents |= pollIn | pollOut
+	}
+	if pending {
+		revents |= pollPri
+	}
+	if revents&events != 0 {
+		return revents & events, nil
+	}
+	if timeout > time.Millisecond {
+		timeout = time.Millisecond
+	}
+	time.Sleep(timeout)
+	return 0, nil
+}
+
+func (f *fakeDevice) read(fd int, p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.caps&v4l2CapReadWrite == 0 {
+		return 0, syscall.EINVAL
+	}
+	f.delivered++
+	n := f.sizeImage
+	if n > len(p) {
+		n = len(p)
+	}
+	for i := range p[:n] {
+		p[i] = byte(f.delivered)
+	}
+	return n, nil
+}
+
+// dup duplicates the pipe standing in for an exported DMABUF.
+func (f *fakeDevice) dup(fd int) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dups++
+	return kernelSyscalls{}.dup(fd)
+}
+
+// seek reports the size of an imported DMABUF.
+func (f *fakeDevice) seek(fd int, offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.imports[fd]
+	if !ok || offset != 0 || whence != io.SeekEnd {
+		return 0, syscall.ESPIPE
+	}
+	return int64(len(data)), nil
+}
+
+func (f *fakeDevice) write(fd int, p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.caps&v4l2CapReadWrite == 0 || f.caps&v4l2CapVideoOutput == 0 {
+		return 0, syscall.EINVAL
+	}
+	n := len(p)
+	if f.writeChunk > 0 && n > f.writeChunk {
+		n = f.writeChunk
+	}
+	// Frames arrive in pieces; a write at the start of the buffer starts
+	// a new one.
+	if len(f.written) == 0 || len(f.written[len(f.written)-1]) >= f.sizeImage {
+		f.written = append(f.written, nil)
+	}
+	last := len(f.written) - 1
+	f.written[last] = append(f.written[last], p[:n]...)
+	return n, nil
+}
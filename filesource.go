@@ -0,0 +1,757 @@
+package gocam
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg" // image sequences and MJPEG
+	_ "image/png"  // image sequences
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FileScheme is the device URI scheme of the file replay source, e.g.
+// "file:///tmp/clip.y4m?loop=1".
+const FileScheme = "file"
+
+// FileFormat identifies the container or layout replayed by a FileSource.
+type FileFormat int
+
+const (
+	// FileAuto detects the format from the path: directories are image
+	// sequences, known extensions pick the format, and Y4M and MJPEG files
+	// are also recognized by their content.
+	FileAuto FileFormat = iota
+	// FileY4M is a YUV4MPEG2 stream with 8-bit 4:2:0, 4:2:2, 4:4:4 or mono
+	// samples.
+	FileY4M
+	// FileRawNV12 is a headerless dump of NV12 frames; Width and Height
+	// are required.
+	FileRawNV12
+	// FileRawYUYV is a headerless dump of YUYV frames; Width and Height
+	// are required.
+	FileRawYUYV
+	// FileRawI420 is a headerless dump of I420 frames; Width and Height
+	// are required.
+	FileRawI420
+	// FileImages is a directory of PNG and JPEG images played in name order.
+	FileImages
+	// FileMJPEG is a file of concatenated JPEG images.
+	FileMJPEG
+)
+
+func (f FileFormat) String() string {
+	switch f {
+	case FileAuto:
+		return "auto"
+	case FileY4M:
+		return "y4m"
+	case FileRawNV12:
+		return "nv12"
+	case FileRawYUYV:
+		return "yuyv"
+	case FileRawI420:
+		return "i420"
+	case FileImages:
+		return "images"
+	case FileMJPEG:
+		return "mjpeg"
+	}
+	return "unknown"
+}
+
+// ReplayMode controls the pacing of a FileSource.
+type ReplayMode int
+
+const (
+	// ReplayRealtime emits frames at the file's frame rate with the same
+	// latest-only semantics as a camera: a slow consumer loses frames.
+	ReplayRealtime ReplayMode = iota
+	// ReplayFast emits frames as fast as the consumer takes them. No frame
+	// is dropped, which makes replays reproducible.
+	ReplayFast
+)
+
+func (m ReplayMode) String() string {
+	switch m {
+	case ReplayRealtime:
+		return "realtime"
+	case ReplayFast:
+		return "fast"
+	}
+	return "unknown"
+}
+
+const defaultReplayFPS = 30
+
+// FileSource replays recorded footage as a frame stream, so bugs seen with
+// real cameras can be reproduced through the same pipeline. Frames are
+// packed YCbCr444 like those of every other source.
+type FileSource struct {
+	sourceState
+
+	Path   string
+	Format FileFormat
+
+	// Width and Height give the frame size of raw dumps.
+	Width  int
+	Height int
+
+	// FPS sets the playback rate. It defaults to the Y4M header rate, or
+	// to 30 for formats that carry no rate. Timestamps follow this rate in
+	// both replay modes.
+	FPS float64
+
+	Mode ReplayMode
+	// Loop restarts the file at its end instead of ending the stream.
+	Loop bool
+}
+
+func init() {
+	Register(FileScheme, func(uri string, opts ...StreamOption) (Source, error) {
+		return ParseFileURI(uri)
+	})
+}
+
+// ParseFileURI builds a FileSource from a device URI such as
+// "file:///data/clip.nv12?w=1280&h=720&fps=25&mode=fast&loop=1". The query
+// accepts format (y4m, nv12, yuyv, i420, images, mjpeg), w, h, fps, mode
+// (realtime or fast) and loop.
+func ParseFileURI(uri string) (*FileSource, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("gocam: invalid device URI %q: %w", uri, err)
+	}
+	if u.Scheme != FileScheme {
+		return nil, fmt.Errorf("gocam: not a file URI: %q", uri)
+	}
+
+	src := &FileSource{Path: u.Host + u.Path}
+	if u.Opaque != "" {
+		src.Path = u.Opaque // file:relative/path
+	}
+	if src.Path == "" {
+		return nil, fmt.Errorf("gocam: file URI without path: %q", uri)
+	}
+
+	q := u.Query()
+	if v := q.Get("format"); v != "" {
+		src.Format = FileAuto
+		for f := FileY4M; f <= FileMJPEG; f++ {
+			if f.String() == v {
+				src.Format = f
+			}
+		}
+		if src.Format == FileAuto {
+			return nil, fmt.Errorf("gocam: unknown file format %q in %q", v, uri)
+		}
+	}
+	intParam := func(name string, dst *int) error {
+		v := q.Get(name)
+		if v == "" {
+			return nil
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("gocam: invalid %s %q in %q", name, v, uri)
+		}
+		*dst = n
+		return nil
+	}
+	if err := intParam("w", &src.Width); err != nil {
+		return nil, err
+	}
+	if err := intParam("h", &src.Height); err != nil {
+		return nil, err
+	}
+	if v := q.Get("fps"); v != "" {
+		fps, err := strconv.ParseFloat(v, 64)
+		if err != nil || fps <= 0 {
+			return nil, fmt.Errorf("gocam: invalid fps %q in %q", v, uri)
+		}
+		src.FPS = fps
+	}
+	switch v := q.Get("mode"); v {
+	case "", "realtime":
+		src.Mode = ReplayRealtime
+	case "fast":
+		src.Mode = ReplayFast
+	default:
+		return nil, fmt.Errorf("gocam: invalid mode %q in %q", v, uri)
+	}
+	if v := q.Get("loop"); v != "" {
+		loop, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("gocam: invalid loop %q in %q", v, uri)
+		}
+		src.Loop = loop
+	}
+	return src, nil
+}
+
+// frameReader yields the frames of one pass over a file.
+type frameReader interface {
+	// next returns the next frame as packed YCbCr444, or io.EOF at the end.
+	next() (data []byte, width, height int, err error)
+	// rate returns the frame rate stored in the file, or 0.
+	rate() float64
+	// size returns the frame size when it is fixed for the whole file.
+	size() (width, height int, ok bool)
+	close() error
+}
+
+// Open opens the file, validates its header and starts replaying it. The
+// source stops when ctx is canceled, Close is called or, without Loop, at
+// the end of the file, which is announced with EventEOS.
+func (s *FileSource) Open(ctx context.Context) error {
+	return s.attach(ctx, s.start)
+}
+
+// Info describes the replayed file.
+func (s *FileSource) Info() SourceInfo {
+	info := SourceInfo{
+		Backend: FileScheme,
+		Device:  s.Path,
+		Name:    filepath.Base(s.Path),
+		Width:   s.Width,
+		Height:  s.Height,
+		FPS:     s.FPS,
+	}
+	if st := s.current(); st != nil {
+		info.Width, info.Height, info.FPS = st.info.Width, st.info.Height, st.info.FPS
+	}
+	return info
+}
+
+// Controls returns nil; files have no controls.
+func (s *FileSource) Controls() []Control {
+	return nil
+}
+
+// start opens a reader and replays it until ctx is done.
+func (s *FileSource) start(ctx context.Context) (*Stream, error) {
+	rd, err := s.openReader()
+	if err != nil {
+		return nil, err
+	}
+
+	fps := s.FPS
+	if fps <= 0 {
+		fps = rd.rate()
+	}
+	if fps <= 0 {
+		fps = defaultReplayFPS
+	}
+	period := time.Duration(float64(time.Second) / fps)
+
+	frames := make(chan Frame, 1)
+	events := make(chan Event, eventQueueSize)
+	stats := &streamStats{}
+
+	go func() {
+		defer close(frames)
+		defer close(events)
+		defer func() {
+			if rd != nil {
+				_ = rd.close()
+			}
+		}()
+
+		sendFrame := func(frame Frame) bool {
+			if s.Mode == ReplayFast {
+				select {
+				case frames <- frame:
+					stats.frames.Add(1)
+					return true
+				case <-ctx.Done():
+					return false
+				}
+			}
+
+			stats.frames.Add(1)
+			select {
+			case frames <- frame:
+			default:
+				select {
+				case old := <-frames:
+					old.Release()
+					stats.dropped.Add(1)
+				default:
+				}
+				frames <- frame
+			}
+			return true
+		}
+
+		start := time.Now()
+		var seq uint64
+		passFrames := 0
+		for ctx.Err() == nil {
+			data, w, h, err := rd.next()
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				// Stop on an empty file even when looping.
+				if !s.Loop || passFrames == 0 {
+					sendEvent(events, Event{Type: EventEOS})
+					return
+				}
+				_ = rd.close()
+				if rd, err = s.openReader(); err != nil {
+					rd = nil
+					camLog.Printf("[gocam] replay %s: %v\n", s.Path, err)
+					return
+				}
+				passFrames = 0
+				continue
+			}
+			if err != nil {
+				camLog.Printf("[gocam] replay %s: %v\n", s.Path, err)
+				return
+			}
+			passFrames++
+
+			ts := start.Add(time.Duration(seq) * period)
+			if s.Mode == ReplayRealtime {
+				if wait := time.Until(ts); wait > 0 {
+					timer := time.NewTimer(wait)
+					select {
+					case <-ctx.Done():
+						timer.Stop()
+						return
+					case <-timer.C:
+					}
+				}
+			}
+
+			frame := Frame{Data: data, Width: w, Height: h, Timestamp: ts, Sequence: seq}
+			if mr, ok := rd.(*mjpegReader); ok {
+				frame.JPEG = mr.jpg
+			}
+			if !sendFrame(frame) {
+				return
+			}
+			seq++
+		}
+	}()
+
+	info := SourceInfo{FPS: fps}
+	if w, h, ok := rd.size(); ok {
+		info.Width, info.Height = w, h
+	}
+	return &Stream{frames: frames, events: events, stats: stats, info: info}, nil
+}
+
+// openReader starts a new pass over the file.
+func (s *FileSource) openReader() (frameReader, error) {
+	format := s.Format
+	if format == FileAuto {
+		var err error
+		if format, err = detectFileFormat(s.Path); err != nil {
+			return nil, err
+		}
+	}
+
+	switch format {
+	case FileImages:
+		return openImageDirReader(s.Path)
+	case FileY4M, FileMJPEG, FileRawNV12, FileRawYUYV, FileRawI420:
+	default:
+		return nil, fmt.Errorf("gocam: unknown file format %d", int(format))
+	}
+
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return nil, fmt.Errorf("gocam: cannot open %s: %w", s.Path, err)
+	}
+	br := bufio.NewReaderSize(f, 1<<20)
+
+	var rd frameReader
+	switch format {
+	case FileY4M:
+		rd, err = newY4MReader(f, br)
+	case FileMJPEG:
+		rd = &mjpegReader{f: f, r: br}
+	default:
+		rd, err = newRawReader(f, br, format, s.Width, s.Height)
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return rd, nil
+}
+
+// detectFileFormat guesses the format of path from its type, extension and
+// first bytes.
+func detectFileFormat(path string) (FileFormat, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return FileAuto, fmt.Errorf("gocam: cannot open %s: %w", path, err)
+	}
+	if info.IsDir() {
+		return FileImages, nil
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".y4m":
+		return FileY4M, nil
+	case ".mjpeg", ".mjpg":
+		return FileMJPEG, nil
+	case ".nv12":
+		return FileRawNV12, nil
+	case ".yuyv", ".yuy2":
+		return FileRawYUYV, nil
+	case ".i420", ".yuv":
+		return FileRawI420, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return FileAuto, fmt.Errorf("gocam: cannot open %s: %w", path, err)
+	}
+	defer f.Close()
+	head := make([]byte, len(y4mMagic))
+	n, _ := io.ReadFull(f, head)
+	head = head[:n]
+	switch {
+	case bytes.Equal(head, []byte(y4mMagic)):
+		return FileY4M, nil
+	case len(head) >= 2 && head[0] == 0xFF && head[1] == 0xD8:
+		return FileMJPEG, nil
+	}
+	return FileAuto, fmt.Errorf("gocam: cannot detect the format of %s; set it explicitly", path)
+}
+
+const y4mMagic = "YUV4MPEG2"
+
+// y4mReader reads 8-bit YUV4MPEG2 streams.
+type y4mReader struct {
+	f             *os.File
+	r             *bufio.Reader
+	width, height int
+	subX, subY    int // chroma subsampling; 0 for mono
+	fps           float64
+	buf           []byte
+}
+
+func newY4MReader(f *os.File, r *bufio.Reader) (*y4mReader, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("gocam: Y4M header: %w", err)
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 || fields[0] != y4mMagic {
+		return nil, fmt.Errorf("gocam: not a YUV4MPEG2 stream")
+	}
+
+	rd := &y4mReader{f: f, r: r, subX: 2, subY: 2}
+	for _, tag := range fields[1:] {
+		val := tag[1:]
+		switch tag[0] {
+		case 'W':
+			rd.width, _ = strconv.Atoi(val)
+		case 'H':
+			rd.height, _ = strconv.Atoi(val)
+		case 'F':
+			num, den, ok := strings.Cut(val, ":")
+			n, err1 := strconv.ParseFloat(num, 64)
+			d, err2 := strconv.ParseFloat(den, 64)
+			if ok && err1 == nil && err2 == nil && n > 0 && d > 0 {
+				rd.fps = n / d
+			}
+		case 'C':
+			switch val {
+			case "420jpeg", "420paldv", "420mpeg2", "420":
+				rd.subX, rd.subY = 2, 2
+			case "422":
+				rd.subX, rd.subY = 2, 1
+			case "444":
+				rd.subX, rd.subY = 1, 1
+			case "mono":
+				rd.subX, rd.subY = 0, 0
+			default:
+				return nil, fmt.Errorf("gocam: unsupported Y4M colorspace %q", val)
+			}
+		}
+	}
+	if rd.width <= 0 || rd.height <= 0 {
+		return nil, fmt.Errorf("gocam: invalid Y4M frame size %dx%d", rd.width, rd.height)
+	}
+	return rd, nil
+}
+
+func (rd *y4mReader) next() ([]byte, int, int, error) {
+	line, err := rd.r.ReadString('\n')
+	if err != nil {
+		if err == io.EOF && line != "" {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, 0, err
+	}
+	if !strings.HasPrefix(line, "FRAME") {
+		return nil, 0, 0, fmt.Errorf("gocam: corrupt Y4M frame header %q", strings.TrimSpace(line))
+	}
+
+	ySize := rd.width * rd.height
+	cw, ch, cSize := 0, 0, 0
+	if rd.subX > 0 {
+		cw = (rd.width + rd.subX - 1) / rd.subX
+		ch = (rd.height + rd.subY - 1) / rd.subY
+		cSize = cw * ch
+	}
+	if need := ySize + 2*cSize; len(rd.buf) != need {
+		rd.buf = make([]byte, need)
+	}
+	if _, err := io.ReadFull(rd.r, rd.buf); err != nil {
+		return nil, 0, 0, io.ErrUnexpectedEOF
+	}
+
+	var cb, cr []byte
+	if cSize > 0 {
+		cb = rd.buf[ySize : ySize+cSize]
+		cr = rd.buf[ySize+cSize:]
+	}
+	subX, subY := rd.subX, rd.subY
+	if subX == 0 {
+		subX, subY = 1, 1
+	}
+	data := planarToYCbCr444(rd.buf[:ySize], cb, cr, rd.width, rd.height, rd.width, cw, subX, subY)
+	return data, rd.width, rd.height, nil
+}
+
+func (rd *y4mReader) rate() float64          { return rd.fps }
+func (rd *y4mReader) size() (int, int, bool) { return rd.width, rd.height, true }
+func (rd *y4mReader) close() error           { return rd.f.Close() }
+
+// rawReader reads headerless frames of a fixed size.
+type rawReader struct {
+	f             *os.File
+	r             *bufio.Reader
+	pixFmt        uint32
+	width, height int
+	buf           []byte
+}
+
+func newRawReader(f *os.File, r *bufio.Reader, format FileFormat, width, height int) (*rawReader, error) {
+	if width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("gocam: raw %s replay needs the frame size", format)
+	}
+	if width%2 != 0 || height%2 != 0 {
+		return nil, fmt.Errorf("gocam: raw %s frames must have even dimensions, got %dx%d", format, width, height)
+	}
+
+	rd := &rawReader{f: f, r: r, width: width, height: height}
+	size := width * height * 3 / 2
+	switch format {
+	case FileRawNV12:
+		rd.pixFmt = v4l2PixFmtNV12
+	case FileRawI420:
+		rd.pixFmt = v4l2PixFmtI420
+	case FileRawYUYV:
+		rd.pixFmt = v4l2PixFmtYUYV
+		size = width * height * 2
+	}
+	rd.buf = make([]byte, size)
+	return rd, nil
+}
+
+func (rd *rawReader) next() ([]byte, int, int, error) {
+	if _, err := io.ReadFull(rd.r, rd.buf); err != nil {
+		return nil, 0, 0, err
+	}
+	data := convertFrame(rd.buf, rd.pixFmt, rd.width, rd.height, 0)
+	if data == nil {
+		return nil, 0, 0, fmt.Errorf("gocam: cannot convert raw frame")
+	}
+	return data, rd.width, rd.height, nil
+}
+
+func (rd *rawReader) rate() float64          { return 0 }
+func (rd *rawReader) size() (int, int, bool) { return rd.width, rd.height, true }
+func (rd *rawReader) close() error           { return rd.f.Close() }
+
+// imageDirReader decodes the PNG and JPEG files of a directory in name order.
+type imageDirReader struct {
+	files []string
+	pos   int
+}
+
+func openImageDirReader(dir string) (*imageDirReader, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("gocam: cannot read %s: %w", dir, err)
+	}
+	rd := &imageDirReader{}
+	for _, e := range entries {
+		switch strings.ToLower(filepath.Ext(e.Name())) {
+		case ".png", ".jpg", ".jpeg":
+			if !e.IsDir() {
+				rd.files = append(rd.files, filepath.Join(dir, e.Name()))
+			}
+		}
+	}
+	if len(rd.files) == 0 {
+		return nil, fmt.Errorf("gocam: no PNG or JPEG images in %s", dir)
+	}
+	return rd, nil
+}
+
+func (rd *imageDirReader) next() ([]byte, int, int, error) {
+	if rd.pos >= len(rd.files) {
+		return nil, 0, 0, io.EOF
+	}
+	path := rd.files[rd.pos]
+	rd.pos++
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(bufio.NewReader(f))
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("gocam: decode %s: %w", path, err)
+	}
+	data, w, h := imageToYCbCr444(img)
+	return data, w, h, nil
+}
+
+func (rd *imageDirReader) rate() float64          { return 0 }
+func (rd *imageDirReader) size() (int, int, bool) { return 0, 0, false }
+func (rd *imageDirReader) close() error           { return nil }
+
+// mjpegReader splits a file of concatenated JPEG images.
+type mjpegReader struct {
+	f   *os.File
+	r   *bufio.Reader
+	jpg []byte // last image read, for Frame.JPEG
+}
+
+func (rd *mjpegReader) next() ([]byte, int, int, error) {
+	jpg, err := readJPEG(rd.r)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	jpg = completeJPEG(jpg)
+	rd.jpg = jpg
+	img, _, err := image.Decode(bytes.NewReader(jpg))
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("gocam: decode MJPEG frame: %w", err)
+	}
+	data, w, h := imageToYCbCr444(img)
+	return data, w, h, nil
+}
+
+func (rd *mjpegReader) rate() float64          { return 0 }
+func (rd *mjpegReader) size() (int, int, bool) { return 0, 0, false }
+func (rd *mjpegReader) close() error           { return rd.f.Close() }
+
+// readJPEG returns the next complete JPEG image (SOI to EOI) from r. Segment
+// lengths are followed, so embedded thumbnails do not end the image early.
+// It returns io.EOF when no further image starts and io.ErrUnexpectedEOF for
+// a truncated one.
+func readJPEG(r *bufio.Reader) ([]byte, error) {
+	// Skip anything before the start-of-image marker.
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, io.EOF
+		}
+		if b != 0xFF {
+			continue
+		}
+		if next, err := r.Peek(1); err == nil && next[0] == 0xD8 {
+			_, _ = r.ReadByte()
+			break
+		}
+	}
+
+	buf := []byte{0xFF, 0xD8}
+	m, err := jpegMarker(r)
+	for {
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, 0xFF, m)
+		switch {
+		case m == 0xD9: // EOI
+			return buf, nil
+		case m == 0x01 || (m >= 0xD0 && m <= 0xD7): // no payload
+			m, err = jpegMarker(r)
+			continue
+		}
+
+		var length [2]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		n := int(length[0])<<8 | int(length[1])
+		if n < 2 {
+			return nil, fmt.Errorf("gocam: corrupt JPEG segment length %d", n)
+		}
+		seg := make([]byte, n-2)
+		if _, err := io.ReadFull(r, seg); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		buf = append(buf, length[:]...)
+		buf = append(buf, seg...)
+
+		if m == 0xDA { // SOS: entropy-coded data runs up to the next marker
+			buf, m, err = readJPEGScan(r, buf)
+			continue
+		}
+		m, err = jpegMarker(r)
+	}
+}
+
+// jpegMarker reads a marker, skipping fill bytes, and returns its code.
+func jpegMarker(r *bufio.Reader) (byte, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if b != 0xFF {
+		return 0, fmt.Errorf("gocam: corrupt JPEG stream: expected marker, got 0x%02x", b)
+	}
+	for b == 0xFF {
+		if b, err = r.ReadByte(); err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+	}
+	return b, nil
+}
+
+// readJPEGScan appends entropy-coded data to buf and returns the code of the
+// marker that ends it. Stuffed zero bytes and restart markers belong to the
+// scan.
+func readJPEGScan(r *bufio.Reader, buf []byte) ([]byte, byte, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return buf, 0, io.ErrUnexpectedEOF
+		}
+		if b != 0xFF {
+			buf = append(buf, b)
+			continue
+		}
+		m, err := r.ReadByte()
+		for err == nil && m == 0xFF {
+			m, err = r.ReadByte()
+		}
+		if err != nil {
+			return buf, 0, io.ErrUnexpectedEOF
+		}
+		if m == 0x00 || (m >= 0xD0 && m <= 0xD7) {
+			buf = append(buf, 0xFF, m)
+			continue
+		}
+		return buf, m, nil
+	}
+}
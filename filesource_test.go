@@ -0,0 +1,423 @@
+package gocam
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/svanichkin/gocam/pixconv"
+)
+
+func TestParseFileURI(t *testing.T) {
+	// parsed holds the configuration fields of a FileSource.
+	type parsed struct {
+		Path          string
+		Format        FileFormat
+		Width, Height int
+		FPS           float64
+		Mode          ReplayMode
+		Loop          bool
+	}
+	tests := []struct {
+		uri  string
+		want parsed
+	}{
+		{"file:///data/clip.y4m", parsed{Path: "/data/clip.y4m"}},
+		{"file:clips/a.mjpeg", parsed{Path: "clips/a.mjpeg"}},
+		{
+			"file:///data/clip.bin?format=nv12&w=1280&h=720&fps=25&mode=fast&loop=1",
+			parsed{Path: "/data/clip.bin", Format: FileRawNV12, Width: 1280, Height: 720, FPS: 25, Mode: ReplayFast, Loop: true},
+		},
+		{"file:///d?format=images&mode=realtime&loop=false", parsed{Path: "/d", Format: FileImages}},
+		{"file:///a.raw?format=yuyv&fps=29.97", parsed{Path: "/a.raw", Format: FileRawYUYV, FPS: 29.97}},
+	}
+	for _, tc := range tests {
+		src, err := ParseFileURI(tc.uri)
+		if err != nil {
+			t.Errorf("%s: %v", tc.uri, err)
+			continue
+		}
+		got := parsed{src.Path, src.Format, src.Width, src.Height, src.FPS, src.Mode, src.Loop}
+		if got != tc.want {
+			t.Errorf("%s: got %+v, want %+v", tc.uri, got, tc.want)
+		}
+	}
+
+	for _, uri := range []string{
+		"test://bars",
+		"file://",
+		"file:///a?format=avi",
+		"file:///a?w=0",
+		"file:///a?h=tall",
+		"file:///a?fps=-1",
+		"file:///a?fps=x",
+		"file:///a?mode=slow",
+		"file:///a?loop=maybe",
+		"file://%zz",
+	} {
+		if _, err := ParseFileURI(uri); err == nil {
+			t.Errorf("%s: accepted", uri)
+		}
+	}
+}
+
+func TestDetectFileFormat(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	tests := map[string]FileFormat{
+		dir:                                      FileImages,
+		write("a.Y4M", nil):                      FileY4M,
+		write("a.mjpg", nil):                     FileMJPEG,
+		write("a.nv12", nil):                     FileRawNV12,
+		write("a.yuy2", nil):                     FileRawYUYV,
+		write("a.yuv", nil):                      FileRawI420,
+		write("y4m.bin", []byte(y4mMagic+" W2")): FileY4M,
+		write("jpeg.bin", []byte{0xFF, 0xD8, 0xFF}): FileMJPEG,
+	}
+	for path, want := range tests {
+		if got, err := detectFileFormat(path); err != nil || got != want {
+			t.Errorf("%s: %v (%v), want %v", filepath.Base(path), got, err, want)
+		}
+	}
+	for _, path := range []string{write("noise.bin", []byte("hello")), write("empty", nil), filepath.Join(dir, "missing.y4m")} {
+		if _, err := detectFileFormat(path); err == nil {
+			t.Errorf("%s: detected", filepath.Base(path))
+		}
+	}
+}
+
+// replay opens uri and returns every frame and event up to the end of the
+// stream.
+func replay(t *testing.T, uri string) ([]Frame, []Event, *Stream) {
+	t.Helper()
+	s, err := OpenStream(context.Background(), WithDevice(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	var frames []Frame
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case f, ok := <-s.Frames():
+			if !ok {
+				var events []Event
+				for ev := range s.Events() {
+					events = append(events, ev)
+				}
+				return frames, events, s
+			}
+			frames = append(frames, f)
+		case <-timeout:
+			t.Fatal("stream did not end")
+		}
+	}
+}
+
+// onlyEOS reports whether events holds just the end-of-stream event.
+func onlyEOS(events []Event) bool {
+	return len(events) == 1 && events[0].Type == EventEOS
+}
+
+// writeY4MFile writes frames to a 4:4:4 Y4M file at fps.
+func writeY4MFile(t *testing.T, path string, fps float64, frames ...Frame) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	yw := NewY4MWriter(w, &Y4MOptions{FPS: fps})
+	for _, frame := range frames {
+		if err := yw.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := yw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileSourceY4M(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clip.y4m")
+	want := []Frame{colorFrame(6, 4), pixelFrame(6, 4), colorFrame(6, 4)}
+	writeY4MFile(t, path, 10, want...)
+
+	frames, events, s := replay(t, "file://"+path+"?mode=fast")
+	if len(frames) != len(want) || !onlyEOS(events) {
+		t.Fatalf("%d frames and events %v", len(frames), events)
+	}
+	for i, f := range frames {
+		if f.Width != 6 || f.Height != 4 || !bytes.Equal(f.Data, want[i].Data) || f.Sequence != uint64(i) {
+			t.Errorf("frame %d: %dx%d #%d differs", i, f.Width, f.Height, f.Sequence)
+		}
+		// Timestamps follow the file rate even in fast mode.
+		if i > 0 {
+			if d := f.Timestamp.Sub(frames[i-1].Timestamp); d != 100*time.Millisecond {
+				t.Errorf("frame %d: %v after the previous one", i, d)
+			}
+		}
+	}
+	if info := s.Info(); info.Backend != FileScheme || info.Width != 6 || info.Height != 4 || info.FPS != 10 {
+		t.Errorf("info %+v", info)
+	}
+}
+
+func TestFileSourceLoop(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "clip.y4m")
+	writeY4MFile(t, path, 25, colorFrame(4, 2), pixelFrame(4, 2))
+
+	s, err := OpenStream(context.Background(), WithDevice("file://"+path+"?mode=fast&loop=1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		f := nextFileFrame(t, s)
+		want := colorFrame(4, 2)
+		if i%2 == 1 {
+			want = pixelFrame(4, 2)
+		}
+		if f.Sequence != uint64(i) || !bytes.Equal(f.Data, want.Data) {
+			t.Fatalf("frame %d: #%d differs", i, f.Sequence)
+		}
+	}
+	s.Close()
+	for range s.Frames() {
+	}
+
+	// A file without frames ends even when looping.
+	empty := filepath.Join(dir, "empty.y4m")
+	if err := os.WriteFile(empty, []byte(y4mMagic+" W4 H2 F25:1 C444\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	frames, events, _ := replay(t, "file://"+empty+"?loop=1")
+	if len(frames) != 0 || !onlyEOS(events) {
+		t.Errorf("empty file: %d frames, events %v", len(frames), events)
+	}
+}
+
+// nextFileFrame waits for the next frame of a replay.
+func nextFileFrame(t *testing.T, s *Stream) Frame {
+	t.Helper()
+	select {
+	case f, ok := <-s.Frames():
+		if !ok {
+			t.Fatal("stream ended")
+		}
+		return f
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a frame")
+	}
+	return Frame{}
+}
+
+func TestFileSourceRealtime(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clip.y4m")
+	writeY4MFile(t, path, 25, colorFrame(4, 2), colorFrame(4, 2), colorFrame(4, 2))
+
+	start := time.Now()
+	s, err := OpenStream(context.Background(), WithDevice("file://"+path+"?fps=20"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	var last Frame
+	for i := 0; i < 3; i++ {
+		last = nextFileFrame(t, s)
+	}
+	// The third frame is due 100 ms after the first at 20 fps.
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("three frames after %v, want at least 100ms", elapsed)
+	}
+	if s.Info().FPS != 20 || last.Sequence != 2 {
+		t.Errorf("FPS %v, last frame #%d", s.Info().FPS, last.Sequence)
+	}
+}
+
+// chromaFrame returns a frame with a luma gradient and uniform chroma, which
+// survives chroma subsampling exactly.
+func chromaFrame(w, h int) Frame {
+	data := make([]byte, 0, w*h*3)
+	for i := 0; i < w*h; i++ {
+		data = append(data, byte(20+i*3), 90, 200)
+	}
+	return Frame{Data: data, Width: w, Height: h}
+}
+
+func TestFileSourceRaw(t *testing.T) {
+	dir := t.TempDir()
+	frame := chromaFrame(6, 4)
+	tests := []struct {
+		ext    string
+		format pixconv.Format
+		size   int
+	}{
+		{"nv12", pixconv.NV12, 6 * 4 * 3 / 2},
+		{"i420", pixconv.I420, 6 * 4 * 3 / 2},
+		{"yuyv", pixconv.YUYV, 6 * 4 * 2},
+	}
+	for _, tc := range tests {
+		raw := make([]byte, tc.size)
+		frame.convertTo(tc.format, raw, 0)
+		// Two frames and a truncated third, which is dropped.
+		path := filepath.Join(dir, "clip."+tc.ext)
+		data := append(append(append([]byte(nil), raw...), raw...), raw[:5]...)
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		frames, events, _ := replay(t, "file://"+path+"?w=6&h=4&mode=fast")
+		if len(frames) != 2 || !onlyEOS(events) {
+			t.Fatalf("%s: %d frames, events %v", tc.ext, len(frames), events)
+		}
+		for _, f := range frames {
+			if f.Width != 6 || f.Height != 4 || !bytes.Equal(f.Data, frame.Data) {
+				t.Errorf("%s: frame differs", tc.ext)
+			}
+		}
+	}
+
+	// Raw files need an even frame size.
+	path := filepath.Join(dir, "clip.nv12")
+	for _, query := range []string{"", "?w=6", "?w=5&h=4"} {
+		if _, err := OpenStream(context.Background(), WithDevice("file://"+path+query)); err == nil {
+			t.Errorf("raw replay opened with %q", query)
+		}
+	}
+}
+
+func TestFileSourceImages(t *testing.T) {
+	dir := t.TempDir()
+	writePNG := func(name string, w, h int, v uint8) {
+		img := image.NewGray(image.Rect(0, 0, w, h))
+		for i := range img.Pix {
+			img.Pix[i] = v
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), buf.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writePNG("b.png", 6, 3, 200)
+	writePNG("a.PNG", 4, 2, 50)
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("skip"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "c.png"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	frames, events, _ := replay(t, "file://"+dir+"?mode=fast")
+	if len(frames) != 2 || !onlyEOS(events) {
+		t.Fatalf("%d frames, events %v", len(frames), events)
+	}
+	// Images play in name order, each at its own size.
+	if f := frames[0]; f.Width != 4 || f.Height != 2 || !bytes.Equal(f.Data[:3], []byte{50, 128, 128}) {
+		t.Errorf("first frame %dx%d starts %v", f.Width, f.Height, f.Data[:3])
+	}
+	if f := frames[1]; f.Width != 6 || f.Height != 3 || !bytes.Equal(f.Data[:3], []byte{200, 128, 128}) {
+		t.Errorf("second frame %dx%d starts %v", f.Width, f.Height, f.Data[:3])
+	}
+
+	if _, err := OpenStream(context.Background(), WithDevice("file://"+t.TempDir()+"?format=images")); err == nil {
+		t.Error("empty directory opened")
+	}
+}
+
+func TestFileSourceMJPEG(t *testing.T) {
+	var jpegs [2][]byte
+	for i, frame := range []Frame{colorFrame(16, 8), chromaFrame(16, 8)} {
+		var buf bytes.Buffer
+		if err := EncodeJPEG(&buf, frame, 90); err != nil {
+			t.Fatal(err)
+		}
+		jpegs[i] = buf.Bytes()
+	}
+	// Junk before and between the images is skipped; a truncated last
+	// image ends the stream.
+	var file []byte
+	file = append(file, "junk"...)
+	file = append(file, jpegs[0]...)
+	file = append(file, 0, 0)
+	file = append(file, jpegs[1]...)
+	file = append(file, jpegs[0][:len(jpegs[0])/2]...)
+	path := filepath.Join(t.TempDir(), "clip.mjpeg")
+	if err := os.WriteFile(path, file, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	frames, events, _ := replay(t, "file://"+path+"?mode=fast")
+	if len(frames) != 2 || !onlyEOS(events) {
+		t.Fatalf("%d frames, events %v", len(frames), events)
+	}
+	for i, f := range frames {
+		if f.Width != 16 || f.Height != 8 || !bytes.Equal(f.JPEG, jpegs[i]) {
+			t.Errorf("frame %d: %dx%d, JPEG kept %v", i, f.Width, f.Height, bytes.Equal(f.JPEG, jpegs[i]))
+		}
+	}
+	if cb, cr := frames[1].Data[1], frames[1].Data[2]; cb < 86 || cb > 94 || cr < 196 || cr > 204 {
+		t.Errorf("second frame decoded with chroma %d, %d, want about 90, 200", cb, cr)
+	}
+}
+
+func TestReadJPEG(t *testing.T) {
+	// SOI, an APP1 segment whose payload contains an EOI, a scan with a
+	// stuffed byte, a restart marker and fill bytes before EOI.
+	img := []byte{
+		0xFF, 0xD8,
+		0xFF, 0xE1, 0x00, 0x06, 0xFF, 0xD9, 0xFF, 0xD8,
+		0xFF, 0xDA, 0x00, 0x03, 0x01,
+		0x12, 0xFF, 0x00, 0x34, 0xFF, 0xD0, 0x56,
+		0xFF, 0xFF, 0xFF, 0xD9,
+	}
+	want := append(append([]byte(nil), img[:22]...), 0xFF, 0xD9)
+
+	r := bufio.NewReader(bytes.NewReader(append(append([]byte{0x00, 0xFF, 0x12}, img...), img...)))
+	for i := 0; i < 2; i++ {
+		got, err := readJPEG(r)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("image %d: % x (%v), want % x", i, got, err, want)
+		}
+	}
+	if _, err := readJPEG(r); err != io.EOF {
+		t.Errorf("after the last image: %v, want EOF", err)
+	}
+
+	for _, n := range []int{4, 8, 13, 18, len(img) - 1} {
+		r := bufio.NewReader(bytes.NewReader(img[:n]))
+		if _, err := readJPEG(r); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("image cut at %d: %v, want unexpected EOF", n, err)
+		}
+	}
+	bad := append([]byte(nil), img...)
+	bad[12], bad[13] = 0, 1 // segment length below 2
+	if _, err := readJPEG(bufio.NewReader(bytes.NewReader(bad))); err == nil || err == io.EOF {
+		t.Errorf("corrupt segment length: %v", err)
+	}
+	if _, err := readJPEG(bufio.NewReader(strings.NewReader("no image"))); err != io.EOF {
+		t.Errorf("no image: %v, want EOF", err)
+	}
+}
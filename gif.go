@@ -0,0 +1,384 @@
+package gocam
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/svanichkin/gocam/pixconv"
+)
+
+// GIFOptions configures a GIFWriter. The zero value (or a nil pointer)
+// keeps the frame size, uses 256 colors without dithering and times the
+// frames by their timestamps.
+type GIFOptions struct {
+	// Colors is the palette size of each frame, 2 to 256; zero means 256.
+	Colors int
+	// Dither spreads the quantization error over neighboring pixels
+	// (Floyd-Steinberg), which smooths gradients but compresses worse.
+	Dither bool
+	// Width and Height scale the frames, cropping centrally to keep the
+	// aspect ratio. Zero keeps the frame size, or keeps the aspect ratio
+	// when the other one is set.
+	Width, Height int
+	// FPS fixes the frame rate. When zero, each frame is shown until the
+	// timestamp of the next one.
+	FPS float64
+	// LoopCount is as in gif.GIF: 0 loops forever, -1 plays once and n
+	// plays n+1 times.
+	LoopCount int
+}
+
+// defaultGIFDelay is the frame delay, in hundredths of a second, used when
+// neither the rate nor the timestamps give one.
+const defaultGIFDelay = 10
+
+// minGIFDelay is the shortest delay browsers honor; they slow down shorter
+// ones to 10.
+const minGIFDelay = 2
+
+// GIFWriter writes frames as an animated GIF with image/gif. Each frame
+// gets its own median-cut palette. The animation is encoded by Close, so
+// frames are kept in memory until then, one byte per pixel: GIFs suit
+// short clips and time-lapses, not long recordings.
+type GIFWriter struct {
+	w    io.Writer
+	opts GIFOptions
+
+	width, height int
+	anim          gif.GIF
+	times         []time.Time
+	q             gifQuantizer
+	rgb           []byte
+	closed        bool
+}
+
+// NewGIFWriter returns a writer producing an animated GIF on w. opts may be
+// nil.
+func NewGIFWriter(w io.Writer, opts *GIFOptions) *GIFWriter {
+	gw := &GIFWriter{w: w}
+	if opts != nil {
+		gw.opts = *opts
+	}
+	gw.anim.LoopCount = gw.opts.LoopCount
+	return gw
+}
+
+// WriteFrame quantizes a frame and adds it to the animation.
+func (gw *GIFWriter) WriteFrame(frame Frame) error {
+	if gw.closed {
+		return errors.New("gocam: GIF writer closed")
+	}
+	if err := checkFrame(frame); err != nil {
+		return err
+	}
+	colors := gw.opts.Colors
+	if colors == 0 {
+		colors = 256
+	}
+	if colors < 2 || colors > 256 {
+		return fmt.Errorf("gocam: GIF palette of %d colors out of range 2-256", colors)
+	}
+
+	w, h := gw.opts.Width, gw.opts.Height
+	switch {
+	case w <= 0 && h <= 0:
+		w, h = frame.Width, frame.Height
+	case w <= 0:
+		w = max(1, frame.Width*h/frame.Height)
+	case h <= 0:
+		h = max(1, frame.Height*w/frame.Width)
+	}
+	if w > math.MaxUint16 || h > math.MaxUint16 {
+		return fmt.Errorf("gocam: %dx%d is too large for GIF", w, h)
+	}
+	if gw.width == 0 {
+		gw.width, gw.height = w, h
+	} else if w != gw.width || h != gw.height {
+		return fmt.Errorf("gocam: GIF frame size changed from %dx%d to %dx%d", gw.width, gw.height, w, h)
+	}
+	if w != frame.Width || h != frame.Height {
+		frame = Frame{Data: scaleYCbCr444Fill(frame.Data, frame.Width, frame.Height, w, h), Width: w, Height: h, Timestamp: frame.Timestamp}
+	}
+
+	if len(gw.rgb) != w*h*3 {
+		gw.rgb = make([]byte, w*h*3)
+	}
+	frame.convertTo(pixconv.RGB24, gw.rgb, w*3)
+	gw.anim.Image = append(gw.anim.Image, gw.q.quantize(gw.rgb, w, h, colors, gw.opts.Dither))
+	gw.times = append(gw.times, frame.Timestamp)
+	return nil
+}
+
+// Close computes the frame delays and writes the animation. Nothing is
+// written if no frame was. It does not close the underlying writer.
+func (gw *GIFWriter) Close() error {
+	if gw.closed {
+		return nil
+	}
+	gw.closed = true
+	if len(gw.anim.Image) == 0 {
+		return nil
+	}
+	gw.anim.Delay = gifDelays(gw.times, gw.opts.FPS)
+	err := gif.EncodeAll(gw.w, &gw.anim)
+	gw.anim.Image, gw.times = nil, nil
+	return err
+}
+
+// gifDelays returns the delays, in hundredths of a second, of frames taken
+// at times, or played at fps when it is positive. Delays are rounded on
+// the running total so they do not drift.
+func gifDelays(times []time.Time, fps float64) []int {
+	n := len(times)
+	// end returns the time frame i ends, in hundredths after the first.
+	var end func(i int) float64
+	switch {
+	case fps > 0:
+		end = func(i int) float64 { return float64(i+1) * 100 / fps }
+	case n > 1 && timesKnown(times):
+		total := times[n-1].Sub(times[0]).Seconds() * 100
+		end = func(i int) float64 {
+			if i == n-1 {
+				// The last frame is shown for the average delay.
+				return total + total/float64(n-1)
+			}
+			return times[i+1].Sub(times[0]).Seconds() * 100
+		}
+	default:
+		end = func(i int) float64 { return float64((i + 1) * defaultGIFDelay) }
+	}
+
+	delays := make([]int, n)
+	prev := 0
+	for i := range delays {
+		e := max(int(math.Round(end(i))), prev+minGIFDelay)
+		delays[i] = e - prev
+		prev = e
+	}
+	return delays
+}
+
+// timesKnown reports whether every frame has a timestamp.
+func timesKnown(times []time.Time) bool {
+	for _, t := range times {
+		if t.IsZero() {
+			return false
+		}
+	}
+	return true
+}
+
+// The quantizer works on colors reduced to gifHistBits per channel, which
+// keeps the histogram and the palette lookup table small.
+const (
+	gifHistBits = 5
+	gifHistSize = 1 << (3 * gifHistBits)
+)
+
+func gifKey(r, g, b int) int {
+	const shift = 8 - gifHistBits
+	return r>>shift<<(2*gifHistBits) | g>>shift<<gifHistBits | b>>shift
+}
+
+// gifQuantizer builds median-cut palettes. Its buffers are reused from
+// frame to frame.
+type gifQuantizer struct {
+	count []uint32    // pixels per histogram cell
+	sum   [][3]uint32 // color sums per cell, for exact box averages
+	keys  []int       // occupied cells
+	lut   []int16     // palette index per cell, -1 until needed
+	pal   [][3]int
+	errs  []int32 // dithering error of this row and the next
+}
+
+// gifBox is a range of keys, a box of the color cube.
+type gifBox struct {
+	keys   []int
+	count  uint64
+	axis   int // channel with the widest range
+	spread int // that range, in histogram cells
+}
+
+// quantize maps the RGB24 pixels to a palette of at most n colors.
+func (q *gifQuantizer) quantize(rgb []byte, w, h, n int, dither bool) *image.Paletted {
+	if q.count == nil {
+		q.count = make([]uint32, gifHistSize)
+		q.sum = make([][3]uint32, gifHistSize)
+		q.lut = make([]int16, gifHistSize)
+	}
+	for _, k := range q.keys {
+		q.count[k], q.sum[k] = 0, [3]uint32{}
+	}
+	q.keys = q.keys[:0]
+	for i := 0; i+2 < len(rgb); i += 3 {
+		r, g, b := rgb[i], rgb[i+1], rgb[i+2]
+		k := gifKey(int(r), int(g), int(b))
+		if q.count[k] == 0 {
+			q.keys = append(q.keys, k)
+		}
+		q.count[k]++
+		s := &q.sum[k]
+		s[0] += uint32(r)
+		s[1] += uint32(g)
+		s[2] += uint32(b)
+	}
+
+	q.medianCut(n)
+	for i := range q.lut {
+		q.lut[i] = -1
+	}
+	palette := make(color.Palette, len(q.pal))
+	for i, c := range q.pal {
+		palette[i] = color.RGBA{uint8(c[0]), uint8(c[1]), uint8(c[2]), 0xff}
+	}
+
+	img := image.NewPaletted(image.Rect(0, 0, w, h), palette)
+	if !dither {
+		for i := range img.Pix {
+			p := rgb[i*3 : i*3+3]
+			img.Pix[i] = q.index(int(p[0]), int(p[1]), int(p[2]))
+		}
+		return img
+	}
+
+	// Floyd-Steinberg: the error of each pixel goes 7/16 to the right and
+	// 3/16, 5/16 and 1/16 to the row below. Rows are padded by a pixel on
+	// each side.
+	stride := (w + 2) * 3
+	if len(q.errs) < 2*stride {
+		q.errs = make([]int32, 2*stride)
+	}
+	cur, next := q.errs[:stride], q.errs[stride:2*stride]
+	clear(cur)
+	for y := 0; y < h; y++ {
+		clear(next)
+		for x := 0; x < w; x++ {
+			p := rgb[(y*w+x)*3:]
+			e := cur[(x+1)*3:]
+			var c [3]int
+			for ch := range c {
+				c[ch] = min(max(int(p[ch])+int(e[ch]+8)>>4, 0), 255)
+			}
+			idx := q.index(c[0], c[1], c[2])
+			img.Pix[y*img.Stride+x] = idx
+			for ch := range c {
+				d := int32(c[ch] - q.pal[idx][ch])
+				cur[(x+2)*3+ch] += d * 7
+				next[x*3+ch] += d * 3
+				next[(x+1)*3+ch] += d * 5
+				next[(x+2)*3+ch] += d
+			}
+		}
+		cur, next = next, cur
+	}
+	return img
+}
+
+// index returns the palette entry nearest to a color.
+func (q *gifQuantizer) index(r, g, b int) uint8 {
+	k := gifKey(r, g, b)
+	if i := q.lut[k]; i >= 0 {
+		return uint8(i)
+	}
+	// Match the center of the cell, so the table does not depend on the
+	// first color looked up in it.
+	const shift = 8 - gifHistBits
+	const half = 1 << (shift - 1)
+	cr := k>>(2*gifHistBits)<<shift | half
+	cg := (k>>gifHistBits)&(1<<gifHistBits-1)<<shift | half
+	cb := k&(1<<gifHistBits-1)<<shift | half
+	best, bestDist := 0, math.MaxInt
+	for i, c := range q.pal {
+		dr, dg, db := c[0]-cr, c[1]-cg, c[2]-cb
+		if d := 2*dr*dr + 4*dg*dg + 3*db*db; d < bestDist {
+			best, bestDist = i, d
+		}
+	}
+	q.lut[k] = int16(best)
+	return uint8(best)
+}
+
+// medianCut fills q.pal with the averages of at most n boxes, splitting
+// the box with the most pixels times spread at its median pixel along its
+// widest channel until there are n boxes or none can be split.
+func (q *gifQuantizer) medianCut(n int) {
+	boxes := []gifBox{q.box(q.keys)}
+	for len(boxes) < n {
+		best, bestScore := -1, uint64(0)
+		for i, b := range boxes {
+			if score := b.count * uint64(b.spread); b.spread > 0 && score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		if best < 0 {
+			break
+		}
+		a, b := q.split(boxes[best])
+		boxes[best] = a
+		boxes = append(boxes, b)
+	}
+
+	q.pal = q.pal[:0]
+	for _, b := range boxes {
+		var s [3]uint64
+		for _, k := range b.keys {
+			for ch := range s {
+				s[ch] += uint64(q.sum[k][ch])
+			}
+		}
+		if b.count == 0 {
+			q.pal = append(q.pal, [3]int{})
+			continue
+		}
+		q.pal = append(q.pal, [3]int{int(s[0] / b.count), int(s[1] / b.count), int(s[2] / b.count)})
+	}
+}
+
+// channel returns channel ch of a histogram key.
+func gifChannel(k, ch int) int {
+	return k >> ((2 - ch) * gifHistBits) & (1<<gifHistBits - 1)
+}
+
+func (q *gifQuantizer) box(keys []int) gifBox {
+	b := gifBox{keys: keys}
+	lo := [3]int{1 << gifHistBits, 1 << gifHistBits, 1 << gifHistBits}
+	var hi [3]int
+	for _, k := range keys {
+		b.count += uint64(q.count[k])
+		for ch := 0; ch < 3; ch++ {
+			v := gifChannel(k, ch)
+			lo[ch], hi[ch] = min(lo[ch], v), max(hi[ch], v)
+		}
+	}
+	for ch := 0; ch < 3; ch++ {
+		if s := hi[ch] - lo[ch]; s > b.spread {
+			b.axis, b.spread = ch, s
+		}
+	}
+	return b
+}
+
+// split divides a box at the median pixel of its widest channel. Both
+// halves keep at least one cell.
+func (q *gifQuantizer) split(b gifBox) (gifBox, gifBox) {
+	sort.Slice(b.keys, func(i, j int) bool {
+		return gifChannel(b.keys[i], b.axis) < gifChannel(b.keys[j], b.axis)
+	})
+	var acc uint64
+	cut := 1
+	for i, k := range b.keys[:len(b.keys)-1] {
+		acc += uint64(q.count[k])
+		cut = i + 1
+		if 2*acc >= b.count {
+			break
+		}
+	}
+	return q.box(b.keys[:cut]), q.box(b.keys[cut:])
+}
@@ -0,0 +1,135 @@
+package gocam
+
+import (
+	"bytes"
+	"image/gif"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// decodeGIF writes frames through a GIFWriter and decodes the result.
+func decodeGIF(t *testing.T, opts *GIFOptions, frames ...Frame) *gif.GIF {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := NewGIFWriter(&buf, opts)
+	for _, frame := range frames {
+		if err := gw.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	g, err := gif.DecodeAll(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestGIFWriterColors(t *testing.T) {
+	// Four flat quadrants: a palette of four reproduces them within the
+	// YCbCr to RGB rounding.
+	const w, h = 16, 16
+	frame := Frame{Data: make([]byte, w*h*3), Width: w, Height: h}
+	quads := [][3]byte{{81, 90, 240}, {145, 54, 34}, {41, 240, 110}, {210, 16, 146}}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			copy(frame.Data[(y*w+x)*3:], quads[y/8*2+x/8][:])
+		}
+	}
+	want := frame.NRGBA()
+
+	for _, dither := range []bool{false, true} {
+		g := decodeGIF(t, &GIFOptions{Colors: 4, Dither: dither}, frame)
+		img := g.Image[0]
+		if len(img.Palette) != 4 {
+			t.Errorf("dither %v: %d palette entries, want 4", dither, len(img.Palette))
+		}
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				r, gr, b, _ := img.At(x, y).RGBA()
+				c := want.NRGBAAt(x, y)
+				for _, d := range []int{int(r>>8) - int(c.R), int(gr>>8) - int(c.G), int(b>>8) - int(c.B)} {
+					if d < -2 || d > 2 {
+						t.Fatalf("dither %v: pixel (%d,%d) is %d,%d,%d, want %v", dither, x, y, r>>8, gr>>8, b>>8, c)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestGIFWriterGradient(t *testing.T) {
+	// A smooth gradient quantized to 16 colors stays close; dithering
+	// trades a larger error per pixel for a mean that stays on target.
+	const w, h = 48, 32
+	frame := colorFrame(w, h)
+	want := frame.NRGBA()
+	for _, tc := range []struct {
+		dither bool
+		max    int
+	}{{false, 12}, {true, 24}} {
+		img := decodeGIF(t, &GIFOptions{Colors: 16, Dither: tc.dither}, frame).Image[0]
+		var sumErr, maxErr int
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				r, _, _, _ := img.At(x, y).RGBA()
+				d := int(r>>8) - int(want.NRGBAAt(x, y).R)
+				sumErr += d
+				maxErr = max(maxErr, max(d, -d))
+			}
+		}
+		if mean := sumErr / (w * h); maxErr > tc.max || mean < -2 || mean > 2 {
+			t.Errorf("dither %v: red error max %d, mean %d", tc.dither, maxErr, mean)
+		}
+	}
+}
+
+func TestGIFWriterTiming(t *testing.T) {
+	start := time.Unix(100, 0)
+	var frames []Frame
+	for _, ms := range []int{0, 100, 233, 366, 500} {
+		f := colorFrame(8, 6)
+		f.Timestamp = start.Add(time.Duration(ms) * time.Millisecond)
+		frames = append(frames, f)
+	}
+
+	g := decodeGIF(t, nil, frames...)
+	if len(g.Image) != 5 || g.Config.Width != 8 || g.Config.Height != 6 {
+		t.Fatalf("%d frames of %dx%d", len(g.Image), g.Config.Width, g.Config.Height)
+	}
+	// Rounded on the running total: 10, 23, 37, 50, then 62.5 after the average.
+	if want := []int{10, 13, 14, 13, 13}; !reflect.DeepEqual(g.Delay, want) {
+		t.Errorf("delays %v, want %v", g.Delay, want)
+	}
+
+	g = decodeGIF(t, &GIFOptions{FPS: 30, Width: 4, LoopCount: -1}, frames...)
+	if want := []int{3, 4, 3, 3, 4}; !reflect.DeepEqual(g.Delay, want) {
+		t.Errorf("30 fps delays %v, want %v", g.Delay, want)
+	}
+	if g.Config.Width != 4 || g.Config.Height != 3 || g.LoopCount != -1 {
+		t.Errorf("scaled to %dx%d, loop count %d", g.Config.Width, g.Config.Height, g.LoopCount)
+	}
+
+	// Without timestamps frames play at 10 fps; delays never drop below 2.
+	if got := gifDelays(make([]time.Time, 3), 0); !reflect.DeepEqual(got, []int{10, 10, 10}) {
+		t.Errorf("untimed delays %v", got)
+	}
+	same := []time.Time{start, start, start.Add(time.Second)}
+	if got := gifDelays(same, 0); !reflect.DeepEqual(got, []int{2, 98, 50}) {
+		t.Errorf("delays for equal timestamps %v", got)
+	}
+
+	var buf bytes.Buffer
+	gw := NewGIFWriter(&buf, nil)
+	if err := gw.Close(); err != nil || buf.Len() != 0 {
+		t.Errorf("empty GIF: %d bytes, %v", buf.Len(), err)
+	}
+	gw = NewGIFWriter(&buf, nil)
+	gw.WriteFrame(colorFrame(4, 4))
+	if err := gw.WriteFrame(colorFrame(5, 4)); err == nil {
+		t.Error("size change accepted")
+	}
+}
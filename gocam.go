@@ -1,7 +1,44 @@
 package gocam
 
+import "time"
+
 type Frame struct {
 	Data   []byte
 	Width  int
 	Height int
-}
\ No newline at end of file
+
+	// Timestamp is the capture time and Sequence the position of the frame
+	// in the stream. Gaps in Sequence mean frames were skipped by the driver
+	// or replaced before the consumer read them.
+	Timestamp time.Time
+	Sequence  uint64
+
+	// Field describes the interlacing layout of Data. It is
+	// FieldProgressive for progressive sources and for deinterlaced streams.
+	Field FieldOrder
+
+	// JPEG holds the compressed image as the camera delivered it when the
+	// source captures MJPEG, so recorders and streamers can pass it through
+	// without re-encoding; Data is its decoded form. The image keeps the
+	// capture size, which may exceed Data's when frames are downscaled. It
+	// is nil for other formats and for frames that were deinterlaced or
+	// transformed after decoding.
+	JPEG []byte
+
+	// DMABufs holds the driver buffers behind the frame when the stream was
+	// started with WithDMABufExport. The descriptors belong to the frame and
+	// are closed by Release.
+	DMABufs []DMABuf
+
+	release *frameRelease
+}
+
+// Release hands resources held by the frame, such as exported DMABUF
+// descriptors and the driver buffer behind them, back to the stream. Frames
+// without such resources ignore the call, so consumers may call it
+// unconditionally. Calling Release more than once is safe.
+func (f Frame) Release() {
+	if f.release != nil {
+		f.release.once.Do(f.release.fn)
+	}
+}
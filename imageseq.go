@@ -0,0 +1,52 @@
+package gocam
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ImageSequenceWriter saves each frame as an image file named by a
+// printf-style pattern holding the frame number, such as
+// "frames/img-%06d.jpg". Frames are numbered from zero in the order they
+// are written; the format follows the extension, as for SaveFrame.
+type ImageSequenceWriter struct {
+	pattern string
+	opts    SaveOptions
+	n       int
+}
+
+// NewImageSequenceWriter returns a writer saving frames to the files named
+// by pattern, which must contain one integer verb such as %05d. opts may
+// be nil.
+func NewImageSequenceWriter(pattern string, opts *SaveOptions) (*ImageSequenceWriter, error) {
+	if name := fmt.Sprintf(pattern, 0); strings.Contains(name, "%!") || name == fmt.Sprintf(pattern, 1) {
+		return nil, fmt.Errorf("gocam: image sequence pattern %q needs one integer verb such as %%05d", pattern)
+	}
+	sw := &ImageSequenceWriter{pattern: pattern}
+	if opts != nil {
+		sw.opts = *opts
+	}
+	if sw.opts.Format == FormatAuto && ImageFormatForPath(pattern) == FormatAuto {
+		return nil, fmt.Errorf("gocam: unknown image format for %q", pattern)
+	}
+	return sw, nil
+}
+
+// WriteFrame saves the frame to the next file.
+func (sw *ImageSequenceWriter) WriteFrame(frame Frame) error {
+	if err := SaveFrame(frame, fmt.Sprintf(sw.pattern, sw.n), &sw.opts); err != nil {
+		return err
+	}
+	sw.n++
+	return nil
+}
+
+// Frames returns the number of files written.
+func (sw *ImageSequenceWriter) Frames() int {
+	return sw.n
+}
+
+// Close does nothing; every file is complete once WriteFrame returns.
+func (sw *ImageSequenceWriter) Close() error {
+	return nil
+}
@@ -0,0 +1,429 @@
+// Package websocket implements the parts of RFC 6455 gocam needs: the
+// opening handshake on both sides, unfragmented and fragmented messages,
+// ping/pong and the closing handshake. Extensions and subprotocols are not
+// negotiated.
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message types, the opcodes of data frames.
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+)
+
+const (
+	opContinuation = 0
+	opClose        = 8
+	opPing         = 9
+	opPong         = 10
+)
+
+// Close status codes used by gocam.
+const (
+	CloseNormal        = 1000
+	CloseGoingAway     = 1001
+	CloseProtocol      = 1002
+	CloseUnsupported   = 1003
+	CloseInvalidData   = 1007
+	CloseMessageTooBig = 1009
+)
+
+// acceptGUID is appended to the client key to form the accept value.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// writeTimeout bounds each frame write, so a client that stops reading
+// cannot block its writers, Close or the answers to pings and closes.
+const writeTimeout = 5 * time.Second
+
+// ErrClosed is returned by ReadMessage after the peer closed the
+// connection with a normal close frame.
+var ErrClosed = errors.New("websocket: connection closed")
+
+// Conn is a WebSocket connection. ReadMessage must be called from one
+// goroutine; WriteMessage and Close may be called concurrently with it and
+// with each other.
+type Conn struct {
+	conn   net.Conn
+	rd     *bufio.Reader
+	client bool // mask outgoing frames
+	limit  int64
+
+	wmu          sync.Mutex
+	closeSent    bool
+	writeTimeout time.Duration // 0: writeTimeout
+}
+
+func acceptKey(key string) string {
+	h := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// SameOrigin reports whether r carries no Origin header or one naming the
+// host r was sent to. Browsers send Origin with every WebSocket handshake,
+// so this keeps pages of other sites from opening connections with the
+// network access of whoever visits them.
+func SameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// Upgrade answers a WebSocket handshake request and takes over the
+// connection. On failure it has written an HTTP error response.
+// Incoming messages larger than limit bytes end the connection.
+// checkOrigin decides whether the request's origin may connect; nil
+// means SameOrigin.
+func Upgrade(w http.ResponseWriter, r *http.Request, limit int64, checkOrigin func(*http.Request) bool) (*Conn, error) {
+	if r.Method != http.MethodGet ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "WebSocket upgrade required", http.StatusUpgradeRequired)
+		return nil, errors.New("websocket: not a handshake request")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusBadRequest)
+		return nil, errors.New("websocket: unsupported version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("websocket: missing key")
+	}
+	if checkOrigin == nil {
+		checkOrigin = SameOrigin
+	}
+	if !checkOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return nil, fmt.Errorf("websocket: origin %q not allowed", r.Header.Get("Origin"))
+	}
+
+	nc, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return nil, err
+	}
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	if _, err := nc.Write([]byte(resp)); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return &Conn{conn: nc, rd: brw.Reader, limit: limit}, nil
+}
+
+// headerContains reports whether a comma-separated header has token.
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Dial opens a client connection to a ws:// or wss:// URL. Incoming
+// messages larger than limit bytes end the connection.
+func Dial(ctx context.Context, rawURL string, header http.Header, limit int64) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	switch u.Scheme {
+	case "ws":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	case "wss":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		}
+	default:
+		return nil, fmt.Errorf("websocket: unsupported scheme %q", u.Scheme)
+	}
+
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "wss" {
+		tc := tls.Client(nc, &tls.Config{ServerName: u.Hostname()})
+		if err := tc.HandshakeContext(ctx); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		nc = tc
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		nc.SetDeadline(deadline)
+	}
+
+	var nonce [16]byte
+	rand.Read(nonce[:])
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(nc); err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	rd := bufio.NewReader(nc)
+	resp, err := http.ReadResponse(rd, req)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		nc.Close()
+		return nil, fmt.Errorf("websocket: handshake failed: %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		nc.Close()
+		return nil, errors.New("websocket: bad Sec-WebSocket-Accept")
+	}
+	nc.SetDeadline(time.Time{})
+	return &Conn{conn: nc, rd: rd, client: true, limit: limit}, nil
+}
+
+// ReadMessage returns the next text or binary message. Control frames are
+// handled on the way: pings are answered and a close frame is echoed, after
+// which ReadMessage returns ErrClosed for a normal closure or when the
+// peer is going away, and an error carrying the status otherwise.
+func (c *Conn) ReadMessage() (typ int, data []byte, err error) {
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch op {
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			code := CloseNormal
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			c.closeWith(code)
+			c.conn.Close()
+			if code == CloseNormal || code == CloseGoingAway {
+				return 0, nil, ErrClosed
+			}
+			return 0, nil, fmt.Errorf("websocket: closed with status %d", code)
+		case TextMessage, BinaryMessage:
+		default:
+			return 0, nil, c.fail(CloseProtocol, "unexpected opcode")
+		}
+
+		typ, data = op, payload
+		for !fin {
+			fin, op, payload, err = c.readFrame()
+			if err != nil {
+				return 0, nil, err
+			}
+			switch op {
+			case opPing:
+				if err := c.writeFrame(opPong, payload); err != nil {
+					return 0, nil, err
+				}
+				fin = false
+				continue
+			case opPong:
+				fin = false
+				continue
+			case opContinuation:
+			default:
+				return 0, nil, c.fail(CloseProtocol, "unexpected opcode in fragmented message")
+			}
+			if int64(len(data)+len(payload)) > c.limit {
+				return 0, nil, c.fail(CloseMessageTooBig, "message too big")
+			}
+			data = append(data, payload...)
+		}
+		return typ, data, nil
+	}
+}
+
+// readFrame reads one frame and unmasks its payload.
+func (c *Conn) readFrame() (fin bool, op int, payload []byte, err error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.rd, hdr[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin, op = hdr[0]&0x80 != 0, int(hdr[0]&0x0F)
+	if hdr[0]&0x70 != 0 {
+		return false, 0, nil, c.fail(CloseProtocol, "reserved bits set")
+	}
+	masked := hdr[1]&0x80 != 0
+	if masked == c.client {
+		return false, 0, nil, c.fail(CloseProtocol, "bad masking")
+	}
+	n := int64(hdr[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.rd, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.rd, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = int64(binary.BigEndian.Uint64(ext[:]) & (1<<63 - 1))
+	}
+	if op >= opClose && (n > 125 || !fin) {
+		return false, 0, nil, c.fail(CloseProtocol, "bad control frame")
+	}
+	if n > c.limit {
+		return false, 0, nil, c.fail(CloseMessageTooBig, "message too big")
+	}
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.rd, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(c.rd, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i&3]
+		}
+	}
+	return fin, op, payload, nil
+}
+
+// fail closes the connection with a status after a protocol error.
+func (c *Conn) fail(code int, reason string) error {
+	c.closeWith(code)
+	c.conn.Close()
+	return errors.New("websocket: " + reason)
+}
+
+// WriteMessage sends data as one text or binary message.
+func (c *Conn) WriteMessage(typ int, data []byte) error {
+	return c.writeFrame(typ, data)
+}
+
+func (c *Conn) writeFrame(op int, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return ErrClosed
+	}
+	if op == opClose {
+		c.closeSent = true
+	}
+	return c.writeFrameLocked(op, payload)
+}
+
+func (c *Conn) writeFrameLocked(op int, payload []byte) error {
+	hdr := make([]byte, 0, 14)
+	hdr = append(hdr, 0x80|byte(op))
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		hdr = append(hdr, maskBit|byte(n))
+	case n <= 0xFFFF:
+		hdr = append(hdr, maskBit|126)
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(n))
+	default:
+		hdr = append(hdr, maskBit|127)
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(n))
+	}
+	if c.client {
+		var mask [4]byte
+		rand.Read(mask[:])
+		hdr = append(hdr, mask[:]...)
+		masked := make([]byte, len(payload))
+		for i, b := range payload {
+			masked[i] = b ^ mask[i&3]
+		}
+		payload = masked
+	}
+	timeout := c.writeTimeout
+	if timeout == 0 {
+		timeout = writeTimeout
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	bufs := net.Buffers{hdr, payload}
+	_, err := bufs.WriteTo(c.conn)
+	return err
+}
+
+// closeWith sends a close frame with the status unless one was sent.
+func (c *Conn) closeWith(code int) {
+	var payload [2]byte
+	binary.BigEndian.PutUint16(payload[:], uint16(code))
+	c.writeFrame(opClose, payload[:])
+}
+
+// Close sends a normal close frame and closes the connection without
+// waiting for the peer's answer.
+func (c *Conn) Close() error {
+	c.closeWith(CloseNormal)
+	return c.conn.Close()
+}
+
+// CloseWith sends a close frame with the given status and closes the
+// connection.
+func (c *Conn) CloseWith(code int) error {
+	c.closeWith(code)
+	return c.conn.Close()
+}
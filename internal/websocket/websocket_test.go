@@ -0,0 +1,175 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// echoServer echoes every message back until the client closes.
+func echoServer(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := Upgrade(w, r, 1<<20, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			typ, msg, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := c.WriteMessage(typ, msg); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func dialEcho(t *testing.T) *Conn {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := Dial(ctx, echoServer(t), nil, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestEcho(t *testing.T) {
+	c := dialEcho(t)
+	// Sizes around the 7-bit, 16-bit and 64-bit length encodings.
+	for _, n := range []int{0, 125, 126, 65535, 65536, 300000} {
+		msg := bytes.Repeat([]byte{byte(n)}, n)
+		if err := c.WriteMessage(BinaryMessage, msg); err != nil {
+			t.Fatal(err)
+		}
+		typ, got, err := c.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ != BinaryMessage || !bytes.Equal(got, msg) {
+			t.Fatalf("%d bytes: echo of type %d with %d bytes", n, typ, len(got))
+		}
+	}
+}
+
+func TestPingAndClose(t *testing.T) {
+	c := dialEcho(t)
+	if err := c.writeFrame(opPing, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WriteMessage(TextMessage, []byte("after ping")); err != nil {
+		t.Fatal(err)
+	}
+	// The pong is consumed by ReadMessage.
+	typ, msg, err := c.ReadMessage()
+	if err != nil || typ != TextMessage || string(msg) != "after ping" {
+		t.Fatalf("got %d %q %v", typ, msg, err)
+	}
+
+	if err := c.writeFrame(opClose, []byte{0x03, 0xE8}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadMessage(); !errors.Is(err, ErrClosed) {
+		t.Errorf("read after close: %v, want ErrClosed", err)
+	}
+}
+
+func TestMessageLimit(t *testing.T) {
+	c := dialEcho(t)
+	if err := c.WriteMessage(BinaryMessage, make([]byte, 1<<20+1)); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err := c.ReadMessage()
+	if err == nil || errors.Is(err, ErrClosed) {
+		t.Errorf("oversized message: %v, want a close with status", err)
+	}
+}
+
+func TestUpgradeOrigin(t *testing.T) {
+	var allowAll atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var check func(*http.Request) bool
+		if allowAll.Load() {
+			check = func(*http.Request) bool { return true }
+		}
+		if c, err := Upgrade(w, r, 1<<20, check); err == nil {
+			c.Close()
+		}
+	}))
+	defer srv.Close()
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	dial := func(origin string) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		c, err := Dial(ctx, wsURL, header, 1<<20)
+		if err == nil {
+			c.Close()
+		}
+		return err
+	}
+
+	// Clients that are not browsers send no Origin.
+	for _, origin := range []string{"", srv.URL} {
+		if err := dial(origin); err != nil {
+			t.Errorf("origin %q: %v", origin, err)
+		}
+	}
+	for _, origin := range []string{"http://evil.example", "http://" + srv.Listener.Addr().String() + ".evil.example", "::"} {
+		if err := dial(origin); err == nil || !strings.Contains(err.Error(), "403") {
+			t.Errorf("origin %q: %v, want 403 Forbidden", origin, err)
+		}
+	}
+
+	allowAll.Store(true)
+	if err := dial("http://evil.example"); err != nil {
+		t.Errorf("with a permissive check: %v", err)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	// The peer never reads, so the pipe blocks every write.
+	server, client := net.Pipe()
+	defer client.Close()
+	c := &Conn{conn: server, rd: bufio.NewReader(server), limit: 1 << 20, writeTimeout: 50 * time.Millisecond}
+
+	start := time.Now()
+	err := c.WriteMessage(BinaryMessage, []byte("frame"))
+	var nerr net.Error
+	if !errors.As(err, &nerr) || !nerr.Timeout() {
+		t.Fatalf("write to a stalled peer: %v, want a timeout", err)
+	}
+	// Close is not held up by the stalled peer either.
+	done := make(chan struct{})
+	go func() {
+		c.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close blocked on the stalled peer")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("took %v", elapsed)
+	}
+}
@@ -0,0 +1,126 @@
+package gocam
+
+import (
+	"bytes"
+	"image/jpeg"
+)
+
+// MJPEG cameras commonly leave out the Huffman tables and rely on the
+// defaults of the AVI MJPEG format, which are the example tables of ITU-T
+// T.81 Annex K.3. image/jpeg and most image tools insist on them.
+
+// defaultDHT is a DHT segment holding the four standard tables.
+var defaultDHT = func() []byte {
+	tables := []struct {
+		class  byte // 0x00 DC luma, 0x01 DC chroma, 0x10 AC luma, 0x11 AC chroma
+		counts [16]byte
+		values []byte
+	}{
+		{0x00, [16]byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+			[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}},
+		{0x01, [16]byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+			[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}},
+		{0x10, [16]byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 0x7d}, []byte{
+			0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12, 0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+			0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08, 0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+			0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16, 0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+			0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+			0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+			0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79, 0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+			0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+			0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+			0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+			0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea, 0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		}},
+		{0x11, [16]byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 0x77}, []byte{
+			0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21, 0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+			0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91, 0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+			0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34, 0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+			0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38, 0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+			0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+			0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+			0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+			0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+			0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+			0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		}},
+	}
+
+	seg := []byte{0xFF, 0xC4, 0, 0}
+	for _, t := range tables {
+		seg = append(seg, t.class)
+		seg = append(seg, t.counts[:]...)
+		seg = append(seg, t.values...)
+	}
+	n := len(seg) - 2
+	seg[2], seg[3] = byte(n>>8), byte(n)
+	return seg
+}()
+
+// completeJPEG returns a copy of the JPEG image at the start of src, with
+// the default Huffman tables inserted before the first scan if it has none
+// and anything after the end-of-image marker dropped. Data that does not
+// look like a JPEG image is copied unchanged.
+func completeJPEG(src []byte) []byte {
+	if len(src) < 4 || src[0] != 0xFF || src[1] != 0xD8 {
+		return append([]byte(nil), src...)
+	}
+	// Walk the marker segments up to the first scan.
+	i := 2
+	for i+4 <= len(src) {
+		if src[i] != 0xFF {
+			break
+		}
+		m := src[i+1]
+		if m == 0xFF {
+			i++ // fill byte
+			continue
+		}
+		if m == 0xC4 {
+			return append([]byte(nil), trimJPEG(src, i)...)
+		}
+		if m == 0xDA {
+			src = trimJPEG(src, i)
+			out := make([]byte, 0, len(src)+len(defaultDHT))
+			out = append(out, src[:i]...)
+			out = append(out, defaultDHT...)
+			return append(out, src[i:]...)
+		}
+		i += 2 + (int(src[i+2])<<8 | int(src[i+3]))
+	}
+	return append([]byte(nil), src...)
+}
+
+// trimJPEG drops padding after the last end-of-image marker at or after
+// from, which drivers leave in buffers whose payload size they round up.
+func trimJPEG(src []byte, from int) []byte {
+	if end := bytes.LastIndex(src[from:], []byte{0xFF, 0xD9}); end >= 0 {
+		return src[:from+end+2]
+	}
+	return src
+}
+
+// decodeJPEG444 decodes a JPEG image of the given size into a packed
+// YCbCr444 buffer. It returns nil for corrupt images and other sizes.
+func decodeJPEG444(jpg []byte, width, height int) []byte {
+	img, err := jpeg.Decode(bytes.NewReader(jpg))
+	if err != nil {
+		return nil
+	}
+	data, w, h := imageToYCbCr444(img)
+	if w != width || h != height {
+		return nil
+	}
+	return data
+}
+
+// jpegSize returns the dimensions from the frame header of a JPEG image.
+func jpegSize(jpg []byte) (width, height int, ok bool) {
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(jpg))
+	if err != nil {
+		return 0, 0, false
+	}
+	return cfg.Width, cfg.Height, true
+}
@@ -0,0 +1,59 @@
+package gocam
+
+import (
+	"bytes"
+	"testing"
+)
+
+// stripDHT removes the Huffman table segments of a JPEG image, as MJPEG
+// cameras do.
+func stripDHT(jpg []byte) []byte {
+	out := append([]byte(nil), jpg[:2]...)
+	i := 2
+	for i+4 <= len(jpg) && jpg[i] == 0xFF && jpg[i+1] != 0xDA {
+		n := 2 + (int(jpg[i+2])<<8 | int(jpg[i+3]))
+		if jpg[i+1] != 0xC4 {
+			out = append(out, jpg[i:i+n]...)
+		}
+		i += n
+	}
+	return append(out, jpg[i:]...)
+}
+
+func TestCompleteJPEG(t *testing.T) {
+	var buf bytes.Buffer
+	if err := EncodeJPEG(&buf, colorFrame(24, 16), 80); err != nil {
+		t.Fatal(err)
+	}
+	full := buf.Bytes()
+	want := decodeJPEG444(full, 24, 16)
+	if want == nil {
+		t.Fatal("cannot decode the reference image")
+	}
+
+	bare := stripDHT(full)
+	if len(bare) >= len(full) {
+		t.Fatal("no Huffman tables stripped")
+	}
+	if decodeJPEG444(bare, 24, 16) != nil {
+		t.Fatal("image without Huffman tables decoded")
+	}
+	// image/jpeg uses the standard tables, so the restored image decodes
+	// identically.
+	padded := append(append([]byte(nil), bare...), 0, 0, 0, 0)
+	fixed := completeJPEG(padded)
+	if got := decodeJPEG444(fixed, 24, 16); !bytes.Equal(got, want) {
+		t.Fatal("restored image decodes differently")
+	}
+	if !bytes.HasSuffix(fixed, []byte{0xFF, 0xD9}) {
+		t.Error("padding after EOI kept")
+	}
+
+	// Complete images are copied unchanged.
+	if got := completeJPEG(full); !bytes.Equal(got, full) || &got[0] == &full[0] {
+		t.Error("complete image not copied unchanged")
+	}
+	if w, h, ok := jpegSize(bare); !ok || w != 24 || h != 16 {
+		t.Errorf("jpegSize = %d, %d, %v", w, h, ok)
+	}
+}
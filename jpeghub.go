@@ -0,0 +1,184 @@
+package gocam
+
+import (
+	"sync"
+	"time"
+)
+
+// jpegImage is an encoded frame handed to network clients.
+type jpegImage struct {
+	data []byte
+	time time.Time
+}
+
+// jpegHub encodes the frames of one channel for any number of network
+// clients. Each frame is encoded once, and only while somebody is
+// subscribed. Stream subscribers hold just the latest image, so a slow
+// client skips frames without holding back the others or the capture;
+// one-shot subscribers receive the next image regardless of the rate cap.
+type jpegHub struct {
+	quality  int
+	interval time.Duration
+	// width and height scale the frames, as in MJPEGOptions.
+	width, height int
+	// align rounds the encoded size down to a multiple of it.
+	align int
+	// passThrough reports whether a camera JPEG may be sent as it is; nil
+	// accepts all of them.
+	passThrough func(jpg []byte) bool
+
+	mu      sync.Mutex
+	streams map[chan jpegImage]struct{}
+	once    map[chan jpegImage]struct{}
+	done    chan struct{}
+	closed  bool
+}
+
+func newJPEGHub(quality int, maxFPS float64, width, height int) *jpegHub {
+	h := &jpegHub{
+		quality: quality,
+		width:   width,
+		height:  height,
+		align:   1,
+		streams: make(map[chan jpegImage]struct{}),
+		once:    make(map[chan jpegImage]struct{}),
+		done:    make(chan struct{}),
+	}
+	if maxFPS > 0 {
+		h.interval = time.Duration(float64(time.Second) / maxFPS)
+	}
+	return h
+}
+
+// run distributes the frames until the channel closes, then closes the
+// subscriber channels.
+func (h *jpegHub) run(frames <-chan Frame) {
+	var last time.Time
+	for frame := range frames {
+		now := time.Now()
+		due := h.interval == 0 || last.IsZero() || now.Sub(last) >= h.interval
+
+		h.mu.Lock()
+		watched := due && len(h.streams) > 0 || len(h.once) > 0
+		h.mu.Unlock()
+		if !watched {
+			frame.Release()
+			continue
+		}
+
+		jpg, err := h.encode(frame)
+		frame.Release()
+		if err != nil {
+			continue
+		}
+		img := jpegImage{data: jpg, time: frame.Timestamp}
+		if img.time.IsZero() {
+			img.time = now
+		}
+
+		h.mu.Lock()
+		if due && len(h.streams) > 0 {
+			for ch := range h.streams {
+				sendLatest(ch, img)
+			}
+			last = now
+		}
+		for ch := range h.once {
+			ch <- img
+			delete(h.once, ch)
+		}
+		h.mu.Unlock()
+	}
+
+	h.mu.Lock()
+	h.closed = true
+	for ch := range h.streams {
+		close(ch)
+	}
+	for ch := range h.once {
+		close(ch)
+		delete(h.once, ch)
+	}
+	h.mu.Unlock()
+	close(h.done)
+}
+
+// sendLatest replaces the image waiting in ch, if any, with img. Only the
+// distributing goroutine sends, so the second send cannot block.
+func sendLatest(ch chan jpegImage, img jpegImage) {
+	select {
+	case ch <- img:
+	default:
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- img
+	}
+}
+
+// encode returns the JPEG image sent for frame.
+func (h *jpegHub) encode(frame Frame) ([]byte, error) {
+	w, ht := h.width, h.height
+	if w <= 0 && ht <= 0 && frame.JPEG != nil && (h.passThrough == nil || h.passThrough(frame.JPEG)) {
+		return frame.JPEG, nil
+	}
+	if err := checkFrame(frame); err != nil {
+		return nil, err
+	}
+	switch {
+	case w <= 0 && ht <= 0:
+		w, ht = frame.Width, frame.Height
+	case w <= 0:
+		w = max(1, frame.Width*ht/frame.Height)
+	case ht <= 0:
+		ht = max(1, frame.Height*w/frame.Width)
+	}
+	if h.align > 1 {
+		w, ht = max(h.align, w/h.align*h.align), max(h.align, ht/h.align*h.align)
+	}
+	if w != frame.Width || ht != frame.Height {
+		frame = Frame{
+			Data:   scaleYCbCr444Fill(frame.Data, frame.Width, frame.Height, w, ht),
+			Width:  w,
+			Height: ht,
+		}
+	}
+	var buf jpegBuffer
+	if err := EncodeJPEG(&buf, frame, h.quality); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// subscribe registers a channel for the following images, or for the next
+// one only, and returns nil once the frame channel has closed.
+func (h *jpegHub) subscribe(once bool) chan jpegImage {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil
+	}
+	ch := make(chan jpegImage, 1)
+	if once {
+		h.once[ch] = struct{}{}
+	} else {
+		h.streams[ch] = struct{}{}
+	}
+	return ch
+}
+
+// unsubscribe removes ch unless the hub already has.
+func (h *jpegHub) unsubscribe(ch chan jpegImage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.streams, ch)
+	delete(h.once, ch)
+}
+
+// subscribers returns the number of stream subscribers.
+func (h *jpegHub) subscribers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.streams)
+}
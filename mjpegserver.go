@@ -0,0 +1,159 @@
+package gocam
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// mjpegBoundary separates the parts of the multipart stream.
+const mjpegBoundary = "gocamframe"
+
+// DefaultSnapshotTimeout is used when MJPEGOptions.SnapshotTimeout is zero.
+const DefaultSnapshotTimeout = 5 * time.Second
+
+// MJPEGOptions configures an MJPEGServer. The zero value (or a nil pointer)
+// streams every frame at its own size with DefaultJPEGQuality.
+type MJPEGOptions struct {
+	// Quality is the JPEG quality (1-100) of frames encoded from Data;
+	// zero means DefaultJPEGQuality.
+	Quality int
+	// MaxFPS caps the rate sent to viewers; frames arriving sooner are
+	// skipped. Zero sends every frame.
+	MaxFPS float64
+	// Width and Height scale the frames, cropping centrally to keep the
+	// aspect ratio. A zero dimension follows the other one; both zero
+	// keep the frame size.
+	Width, Height int
+	// SnapshotTimeout bounds how long a snapshot request waits for the
+	// next frame; zero means DefaultSnapshotTimeout.
+	SnapshotTimeout time.Duration
+}
+
+// MJPEGServer shares one frame channel with any number of browsers. It
+// serves the frames as a multipart/x-mixed-replace JPEG stream, which
+// browsers show in an <img> element, and single images through
+// SnapshotHandler.
+//
+// Each frame is encoded once for all viewers. Every viewer holds only the
+// latest image, so a slow connection skips frames without holding back the
+// others or the capture. Frames carrying the camera's image in Frame.JPEG
+// are sent without re-encoding unless scaling is configured. Frames are
+// released once handled; nothing is encoded while nobody is watching.
+type MJPEGServer struct {
+	opts MJPEGOptions
+	hub  *jpegHub
+}
+
+// NewMJPEGServer starts serving frames from the channel, such as
+// Stream.Frames. The server stops when the channel closes: open streams
+// end and new requests get 503 Service Unavailable.
+func NewMJPEGServer(frames <-chan Frame, opts *MJPEGOptions) *MJPEGServer {
+	s := &MJPEGServer{}
+	if opts != nil {
+		s.opts = *opts
+	}
+	if s.opts.SnapshotTimeout <= 0 {
+		s.opts.SnapshotTimeout = DefaultSnapshotTimeout
+	}
+	s.hub = newJPEGHub(s.opts.Quality, s.opts.MaxFPS, s.opts.Width, s.opts.Height)
+	go s.hub.run(frames)
+	return s
+}
+
+// Viewers returns the number of connected stream clients.
+func (s *MJPEGServer) Viewers() int {
+	return s.hub.subscribers()
+}
+
+// Done is closed when the frame channel has closed and all clients have
+// been told.
+func (s *MJPEGServer) Done() <-chan struct{} {
+	return s.hub.done
+}
+
+// ServeHTTP streams the frames as multipart/x-mixed-replace JPEG until the
+// client disconnects or the frame channel closes.
+func (s *MJPEGServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ch := s.hub.subscribe(false)
+	if ch == nil {
+		http.Error(w, "stream ended", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.hub.unsubscribe(ch)
+
+	h := w.Header()
+	h.Set("Content-Type", "multipart/x-mixed-replace; boundary="+mjpegBoundary)
+	h.Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	h.Set("Pragma", "no-cache")
+	h.Set("Connection", "close")
+	w.WriteHeader(http.StatusOK)
+	// Send the headers now so the client does not wait for the first frame.
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case img, ok := <-ch:
+			if !ok {
+				return
+			}
+			jpg := img.data
+			if _, err := fmt.Fprintf(w, "--%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", mjpegBoundary, len(jpg)); err != nil {
+				return
+			}
+			if _, err := w.Write(jpg); err != nil {
+				return
+			}
+			if _, err := w.Write([]byte("\r\n")); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+				return
+			}
+		}
+	}
+}
+
+// SnapshotHandler returns a handler that answers with the next frame as a
+// single JPEG image, like CaptureSingleFrame but on the shared stream. It
+// responds 504 Gateway Timeout when no frame arrives within
+// MJPEGOptions.SnapshotTimeout and 503 Service Unavailable once the frame
+// channel has closed. Snapshots ignore MaxFPS.
+func (s *MJPEGServer) SnapshotHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ch := s.hub.subscribe(true)
+		if ch == nil {
+			http.Error(w, "stream ended", http.StatusServiceUnavailable)
+			return
+		}
+		defer s.hub.unsubscribe(ch)
+
+		timer := time.NewTimer(s.opts.SnapshotTimeout)
+		defer timer.Stop()
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-timer.C:
+			http.Error(w, "capture timeout", http.StatusGatewayTimeout)
+		case img, ok := <-ch:
+			if !ok {
+				http.Error(w, "stream ended", http.StatusServiceUnavailable)
+				return
+			}
+			jpg := img.data
+			h := w.Header()
+			h.Set("Content-Type", "image/jpeg")
+			h.Set("Content-Length", strconv.Itoa(len(jpg)))
+			h.Set("Cache-Control", "no-cache, no-store, must-revalidate")
+			w.Write(jpg)
+		}
+	})
+}
@@ -0,0 +1,194 @@
+package gocam
+
+import (
+	"bytes"
+	"image/jpeg"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// feedUntil sends frame to the server repeatedly until done is closed.
+func feedUntil(t *testing.T, frames chan<- Frame, frame Frame, done <-chan struct{}) {
+	t.Helper()
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case <-done:
+			return
+		case frames <- frame:
+			time.Sleep(time.Millisecond)
+		case <-deadline:
+			t.Fatal("timed out feeding frames")
+		}
+	}
+}
+
+// firstPart opens the stream at url and returns a channel that receives
+// its first JPEG part.
+func firstPart(t *testing.T, url string) <-chan []byte {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/x-mixed-replace" {
+		t.Fatalf("Content-Type %q", resp.Header.Get("Content-Type"))
+	}
+
+	part := make(chan []byte, 1)
+	go func() {
+		defer close(part)
+		p, err := multipart.NewReader(resp.Body, params["boundary"]).NextPart()
+		if err != nil || p.Header.Get("Content-Type") != "image/jpeg" {
+			return
+		}
+		if b, err := io.ReadAll(p); err == nil {
+			part <- b
+		}
+	}()
+	return part
+}
+
+func TestMJPEGServerStream(t *testing.T) {
+	frames := make(chan Frame)
+	s := NewMJPEGServer(frames, &MJPEGOptions{Width: 8, Quality: 80})
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	// Ending the stream first lets the server shut down.
+	defer close(frames)
+
+	// The first viewer never reads; it must not hold back the others.
+	stalled, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Body.Close()
+	parts := []<-chan []byte{firstPart(t, srv.URL), firstPart(t, srv.URL)}
+
+	var images [][]byte
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, part := range parts {
+			if jpg, ok := <-part; ok {
+				images = append(images, jpg)
+			}
+		}
+	}()
+	feedUntil(t, frames, colorFrame(16, 8), done)
+
+	if len(images) != 2 {
+		t.Fatalf("%d viewers got a frame, want 2", len(images))
+	}
+	for _, jpg := range images {
+		img, err := jpeg.Decode(bytes.NewReader(jpg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b := img.Bounds(); b.Dx() != 8 || b.Dy() != 4 {
+			t.Errorf("image is %dx%d, want 8x4", b.Dx(), b.Dy())
+		}
+	}
+	if n := s.Viewers(); n != 3 {
+		t.Errorf("Viewers() = %d, want 3", n)
+	}
+}
+
+func TestMJPEGServerSnapshot(t *testing.T) {
+	frames := make(chan Frame)
+	defer close(frames)
+	srv := httptest.NewServer(NewMJPEGServer(frames, nil).SnapshotHandler())
+	defer srv.Close()
+
+	// Camera images are passed through unchanged.
+	frame := colorFrame(16, 8)
+	var buf bytes.Buffer
+	if err := EncodeJPEG(&buf, frame, 50); err != nil {
+		t.Fatal(err)
+	}
+	frame.JPEG = buf.Bytes()
+
+	var body []byte
+	var resp *http.Response
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var err error
+		resp, err = http.Get(srv.URL)
+		if err != nil {
+			return
+		}
+		defer resp.Body.Close()
+		body, _ = io.ReadAll(resp.Body)
+	}()
+	feedUntil(t, frames, frame, done)
+
+	if resp == nil {
+		t.Fatal("request failed")
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("status %d, Content-Type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if !bytes.Equal(body, frame.JPEG) {
+		t.Error("snapshot is not the camera image")
+	}
+}
+
+func TestMJPEGServerSnapshotErrors(t *testing.T) {
+	frames := make(chan Frame)
+	s := NewMJPEGServer(frames, &MJPEGOptions{SnapshotTimeout: 20 * time.Millisecond})
+	srv := httptest.NewServer(s.SnapshotHandler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("status %d without frames, want %d", resp.StatusCode, http.StatusGatewayTimeout)
+	}
+
+	close(frames)
+	<-s.Done()
+	resp, err = http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status %d after the stream ended, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+}
+
+func TestMJPEGServerMaxFPS(t *testing.T) {
+	frames := make(chan Frame)
+	s := NewMJPEGServer(frames, &MJPEGOptions{MaxFPS: 1})
+	viewer := s.hub.subscribe(false)
+
+	// A send completes once the previous frame has been handled.
+	n := 0
+	for i := 0; i < 5; i++ {
+		frames <- colorFrame(4, 4)
+		select {
+		case <-viewer:
+			n++
+		default:
+		}
+	}
+	close(frames)
+	<-s.Done()
+	for range viewer {
+		n++
+	}
+	if n != 1 {
+		t.Errorf("%d images sent within a second at MaxFPS 1, want 1", n)
+	}
+}
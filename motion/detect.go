@@ -0,0 +1,251 @@
+package motion
+
+import (
+	"image"
+	"image/color"
+	"sort"
+)
+
+// analysis holds the per-size state of a Detector: the downscaled luma,
+// the background and the masks, all on a grid of aw x ah cells, each
+// covering scale x scale frame pixels.
+type analysis struct {
+	w, h   int // frame size
+	scale  int
+	aw, ah int
+
+	y       []float32
+	bg      []float32
+	allowed []bool // nil when the whole frame is watched
+	watched int    // allowed cells
+	changed []bool
+	tmp     []bool
+
+	labels []int32 // component of each changed cell, from 1
+	kept   []bool  // per component, whether it passed the area filter
+	stack  []int
+
+	cols, rows int // detection grid
+}
+
+// resize prepares the analysis for frames of w x h and reports whether the
+// size changed, which discards the background.
+func (a *analysis) resize(w, h int, o *Options) bool {
+	if w == a.w && h == a.h {
+		return false
+	}
+	a.w, a.h = w, h
+	a.scale = (w + o.MaxWidth - 1) / o.MaxWidth
+	a.aw, a.ah = max(1, w/a.scale), max(1, h/a.scale)
+	n := a.aw * a.ah
+	a.y = make([]float32, n)
+	a.bg = make([]float32, n)
+	a.changed = make([]bool, n)
+	a.tmp = make([]bool, n)
+	a.labels = make([]int32, n)
+	a.cols, a.rows = o.Grid.Cols, o.Grid.Rows
+	if a.cols <= 0 || a.rows <= 0 {
+		a.cols, a.rows = 0, 0
+	}
+
+	a.allowed, a.watched = nil, n
+	var cells []bool
+	if a.cols > 0 && o.Grid.Enabled != nil {
+		cells = make([]bool, a.cols*a.rows)
+		for _, c := range o.Grid.Enabled {
+			if c >= 0 && c < len(cells) {
+				cells[c] = true
+			}
+		}
+	}
+	if o.Mask == nil && cells == nil {
+		return true
+	}
+	a.allowed = make([]bool, n)
+	a.watched = 0
+	for i := range a.allowed {
+		// Judge each cell by the frame pixel at its center.
+		fx, fy := a.center(i)
+		ok := cells == nil || cells[a.cell(fx, fy)]
+		if ok && o.Mask != nil {
+			b := o.Mask.Bounds()
+			mx := b.Min.X + fx*b.Dx()/w
+			my := b.Min.Y + fy*b.Dy()/h
+			ok = color.GrayModel.Convert(o.Mask.At(mx, my)).(color.Gray).Y >= 128
+		}
+		a.allowed[i] = ok
+		if ok {
+			a.watched++
+		}
+	}
+	return true
+}
+
+// center returns the frame pixel at the center of analysis cell i.
+func (a *analysis) center(i int) (x, y int) {
+	return min(a.w-1, i%a.aw*a.scale+a.scale/2), min(a.h-1, i/a.aw*a.scale+a.scale/2)
+}
+
+// cell returns the grid cell holding frame pixel (x, y).
+func (a *analysis) cell(x, y int) int {
+	return y*a.rows/a.h*a.cols + x*a.cols/a.w
+}
+
+// luma averages the Y samples of the packed YCbCr444 frame over each
+// scale x scale block, clipped to the frame.
+func (a *analysis) luma(data []byte) {
+	s := a.scale
+	for ay := 0; ay < a.ah; ay++ {
+		for ax := 0; ax < a.aw; ax++ {
+			sum, n := 0, 0
+			for y := ay * s; y < min(ay*s+s, a.h); y++ {
+				row := data[(y*a.w+ax*s)*3:]
+				for x := 0; x < min(s, a.w-ax*s); x++ {
+					sum += int(row[x*3])
+					n++
+				}
+			}
+			a.y[ay*a.aw+ax] = float32(sum) / float32(n)
+		}
+	}
+}
+
+func (a *analysis) initBackground() {
+	copy(a.bg, a.y)
+}
+
+// diff marks the watched cells that differ from the background by more
+// than threshold.
+func (a *analysis) diff(threshold int) {
+	th := float32(threshold)
+	for i, v := range a.y {
+		d := v - a.bg[i]
+		a.changed[i] = (d > th || d < -th) && (a.allowed == nil || a.allowed[i])
+	}
+}
+
+// update moves the background towards the current frame.
+func (a *analysis) update(o *Options) {
+	if o.Background == Median {
+		for i, v := range a.y {
+			switch {
+			case v > a.bg[i]+0.5:
+				a.bg[i]++
+			case v < a.bg[i]-0.5:
+				a.bg[i]--
+			}
+		}
+		return
+	}
+	rate := float32(o.LearningRate)
+	for i, v := range a.y {
+		a.bg[i] += rate * (v - a.bg[i])
+	}
+}
+
+// open erodes the changed cells n times and dilates them n times with a
+// 3x3 square, removing specks smaller than the square while keeping the
+// shape of larger areas. Neighbors outside the grid are ignored.
+func (a *analysis) open(n int) {
+	for i := 0; i < n; i++ {
+		a.morph(false)
+	}
+	for i := 0; i < n; i++ {
+		a.morph(true)
+	}
+	if a.allowed != nil && n > 0 {
+		for i, ok := range a.allowed {
+			a.changed[i] = a.changed[i] && ok
+		}
+	}
+}
+
+// morph dilates the changed cells, or erodes them.
+func (a *analysis) morph(dilate bool) {
+	for y := 0; y < a.ah; y++ {
+		for x := 0; x < a.aw; x++ {
+			v := !dilate
+			for ny := max(0, y-1); ny <= min(a.ah-1, y+1); ny++ {
+				for nx := max(0, x-1); nx <= min(a.aw-1, x+1); nx++ {
+					if a.changed[ny*a.aw+nx] == dilate {
+						v = dilate
+					}
+				}
+			}
+			a.tmp[y*a.aw+x] = v
+		}
+	}
+	a.changed, a.tmp = a.tmp, a.changed
+}
+
+// regions groups the changed cells into 8-connected regions and returns
+// those of at least minArea frame pixels, largest first, with the changed
+// fraction of the watched area they make up.
+func (a *analysis) regions(minArea int) ([]Region, float64) {
+	clear(a.labels)
+	a.kept = a.kept[:0]
+	a.kept = append(a.kept, false) // label 0: unchanged
+	var regions []Region
+	total := 0
+	for start, c := range a.changed {
+		if !c || a.labels[start] != 0 {
+			continue
+		}
+		label := int32(len(a.kept))
+		a.labels[start] = label
+		a.stack = append(a.stack[:0], start)
+		count := 0
+		x0, y0, x1, y1 := a.aw, a.ah, -1, -1
+		for len(a.stack) > 0 {
+			i := a.stack[len(a.stack)-1]
+			a.stack = a.stack[:len(a.stack)-1]
+			count++
+			x, y := i%a.aw, i/a.aw
+			x0, y0, x1, y1 = min(x0, x), min(y0, y), max(x1, x), max(y1, y)
+			for ny := max(0, y-1); ny <= min(a.ah-1, y+1); ny++ {
+				for nx := max(0, x-1); nx <= min(a.aw-1, x+1); nx++ {
+					if j := ny*a.aw + nx; a.changed[j] && a.labels[j] == 0 {
+						a.labels[j] = label
+						a.stack = append(a.stack, j)
+					}
+				}
+			}
+		}
+
+		area := count * a.scale * a.scale
+		keep := area >= minArea
+		a.kept = append(a.kept, keep)
+		if !keep {
+			continue
+		}
+		total += count
+		r := image.Rect(x0*a.scale, y0*a.scale, (x1+1)*a.scale, (y1+1)*a.scale)
+		regions = append(regions, Region{Bounds: r.Intersect(image.Rect(0, 0, a.w, a.h)), Area: area})
+	}
+	sort.SliceStable(regions, func(i, j int) bool { return regions[i].Area > regions[j].Area })
+	if a.watched == 0 {
+		return regions, 0
+	}
+	return regions, float64(total) / float64(a.watched)
+}
+
+// cells returns the grid cells holding cells of the kept regions of the
+// last call to regions, in increasing order, or nil without a grid.
+func (a *analysis) cells(regions []Region) []int {
+	if a.cols == 0 || len(regions) == 0 {
+		return nil
+	}
+	hit := make([]bool, a.cols*a.rows)
+	for i, l := range a.labels {
+		if l != 0 && a.kept[l] {
+			hit[a.cell(a.center(i))] = true
+		}
+	}
+	var cells []int
+	for c, ok := range hit {
+		if ok {
+			cells = append(cells, c)
+		}
+	}
+	return cells
+}
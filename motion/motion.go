@@ -0,0 +1,308 @@
+// Package motion detects activity in a stream of gocam frames.
+//
+// A Detector compares the luma of each frame with a background model, a
+// running average or an approximate running median, on a downscaled
+// grid. Pixels that differ by more than a threshold are cleaned up with a
+// morphological opening and grouped into regions; regions smaller than a
+// minimum area are ignored. Masks and detection grids restrict where
+// motion counts. The detector reports a MotionStart event when motion
+// appears and a MotionEnd event once it has been absent for a while:
+//
+//	det := motion.NewDetector(&motion.Options{Threshold: 20})
+//	for ev := range det.Watch(ctx, stream.Frames()) {
+//		log.Println(ev.Type, ev.Score, ev.Regions)
+//	}
+package motion
+
+import (
+	"context"
+	"errors"
+	"image"
+	"time"
+
+	gocam "github.com/svanichkin/gocam"
+)
+
+// Background selects the background model.
+type Background int
+
+const (
+	// RunningAverage blends every frame into the background with weight
+	// Options.LearningRate. It adapts quickly to lighting changes.
+	RunningAverage Background = iota
+	// Median moves the background one luma level towards every frame, an
+	// approximate running median. It ignores brief passers-by better and
+	// adapts slowly.
+	Median
+)
+
+func (b Background) String() string {
+	switch b {
+	case RunningAverage:
+		return "running average"
+	case Median:
+		return "median"
+	}
+	return "unknown"
+}
+
+// Defaults used for zero Options fields.
+const (
+	DefaultLearningRate = 0.05
+	DefaultThreshold    = 25
+	DefaultMaxWidth     = 320
+	DefaultHold         = time.Second
+	DefaultWarmup       = 10
+	// DefaultMinArea is the minimum region area as a fraction of the frame.
+	DefaultMinArea = 0.002
+)
+
+// Options configures a Detector. The zero value (or a nil pointer) uses
+// the defaults above on the whole frame.
+type Options struct {
+	Background Background
+	// LearningRate is the weight of each frame in a RunningAverage
+	// background, between 0 and 1.
+	LearningRate float64
+	// Threshold is the luma difference from the background, 1 to 255,
+	// above which a pixel counts as changed. Raise it for noisy sensors.
+	Threshold int
+	// MaxWidth bounds the width of the analysis grid: frames are
+	// downscaled by averaging blocks of pixels until they fit, which also
+	// averages out sensor noise.
+	MaxWidth int
+	// Open is the number of 3x3 erosions, then dilations, applied to the
+	// changed pixels to drop speckles. Zero means 1; negative disables it.
+	Open int
+	// MinArea is the smallest region that counts, in frame pixels. Zero
+	// means DefaultMinArea of the frame.
+	MinArea int
+	// Mask limits detection to where it is at least half bright, such as
+	// an image.Gray painted white over a doorway. It is scaled to the
+	// frame. Nil allows the whole frame.
+	Mask image.Image
+	// Grid divides the frame into Cols x Rows cells for detection zones;
+	// see Grid.
+	Grid Grid
+	// Hold is how long motion must be absent before MotionEnd.
+	Hold time.Duration
+	// Warmup is the number of frames used to learn the background before
+	// motion is reported. Zero means DefaultWarmup; negative disables it.
+	Warmup int
+}
+
+// Grid is a detection grid. Cells are numbered row by row from the top
+// left. If Enabled is set, motion counts only in the listed cells; events
+// report the cells their regions touch.
+type Grid struct {
+	Cols, Rows int
+	Enabled    []int
+}
+
+// EventType tells whether motion starts or ends.
+type EventType int
+
+const (
+	MotionStart EventType = iota
+	MotionEnd
+)
+
+func (t EventType) String() string {
+	switch t {
+	case MotionStart:
+		return "start"
+	case MotionEnd:
+		return "end"
+	}
+	return "unknown"
+}
+
+// Region is a connected area of change.
+type Region struct {
+	// Bounds is the bounding box in frame coordinates.
+	Bounds image.Rectangle
+	// Area is the number of changed frame pixels.
+	Area int
+}
+
+// MotionEvent reports the start or the end of motion.
+type MotionEvent struct {
+	Type EventType
+	// Regions are the areas of change in the frame that started the
+	// motion, largest first. They are nil for MotionEnd.
+	Regions []Region
+	// Cells are the grid cells touched by Regions, if a grid is set.
+	Cells []int
+	// Score is the changed fraction of the watched area, 0 to 1: in the
+	// starting frame for MotionStart and the peak over the motion for
+	// MotionEnd.
+	Score float64
+	// Timestamp is the time of the starting frame for MotionStart and of
+	// the last frame with motion for MotionEnd.
+	Timestamp time.Time
+	// Sequence is the sequence number of that frame.
+	Sequence uint64
+}
+
+// Detector finds motion in consecutive frames of one stream. Its methods
+// must not be called concurrently.
+type Detector struct {
+	opts Options
+
+	a      analysis
+	frames int
+
+	active  bool
+	peak    float64
+	last    time.Time // last frame with motion
+	lastSeq uint64
+	score   float64
+	regions []Region
+}
+
+// NewDetector returns a detector. opts may be nil.
+func NewDetector(opts *Options) *Detector {
+	d := &Detector{}
+	if opts != nil {
+		d.opts = *opts
+	}
+	o := &d.opts
+	if o.LearningRate <= 0 || o.LearningRate > 1 {
+		o.LearningRate = DefaultLearningRate
+	}
+	if o.Threshold <= 0 {
+		o.Threshold = DefaultThreshold
+	}
+	if o.MaxWidth <= 0 {
+		o.MaxWidth = DefaultMaxWidth
+	}
+	if o.Open == 0 {
+		o.Open = 1
+	}
+	if o.Hold <= 0 {
+		o.Hold = DefaultHold
+	}
+	if o.Warmup == 0 {
+		o.Warmup = DefaultWarmup
+	}
+	return d
+}
+
+// Process analyzes a frame and returns the event it causes, if any. The
+// frame is not retained or released. A frame of another size restarts the
+// background model.
+func (d *Detector) Process(frame gocam.Frame) (MotionEvent, bool, error) {
+	if frame.Width <= 0 || frame.Height <= 0 || len(frame.Data) < frame.Width*frame.Height*3 {
+		return MotionEvent{}, false, errors.New("motion: invalid frame")
+	}
+	t := frame.Timestamp
+	if t.IsZero() {
+		t = time.Now()
+	}
+	if d.a.resize(frame.Width, frame.Height, &d.opts) {
+		d.frames = 0
+	}
+	d.a.luma(frame.Data)
+	d.frames++
+	if d.frames == 1 {
+		d.a.initBackground()
+		return d.quiet(t)
+	}
+	d.a.diff(d.opts.Threshold)
+	d.a.update(&d.opts)
+	if d.opts.Warmup > 0 && d.frames <= d.opts.Warmup {
+		return d.quiet(t)
+	}
+
+	d.a.open(d.opts.Open)
+	d.regions, d.score = d.a.regions(d.minArea(frame.Width, frame.Height))
+	if len(d.regions) == 0 {
+		return d.quiet(t)
+	}
+
+	d.last, d.lastSeq = t, frame.Sequence
+	if d.active {
+		d.peak = max(d.peak, d.score)
+		return MotionEvent{}, false, nil
+	}
+	d.active, d.peak = true, d.score
+	return MotionEvent{
+		Type:      MotionStart,
+		Regions:   append([]Region(nil), d.regions...),
+		Cells:     d.a.cells(d.regions),
+		Score:     d.score,
+		Timestamp: t,
+		Sequence:  frame.Sequence,
+	}, true, nil
+}
+
+// quiet handles a frame without motion at time t.
+func (d *Detector) quiet(t time.Time) (MotionEvent, bool, error) {
+	d.regions, d.score = nil, 0
+	if !d.active || t.Sub(d.last) < d.opts.Hold {
+		return MotionEvent{}, false, nil
+	}
+	d.active = false
+	return MotionEvent{Type: MotionEnd, Score: d.peak, Timestamp: d.last, Sequence: d.lastSeq}, true, nil
+}
+
+func (d *Detector) minArea(w, h int) int {
+	if d.opts.MinArea > 0 {
+		return d.opts.MinArea
+	}
+	return max(1, int(DefaultMinArea*float64(w*h)))
+}
+
+// Active reports whether motion is in progress, between a MotionStart and
+// its MotionEnd.
+func (d *Detector) Active() bool {
+	return d.active
+}
+
+// Regions returns the regions and score of the last frame processed, for
+// drawing overlays. They are empty during the warmup.
+func (d *Detector) Regions() ([]Region, float64) {
+	return d.regions, d.score
+}
+
+// Watch processes frames until the channel closes or ctx is canceled,
+// releasing each, and sends the events on the returned channel, which is
+// closed at the end. A MotionEnd is sent for motion still in progress when
+// the frames end. While the receiver is busy no frames are taken, so with
+// a stream's latest-only channel the detector skips frames rather than
+// events.
+func (d *Detector) Watch(ctx context.Context, frames <-chan gocam.Frame) <-chan MotionEvent {
+	events := make(chan MotionEvent, 1)
+	go func() {
+		defer close(events)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case frame, ok := <-frames:
+				if !ok {
+					if d.active {
+						d.active = false
+						ev := MotionEvent{Type: MotionEnd, Score: d.peak, Timestamp: d.last, Sequence: d.lastSeq}
+						select {
+						case events <- ev:
+						case <-ctx.Done():
+						}
+					}
+					return
+				}
+				ev, fired, err := d.Process(frame)
+				frame.Release()
+				if err != nil || !fired {
+					continue
+				}
+				select {
+				case events <- ev:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events
+}
@@ -0,0 +1,195 @@
+package motion
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+	"time"
+
+	gocam "github.com/svanichkin/gocam"
+)
+
+const testW, testH = 160, 120
+
+// scene returns frame n of a gray scene with sensor noise of up to
+// +-noise levels, with a bright rectangle at box unless it is empty.
+// Frames are 100 ms apart.
+func scene(n int, noise int, box image.Rectangle) gocam.Frame {
+	data := make([]byte, testW*testH*3)
+	seed := uint32(n*7919 + 1)
+	for y := 0; y < testH; y++ {
+		for x := 0; x < testW; x++ {
+			seed = seed*1664525 + 1013904223
+			v := 100
+			if noise > 0 {
+				v += int(seed>>24)%(2*noise+1) - noise
+			}
+			if image.Pt(x, y).In(box) {
+				v = 220
+			}
+			p := data[(y*testW+x)*3:]
+			p[0], p[1], p[2] = byte(v), 128, 128
+		}
+	}
+	return gocam.Frame{Data: data, Width: testW, Height: testH, Sequence: uint64(n),
+		Timestamp: time.Unix(1000, 0).Add(time.Duration(n) * 100 * time.Millisecond)}
+}
+
+// run feeds frames 0 to n-1 of scene through d and returns the events,
+// with the box present from frame on to frame off.
+func run(t *testing.T, d *Detector, n, on, off, noise int, box image.Rectangle) []MotionEvent {
+	t.Helper()
+	var events []MotionEvent
+	for i := 0; i < n; i++ {
+		b := image.Rectangle{}
+		if i >= on && i < off {
+			b = box
+		}
+		ev, fired, err := d.Process(scene(i, noise, b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fired {
+			events = append(events, ev)
+		}
+	}
+	return events
+}
+
+func TestDetectorStartEnd(t *testing.T) {
+	box := image.Rect(40, 30, 70, 60)
+	for _, bg := range []Background{RunningAverage, Median} {
+		d := NewDetector(&Options{Background: bg})
+		events := run(t, d, 40, 15, 20, 6, box)
+		if len(events) != 2 {
+			t.Fatalf("%v: %d events: %+v", bg, len(events), events)
+		}
+		start, end := events[0], events[1]
+		if start.Type != MotionStart || start.Sequence != 15 || len(start.Regions) != 1 {
+			t.Fatalf("%v: start %+v", bg, start)
+		}
+		if r := start.Regions[0]; r.Bounds != box || r.Area != 30*30 {
+			t.Errorf("%v: region %v of %d pixels, want %v", bg, r.Bounds, r.Area, box)
+		}
+		if want := 900.0 / (testW * testH); start.Score != want {
+			t.Errorf("%v: score %v, want %v", bg, start.Score, want)
+		}
+		// The end comes a second after the last frame with motion,
+		// which the event reports. Leaving may itself register as
+		// motion while the background recovers.
+		if end.Type != MotionEnd || end.Sequence < 19 || end.Score < start.Score {
+			t.Errorf("%v: end %+v", bg, end)
+		}
+		if d.Active() {
+			t.Errorf("%v: still active", bg)
+		}
+	}
+}
+
+func TestDetectorFiltering(t *testing.T) {
+	// Noise below the threshold, and bursts of single pixels, are ignored.
+	d := NewDetector(nil)
+	if events := run(t, d, 30, 0, 0, 20, image.Rectangle{}); len(events) != 0 {
+		t.Errorf("events from noise: %+v", events)
+	}
+	speckle := func(n int) gocam.Frame {
+		f := scene(n, 0, image.Rectangle{})
+		for i := 0; i < 50; i++ {
+			f.Data[((i*37%testH)*testW+i*53%testW)*3] = 255
+		}
+		return f
+	}
+	d = NewDetector(nil)
+	for i := 0; i < 30; i++ {
+		f := scene(i, 0, image.Rectangle{})
+		if i > 12 {
+			f = speckle(i)
+		}
+		if _, fired, _ := d.Process(f); fired {
+			t.Fatalf("frame %d: event from speckles", i)
+		}
+	}
+
+	// A change smaller than MinArea does not count.
+	d = NewDetector(&Options{MinArea: 200})
+	if events := run(t, d, 30, 15, 30, 0, image.Rect(10, 10, 22, 22)); len(events) != 0 {
+		t.Errorf("events from a small change: %+v", events)
+	}
+	// Nor does anything during the warmup.
+	d = NewDetector(&Options{Warmup: 20})
+	if events := run(t, d, 20, 5, 20, 0, image.Rect(10, 10, 50, 50)); len(events) != 0 {
+		t.Errorf("events during warmup: %+v", events)
+	}
+}
+
+func TestDetectorMaskAndGrid(t *testing.T) {
+	left, right := image.Rect(10, 40, 40, 70), image.Rect(110, 40, 140, 70)
+
+	// A quarter-size mask enabling the right half.
+	mask := image.NewGray(image.Rect(0, 0, testW/4, testH/4))
+	for y := 0; y < testH/4; y++ {
+		for x := testW / 8; x < testW/4; x++ {
+			mask.SetGray(x, y, color.Gray{255})
+		}
+	}
+	if events := run(t, NewDetector(&Options{Mask: mask}), 25, 15, 25, 0, left); len(events) != 0 {
+		t.Errorf("events outside the mask: %+v", events)
+	}
+	events := run(t, NewDetector(&Options{Mask: mask}), 25, 15, 25, 0, right)
+	if len(events) != 1 || events[0].Regions[0].Bounds != right {
+		t.Errorf("events inside the mask: %+v", events)
+	}
+	if want := 900.0 / (testW * testH / 2); len(events) == 1 && events[0].Score != want {
+		t.Errorf("score %v, want %v of the watched half", events[0].Score, want)
+	}
+
+	// A 4x3 grid watching its right column, where the box is clipped to
+	// cells 3 and 7.
+	grid := Grid{Cols: 4, Rows: 3, Enabled: []int{3, 7, 11}}
+	if events := run(t, NewDetector(&Options{Grid: grid}), 25, 15, 25, 0, left); len(events) != 0 {
+		t.Errorf("events outside the grid: %+v", events)
+	}
+	events = run(t, NewDetector(&Options{Grid: grid}), 25, 15, 25, 0, image.Rect(110, 20, 140, 60))
+	if len(events) != 1 || !reflect.DeepEqual(events[0].Cells, []int{3, 7}) ||
+		events[0].Regions[0].Bounds != image.Rect(120, 20, 140, 60) {
+		t.Errorf("grid events: %+v", events)
+	}
+}
+
+func TestDetectorDownscale(t *testing.T) {
+	// At a quarter of the width the region is found on 4x4 blocks.
+	d := NewDetector(&Options{MaxWidth: testW / 4})
+	events := run(t, d, 25, 15, 25, 4, image.Rect(40, 40, 80, 72))
+	if len(events) != 1 {
+		t.Fatalf("%d events", len(events))
+	}
+	if r := events[0].Regions[0]; r.Bounds != image.Rect(40, 40, 80, 72) || r.Area != 40*32 {
+		t.Errorf("region %v of %d pixels", r.Bounds, r.Area)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	frames := make(chan gocam.Frame)
+	events := NewDetector(nil).Watch(context.Background(), frames)
+	go func() {
+		defer close(frames)
+		for i := 0; i < 25; i++ {
+			b := image.Rectangle{}
+			if i >= 15 {
+				b = image.Rect(50, 50, 90, 90)
+			}
+			frames <- scene(i, 0, b)
+		}
+	}()
+
+	var got []EventType
+	for ev := range events {
+		got = append(got, ev.Type)
+	}
+	// The motion is still going on when the frames end.
+	if !reflect.DeepEqual(got, []EventType{MotionStart, MotionEnd}) {
+		t.Errorf("events %v", got)
+	}
+}
@@ -0,0 +1,141 @@
+package gocam
+
+// IOMethod selects how frame data is exchanged with the capture driver.
+// Only the V4L2 backend honors it; other platforms ignore the setting.
+type IOMethod int
+
+const (
+	// IOAuto picks the best method the device advertises: memory-mapped
+	// streaming when available, otherwise read() I/O.
+	IOAuto IOMethod = iota
+	// IOMMap uses driver-allocated buffers mapped into the process.
+	IOMMap
+	// IOUserPtr uses streaming I/O with buffers allocated by gocam.
+	IOUserPtr
+	// IORead copies each frame out of the driver with read().
+	IORead
+	// IODMABuf captures into external DMABUF buffers supplied with
+	// WithDMABufImport.
+	IODMABuf
+)
+
+func (m IOMethod) String() string {
+	switch m {
+	case IOAuto:
+		return "auto"
+	case IOMMap:
+		return "mmap"
+	case IOUserPtr:
+		return "userptr"
+	case IORead:
+		return "read"
+	case IODMABuf:
+		return "dmabuf"
+	}
+	return "unknown"
+}
+
+// StreamOption customizes a stream started with StartStream or OpenStream.
+type StreamOption func(*streamConfig)
+
+type streamConfig struct {
+	device       string
+	ioMethod     IOMethod
+	dmabufExport bool
+	dmabufImport []int
+	deinterlace  DeinterlaceMode
+	bufferCount  int
+	transform    Transform
+	mjpeg        bool
+}
+
+func newStreamConfig(opts []StreamOption) streamConfig {
+	var cfg streamConfig
+	for _, opt := range opts {
+		if opt != nil {
+			opt(&cfg)
+		}
+	}
+	return cfg
+}
+
+// WithDevice selects the source by URI; the scheme picks a source added
+// with Register. "test://" URIs open the built-in TestPatternSource (see
+// ParseTestPatternURI) and "file://" URIs replay recorded footage (see
+// ParseFileURI). Plain paths and the platform scheme ("v4l2", "avfoundation"
+// or "mediafoundation") open the camera: on Linux the value names the V4L2
+// device node, e.g. "/dev/video2"; other platforms always use their default
+// camera.
+func WithDevice(uri string) StreamOption {
+	return func(cfg *streamConfig) {
+		cfg.device = uri
+	}
+}
+
+// WithIOMethod forces a specific driver I/O method instead of choosing one
+// from the device capabilities.
+func WithIOMethod(m IOMethod) StreamOption {
+	return func(cfg *streamConfig) {
+		cfg.ioMethod = m
+	}
+}
+
+// WithDMABufExport attaches the driver buffer behind every frame as a DMABUF
+// file descriptor (VIDIOC_EXPBUF) for zero-copy handoff to encoders or other
+// processes. The driver does not reuse a buffer until its frame is released,
+// so consumers must call Frame.Release when done. Requires mmap I/O.
+func WithDMABufExport() StreamOption {
+	return func(cfg *streamConfig) {
+		cfg.dmabufExport = true
+	}
+}
+
+// WithDMABufImport captures into the given DMABUF file descriptors instead of
+// driver-allocated memory, one capture buffer per descriptor. The descriptors
+// stay owned by the caller and must remain open until the stream ends.
+func WithDMABufImport(fds ...int) StreamOption {
+	fds = append([]int(nil), fds...)
+	return func(cfg *streamConfig) {
+		cfg.ioMethod = IODMABuf
+		cfg.dmabufImport = fds
+	}
+}
+
+// WithDeinterlace applies a software deinterlacer to interlaced sources such
+// as analog capture cards. Frames from progressive sources pass unchanged.
+func WithDeinterlace(mode DeinterlaceMode) StreamOption {
+	return func(cfg *streamConfig) {
+		cfg.deinterlace = mode
+	}
+}
+
+// WithBufferCount sets how many capture buffers are requested from the
+// driver (default 4). More buffers absorb slow conversion at high frame
+// rates; two keep latency minimal because no stale frames pile up in the
+// queue. The driver may grant a different number; Stream.Stats reports it.
+func WithBufferCount(n int) StreamOption {
+	return func(cfg *streamConfig) {
+		cfg.bufferCount = n
+	}
+}
+
+// WithTransform rotates or mirrors every frame after conversion. On V4L2
+// devices with HFLIP/VFLIP controls the flipping is done by the driver, and
+// 90 and 270 degree rotations only transpose in software. Rotations by 90
+// and 270 degrees and Transpose swap the frame width and height.
+func WithTransform(t Transform) StreamOption {
+	return func(cfg *streamConfig) {
+		cfg.transform = t
+	}
+}
+
+// WithMJPEG asks the camera for Motion-JPEG before the raw formats. USB
+// cameras often offer larger sizes or higher rates in MJPEG, and the
+// compressed images reach Frame.JPEG for recorders and streamers to pass
+// through. Frame.Data is decoded as usual. Only the V4L2 backend honors it;
+// without the option MJPEG is used when the camera offers nothing else.
+func WithMJPEG() StreamOption {
+	return func(cfg *streamConfig) {
+		cfg.mjpeg = true
+	}
+}
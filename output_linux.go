@@ -0,0 +1,346 @@
+//go:build linux
+// +build linux
+
+package gocam
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/svanichkin/gocam/pixconv"
+)
+
+// OutputFormat is the pixel format written to a V4L2 output device.
+type OutputFormat int
+
+const (
+	// OutputYUYV is packed YCbCr 4:2:2, the format most consumers of a
+	// virtual camera (browsers, conferencing tools) accept.
+	OutputYUYV OutputFormat = iota
+	// OutputNV12 is YCbCr 4:2:0 with a luma plane and an interleaved CbCr
+	// plane.
+	OutputNV12
+	// OutputI420 is planar YCbCr 4:2:0 (Y, Cb, Cr planes).
+	OutputI420
+)
+
+func (f OutputFormat) String() string {
+	switch f {
+	case OutputYUYV:
+		return "YUYV"
+	case OutputNV12:
+		return "NV12"
+	case OutputI420:
+		return "I420"
+	}
+	return "unknown"
+}
+
+func (f OutputFormat) fourcc() (uint32, error) {
+	switch f {
+	case OutputYUYV:
+		return v4l2PixFmtYUYV, nil
+	case OutputNV12:
+		return v4l2PixFmtNV12, nil
+	case OutputI420:
+		return v4l2PixFmtI420, nil
+	}
+	return 0, fmt.Errorf("gocam: unknown output format %d", int(f))
+}
+
+// outputTimeout bounds how long WriteFrame waits for the driver to hand back
+// a buffer before giving up.
+const outputTimeout = 2 * time.Second
+
+// OutputStream writes frames to a V4L2 output device such as a v4l2loopback
+// node, which other applications then see as a regular camera.
+type OutputStream struct {
+	mu     sync.Mutex
+	dev    *v4l2Device
+	free   []uint32 // indices of mmap buffers owned by us
+	closed bool
+}
+
+// OpenOutput opens the V4L2 output device at path (e.g. a v4l2loopback node
+// such as /dev/video10) and configures it for width x height frames in the
+// given format. Memory-mapped streaming is used when the device supports it,
+// write() otherwise.
+func OpenOutput(path string, width, height int, format OutputFormat) (*OutputStream, error) {
+	if width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("gocam: invalid output size %dx%d", width, height)
+	}
+	pixFmt, err := format.fourcc()
+	if err != nil {
+		return nil, err
+	}
+
+	dev, err := openV4L2Device(path, v4l2BufTypeVideoOutput)
+	if err != nil {
+		return nil, err
+	}
+	if err := dev.selectIO(IOAuto); err != nil {
+		dev.close()
+		return nil, err
+	}
+	if err := dev.setOutputFormat(pixFmt, width, height); err != nil {
+		dev.close()
+		return nil, err
+	}
+	if err := dev.initBuffers(v4l2BufferCount); err != nil {
+		dev.close()
+		return nil, err
+	}
+
+	o := &OutputStream{dev: dev}
+	for i := range dev.buffers {
+		o.free = append(o.free, uint32(i))
+	}
+	logOutputConfig(dev)
+	return o, nil
+}
+
+// setOutputFormat sets the output format. Unlike capture there is no
+// fallback: the caller asked for a specific format and size.
+func (d *v4l2Device) setOutputFormat(pixFmt uint32, width, height int) error {
+	pix, err := d.setFormat(pixFmt, uint32(width), uint32(height))
+	if err != nil {
+		return fmt.Errorf("gocam: VIDIOC_S_FMT %s failed: %w", v4l2FormatName(pixFmt), err)
+	}
+	if pix.Pixelformat != pixFmt {
+		return fmt.Errorf("gocam: output device does not accept %s", v4l2FormatName(pixFmt))
+	}
+
+	d.pixelFormat = pix.Pixelformat
+	d.width = int(pix.Width)
+	d.height = int(pix.Height)
+	d.stride = int(pix.Bytesperline)
+	d.field = pix.Field
+	if d.stride == 0 {
+		d.stride = d.width
+		if pixFmt == v4l2PixFmtYUYV {
+			d.stride = d.width * 2
+		}
+	}
+
+	need := outputImageSize(pixFmt, d.stride, d.height)
+	d.sizeImage = int(pix.Sizeimage)
+	if d.sizeImage < need {
+		d.sizeImage = need
+	}
+	return nil
+}
+
+// logOutputConfig prints a human-readable description of an output device.
+func logOutputConfig(dev *v4l2Device) {
+	card := v4l2CString(dev.caps.Card[:])
+	driver := v4l2CString(dev.caps.Driver[:])
+
+	camLog.Println("[gocam] [V4L2]")
+	camLog.Printf("[gocam]   %s (Output)\n", dev.path)
+	if card != "" || driver != "" {
+		camLog.Printf("[gocam]     Card:       %s\n", card)
+		camLog.Printf("[gocam]     Driver:     %s\n", driver)
+	}
+	camLog.Printf("[gocam]     Format:      YCbCr 4:4:4 (uint8) -> %s\n", v4l2FormatName(dev.pixelFormat))
+	camLog.Printf("[gocam]     Resolution:  %d x %d\n", dev.width, dev.height)
+	camLog.Printf("[gocam]     Stride:      %d bytes\n", dev.stride)
+	camLog.Printf("[gocam]     I/O:         %s\n", outputIOName(dev.io))
+	if len(dev.buffers) > 0 {
+		camLog.Printf("[gocam]     Buffers:     %d\n", len(dev.buffers))
+	}
+}
+
+func outputIOName(m IOMethod) string {
+	if m == IORead {
+		return "write"
+	}
+	return m.String()
+}
+
+// Width returns the negotiated output width.
+func (o *OutputStream) Width() int { return o.dev.width }
+
+// Height returns the negotiated output height.
+func (o *OutputStream) Height() int { return o.dev.height }
+
+// WriteFrame converts a packed YCbCr444 frame to the output format and hands
+// it to the device. Frames of a different size are scaled and cropped to fit.
+// WriteFrame blocks while all driver buffers are in use.
+func (o *OutputStream) WriteFrame(f Frame) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return fmt.Errorf("gocam: output stream closed")
+	}
+	d := o.dev
+
+	src := f.Data
+	if f.Width != d.width || f.Height != d.height {
+		src = scaleYCbCr444Fill(f.Data, f.Width, f.Height, d.width, d.height)
+	}
+	if len(src) < d.width*d.height*3 {
+		return fmt.Errorf("gocam: frame data too short for %dx%d", f.Width, f.Height)
+	}
+
+	if d.io == IORead {
+		n, err := packOutput(d.readBuf, src, d.width, d.height, d.stride, d.pixelFormat)
+		if err != nil {
+			return err
+		}
+		return o.write(d.readBuf[:n])
+	}
+
+	index, err := o.freeBuffer()
+	if err != nil {
+		return err
+	}
+	n, err := packOutput(d.buffers[index].data, src, d.width, d.height, d.stride, d.pixelFormat)
+	if err != nil {
+		o.free = append(o.free, index)
+		return err
+	}
+
+	buf := v4l2Buffer{
+		Type:      d.bufType,
+		Memory:    d.memoryType(),
+		Index:     index,
+		Bytesused: uint32(n),
+		Field:     v4l2FieldNone,
+	}
+	if err := d.requeue(&buf); err != nil {
+		o.free = append(o.free, index)
+		return fmt.Errorf("gocam: VIDIOC_QBUF index %d failed: %w", index, err)
+	}
+
+	// Streaming starts once the driver holds a frame to show.
+	if !d.streaming {
+		return d.start()
+	}
+	return nil
+}
+
+// freeBuffer returns the index of a buffer we may fill, reclaiming buffers
+// the driver has finished with and waiting for one if necessary.
+func (o *OutputStream) freeBuffer() (uint32, error) {
+	d := o.dev
+	deadline := time.Now().Add(outputTimeout)
+	for len(o.free) == 0 {
+		_, buf, err := d.dequeue()
+		if err == nil {
+			o.free = append(o.free, buf.Index)
+			break
+		}
+		if err != syscall.EAGAIN && err != syscall.EINTR {
+			return 0, fmt.Errorf("gocam: VIDIOC_DQBUF failed: %w", err)
+		}
+		if err := o.wait(deadline); err != nil {
+			return 0, err
+		}
+	}
+
+	index := o.free[len(o.free)-1]
+	o.free = o.free[:len(o.free)-1]
+	return index, nil
+}
+
+// write pushes one frame with write(), waiting while the device is full.
+func (o *OutputStream) write(data []byte) error {
+	deadline := time.Now().Add(outputTimeout)
+	for len(data) > 0 {
+		n, err := v4l2Sys.write(o.dev.fd, data)
+		if n > 0 {
+			data = data[n:]
+		}
+		switch {
+		case err == nil && n == 0:
+			return fmt.Errorf("gocam: write to %s made no progress", o.dev.path)
+		case err == nil:
+		case err == syscall.EAGAIN || err == syscall.EINTR:
+			if err := o.wait(deadline); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("gocam: write to %s failed: %w", o.dev.path, err)
+		}
+	}
+	return nil
+}
+
+// wait blocks until the device accepts more data or deadline passes.
+func (o *OutputStream) wait(deadline time.Time) error {
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		return fmt.Errorf("gocam: timed out waiting for %s", o.dev.path)
+	}
+	if _, err := o.dev.poll(pollOut, remaining); err != nil && err != syscall.EINTR {
+		return fmt.Errorf("gocam: poll %s failed: %w", o.dev.path, err)
+	}
+	return nil
+}
+
+// Close stops streaming and closes the output device.
+func (o *OutputStream) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return nil
+	}
+	o.closed = true
+	o.dev.close()
+	return nil
+}
+
+// outputImageSize returns the bytes needed for one frame of pixFmt.
+func outputImageSize(pixFmt uint32, stride, height int) int {
+	chromaH := (height + 1) / 2
+	switch pixFmt {
+	case v4l2PixFmtNV12:
+		return stride*height + chromaStride(pixFmt, stride)*chromaH
+	case v4l2PixFmtI420:
+		return stride*height + 2*chromaStride(pixFmt, stride)*chromaH
+	}
+	return stride * height
+}
+
+// chromaStride returns the row stride of the chroma plane(s) of a 4:2:0
+// format, rounding up so odd widths keep their last chroma sample.
+func chromaStride(pixFmt uint32, stride int) int {
+	if pixFmt == v4l2PixFmtNV12 {
+		return (stride + 1) &^ 1
+	}
+	return (stride + 1) / 2
+}
+
+// packOutput converts tightly packed YCbCr444 src into dst laid out as
+// pixFmt with the given luma stride and returns the number of bytes written.
+// Chroma is averaged over each 2x1 (YUYV) or 2x2 (4:2:0) block.
+func packOutput(dst, src []byte, width, height, stride int, pixFmt uint32) (int, error) {
+	size := outputImageSize(pixFmt, stride, height)
+	if len(dst) < size {
+		return 0, fmt.Errorf("gocam: output buffer of %d bytes too small for a %d-byte %s frame", len(dst), size, v4l2FormatName(pixFmt))
+	}
+
+	format := pixconv.YUYV
+	switch pixFmt {
+	case v4l2PixFmtNV12:
+		format = pixconv.NV12
+	case v4l2PixFmtI420:
+		format = pixconv.I420
+	}
+	out, err := pixconv.Wrap(format, width, height, dst[:size], stride)
+	if err != nil {
+		return 0, fmt.Errorf("gocam: output buffer: %w", err)
+	}
+	in, err := pixconv.Wrap(pixconv.YCbCr444, width, height, src, 0)
+	if err != nil {
+		return 0, fmt.Errorf("gocam: output frame: %w", err)
+	}
+	if err := pixconv.Convert(out, in, pixconv.JFIF); err != nil {
+		return 0, fmt.Errorf("gocam: output conversion: %w", err)
+	}
+	return size, nil
+}
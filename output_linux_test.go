@@ -0,0 +1,209 @@
+//go:build linux
+// +build linux
+
+package gocam
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/svanichkin/gocam/pixconv"
+)
+
+// newFakeOutput returns an output device offering formats at width x height
+// with the given I/O capability.
+func newFakeOutput(t *testing.T, width, height int, io uint32, formats ...uint32) *fakeDevice {
+	dev := newFakeDevice(width, height, formats...)
+	dev.caps = v4l2CapVideoOutput | io
+	dev.install(t)
+	return dev
+}
+
+// packed returns frame converted to format, as the device should receive it.
+func packed(frame Frame, format pixconv.Format, size int) []byte {
+	buf := make([]byte, size)
+	frame.convertTo(format, buf, 0)
+	return buf
+}
+
+// writtenFrames returns a copy of the frames the device received.
+func (f *fakeDevice) writtenFrames() [][]byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]byte(nil), f.written...)
+}
+
+func TestOutputMMap(t *testing.T) {
+	dev := newFakeOutput(t, 8, 4, v4l2CapStreaming, v4l2PixFmtYUYV)
+	o, err := OpenOutput(fakeDevicePath, 8, 4, OutputYUYV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := chromaFrame(8, 4)
+	// More frames than buffers: the driver hands shown buffers back.
+	for i := 0; i < 2*v4l2BufferCount; i++ {
+		if err := o.WriteFrame(frame); err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+	}
+	written := dev.writtenFrames()
+	if len(written) != 2*v4l2BufferCount {
+		t.Fatalf("device received %d frames", len(written))
+	}
+	want := packed(frame, pixconv.YUYV, 8*4*2)
+	for i, data := range written {
+		if !bytes.Equal(data, want) {
+			t.Fatalf("frame %d differs: % x", i, data)
+		}
+	}
+	if !dev.streaming {
+		t.Error("not streaming after the first frame")
+	}
+
+	// A frame of another size is scaled to the output.
+	if err := o.WriteFrame(chromaFrame(16, 8)); err != nil {
+		t.Fatal(err)
+	}
+	if written = dev.writtenFrames(); len(written[len(written)-1]) != 8*4*2 {
+		t.Errorf("scaled frame of %d bytes", len(written[len(written)-1]))
+	}
+
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !dev.isClosed() || dev.unmapCount != dev.granted {
+		t.Errorf("closed %v, unmapped %d of %d buffers", dev.isClosed(), dev.unmapCount, dev.granted)
+	}
+	if err := o.WriteFrame(frame); err == nil {
+		t.Error("write after Close accepted")
+	}
+}
+
+func TestOutputWrite(t *testing.T) {
+	// A device without streaming gets frames through write(), which may
+	// take them in pieces.
+	dev := newFakeOutput(t, 6, 4, v4l2CapReadWrite, v4l2PixFmtI420)
+	dev.writeChunk = 5
+	o, err := OpenOutput(fakeDevicePath, 6, 4, OutputI420)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	frames := []Frame{chromaFrame(6, 4), colorFrame(6, 4)}
+	for _, frame := range frames {
+		if err := o.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	written := dev.writtenFrames()
+	if len(written) != len(frames) {
+		t.Fatalf("device received %d frames", len(written))
+	}
+	for i, frame := range frames {
+		if want := packed(frame, pixconv.I420, 6*4*3/2); !bytes.Equal(written[i], want) {
+			t.Errorf("frame %d: % x, want % x", i, written[i], want)
+		}
+	}
+	if dev.granted != 0 {
+		t.Error("write() I/O requested driver buffers")
+	}
+}
+
+func TestOutputFormatNegotiation(t *testing.T) {
+	// The driver settles on its own size, which frames are scaled to.
+	newFakeOutput(t, 8, 6, v4l2CapStreaming, v4l2PixFmtNV12)
+	o, err := OpenOutput(fakeDevicePath, 640, 480, OutputNV12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Width() != 8 || o.Height() != 6 {
+		t.Errorf("output size %dx%d, want the driver's 8x6", o.Width(), o.Height())
+	}
+	o.Close()
+
+	// There is no fallback to another format.
+	dev := newFakeOutput(t, 8, 6, v4l2CapStreaming, v4l2PixFmtYUYV)
+	if _, err := OpenOutput(fakeDevicePath, 8, 6, OutputNV12); err == nil {
+		t.Error("NV12 output opened on a YUYV-only device")
+	}
+	if !dev.isClosed() {
+		t.Error("device left open after a failed open")
+	}
+
+	for _, tc := range []struct {
+		name   string
+		caps   uint32
+		w, h   int
+		format OutputFormat
+	}{
+		{"capture device", v4l2CapVideoCapture | v4l2CapStreaming, 8, 6, OutputYUYV},
+		{"no I/O", v4l2CapVideoOutput, 8, 6, OutputYUYV},
+		{"empty size", v4l2CapVideoOutput | v4l2CapStreaming, 0, 6, OutputYUYV},
+		{"unknown format", v4l2CapVideoOutput | v4l2CapStreaming, 8, 6, OutputFormat(9)},
+	} {
+		dev := newFakeDevice(8, 6, v4l2PixFmtYUYV)
+		dev.caps = tc.caps
+		dev.install(t)
+		if _, err := OpenOutput(fakeDevicePath, tc.w, tc.h, tc.format); err == nil {
+			t.Errorf("%s: opened", tc.name)
+		}
+	}
+}
+
+func TestOutputBufferTooSmall(t *testing.T) {
+	dev := newFakeOutput(t, 8, 4, v4l2CapStreaming, v4l2PixFmtYUYV)
+	dev.bufLength = 16
+	o, err := OpenOutput(fakeDevicePath, 8, 4, OutputYUYV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	// Every attempt fails without queueing an empty buffer, and the
+	// buffer stays available.
+	for i := 0; i < v4l2BufferCount+1; i++ {
+		if err := o.WriteFrame(chromaFrame(8, 4)); err == nil {
+			t.Fatal("frame written to a short buffer")
+		}
+	}
+	if written := dev.writtenFrames(); len(written) != 0 {
+		t.Errorf("%d frames queued", len(written))
+	}
+}
+
+func TestPackOutput(t *testing.T) {
+	// A 3x2 frame: the odd width leaves a lone last pixel, which YUYV
+	// repeats to fill its pair. Padding past that stays untouched.
+	src := []byte{
+		10, 100, 200, 20, 110, 210, 30, 120, 220,
+		40, 130, 230, 50, 140, 240, 60, 150, 250,
+	}
+	tests := []struct {
+		pixFmt uint32
+		stride int
+		want   []byte
+	}{
+		{v4l2PixFmtYUYV, 8, []byte{
+			10, 105, 20, 205, 30, 120, 30, 220,
+			40, 135, 50, 235, 60, 150, 60, 250,
+		}},
+		{v4l2PixFmtI420, 4, []byte{
+			10, 20, 30, 0, 40, 50, 60, 0,
+			120, 135, // Cb
+			220, 235, // Cr
+		}},
+		{v4l2PixFmtNV12, 4, []byte{
+			10, 20, 30, 0, 40, 50, 60, 0,
+			120, 220, 135, 235,
+		}},
+	}
+	for _, tc := range tests {
+		dst := make([]byte, len(tc.want))
+		n, err := packOutput(dst, src, 3, 2, tc.stride, tc.pixFmt)
+		if err != nil || n != len(tc.want) || !bytes.Equal(dst, tc.want) {
+			t.Errorf("%s: %v (%d bytes, %v), want %v", v4l2FormatName(tc.pixFmt), dst, n, err, tc.want)
+		}
+		if _, err := packOutput(dst[:len(dst)-1], src, 3, 2, tc.stride, tc.pixFmt); err == nil {
+			t.Errorf("%s: short buffer accepted", v4l2FormatName(tc.pixFmt))
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package pixconv
+
+// Matrix selects the luma coefficients used between RGB and YCbCr.
+type Matrix int
+
+const (
+	// BT601 is ITU-R BT.601, used by JPEG and standard definition video.
+	BT601 Matrix = iota
+	// BT709 is ITU-R BT.709, used by HD video.
+	BT709
+	// BT2020 is ITU-R BT.2020 (non-constant luminance).
+	BT2020
+)
+
+func (m Matrix) String() string {
+	switch m {
+	case BT601:
+		return "BT.601"
+	case BT709:
+		return "BT.709"
+	case BT2020:
+		return "BT.2020"
+	}
+	return "unknown"
+}
+
+// Range selects the quantization range of YCbCr samples.
+type Range int
+
+const (
+	// FullRange uses 0-255 for Y, Cb and Cr.
+	FullRange Range = iota
+	// LimitedRange ("studio swing") uses 16-235 for Y and 16-240 for Cb
+	// and Cr.
+	LimitedRange
+)
+
+func (r Range) String() string {
+	switch r {
+	case FullRange:
+		return "full"
+	case LimitedRange:
+		return "limited"
+	}
+	return "unknown"
+}
+
+// Colorimetry describes how YCbCr samples relate to RGB. The zero value is
+// JFIF.
+type Colorimetry struct {
+	Matrix Matrix
+	Range  Range
+}
+
+var (
+	// JFIF is full-range BT.601 as used by JPEG, image/color and gocam
+	// frames.
+	JFIF = Colorimetry{Matrix: BT601, Range: FullRange}
+	// Rec601 is limited-range BT.601, common for SD capture devices.
+	Rec601 = Colorimetry{Matrix: BT601, Range: LimitedRange}
+	// Rec709 is limited-range BT.709, common for HD capture devices.
+	Rec709 = Colorimetry{Matrix: BT709, Range: LimitedRange}
+	// Rec2020 is limited-range BT.2020.
+	Rec2020 = Colorimetry{Matrix: BT2020, Range: LimitedRange}
+)
+
+func (c Colorimetry) String() string {
+	return c.Matrix.String() + " " + c.Range.String()
+}
+
+// fixedShift is the precision of the fixed-point conversion coefficients.
+const fixedShift = 16
+
+const fixedHalf = 1 << (fixedShift - 1)
+
+// coefficients holds the fixed-point matrices of a Colorimetry.
+type coefficients struct {
+	yOff int32
+
+	// RGB to YCbCr.
+	yR, yG, yB    int32
+	cbR, cbG, cbB int32
+	crR, crG, crB int32
+
+	// YCbCr to RGB.
+	yScale        int32
+	rCr, gCb, gCr int32
+	bCb           int32
+}
+
+func fixed(v float64) int32 {
+	if v < 0 {
+		return int32(v*(1<<fixedShift) - 0.5)
+	}
+	return int32(v*(1<<fixedShift) + 0.5)
+}
+
+func (c Colorimetry) coefficients() *coefficients {
+	var kr, kb float64
+	switch c.Matrix {
+	case BT709:
+		kr, kb = 0.2126, 0.0722
+	case BT2020:
+		kr, kb = 0.2627, 0.0593
+	default:
+		kr, kb = 0.299, 0.114
+	}
+	kg := 1 - kr - kb
+
+	yScale, cScale := 1.0, 1.0
+	k := &coefficients{}
+	if c.Range == LimitedRange {
+		yScale, cScale = 219.0/255, 224.0/255
+		k.yOff = 16
+	}
+
+	if c == Rec601 {
+		// The classic 8-bit integer matrix, which capture devices and
+		// earlier gocam releases use; exact coefficients differ by one
+		// level on some colors.
+		k.yR, k.yG, k.yB = 66<<8, 129<<8, 25<<8
+		k.cbR, k.cbG, k.cbB = -38<<8, -74<<8, 112<<8
+		k.crR, k.crG, k.crB = 112<<8, -94<<8, -18<<8
+	} else {
+		k.yR, k.yG, k.yB = fixed(kr*yScale), fixed(kg*yScale), fixed(kb*yScale)
+		cb := cScale / (2 * (1 - kb))
+		k.cbR, k.cbG, k.cbB = fixed(-kr*cb), fixed(-kg*cb), fixed(0.5*cScale)
+		cr := cScale / (2 * (1 - kr))
+		k.crR, k.crG, k.crB = fixed(0.5*cScale), fixed(-kg*cr), fixed(-kb*cr)
+	}
+
+	k.yScale = fixed(1 / yScale)
+	k.rCr = fixed(2 * (1 - kr) / cScale)
+	k.gCb = fixed(-2 * kb * (1 - kb) / kg / cScale)
+	k.gCr = fixed(-2 * kr * (1 - kr) / kg / cScale)
+	k.bCb = fixed(2 * (1 - kb) / cScale)
+	return k
+}
+
+func clamp(v int32) byte {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return byte(v)
+}
+
+// toYCbCr converts a row of R, G, B components in place to Y, Cb, Cr.
+func (k *coefficients) toYCbCr(l line) {
+	r, g, b := l[0], l[1][:len(l[0])], l[2][:len(l[0])]
+	for i := range r {
+		R, G, B := int32(r[i]), int32(g[i]), int32(b[i])
+		r[i] = clamp((k.yR*R+k.yG*G+k.yB*B+fixedHalf)>>fixedShift + k.yOff)
+		g[i] = clamp((k.cbR*R+k.cbG*G+k.cbB*B+fixedHalf)>>fixedShift + 128)
+		b[i] = clamp((k.crR*R+k.crG*G+k.crB*B+fixedHalf)>>fixedShift + 128)
+	}
+}
+
+// toRGB converts a row of Y, Cb, Cr components in place to R, G, B.
+func (k *coefficients) toRGB(l line) {
+	y, cb, cr := l[0], l[1][:len(l[0])], l[2][:len(l[0])]
+	for i := range y {
+		Y := (int32(y[i]) - k.yOff) * k.yScale
+		Cb, Cr := int32(cb[i])-128, int32(cr[i])-128
+		y[i] = clamp((Y + k.rCr*Cr + fixedHalf) >> fixedShift)
+		cb[i] = clamp((Y + k.gCb*Cb + k.gCr*Cr + fixedHalf) >> fixedShift)
+		cr[i] = clamp((Y + k.bCb*Cb + fixedHalf) >> fixedShift)
+	}
+}
@@ -0,0 +1,239 @@
+package pixconv
+
+import "fmt"
+
+// line holds one image row as three full-resolution components, Y, Cb, Cr
+// or R, G, B depending on the format it was read from.
+type line [3][]byte
+
+func newLine(width int) line {
+	buf := make([]byte, 3*width)
+	return line{buf[:width], buf[width : 2*width], buf[2*width:]}
+}
+
+// Convert converts src into dst, which must have the same size. cs
+// describes the YCbCr side when converting between YCbCr and RGB formats; it
+// has no effect between two YCbCr or two RGB formats. Chroma is replicated
+// when upsampling and averaged over each 2x1 or 2x2 block when downsampling.
+func Convert(dst, src *Image, cs Colorimetry) error {
+	if err := src.Validate(); err != nil {
+		return err
+	}
+	if err := dst.Validate(); err != nil {
+		return err
+	}
+	if dst.Width != src.Width || dst.Height != src.Height {
+		return fmt.Errorf("pixconv: size mismatch %dx%d -> %dx%d", src.Width, src.Height, dst.Width, dst.Height)
+	}
+	var run func(y0, y1 int)
+	switch {
+	case dst.Format == src.Format:
+		run = func(y0, y1 int) { copyRows(dst, src, y0, y1) }
+	default:
+		var k *coefficients
+		if src.Format.isRGB() != dst.Format.isRGB() {
+			k = cs.coefficients()
+		}
+		kernel := fastKernel(dst.Format, src.Format)
+		if kernel == nil {
+			kernel = convertRows
+		}
+		run = func(y0, y1 int) { kernel(dst, src, k, y0, y1) }
+	}
+	parallelRows(src.Width, src.Height, run)
+	return nil
+}
+
+// convertRows converts rows [y0, y1) through full-resolution component
+// rows, converting between YCbCr and RGB with k when it is not nil. y0 is
+// even.
+func convertRows(dst, src *Image, k *coefficients, y0, y1 int) {
+	// Rows are handled in pairs so 4:2:0 chroma can be averaged vertically.
+	lines := [2]line{newLine(src.Width), newLine(src.Width)}
+	for y := y0; y < y1; y += 2 {
+		n := 2
+		if y+1 == y1 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			unpack(src, y+i, lines[i])
+			switch {
+			case k == nil:
+			case dst.Format.isRGB():
+				k.toRGB(lines[i])
+			default:
+				k.toYCbCr(lines[i])
+			}
+		}
+		pack(dst, y, lines[:n])
+	}
+}
+
+// copyPlanes copies the samples of src into dst of the same format and
+// size, row by row so that the strides may differ.
+func copyPlanes(dst, src *Image) {
+	copyRows(dst, src, 0, src.Height)
+}
+
+// copyRows copies image rows [y0, y1) and the chroma rows that go with
+// them; y0 is even.
+func copyRows(dst, src *Image, y0, y1 int) {
+	for p := 0; p < src.Format.PlaneCount(); p++ {
+		rowBytes, rows := src.Format.planeSize(p, src.Width, src.Height)
+		r0, r1 := y0, y1
+		if rows != src.Height {
+			r0, r1 = y0/2, (y1+1)/2
+		}
+		for y := r0; y < r1; y++ {
+			copy(dst.Planes[p][y*dst.Strides[p]:y*dst.Strides[p]+rowBytes],
+				src.Planes[p][y*src.Strides[p]:y*src.Strides[p]+rowBytes])
+		}
+	}
+}
+
+// unpack reads row y of img into l.
+func unpack(img *Image, y int, l line) {
+	w := img.Width
+	a, b, c := l[0][:w], l[1][:w], l[2][:w]
+	row := img.Planes[0][y*img.Strides[0]:]
+
+	switch img.Format {
+	case YCbCr444, RGB24:
+		deinterleave(row, a, b, c, 0, 1, 2, 3)
+	case BGR24:
+		deinterleave(row, a, b, c, 2, 1, 0, 3)
+	case RGBA:
+		deinterleave(row, a, b, c, 0, 1, 2, 4)
+	case BGRA:
+		deinterleave(row, a, b, c, 2, 1, 0, 4)
+	case Gray:
+		copy(a, row[:w])
+		fill(b, 128)
+		fill(c, 128)
+	case YUYV, UYVY:
+		yOff, cOff := 0, 1
+		if img.Format == UYVY {
+			yOff, cOff = 1, 0
+		}
+		for x := range a {
+			m := row[x/2*4 : x/2*4+4]
+			a[x] = m[x%2*2+yOff]
+			b[x] = m[cOff]
+			c[x] = m[cOff+2]
+		}
+	case I420:
+		copy(a, row[:w])
+		cb := img.Planes[1][y/2*img.Strides[1]:]
+		cr := img.Planes[2][y/2*img.Strides[2]:]
+		for x := range b {
+			b[x] = cb[x/2]
+			c[x] = cr[x/2]
+		}
+	case NV12, NV21:
+		copy(a, row[:w])
+		cb, cr := b, c
+		if img.Format == NV21 {
+			cb, cr = c, b
+		}
+		uv := img.Planes[1][y/2*img.Strides[1]:]
+		for x := range cb {
+			cb[x] = uv[x/2*2]
+			cr[x] = uv[x/2*2+1]
+		}
+	}
+}
+
+// pack writes lines, one or two rows starting at the even row y, into img.
+func pack(img *Image, y int, lines []line) {
+	w := img.Width
+	for i, l := range lines {
+		a, b, c := l[0][:w], l[1][:w], l[2][:w]
+		row := img.Planes[0][(y+i)*img.Strides[0]:]
+
+		switch img.Format {
+		case YCbCr444, RGB24:
+			interleave(row, a, b, c, 0, 1, 2, 3)
+		case BGR24:
+			interleave(row, a, b, c, 2, 1, 0, 3)
+		case RGBA:
+			interleave(row, a, b, c, 0, 1, 2, 4)
+		case BGRA:
+			interleave(row, a, b, c, 2, 1, 0, 4)
+		case Gray, I420, NV12, NV21:
+			copy(row[:w], a)
+		case YUYV, UYVY:
+			yOff, cOff := 0, 1
+			if img.Format == UYVY {
+				yOff, cOff = 1, 0
+			}
+			for x := 0; x < w; x += 2 {
+				x1 := x + 1
+				if x1 == w {
+					x1 = x
+				}
+				m := row[x*2 : x*2+4]
+				m[yOff] = a[x]
+				m[yOff+2] = a[x1]
+				m[cOff] = byte((int(b[x]) + int(b[x1]) + 1) >> 1)
+				m[cOff+2] = byte((int(c[x]) + int(c[x1]) + 1) >> 1)
+			}
+		}
+	}
+
+	switch img.Format {
+	case I420, NV12, NV21:
+	default:
+		return
+	}
+
+	// 4:2:0 chroma averages each 2x2 block, replicating the last row and
+	// column of odd sizes.
+	top, bottom := lines[0], lines[len(lines)-1]
+	cy := y / 2
+	for cx := 0; cx < (w+1)/2; cx++ {
+		x0, x1 := cx*2, cx*2+1
+		if x1 == w {
+			x1 = x0
+		}
+		cb := byte((int(top[1][x0]) + int(top[1][x1]) + int(bottom[1][x0]) + int(bottom[1][x1]) + 2) >> 2)
+		cr := byte((int(top[2][x0]) + int(top[2][x1]) + int(bottom[2][x0]) + int(bottom[2][x1]) + 2) >> 2)
+		switch img.Format {
+		case I420:
+			img.Planes[1][cy*img.Strides[1]+cx] = cb
+			img.Planes[2][cy*img.Strides[2]+cx] = cr
+		case NV12:
+			img.Planes[1][cy*img.Strides[1]+cx*2] = cb
+			img.Planes[1][cy*img.Strides[1]+cx*2+1] = cr
+		case NV21:
+			img.Planes[1][cy*img.Strides[1]+cx*2] = cr
+			img.Planes[1][cy*img.Strides[1]+cx*2+1] = cb
+		}
+	}
+}
+
+// deinterleave splits packed samples of size bytes each into components;
+// ia, ib and ic are the byte offsets of the components within a sample.
+func deinterleave(row, a, b, c []byte, ia, ib, ic, size int) {
+	for x := range a {
+		s := row[x*size : x*size+size]
+		a[x], b[x], c[x] = s[ia], s[ib], s[ic]
+	}
+}
+
+// interleave is the inverse of deinterleave. Samples of 4 bytes get an
+// opaque alpha channel.
+func interleave(row, a, b, c []byte, ia, ib, ic, size int) {
+	for x := range a {
+		s := row[x*size : x*size+size]
+		s[ia], s[ib], s[ic] = a[x], b[x], c[x]
+		if size == 4 {
+			s[3] = 255
+		}
+	}
+}
+
+func fill(p []byte, v byte) {
+	for i := range p {
+		p[i] = v
+	}
+}
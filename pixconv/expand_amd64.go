@@ -0,0 +1,26 @@
+//go:build amd64 && !purego
+// +build amd64,!purego
+
+package pixconv
+
+// hasSSSE3 reports support for PSHUFB (CPUID leaf 1, ECX bit 9).
+var hasSSSE3 = cpuidECX()&(1<<9) != 0
+
+// cpuidECX returns ECX of CPUID leaf 1.
+func cpuidECX() uint32
+
+// expand422SSSE3 converts blocks of 16 bytes of src into 24 bytes of dst.
+//
+//go:noescape
+func expand422SSSE3(dst, src *byte, blocks int, masks *expandMasks)
+
+// expand422 converts as many whole 8-pixel blocks of a 4:2:2 row s into
+// YCbCr444 d as both hold and returns the number of pixels written.
+func expand422(d, s []byte, masks *expandMasks) int {
+	blocks := min(len(d)/24, len(s)/16)
+	if !hasSSSE3 || blocks == 0 {
+		return 0
+	}
+	expand422SSSE3(&d[0], &s[0], blocks, masks)
+	return blocks * 8
+}
@@ -0,0 +1,38 @@
+//go:build amd64 && !purego
+// +build amd64,!purego
+
+#include "textflag.h"
+
+// func cpuidECX() uint32
+TEXT ·cpuidECX(SB), NOSPLIT, $0-4
+	MOVL $1, AX
+	XORL CX, CX
+	CPUID
+	MOVL CX, ret+0(FP)
+	RET
+
+// func expand422SSSE3(dst, src *byte, blocks int, masks *expandMasks)
+TEXT ·expand422SSSE3(SB), NOSPLIT, $0-32
+	MOVQ  dst+0(FP), DI
+	MOVQ  src+8(FP), SI
+	MOVQ  blocks+16(FP), CX
+	MOVQ  masks+24(FP), AX
+	MOVOU 0(AX), X1
+	MOVOU 16(AX), X2
+
+loop:
+	TESTQ  CX, CX
+	JZ     done
+	MOVOU  (SI), X0
+	MOVO   X0, X3
+	PSHUFB X1, X0
+	PSHUFB X2, X3
+	MOVOU  X0, (DI)
+	MOVQ   X3, 16(DI)
+	ADDQ   $16, SI
+	ADDQ   $24, DI
+	DECQ   CX
+	JMP    loop
+
+done:
+	RET
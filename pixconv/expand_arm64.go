@@ -0,0 +1,20 @@
+//go:build arm64 && !purego
+// +build arm64,!purego
+
+package pixconv
+
+// expand422NEON converts blocks of 16 bytes of src into 24 bytes of dst.
+//
+//go:noescape
+func expand422NEON(dst, src *byte, blocks int, masks *expandMasks)
+
+// expand422 converts as many whole 8-pixel blocks of a 4:2:2 row s into
+// YCbCr444 d as both hold and returns the number of pixels written.
+func expand422(d, s []byte, masks *expandMasks) int {
+	blocks := min(len(d)/24, len(s)/16)
+	if blocks == 0 {
+		return 0
+	}
+	expand422NEON(&d[0], &s[0], blocks, masks)
+	return blocks * 8
+}
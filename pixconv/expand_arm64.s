@@ -0,0 +1,26 @@
+//go:build arm64 && !purego
+// +build arm64,!purego
+
+#include "textflag.h"
+
+// func expand422NEON(dst, src *byte, blocks int, masks *expandMasks)
+TEXT ·expand422NEON(SB), NOSPLIT, $0-32
+	MOVD dst+0(FP), R0
+	MOVD src+8(FP), R1
+	MOVD blocks+16(FP), R2
+	MOVD masks+24(FP), R3
+	VLD1 (R3), [V1.B16, V2.B16]
+
+loop:
+	CBZ    R2, done
+	VLD1.P 16(R1), [V0.B16]
+	VTBL   V1.B16, [V0.B16], V3.B16
+	VTBL   V2.B16, [V0.B16], V4.B16
+	VST1.P [V3.B16], 16(R0)
+	VMOV   V4.D[0], R4
+	MOVD.P R4, 8(R0)
+	SUB    $1, R2
+	B      loop
+
+done:
+	RET
@@ -0,0 +1,10 @@
+//go:build (!amd64 && !arm64) || purego
+// +build !amd64,!arm64 purego
+
+package pixconv
+
+// expand422 has no assembly version on this platform; the callers' Go
+// loops do all the work.
+func expand422(d, s []byte, masks *expandMasks) int {
+	return 0
+}
@@ -0,0 +1,248 @@
+package pixconv
+
+// Dedicated kernels for the conversions on the capture and output paths:
+// camera formats into YCbCr444 and YCbCr444 into the formats virtual
+// cameras and encoders take. They work on whole rows without the
+// intermediate component rows of convertRows, and their loops are written so
+// the compiler can drop the bounds checks.
+
+// kernel converts rows [y0, y1) of src into dst; y0 is even. k is set for
+// conversions between YCbCr and RGB.
+type kernel func(dst, src *Image, k *coefficients, y0, y1 int)
+
+// fastKernel returns the dedicated kernel for a conversion, or nil.
+func fastKernel(dst, src Format) kernel {
+	switch {
+	case dst == YCbCr444 && (src == YUYV || src == UYVY):
+		return packed422To444
+	case dst == YCbCr444 && (src == NV12 || src == NV21):
+		return semiPlanarTo444
+	case dst == YCbCr444 && src == I420:
+		return i420To444
+	case src == YCbCr444 && (dst == YUYV || dst == UYVY):
+		return ycc444ToPacked422
+	case src == YCbCr444 && (dst == NV12 || dst == NV21 || dst == I420):
+		return ycc444To420
+	case dst == YCbCr444 && src.isRGB():
+		return rgbTo444
+	case src == YCbCr444 && dst.isRGB():
+		return ycc444ToRGB
+	}
+	return nil
+}
+
+// expandMasks holds byte shuffles turning 16 bytes of 4:2:2 (8 pixels) into
+// 24 bytes of YCbCr444: output byte j is input byte mask[j], or zero for
+// 0xff. The assembly kernels use them as shuffle tables.
+type expandMasks [32]byte
+
+func newExpandMasks(yOff, cOff int) *expandMasks {
+	var m expandMasks
+	for i := range m {
+		m[i] = 0xff
+	}
+	for j := 0; j < 24; j++ {
+		p, c := j/3, j%3
+		if c == 0 {
+			m[j] = byte(p/2*4 + p%2*2 + yOff)
+		} else {
+			m[j] = byte(p/2*4 + cOff + (c-1)*2)
+		}
+	}
+	return &m
+}
+
+var (
+	yuyvMasks = newExpandMasks(0, 1)
+	uyvyMasks = newExpandMasks(1, 0)
+)
+
+func packed422To444(dst, src *Image, _ *coefficients, y0, y1 int) {
+	w := src.Width
+	yOff, cOff, masks := 0, 1, yuyvMasks
+	if src.Format == UYVY {
+		yOff, cOff, masks = 1, 0, uyvyMasks
+	}
+	rowBytes, _ := src.Format.planeSize(0, w, 1)
+	for y := y0; y < y1; y++ {
+		s := src.Planes[0][y*src.Strides[0] : y*src.Strides[0]+rowBytes]
+		d := dst.Planes[0][y*dst.Strides[0] : y*dst.Strides[0]+w*3]
+
+		// The assembly kernels handle whole blocks of 8 pixels.
+		if n := expand422(d, s, masks); n > 0 {
+			d, s = d[n*3:], s[n*2:]
+		}
+		for len(d) >= 6 && len(s) >= 4 {
+			cb, cr := s[cOff], s[cOff+2]
+			d[0], d[1], d[2] = s[yOff], cb, cr
+			d[3], d[4], d[5] = s[yOff+2], cb, cr
+			d, s = d[6:], s[4:]
+		}
+		if len(d) >= 3 && len(s) >= 4 {
+			d[0], d[1], d[2] = s[yOff], s[cOff], s[cOff+2]
+		}
+	}
+}
+
+func semiPlanarTo444(dst, src *Image, _ *coefficients, y0, y1 int) {
+	w := src.Width
+	iCb, iCr := 0, 1
+	if src.Format == NV21 {
+		iCb, iCr = 1, 0
+	}
+	for y := y0; y < y1; y++ {
+		luma := src.Planes[0][y*src.Strides[0] : y*src.Strides[0]+w]
+		uv := src.Planes[1][y/2*src.Strides[1] : y/2*src.Strides[1]+(w+1)/2*2]
+		d := dst.Planes[0][y*dst.Strides[0] : y*dst.Strides[0]+w*3]
+		for len(d) >= 6 && len(luma) >= 2 && len(uv) >= 2 {
+			cb, cr := uv[iCb], uv[iCr]
+			d[0], d[1], d[2] = luma[0], cb, cr
+			d[3], d[4], d[5] = luma[1], cb, cr
+			d, luma, uv = d[6:], luma[2:], uv[2:]
+		}
+		if len(d) >= 3 && len(luma) >= 1 && len(uv) >= 2 {
+			d[0], d[1], d[2] = luma[0], uv[iCb], uv[iCr]
+		}
+	}
+}
+
+func i420To444(dst, src *Image, _ *coefficients, y0, y1 int) {
+	w := src.Width
+	cw := (w + 1) / 2
+	for y := y0; y < y1; y++ {
+		luma := src.Planes[0][y*src.Strides[0] : y*src.Strides[0]+w]
+		cb := src.Planes[1][y/2*src.Strides[1] : y/2*src.Strides[1]+cw]
+		cr := src.Planes[2][y/2*src.Strides[2] : y/2*src.Strides[2]+cw]
+		d := dst.Planes[0][y*dst.Strides[0] : y*dst.Strides[0]+w*3]
+		for len(d) >= 6 && len(luma) >= 2 && len(cb) >= 1 && len(cr) >= 1 {
+			d[0], d[1], d[2] = luma[0], cb[0], cr[0]
+			d[3], d[4], d[5] = luma[1], cb[0], cr[0]
+			d, luma, cb, cr = d[6:], luma[2:], cb[1:], cr[1:]
+		}
+		if len(d) >= 3 && len(luma) >= 1 && len(cb) >= 1 && len(cr) >= 1 {
+			d[0], d[1], d[2] = luma[0], cb[0], cr[0]
+		}
+	}
+}
+
+func ycc444ToPacked422(dst, src *Image, _ *coefficients, y0, y1 int) {
+	w := src.Width
+	yOff, cOff := 0, 1
+	if dst.Format == UYVY {
+		yOff, cOff = 1, 0
+	}
+	rowBytes, _ := dst.Format.planeSize(0, w, 1)
+	for y := y0; y < y1; y++ {
+		s := src.Planes[0][y*src.Strides[0] : y*src.Strides[0]+w*3]
+		d := dst.Planes[0][y*dst.Strides[0] : y*dst.Strides[0]+rowBytes]
+		for len(s) >= 6 && len(d) >= 4 {
+			d[yOff] = s[0]
+			d[yOff+2] = s[3]
+			d[cOff] = byte((uint(s[1]) + uint(s[4]) + 1) >> 1)
+			d[cOff+2] = byte((uint(s[2]) + uint(s[5]) + 1) >> 1)
+			s, d = s[6:], d[4:]
+		}
+		if len(s) >= 3 && len(d) >= 4 {
+			// The last pixel of an odd row fills both halves of its pair.
+			d[yOff], d[yOff+2], d[cOff], d[cOff+2] = s[0], s[0], s[1], s[2]
+		}
+	}
+}
+
+func ycc444To420(dst, src *Image, _ *coefficients, y0, y1 int) {
+	w := src.Width
+	cw := (w + 1) / 2
+	for y := y0; y < y1; y += 2 {
+		top := src.Planes[0][y*src.Strides[0] : y*src.Strides[0]+w*3]
+		bottom := top
+		if y+1 < y1 {
+			bottom = src.Planes[0][(y+1)*src.Strides[0] : (y+1)*src.Strides[0]+w*3]
+			lumaRow(dst.Planes[0][(y+1)*dst.Strides[0]:(y+1)*dst.Strides[0]+w], bottom)
+		}
+		lumaRow(dst.Planes[0][y*dst.Strides[0]:y*dst.Strides[0]+w], top)
+
+		var cb, cr []byte
+		step := 1
+		switch dst.Format {
+		case I420:
+			cb = dst.Planes[1][y/2*dst.Strides[1] : y/2*dst.Strides[1]+cw]
+			cr = dst.Planes[2][y/2*dst.Strides[2] : y/2*dst.Strides[2]+cw]
+		case NV12:
+			uv := dst.Planes[1][y/2*dst.Strides[1] : y/2*dst.Strides[1]+cw*2]
+			cb, cr, step = uv, uv[1:], 2
+		case NV21:
+			uv := dst.Planes[1][y/2*dst.Strides[1] : y/2*dst.Strides[1]+cw*2]
+			cr, cb, step = uv, uv[1:], 2
+		}
+		for i := 0; len(top) >= 6 && len(bottom) >= 6; i += step {
+			cb[i] = byte((uint(top[1]) + uint(top[4]) + uint(bottom[1]) + uint(bottom[4]) + 2) >> 2)
+			cr[i] = byte((uint(top[2]) + uint(top[5]) + uint(bottom[2]) + uint(bottom[5]) + 2) >> 2)
+			top, bottom = top[6:], bottom[6:]
+		}
+		if len(top) >= 3 && len(bottom) >= 3 {
+			i := (cw - 1) * step
+			cb[i] = byte((uint(top[1]) + uint(bottom[1]) + 1) >> 1)
+			cr[i] = byte((uint(top[2]) + uint(bottom[2]) + 1) >> 1)
+		}
+	}
+}
+
+// lumaRow copies the Y samples of a YCbCr444 row.
+func lumaRow(d, s []byte) {
+	for len(d) >= 1 && len(s) >= 3 {
+		d[0] = s[0]
+		d, s = d[1:], s[3:]
+	}
+}
+
+// rgbLayout returns the byte offsets of R, G and B and the sample size of
+// an RGB format.
+func rgbLayout(f Format) (r, g, b, size int) {
+	switch f {
+	case BGR24:
+		return 2, 1, 0, 3
+	case RGBA:
+		return 0, 1, 2, 4
+	case BGRA:
+		return 2, 1, 0, 4
+	}
+	return 0, 1, 2, 3
+}
+
+func rgbTo444(dst, src *Image, k *coefficients, y0, y1 int) {
+	w := src.Width
+	ir, ig, ib, size := rgbLayout(src.Format)
+	kc := *k
+	for y := y0; y < y1; y++ {
+		s := src.Planes[0][y*src.Strides[0] : y*src.Strides[0]+w*size]
+		d := dst.Planes[0][y*dst.Strides[0] : y*dst.Strides[0]+w*3]
+		for len(s) >= size && len(d) >= 3 {
+			R, G, B := int32(s[ir]), int32(s[ig]), int32(s[ib])
+			d[0] = clamp((kc.yR*R+kc.yG*G+kc.yB*B+fixedHalf)>>fixedShift + kc.yOff)
+			d[1] = clamp((kc.cbR*R+kc.cbG*G+kc.cbB*B+fixedHalf)>>fixedShift + 128)
+			d[2] = clamp((kc.crR*R+kc.crG*G+kc.crB*B+fixedHalf)>>fixedShift + 128)
+			s, d = s[size:], d[3:]
+		}
+	}
+}
+
+func ycc444ToRGB(dst, src *Image, k *coefficients, y0, y1 int) {
+	w := src.Width
+	ir, ig, ib, size := rgbLayout(dst.Format)
+	kc := *k
+	for y := y0; y < y1; y++ {
+		s := src.Planes[0][y*src.Strides[0] : y*src.Strides[0]+w*3]
+		d := dst.Planes[0][y*dst.Strides[0] : y*dst.Strides[0]+w*size]
+		for len(s) >= 3 && len(d) >= size {
+			Y := (int32(s[0]) - kc.yOff) * kc.yScale
+			Cb, Cr := int32(s[1])-128, int32(s[2])-128
+			d[ir] = clamp((Y + kc.rCr*Cr + fixedHalf) >> fixedShift)
+			d[ig] = clamp((Y + kc.gCb*Cb + kc.gCr*Cr + fixedHalf) >> fixedShift)
+			d[ib] = clamp((Y + kc.bCb*Cb + fixedHalf) >> fixedShift)
+			if size == 4 {
+				d[3] = 255
+			}
+			s, d = s[3:], d[size:]
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package pixconv
+
+import (
+	"runtime"
+	"sync"
+)
+
+// MinStripePixels is the least work, in pixels, handed to a goroutine of
+// its own; below it the scheduling overhead outweighs the gain. Callers
+// splitting their own loops across CPUs use it too.
+const MinStripePixels = 64 << 10
+
+// parallelRows calls fn for consecutive stripes [y0, y1) covering height
+// rows, concurrently when the image is large enough. Stripes start at even
+// rows so 4:2:0 chroma rows are never shared between goroutines.
+func parallelRows(width, height int, fn func(y0, y1 int)) {
+	workers := min(runtime.GOMAXPROCS(0), width*height/MinStripePixels, (height+1)/2)
+	if workers <= 1 {
+		fn(0, height)
+		return
+	}
+
+	rows := ((height+workers-1)/workers + 1) &^ 1
+	var wg sync.WaitGroup
+	for y0 := 0; y0 < height; y0 += rows {
+		wg.Add(1)
+		go func(y0, y1 int) {
+			defer wg.Done()
+			fn(y0, y1)
+		}(y0, min(y0+rows, height))
+	}
+	wg.Wait()
+}
@@ -0,0 +1,251 @@
+// Package pixconv converts raw images between the pixel formats used by
+// cameras, encoders and displays: packed and planar YCbCr at 4:4:4, 4:2:2
+// and 4:2:0, 8-bit RGB variants and grayscale.
+//
+// Images carry explicit row strides for every plane, so buffers handed out
+// by drivers can be converted in place without repacking, and conversions
+// between YCbCr and RGB take an explicit Colorimetry. The package is pure Go
+// and has no platform dependencies.
+package pixconv
+
+import "fmt"
+
+// Format identifies the memory layout of an Image.
+type Format int
+
+const (
+	// YCbCr444 is packed Y, Cb, Cr with 3 bytes per pixel, the frame layout
+	// used throughout gocam.
+	YCbCr444 Format = iota
+	// I420 is planar 4:2:0: a Y plane followed by Cb and Cr planes at half
+	// resolution in both directions.
+	I420
+	// NV12 is a Y plane and an interleaved CbCr plane at 4:2:0.
+	NV12
+	// NV21 is NV12 with Cr before Cb.
+	NV21
+	// YUYV is packed 4:2:2 with the byte order Y0 Cb Y1 Cr.
+	YUYV
+	// UYVY is packed 4:2:2 with the byte order Cb Y0 Cr Y1.
+	UYVY
+	// RGB24 is packed R, G, B.
+	RGB24
+	// BGR24 is packed B, G, R.
+	BGR24
+	// RGBA is packed R, G, B, A. Alpha is ignored on input and opaque on
+	// output.
+	RGBA
+	// BGRA is packed B, G, R, A.
+	BGRA
+	// Gray is 8-bit luma, interpreted with the range of the Colorimetry.
+	Gray
+)
+
+func (f Format) String() string {
+	switch f {
+	case YCbCr444:
+		return "YCbCr444"
+	case I420:
+		return "I420"
+	case NV12:
+		return "NV12"
+	case NV21:
+		return "NV21"
+	case YUYV:
+		return "YUYV"
+	case UYVY:
+		return "UYVY"
+	case RGB24:
+		return "RGB24"
+	case BGR24:
+		return "BGR24"
+	case RGBA:
+		return "RGBA"
+	case BGRA:
+		return "BGRA"
+	case Gray:
+		return "Gray"
+	}
+	return "unknown"
+}
+
+// PlaneCount returns the number of planes of the format: 3 for I420, 2 for
+// NV12 and NV21 and 1 for everything else. It returns 0 for unknown formats.
+func (f Format) PlaneCount() int {
+	switch f {
+	case I420:
+		return 3
+	case NV12, NV21:
+		return 2
+	case YCbCr444, YUYV, UYVY, RGB24, BGR24, RGBA, BGRA, Gray:
+		return 1
+	}
+	return 0
+}
+
+// isRGB reports whether the samples of f are RGB rather than YCbCr.
+func (f Format) isRGB() bool {
+	return f == RGB24 || f == BGR24 || f == RGBA || f == BGRA
+}
+
+// planeSize returns the bytes per row and the number of rows of a plane for
+// a width x height image.
+func (f Format) planeSize(plane, width, height int) (rowBytes, rows int) {
+	chromaW := (width + 1) / 2
+	chromaH := (height + 1) / 2
+	if plane > 0 {
+		if f == I420 {
+			return chromaW, chromaH
+		}
+		return chromaW * 2, chromaH
+	}
+	switch f {
+	case YCbCr444, RGB24, BGR24:
+		return width * 3, height
+	case RGBA, BGRA:
+		return width * 4, height
+	case YUYV, UYVY:
+		return chromaW * 4, height
+	}
+	return width, height
+}
+
+// MinStride returns the smallest valid stride of the first plane for the
+// given width.
+func (f Format) MinStride(width int) int {
+	rowBytes, _ := f.planeSize(0, width, 1)
+	if f == NV12 || f == NV21 {
+		// Wrap derives the chroma stride from the luma stride.
+		return (width + 1) &^ 1
+	}
+	return rowBytes
+}
+
+// Size returns the bytes of a tightly packed width x height image.
+func (f Format) Size(width, height int) int {
+	strides := f.strides(f.MinStride(width))
+	size := 0
+	for p := 0; p < f.PlaneCount(); p++ {
+		_, rows := f.planeSize(p, width, height)
+		size += strides[p] * rows
+	}
+	return size
+}
+
+// strides returns the plane strides that go with a first-plane stride in
+// a contiguous buffer.
+func (f Format) strides(stride int) [3]int {
+	switch f {
+	case I420:
+		return [3]int{stride, (stride + 1) / 2, (stride + 1) / 2}
+	case NV12, NV21:
+		return [3]int{stride, (stride + 1) &^ 1}
+	}
+	return [3]int{stride}
+}
+
+// Image is a raw image in one of the supported formats. Plane p holds rows
+// of Strides[p] bytes; the last row of a plane may be shorter than its
+// stride. Unused planes are nil.
+type Image struct {
+	Format Format
+	Width  int
+	Height int
+
+	Planes  [3][]byte
+	Strides [3]int
+}
+
+// New allocates a tightly packed image.
+func New(f Format, width, height int) *Image {
+	img, err := Wrap(f, width, height, make([]byte, f.Size(width, height)), 0)
+	if err != nil {
+		panic(err)
+	}
+	return img
+}
+
+// Wrap lays an image over a single buffer holding its planes back to back,
+// as V4L2 and most capture APIs deliver them. stride is the row stride of
+// the first plane, or 0 for tightly packed rows. The chroma stride follows
+// from it: half of it for I420, and the same rounded up to even for NV12
+// and NV21.
+func Wrap(f Format, width, height int, data []byte, stride int) (*Image, error) {
+	n := f.PlaneCount()
+	if n == 0 {
+		return nil, fmt.Errorf("pixconv: unknown format %d", int(f))
+	}
+	if width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("pixconv: invalid size %dx%d", width, height)
+	}
+	if stride == 0 {
+		stride = f.MinStride(width)
+	}
+	if stride < 0 {
+		return nil, fmt.Errorf("pixconv: invalid stride %d", stride)
+	}
+	if width > len(data) || height > len(data) {
+		// Every format needs a byte per pixel; this also keeps the plane
+		// sizes below from overflowing.
+		return nil, fmt.Errorf("pixconv: %v buffer too short for %dx%d", f, width, height)
+	}
+
+	img := &Image{Format: f, Width: width, Height: height, Strides: f.strides(stride)}
+	off := 0
+	for p := 0; p < n; p++ {
+		_, rows := f.planeSize(p, width, height)
+		size := img.Strides[p] * rows
+		if p == n-1 || img.Strides[p] > len(data) || off+size > len(data) {
+			// The last plane may omit the padding of its last row.
+			size = len(data) - off
+			if size < 0 {
+				size = 0
+			}
+		}
+		img.Planes[p] = data[off : off+size]
+		off += size
+	}
+	if err := img.Validate(); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// Validate checks that the planes and strides of img hold a full image.
+func (img *Image) Validate() error {
+	n := img.Format.PlaneCount()
+	if n == 0 {
+		return fmt.Errorf("pixconv: unknown format %d", int(img.Format))
+	}
+	if img.Width <= 0 || img.Height <= 0 {
+		return fmt.Errorf("pixconv: invalid size %dx%d", img.Width, img.Height)
+	}
+	for p := 0; p < n; p++ {
+		rowBytes, rows := img.Format.planeSize(p, img.Width, img.Height)
+		stride := img.Strides[p]
+		if stride < rowBytes {
+			return fmt.Errorf("pixconv: %v plane %d stride %d below %d", img.Format, p, stride, rowBytes)
+		}
+		if len(img.Planes[p]) < rowBytes || (len(img.Planes[p])-rowBytes)/stride < rows-1 {
+			return fmt.Errorf("pixconv: %v plane %d too short for %dx%d", img.Format, p, img.Width, img.Height)
+		}
+	}
+	return nil
+}
+
+// Bytes returns the image as one tightly packed buffer with the planes back
+// to back, the layout Wrap accepts with a zero stride. It copies unless the
+// image already has that layout.
+func (img *Image) Bytes() []byte {
+	size := img.Format.Size(img.Width, img.Height)
+	if img.Format.PlaneCount() == 1 && img.Strides[0] == img.Format.MinStride(img.Width) {
+		return img.Planes[0][:size]
+	}
+	buf := make([]byte, size)
+	out, err := Wrap(img.Format, img.Width, img.Height, buf, 0)
+	if err != nil {
+		panic(err)
+	}
+	copyPlanes(out, img)
+	return buf
+}
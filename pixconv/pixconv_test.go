@@ -0,0 +1,300 @@
+package pixconv
+
+import (
+	"bytes"
+	"image/color"
+	"math/rand"
+	"runtime"
+	"testing"
+)
+
+var allFormats = []Format{YCbCr444, I420, NV12, NV21, YUYV, UYVY, RGB24, BGR24, RGBA, BGRA, Gray}
+
+// blockImage returns a YCbCr444 image whose chroma is constant over 2x2
+// blocks, so it survives 4:2:0 and 4:2:2 round trips unchanged.
+func blockImage(w, h int, seed int64) *Image {
+	rng := rand.New(rand.NewSource(seed))
+	img := New(YCbCr444, w, h)
+	chroma := make([]byte, ((w+1)/2)*((h+1)/2)*2)
+	rng.Read(chroma)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := img.Planes[0][y*img.Strides[0]+x*3:]
+			c := chroma[((y/2)*((w+1)/2)+x/2)*2:]
+			p[0], p[1], p[2] = byte(rng.Intn(256)), c[0], c[1]
+		}
+	}
+	return img
+}
+
+func TestRoundTripYCbCr(t *testing.T) {
+	for _, f := range []Format{YCbCr444, I420, NV12, NV21, YUYV, UYVY} {
+		for _, size := range [][2]int{{8, 6}, {7, 5}, {1, 1}} {
+			src := blockImage(size[0], size[1], int64(f))
+			mid := New(f, size[0], size[1])
+			back := New(YCbCr444, size[0], size[1])
+			if err := Convert(mid, src, JFIF); err != nil {
+				t.Fatalf("%v: %v", f, err)
+			}
+			if err := Convert(back, mid, JFIF); err != nil {
+				t.Fatalf("%v: %v", f, err)
+			}
+			if !bytes.Equal(back.Bytes(), src.Bytes()) {
+				t.Errorf("%v %dx%d: round trip changed the image", f, size[0], size[1])
+			}
+		}
+	}
+}
+
+// TestKernelsMatchGeneric checks the dedicated kernels, including the
+// assembly ones, against the generic row converter.
+func TestKernelsMatchGeneric(t *testing.T) {
+	for _, from := range allFormats {
+		for _, to := range allFormats {
+			if fastKernel(to, from) == nil {
+				continue
+			}
+			for _, size := range [][2]int{{1, 1}, {7, 5}, {8, 2}, {33, 9}, {64, 3}} {
+				w, h := size[0], size[1]
+				src := New(from, w, h)
+				rand.New(rand.NewSource(int64(w))).Read(src.Planes[0][:cap(src.Planes[0])])
+				got, want := New(to, w, h), New(to, w, h)
+				if err := Convert(got, src, Rec709); err != nil {
+					t.Fatal(err)
+				}
+				var k *coefficients
+				if from.isRGB() != to.isRGB() {
+					k = Rec709.coefficients()
+				}
+				convertRows(want, src, k, 0, h)
+				if !bytes.Equal(got.Bytes(), want.Bytes()) {
+					t.Errorf("%v -> %v %dx%d: kernel differs from generic conversion", from, to, w, h)
+				}
+			}
+		}
+	}
+}
+
+func TestParallelMatchesSerial(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	const w, h = 1001, 301 // several stripes, odd sizes
+	for _, from := range allFormats {
+		src := New(from, w, h)
+		rand.New(rand.NewSource(2)).Read(src.Planes[0][:cap(src.Planes[0])])
+		for _, to := range []Format{YCbCr444, NV12, I420, RGBA} {
+			if to == from {
+				continue
+			}
+			got, want := New(to, w, h), New(to, w, h)
+			if err := Convert(got, src, JFIF); err != nil {
+				t.Fatal(err)
+			}
+			var k *coefficients
+			if from.isRGB() != to.isRGB() {
+				k = JFIF.coefficients()
+			}
+			convertRows(want, src, k, 0, h)
+			if !bytes.Equal(got.Bytes(), want.Bytes()) {
+				t.Errorf("%v -> %v: striped conversion differs", from, to)
+			}
+		}
+	}
+}
+
+func TestConvertRGB(t *testing.T) {
+	colors := [][3]byte{{0, 0, 0}, {255, 255, 255}, {255, 0, 0}, {0, 255, 0}, {0, 0, 255}, {12, 200, 99}}
+	src := New(RGB24, len(colors), 1)
+	for i, c := range colors {
+		copy(src.Planes[0][i*3:], c[:])
+	}
+
+	ycc := New(YCbCr444, len(colors), 1)
+	if err := Convert(ycc, src, JFIF); err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range colors {
+		y, cb, cr := color.RGBToYCbCr(c[0], c[1], c[2])
+		got := ycc.Planes[0][i*3 : i*3+3]
+		for j, want := range []byte{y, cb, cr} {
+			if d := int(got[j]) - int(want); d > 1 || d < -1 {
+				t.Errorf("%v: got %v, want %v", c, got, []byte{y, cb, cr})
+				break
+			}
+		}
+	}
+
+	// Through every RGB layout and back.
+	for _, f := range []Format{BGR24, RGBA, BGRA} {
+		mid := New(f, len(colors), 1)
+		back := New(RGB24, len(colors), 1)
+		if err := Convert(mid, ycc, JFIF); err != nil {
+			t.Fatal(err)
+		}
+		if err := Convert(back, mid, JFIF); err != nil {
+			t.Fatal(err)
+		}
+		for i := range back.Planes[0] {
+			if d := int(back.Planes[0][i]) - int(src.Planes[0][i]); d > 2 || d < -2 {
+				t.Errorf("%v: round trip %v, want %v", f, back.Planes[0], src.Planes[0])
+				break
+			}
+		}
+		if f == RGBA && mid.Planes[0][3] != 255 {
+			t.Errorf("RGBA alpha = %d, want 255", mid.Planes[0][3])
+		}
+	}
+
+	red, bgr := New(RGB24, 1, 1), New(BGR24, 1, 1)
+	copy(red.Planes[0], []byte{255, 0, 0})
+	if err := Convert(bgr, red, JFIF); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bgr.Planes[0], []byte{0, 0, 255}) {
+		t.Errorf("BGR24 of red = %v", bgr.Planes[0])
+	}
+}
+
+func TestColorimetryRange(t *testing.T) {
+	src := New(RGB24, 2, 1)
+	copy(src.Planes[0], []byte{0, 0, 0, 255, 255, 255})
+	for _, cs := range []Colorimetry{Rec601, Rec709, Rec2020} {
+		dst := New(YCbCr444, 2, 1)
+		if err := Convert(dst, src, cs); err != nil {
+			t.Fatal(err)
+		}
+		if want := []byte{16, 128, 128, 235, 128, 128}; !bytes.Equal(dst.Planes[0], want) {
+			t.Errorf("%v: black and white = %v, want %v", cs, dst.Planes[0], want)
+		}
+	}
+
+	// Pure red differs between the matrices. Rec601 uses the 8-bit integer
+	// matrix, one level above the exact 81.
+	red := New(RGB24, 1, 1)
+	copy(red.Planes[0], []byte{255, 0, 0})
+	y601, y709 := New(Gray, 1, 1), New(Gray, 1, 1)
+	Convert(y601, red, Rec601)
+	Convert(y709, red, Rec709)
+	if y601.Planes[0][0] != 82 || y709.Planes[0][0] != 63 {
+		t.Errorf("red luma = %d (BT.601), %d (BT.709), want 82, 63", y601.Planes[0][0], y709.Planes[0][0])
+	}
+}
+
+func TestNV21SwapsChroma(t *testing.T) {
+	src := New(YCbCr444, 2, 2)
+	for i := 0; i < 4; i++ {
+		copy(src.Planes[0][i*3:], []byte{50, 10, 200})
+	}
+	nv12, nv21 := New(NV12, 2, 2), New(NV21, 2, 2)
+	Convert(nv12, src, JFIF)
+	Convert(nv21, src, JFIF)
+	if !bytes.Equal(nv12.Planes[1], []byte{10, 200}) || !bytes.Equal(nv21.Planes[1], []byte{200, 10}) {
+		t.Errorf("chroma NV12 %v, NV21 %v", nv12.Planes[1], nv21.Planes[1])
+	}
+}
+
+func TestStrides(t *testing.T) {
+	const w, h, pad = 5, 3, 7
+	src := blockImage(w, h, 1)
+	for _, f := range allFormats {
+		stride := f.MinStride(w) + pad
+		buf := make([]byte, f.strides(stride)[0]*h*3)
+		padded, err := Wrap(f, w, h, buf, stride)
+		if err != nil {
+			t.Fatalf("%v: %v", f, err)
+		}
+		tight := New(f, w, h)
+		if err := Convert(padded, src, JFIF); err != nil {
+			t.Fatal(err)
+		}
+		if err := Convert(tight, src, JFIF); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(padded.Bytes(), tight.Bytes()) {
+			t.Errorf("%v: padded rows differ from packed rows", f)
+		}
+	}
+}
+
+func TestWrapErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		f      Format
+		w, h   int
+		n      int
+		stride int
+	}{
+		{"unknown format", Format(99), 4, 4, 100, 0},
+		{"zero size", YCbCr444, 0, 4, 100, 0},
+		{"short stride", RGBA, 4, 4, 100, 8},
+		{"negative stride", RGBA, 4, 4, 100, -16},
+		{"short buffer", YUYV, 4, 4, 31, 0},
+		{"short chroma", I420, 4, 4, 23, 0},
+	}
+	for _, tt := range tests {
+		if _, err := Wrap(tt.f, tt.w, tt.h, make([]byte, tt.n), tt.stride); err == nil {
+			t.Errorf("%s: Wrap succeeded", tt.name)
+		}
+	}
+	for _, f := range allFormats {
+		if _, err := Wrap(f, 7, 5, make([]byte, f.Size(7, 5)), 0); err != nil {
+			t.Errorf("%v: packed buffer of Size rejected: %v", f, err)
+		}
+	}
+	if err := Convert(New(RGB24, 4, 4), New(RGB24, 4, 3), JFIF); err == nil {
+		t.Errorf("Convert accepted images of different sizes")
+	}
+}
+
+func FuzzWrapConvert(f *testing.F) {
+	f.Add([]byte{1, 2, 3, 4, 5, 6}, 1, 2, 2, 0, 6)
+	f.Fuzz(func(t *testing.T, data []byte, from, to, w, h, stride int) {
+		if w > 256 || h > 256 || from < 0 || to < 0 {
+			return
+		}
+		src, err := Wrap(Format(from%len(allFormats)), w, h, data[:len(data):len(data)], stride)
+		if err != nil {
+			return
+		}
+		dst := New(Format(to%len(allFormats)), w, h)
+		if err := Convert(dst, src, Colorimetry{Matrix: Matrix(stride & 3), Range: Range(h & 1)}); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+var benchSizes = []struct {
+	name string
+	w, h int
+}{
+	{"480p", 640, 480},
+	{"720p", 1280, 720},
+	{"1080p", 1920, 1080},
+}
+
+// BenchmarkConvert measures conversions from every format into YCbCr444,
+// the capture path, and from YCbCr444 into every format, the output path.
+func BenchmarkConvert(b *testing.B) {
+	for _, f := range allFormats {
+		for _, size := range benchSizes {
+			src, dst := New(f, size.w, size.h), New(YCbCr444, size.w, size.h)
+			rand.New(rand.NewSource(1)).Read(src.Planes[0][:cap(src.Planes[0])])
+			b.Run("to444/"+f.String()+"/"+size.name, func(b *testing.B) {
+				benchConvert(b, dst, src)
+			})
+			b.Run("from444/"+f.String()+"/"+size.name, func(b *testing.B) {
+				benchConvert(b, src, dst)
+			})
+		}
+	}
+}
+
+func benchConvert(b *testing.B, dst, src *Image) {
+	b.SetBytes(int64(src.Format.Size(src.Width, src.Height)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := Convert(dst, src, Rec601); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N), "ns/frame")
+}
@@ -0,0 +1,320 @@
+package gocam
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/svanichkin/gocam/pixconv"
+)
+
+// RawFormat selects the pixel layout written by RawWriter. The names are
+// ffmpeg's pix_fmt names.
+type RawFormat int
+
+const (
+	// RawYUV444P is planar 4:4:4, losslessly matching Frame.Data.
+	RawYUV444P RawFormat = iota
+	// RawYUV420P is planar 4:2:0 (I420), what most encoders take.
+	RawYUV420P
+	// RawNV12 is a Y plane followed by interleaved Cb, Cr at 4:2:0.
+	RawNV12
+	// RawRGB24 is packed R, G, B.
+	RawRGB24
+	// RawGray is the Y plane alone.
+	RawGray
+)
+
+// rawFormats lists the formats with their ffmpeg and GStreamer names.
+var rawFormats = []struct {
+	format    RawFormat
+	ffmpeg    string
+	gstreamer string
+}{
+	{RawYUV444P, "yuv444p", "Y444"},
+	{RawYUV420P, "yuv420p", "I420"},
+	{RawNV12, "nv12", "NV12"},
+	{RawRGB24, "rgb24", "RGB"},
+	{RawGray, "gray", "GRAY8"},
+}
+
+func (f RawFormat) String() string {
+	for _, rf := range rawFormats {
+		if rf.format == f {
+			return rf.ffmpeg
+		}
+	}
+	return "unknown"
+}
+
+// ParseRawFormat returns the format with the given ffmpeg pix_fmt name,
+// such as "yuv420p".
+func ParseRawFormat(name string) (RawFormat, error) {
+	for _, rf := range rawFormats {
+		if strings.EqualFold(rf.ffmpeg, name) {
+			return rf.format, nil
+		}
+	}
+	names := make([]string, len(rawFormats))
+	for i, rf := range rawFormats {
+		names[i] = rf.ffmpeg
+	}
+	return 0, fmt.Errorf("gocam: unknown raw pixel format %q (use %s)", name, strings.Join(names, ", "))
+}
+
+// gstreamer returns the GStreamer video format name.
+func (f RawFormat) gstreamer() string {
+	for _, rf := range rawFormats {
+		if rf.format == f {
+			return rf.gstreamer
+		}
+	}
+	return ""
+}
+
+// isYUV reports whether f carries YCbCr samples, which are full range.
+func (f RawFormat) isYUV() bool {
+	return f == RawYUV444P || f == RawYUV420P || f == RawNV12
+}
+
+// planes returns the bytes per row and the rows of each plane of a width x
+// height frame, tightly packed as ffmpeg lays out rawvideo.
+func (f RawFormat) planes(width, height int) [][2]int {
+	cw, ch := (width+1)/2, (height+1)/2
+	switch f {
+	case RawYUV444P:
+		return [][2]int{{width, height}, {width, height}, {width, height}}
+	case RawYUV420P:
+		return [][2]int{{width, height}, {cw, ch}, {cw, ch}}
+	case RawNV12:
+		return [][2]int{{width, height}, {2 * cw, ch}}
+	case RawRGB24:
+		return [][2]int{{3 * width, height}}
+	case RawGray:
+		return [][2]int{{width, height}}
+	}
+	return nil
+}
+
+// FrameSize returns the bytes of one width x height frame.
+func (f RawFormat) FrameSize(width, height int) int {
+	size := 0
+	for _, p := range f.planes(width, height) {
+		size += p[0] * p[1]
+	}
+	return size
+}
+
+// RawVideoInfo describes a headerless raw video stream, so the command
+// reading it can be told what to expect.
+type RawVideoInfo struct {
+	Format        RawFormat
+	Width, Height int
+	FPS           float64
+}
+
+// FFmpegArgs returns the ffmpeg input options for the stream read from
+// standard input, ending in "-i -". YUV formats are marked full range, as
+// gocam frames are JFIF.
+func (i RawVideoInfo) FFmpegArgs() []string {
+	num, den := rateFraction(i.fps())
+	args := []string{
+		"-f", "rawvideo",
+		"-pix_fmt", i.Format.String(),
+		"-s", fmt.Sprintf("%dx%d", i.Width, i.Height),
+		"-r", rateString(num, den),
+	}
+	if i.Format.isYUV() {
+		args = append(args, "-color_range", "pc")
+	}
+	return append(args, "-i", "-")
+}
+
+// GStreamerCaps returns the video/x-raw caps of the stream. Caps imply
+// GStreamer's default strides, which pad rows to multiples of 4 bytes, so
+// they match RawWriter's tightly packed rows only when every plane row
+// (width for gray, Y444 and NV12, 3*width for RGB, width/2 for the I420
+// chroma) already is one. GStreamerSource gives the layout explicitly.
+func (i RawVideoInfo) GStreamerCaps() string {
+	num, den := rateFraction(i.fps())
+	caps := fmt.Sprintf("video/x-raw,format=%s,width=%d,height=%d,framerate=%d/%d",
+		i.Format.gstreamer(), i.Width, i.Height, num, den)
+	if i.Format.isYUV() {
+		// Full range, BT.601 matrix.
+		caps += ",colorimetry=1:4:0:0"
+	}
+	return caps
+}
+
+// GStreamerSource returns the start of a gst-launch-1.0 pipeline reading
+// the stream from standard input; append elements such as
+// "! videoconvert ! autovideosink". rawvideoparse is given the plane
+// strides and offsets of the tightly packed frames, so any width works.
+func (i RawVideoInfo) GStreamerSource() string {
+	num, den := rateFraction(i.fps())
+	var strides, offsets []string
+	offset := 0
+	for _, p := range i.Format.planes(i.Width, i.Height) {
+		strides = append(strides, strconv.Itoa(p[0]))
+		offsets = append(offsets, strconv.Itoa(offset))
+		offset += p[0] * p[1]
+	}
+	src := fmt.Sprintf("fdsrc fd=0 ! rawvideoparse format=%s width=%d height=%d framerate=%d/%d "+
+		"plane-strides=\"<%s>\" plane-offsets=\"<%s>\" frame-size=%d",
+		strings.ToLower(i.Format.gstreamer()), i.Width, i.Height, num, den,
+		strings.Join(strides, ","), strings.Join(offsets, ","), offset)
+	if i.Format.isYUV() {
+		src += " colorimetry=1:4:0:0"
+	}
+	return src
+}
+
+func (i RawVideoInfo) fps() float64 {
+	if i.FPS <= 0 {
+		return defaultY4MFPS
+	}
+	return i.FPS
+}
+
+// rateString formats a frame rate fraction as ffmpeg takes it.
+func rateString(num, den int) string {
+	if den == 1 {
+		return strconv.Itoa(num)
+	}
+	return fmt.Sprintf("%d/%d", num, den)
+}
+
+// RawOptions configures a RawWriter.
+type RawOptions struct {
+	Format RawFormat
+	// FPS is reported by Info, usually Stream.Info().FPS; raw video has no
+	// header, so it only matters to the reading command. When zero, the
+	// rate is measured from the timestamps of the first two frames, and
+	// Info reports zero until then.
+	FPS float64
+}
+
+// RawWriter writes frames as headerless raw video, frame after frame, in
+// the layout ffmpeg reads with "-f rawvideo" and GStreamer with
+// rawvideoparse. The first frame fixes the size; frames of another size
+// are rejected.
+type RawWriter struct {
+	w    io.Writer
+	opts RawOptions
+
+	width, height int
+	buf           []byte
+	conv          *pixconv.Image
+	first         time.Time // timestamp of the first frame, to measure FPS
+}
+
+// NewRawWriter returns a writer emitting raw video to w. opts may be nil
+// for yuv444p.
+func NewRawWriter(w io.Writer, opts *RawOptions) *RawWriter {
+	rw := &RawWriter{w: w}
+	if opts != nil {
+		rw.opts = *opts
+	}
+	return rw
+}
+
+// Info describes the stream for the reading command. Width and Height are
+// zero until the first frame, unless set by SetSize.
+func (rw *RawWriter) Info() RawVideoInfo {
+	return RawVideoInfo{Format: rw.opts.Format, Width: rw.width, Height: rw.height, FPS: rw.opts.FPS}
+}
+
+// SetSize fixes the frame size before the first frame, so Info can be
+// reported up front, for example from Stream.Info.
+func (rw *RawWriter) SetSize(width, height int) error {
+	if rw.buf != nil {
+		return fmt.Errorf("gocam: raw video size already fixed at %dx%d", rw.width, rw.height)
+	}
+	if width <= 0 || height <= 0 {
+		return fmt.Errorf("gocam: invalid raw video size %dx%d", width, height)
+	}
+	rw.width, rw.height = width, height
+	return nil
+}
+
+// WriteFrame appends a frame to the stream.
+func (rw *RawWriter) WriteFrame(frame Frame) error {
+	if err := checkFrame(frame); err != nil {
+		return err
+	}
+	firstFrame := rw.buf == nil
+	if firstFrame {
+		if rw.opts.Format.planes(1, 1) == nil {
+			return fmt.Errorf("gocam: unsupported raw pixel format %v", rw.opts.Format)
+		}
+		if rw.width == 0 {
+			rw.width, rw.height = frame.Width, frame.Height
+		}
+		rw.buf = make([]byte, rw.opts.Format.FrameSize(rw.width, rw.height))
+	}
+	if frame.Width != rw.width || frame.Height != rw.height {
+		return fmt.Errorf("gocam: raw video frame size changed from %dx%d to %dx%d", rw.width, rw.height, frame.Width, frame.Height)
+	}
+	if rw.opts.FPS <= 0 {
+		if firstFrame {
+			rw.first = frame.Timestamp
+		} else {
+			rw.opts.FPS = measuredFPS(rw.first, frame.Timestamp)
+		}
+	}
+
+	w, h := frame.Width, frame.Height
+	n := w * h
+	src := frame.Data[:3*n]
+	switch rw.opts.Format {
+	case RawYUV444P:
+		y, cb, cr := rw.buf[:n], rw.buf[n:2*n], rw.buf[2*n:3*n]
+		for i := range y {
+			p := src[i*3 : i*3+3]
+			y[i], cb[i], cr[i] = p[0], p[1], p[2]
+		}
+	case RawGray:
+		for i := range rw.buf {
+			rw.buf[i] = src[i*3]
+		}
+	default:
+		if err := rw.convert(frame); err != nil {
+			return err
+		}
+	}
+	_, err := rw.w.Write(rw.buf)
+	return err
+}
+
+// convert converts the frame with pixconv and packs the planes without the
+// row padding pixconv may use, as for odd NV12 widths.
+func (rw *RawWriter) convert(frame Frame) error {
+	if rw.conv == nil {
+		pf := map[RawFormat]pixconv.Format{RawYUV420P: pixconv.I420, RawNV12: pixconv.NV12, RawRGB24: pixconv.RGB24}[rw.opts.Format]
+		rw.conv = pixconv.New(pf, frame.Width, frame.Height)
+	}
+	src, err := pixconv.Wrap(pixconv.YCbCr444, frame.Width, frame.Height, frame.Data, 0)
+	if err != nil {
+		return err
+	}
+	if err := pixconv.Convert(rw.conv, src, pixconv.JFIF); err != nil {
+		return err
+	}
+	out := rw.buf
+	for p, size := range rw.opts.Format.planes(frame.Width, frame.Height) {
+		rowBytes, rows := size[0], size[1]
+		stride := rw.conv.Strides[p]
+		for y := 0; y < rows; y++ {
+			out = out[copy(out, rw.conv.Planes[p][y*stride:y*stride+rowBytes]):]
+		}
+	}
+	return nil
+}
+
+// Close does nothing: raw video has no trailer. It does not close the
+// underlying writer.
+func (rw *RawWriter) Close() error {
+	return nil
+}
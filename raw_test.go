@@ -0,0 +1,146 @@
+package gocam
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeRaw writes frames through a RawWriter and returns the stream.
+func writeRaw(t *testing.T, format RawFormat, frames ...Frame) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	rw := NewRawWriter(&buf, &RawOptions{Format: format})
+	for _, frame := range frames {
+		if err := rw.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRawWriterLayouts(t *testing.T) {
+	const w, h = 5, 3 // odd sizes exercise the chroma rounding
+	frame := colorFrame(w, h)
+	for _, tc := range []struct {
+		format RawFormat
+		size   int
+	}{
+		{RawYUV444P, 3 * w * h},
+		{RawYUV420P, w*h + 2*3*2},
+		{RawNV12, w*h + 6*2},
+		{RawRGB24, 3 * w * h},
+		{RawGray, w * h},
+	} {
+		if got := tc.format.FrameSize(w, h); got != tc.size {
+			t.Errorf("%v: FrameSize %d, want %d", tc.format, got, tc.size)
+		}
+		if out := writeRaw(t, tc.format, frame, frame); len(out) != 2*tc.size {
+			t.Errorf("%v: %d bytes for two frames, want %d", tc.format, len(out), 2*tc.size)
+		}
+	}
+
+	yuv := writeRaw(t, RawYUV444P, frame)
+	for i := 0; i < w*h; i++ {
+		for p := 0; p < 3; p++ {
+			if yuv[p*w*h+i] != frame.Data[i*3+p] {
+				t.Fatalf("yuv444p plane %d sample %d is %d, want %d", p, i, yuv[p*w*h+i], frame.Data[i*3+p])
+			}
+		}
+	}
+	if gray := writeRaw(t, RawGray, frame); !bytes.Equal(gray, yuv[:w*h]) {
+		t.Error("gray differs from the Y plane")
+	}
+
+	// NV12 carries the samples of yuv420p with the chroma interleaved.
+	i420 := writeRaw(t, RawYUV420P, frame)
+	nv12 := writeRaw(t, RawNV12, frame)
+	if !bytes.Equal(nv12[:w*h], i420[:w*h]) {
+		t.Error("nv12 luma differs from yuv420p")
+	}
+	for i := 0; i < 6; i++ {
+		if nv12[w*h+2*i] != i420[w*h+i] || nv12[w*h+2*i+1] != i420[w*h+6+i] {
+			t.Fatalf("nv12 chroma pair %d differs from yuv420p", i)
+		}
+	}
+
+	rw := NewRawWriter(&bytes.Buffer{}, nil)
+	if err := rw.WriteFrame(frame); err != nil {
+		t.Fatal(err)
+	}
+	if err := rw.WriteFrame(colorFrame(4, 4)); err == nil {
+		t.Error("size change accepted")
+	}
+}
+
+func TestRawWriterMeasuresFPS(t *testing.T) {
+	rw := NewRawWriter(io.Discard, nil)
+	frame := colorFrame(2, 2)
+	frame.Timestamp = time.Unix(100, 0)
+	if err := rw.WriteFrame(frame); err != nil {
+		t.Fatal(err)
+	}
+	if fps := rw.Info().FPS; fps != 0 {
+		t.Errorf("FPS %g after one frame, want 0", fps)
+	}
+	frame.Timestamp = frame.Timestamp.Add(time.Second / 30)
+	if err := rw.WriteFrame(frame); err != nil {
+		t.Fatal(err)
+	}
+	if fps := rw.Info().FPS; fps != 30 {
+		t.Errorf("measured FPS %g, want 30", fps)
+	}
+}
+
+func TestRawVideoInfo(t *testing.T) {
+	info := RawVideoInfo{Format: RawYUV420P, Width: 640, Height: 480, FPS: 30000.0 / 1001}
+	want := "-f rawvideo -pix_fmt yuv420p -s 640x480 -r 30000/1001 -color_range pc -i -"
+	if got := strings.Join(info.FFmpegArgs(), " "); got != want {
+		t.Errorf("ffmpeg args %q, want %q", got, want)
+	}
+	want = "video/x-raw,format=I420,width=640,height=480,framerate=30000/1001,colorimetry=1:4:0:0"
+	if got := info.GStreamerCaps(); got != want {
+		t.Errorf("caps %q, want %q", got, want)
+	}
+
+	info = RawVideoInfo{Format: RawRGB24, Width: 2, Height: 2}
+	if got := strings.Join(info.FFmpegArgs(), " "); got != "-f rawvideo -pix_fmt rgb24 -s 2x2 -r 25 -i -" {
+		t.Errorf("rgb24 ffmpeg args %q", got)
+	}
+	if got := info.GStreamerCaps(); got != "video/x-raw,format=RGB,width=2,height=2,framerate=25/1" {
+		t.Errorf("rgb24 caps %q", got)
+	}
+
+	// Rows are not padded, whatever the width.
+	for _, tc := range []struct {
+		format RawFormat
+		want   string
+	}{
+		{RawYUV420P, `format=i420 width=6 height=3 framerate=25/1 plane-strides="<6,3,3>" plane-offsets="<0,18,24>" frame-size=30 colorimetry=1:4:0:0`},
+		{RawNV12, `format=nv12 width=6 height=3 framerate=25/1 plane-strides="<6,6>" plane-offsets="<0,18>" frame-size=30 colorimetry=1:4:0:0`},
+		{RawYUV444P, `format=y444 width=6 height=3 framerate=25/1 plane-strides="<6,6,6>" plane-offsets="<0,18,36>" frame-size=54 colorimetry=1:4:0:0`},
+		{RawRGB24, `format=rgb width=6 height=3 framerate=25/1 plane-strides="<18>" plane-offsets="<0>" frame-size=54`},
+		{RawGray, `format=gray8 width=6 height=3 framerate=25/1 plane-strides="<6>" plane-offsets="<0>" frame-size=18`},
+	} {
+		info := RawVideoInfo{Format: tc.format, Width: 6, Height: 3}
+		want := "fdsrc fd=0 ! rawvideoparse " + tc.want
+		if got := info.GStreamerSource(); got != want {
+			t.Errorf("%v source %q, want %q", tc.format, got, want)
+		}
+	}
+
+	for _, name := range []string{"yuv444p", "yuv420p", "nv12", "rgb24", "GRAY"} {
+		f, err := ParseRawFormat(name)
+		if err != nil || !strings.EqualFold(f.String(), name) {
+			t.Errorf("ParseRawFormat(%q) = %v, %v", name, f, err)
+		}
+	}
+	if _, err := ParseRawFormat("yuyv422"); err == nil {
+		t.Error("unsupported format accepted")
+	}
+}
@@ -0,0 +1,97 @@
+package gocam
+
+import (
+	"context"
+	"os"
+)
+
+// FrameWriter is implemented by the recorders, such as Y4MWriter and
+// AVIWriter. Close finishes the recording without closing the file or
+// writer underneath.
+type FrameWriter interface {
+	WriteFrame(Frame) error
+	Close() error
+}
+
+// Record writes frames to fw until the channel closes or ctx is canceled,
+// then closes fw so the recording is finalized either way. Frames are
+// released once written. Stopping through ctx is not an error.
+func Record(ctx context.Context, frames <-chan Frame, fw FrameWriter) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return fw.Close()
+		case frame, ok := <-frames:
+			if !ok {
+				return fw.Close()
+			}
+			err := fw.WriteFrame(frame)
+			frame.Release()
+			if err != nil {
+				fw.Close()
+				return err
+			}
+		}
+	}
+}
+
+// Tee fans frames out to n channels, so that several consumers, such as a
+// preview, a RingRecorder and a motion detector, can share one stream. Each
+// output receives its own copy of every frame and, like Stream.Frames,
+// buffers only the latest one: a slow consumer misses frames without
+// holding up the others. Input frames are released once copied; the copies
+// carry Data and JPEG but not DMABufs. The outputs are closed when frames
+// is closed. Tee panics if n is less than one.
+func Tee(frames <-chan Frame, n int) []<-chan Frame {
+	if n < 1 {
+		panic("gocam: Tee needs at least one output")
+	}
+	outs := make([]chan Frame, n)
+	result := make([]<-chan Frame, n)
+	for i := range outs {
+		outs[i] = make(chan Frame, 1)
+		result[i] = outs[i]
+	}
+
+	go func() {
+		defer func() {
+			for _, out := range outs {
+				close(out)
+			}
+		}()
+		for frame := range frames {
+			for _, out := range outs {
+				c := frame
+				c.Data = append([]byte(nil), frame.Data...)
+				c.JPEG = append([]byte(nil), frame.JPEG...)
+				c.DMABufs = nil
+				c.release = nil
+				select {
+				case out <- c:
+				default:
+					select {
+					case <-out:
+					default:
+					}
+					out <- c
+				}
+			}
+			frame.Release()
+		}
+	}()
+	return result
+}
+
+// RecordAVI records frames into a new Motion-JPEG AVI file at path until
+// the channel closes or ctx is canceled; see Record and AVIWriter.
+func RecordAVI(ctx context.Context, frames <-chan Frame, path string, opts *AVIOptions) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = Record(ctx, frames, NewAVIWriter(f, opts))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,326 @@
+package gocam
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultPreRoll is the look-back kept by a RingRecorder when
+// RingOptions.PreRoll is zero.
+const DefaultPreRoll = 10 * time.Second
+
+// DefaultRingMaxBytes caps the frames buffered by a RingRecorder when
+// RingOptions.MaxBytes is zero: about 20 seconds of raw 640x480 frames at
+// 30 fps, or several minutes of JPEG.
+const DefaultRingMaxBytes = 512 << 20
+
+// RingOptions configures a RingRecorder.
+type RingOptions struct {
+	// PreRoll is how far back a trigger reaches. Zero means
+	// DefaultPreRoll.
+	PreRoll time.Duration
+	// PostRoll is how long a trigger keeps recording after the newest
+	// frame at the time of the trigger. Zero records the pre-roll alone.
+	PostRoll time.Duration
+	// JPEGQuality, when positive, keeps frames as JPEG images of that
+	// quality (1-100) instead of raw samples, a fraction of the memory
+	// at the cost of encoding each frame. Frames carrying the camera's
+	// JPEG are kept as delivered.
+	JPEGQuality int
+	// MaxBytes caps the memory of the buffered frames: beyond it the
+	// oldest are dropped, shortening the pre-roll. Zero means
+	// DefaultRingMaxBytes; negative means no cap.
+	MaxBytes int64
+}
+
+// RingRecorder keeps the last PreRoll of a stream in memory, so that an
+// incident can be recorded from before it was noticed. It is a
+// FrameWriter: feed it with Record, or with any loop passing it every
+// frame. To keep it running next to other consumers of the same stream,
+// give it one of the channels returned by Tee. Trigger writes the
+// buffered frames and the following PostRoll to another FrameWriter, such
+// as a Y4MWriter, AVIWriter or ImageSequenceWriter, from a goroutine of
+// its own, so slow recorders never hold up the stream.
+//
+// Frames are copied, so WriteFrame's caller may release them. Times are
+// the frame timestamps, or the arrival time for frames without one.
+type RingRecorder struct {
+	opts RingOptions
+
+	mu      sync.Mutex
+	entries []*ringEntry // oldest first
+	bytes   int64
+	events  []*RingEvent // events still taking frames
+	closed  bool
+	running sync.WaitGroup
+}
+
+// ringEntry is a buffered frame. Entries are immutable once stored, so
+// events share them with the buffer.
+type ringEntry struct {
+	frame Frame // Data is nil when only JPEG is kept
+	time  time.Time
+	size  int64
+}
+
+// NewRingRecorder returns an empty ring recorder. opts may be nil.
+func NewRingRecorder(opts *RingOptions) *RingRecorder {
+	r := &RingRecorder{}
+	if opts != nil {
+		r.opts = *opts
+	}
+	if r.opts.PreRoll <= 0 {
+		r.opts.PreRoll = DefaultPreRoll
+	}
+	if r.opts.MaxBytes == 0 {
+		r.opts.MaxBytes = DefaultRingMaxBytes
+	}
+	return r
+}
+
+// WriteFrame buffers a copy of the frame, dropping frames older than the
+// pre-roll, and passes it to the events in progress.
+func (r *RingRecorder) WriteFrame(frame Frame) error {
+	if err := checkFrame(frame); err != nil {
+		return err
+	}
+	e, err := r.store(frame)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return errors.New("gocam: ring recorder closed")
+	}
+	r.entries = append(r.entries, e)
+	r.bytes += e.size
+	r.evict(e.time)
+
+	events := r.events[:0]
+	for _, ev := range r.events {
+		if e.time.After(ev.end) {
+			ev.finish()
+			continue
+		}
+		ev.queue = append(ev.queue, e)
+		ev.wake()
+		events = append(events, ev)
+	}
+	clear(r.events[len(events):])
+	r.events = events
+	return nil
+}
+
+// store copies a frame into a buffer entry, compressing it if configured.
+func (r *RingRecorder) store(frame Frame) (*ringEntry, error) {
+	e := &ringEntry{time: frame.Timestamp}
+	if e.time.IsZero() {
+		e.time = time.Now()
+	}
+	e.frame = Frame{
+		Width:     frame.Width,
+		Height:    frame.Height,
+		Timestamp: frame.Timestamp,
+		Sequence:  frame.Sequence,
+		Field:     frame.Field,
+	}
+	if r.opts.JPEGQuality <= 0 {
+		e.frame.Data = append([]byte(nil), frame.Data[:frame.Width*frame.Height*3]...)
+		e.size = int64(len(e.frame.Data))
+		return e, nil
+	}
+	if w, h, ok := jpegSize(frame.JPEG); ok && w == frame.Width && h == frame.Height {
+		e.frame.JPEG = append([]byte(nil), frame.JPEG...)
+	} else {
+		var buf jpegBuffer
+		if err := EncodeJPEG(&buf, frame, r.opts.JPEGQuality); err != nil {
+			return nil, err
+		}
+		e.frame.JPEG = buf
+	}
+	e.size = int64(len(e.frame.JPEG))
+	return e, nil
+}
+
+// evict drops the entries older than the pre-roll before now, then the
+// oldest beyond the memory cap, always keeping the newest.
+func (r *RingRecorder) evict(now time.Time) {
+	oldest := now.Add(-r.opts.PreRoll)
+	n := 0
+	for n < len(r.entries)-1 && (r.entries[n].time.Before(oldest) ||
+		r.opts.MaxBytes > 0 && r.bytes > r.opts.MaxBytes) {
+		r.bytes -= r.entries[n].size
+		r.entries[n] = nil
+		n++
+	}
+	r.entries = r.entries[n:]
+}
+
+// Buffered returns the number of frames in the buffer, the time they span
+// and the memory they use.
+func (r *RingRecorder) Buffered() (frames int, span time.Duration, bytes int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if n := len(r.entries); n > 0 {
+		span = r.entries[n-1].time.Sub(r.entries[0].time)
+	}
+	return len(r.entries), span, r.bytes
+}
+
+// Trigger starts recording an event to fw: the buffered pre-roll, then
+// the frames up to PostRoll after the newest buffered one. fw is closed
+// when the event ends, which the returned RingEvent reports. Events are
+// independent; triggering again during an event records the overlap
+// twice, so use RingEvent.Extend to lengthen an event instead.
+func (r *RingRecorder) Trigger(fw FrameWriter) *RingEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ev := &RingEvent{
+		r:       r,
+		fw:      fw,
+		queue:   append([]*ringEntry(nil), r.entries...),
+		signal:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		running: true,
+	}
+	ev.end = r.newest().Add(r.opts.PostRoll)
+	if r.closed || r.opts.PostRoll <= 0 {
+		ev.running = false
+	} else {
+		r.events = append(r.events, ev)
+	}
+	r.running.Add(1)
+	go ev.run()
+	return ev
+}
+
+// newest returns the time of the newest buffered frame, or the current
+// time when there is none.
+func (r *RingRecorder) newest() time.Time {
+	if n := len(r.entries); n > 0 {
+		return r.entries[n-1].time
+	}
+	return time.Now()
+}
+
+// Close ends the events in progress, waits until their recorders are
+// closed and empties the buffer. Errors of the events are reported by
+// their Err methods.
+func (r *RingRecorder) Close() error {
+	r.mu.Lock()
+	r.closed = true
+	for _, ev := range r.events {
+		ev.finish()
+	}
+	r.events = nil
+	r.entries = nil
+	r.bytes = 0
+	r.mu.Unlock()
+	r.running.Wait()
+	return nil
+}
+
+// RingEvent is a recording started by RingRecorder.Trigger.
+type RingEvent struct {
+	r  *RingRecorder
+	fw FrameWriter
+
+	// Guarded by r.mu.
+	queue   []*ringEntry
+	end     time.Time
+	running bool // still taking frames
+
+	signal chan struct{}
+	done   chan struct{}
+	frames atomic.Int64
+	err    error // set before done is closed
+}
+
+// Extend lengthens the event to end no earlier than d after the newest
+// frame, as when the incident goes on. It has no effect once the event
+// has ended.
+func (ev *RingEvent) Extend(d time.Duration) {
+	ev.r.mu.Lock()
+	defer ev.r.mu.Unlock()
+	if end := ev.r.newest().Add(d); ev.running && end.After(ev.end) {
+		ev.end = end
+	}
+}
+
+// Done is closed when the event has been written and its recorder closed.
+func (ev *RingEvent) Done() <-chan struct{} {
+	return ev.done
+}
+
+// Err returns the first error writing or closing the recorder, once Done
+// is closed.
+func (ev *RingEvent) Err() error {
+	select {
+	case <-ev.done:
+		return ev.err
+	default:
+		return nil
+	}
+}
+
+// Frames returns the number of frames written so far.
+func (ev *RingEvent) Frames() int {
+	return int(ev.frames.Load())
+}
+
+// finish stops the event from taking frames. r.mu must be held.
+func (ev *RingEvent) finish() {
+	ev.running = false
+	ev.wake()
+}
+
+func (ev *RingEvent) wake() {
+	select {
+	case ev.signal <- struct{}{}:
+	default:
+	}
+}
+
+// run writes the queued frames until the event has ended and its queue is
+// empty. After an error the remaining frames are discarded.
+func (ev *RingEvent) run() {
+	defer ev.r.running.Done()
+	for {
+		ev.r.mu.Lock()
+		queue, running := ev.queue, ev.running
+		ev.queue = nil
+		ev.r.mu.Unlock()
+
+		for _, e := range queue {
+			if ev.err == nil {
+				ev.err = ev.write(e)
+			}
+		}
+		if !running {
+			break
+		}
+		<-ev.signal
+	}
+	if err := ev.fw.Close(); ev.err == nil {
+		ev.err = err
+	}
+	close(ev.done)
+}
+
+func (ev *RingEvent) write(e *ringEntry) error {
+	frame := e.frame
+	if frame.Data == nil {
+		if frame.Data = decodeJPEG444(frame.JPEG, frame.Width, frame.Height); frame.Data == nil {
+			return errors.New("gocam: corrupt JPEG in ring buffer")
+		}
+	}
+	if err := ev.fw.WriteFrame(frame); err != nil {
+		return err
+	}
+	ev.frames.Add(1)
+	return nil
+}
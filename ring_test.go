@@ -0,0 +1,244 @@
+package gocam
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// feedRing writes flat frames captured at the given milliseconds.
+func feedRing(t *testing.T, r *RingRecorder, ms ...int) {
+	t.Helper()
+	for _, m := range ms {
+		if err := r.WriteFrame(flatFrame(byte(m/10), m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func waitEvent(t *testing.T, ev *RingEvent) {
+	t.Helper()
+	select {
+	case <-ev.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("event did not end")
+	}
+}
+
+// sequences returns the sequence numbers of frames, which flatFrame sets
+// to the capture millisecond.
+func sequences(frames []Frame) []uint64 {
+	seqs := make([]uint64, len(frames))
+	for i, f := range frames {
+		seqs[i] = f.Sequence
+	}
+	return seqs
+}
+
+func TestRingRecorderPrePostRoll(t *testing.T) {
+	r := NewRingRecorder(&RingOptions{PreRoll: time.Second, PostRoll: 500 * time.Millisecond})
+	defer r.Close()
+	feedRing(t, r, 0, 250, 500, 750, 1000, 1250, 1500, 1750, 2000)
+	if n, span, bytes := r.Buffered(); n != 5 || span != time.Second || bytes != 5*12 {
+		t.Errorf("buffered %d frames over %v in %d bytes", n, span, bytes)
+	}
+
+	var sink frameSink
+	ev := r.Trigger(&sink)
+	feedRing(t, r, 2250, 2500, 2750, 3000)
+	waitEvent(t, ev)
+	if ev.Err() != nil || !sink.closed {
+		t.Fatalf("err %v, closed %v", ev.Err(), sink.closed)
+	}
+	want := []uint64{1000, 1250, 1500, 1750, 2000, 2250, 2500}
+	if got := sequences(sink.frames); !reflect.DeepEqual(got, want) || ev.Frames() != len(want) {
+		t.Errorf("recorded %v (%d), want %v", got, ev.Frames(), want)
+	}
+	if sink.frames[0].Data[0] != 100 || !sink.frames[0].Timestamp.Equal(flatFrame(0, 1000).Timestamp) {
+		t.Errorf("first frame %d at %v", sink.frames[0].Data[0], sink.frames[0].Timestamp)
+	}
+
+	// Extend keeps an event going; Close ends it.
+	var long frameSink
+	ev = r.Trigger(&long)
+	ev.Extend(2 * time.Second)
+	feedRing(t, r, 3500, 4000, 4500)
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	waitEvent(t, ev)
+	if got := sequences(long.frames); len(got) != 8 || got[len(got)-1] != 4500 {
+		t.Errorf("extended event recorded %v", got)
+	}
+	if err := r.WriteFrame(flatFrame(0, 5000)); err == nil {
+		t.Error("write after Close accepted")
+	}
+}
+
+func TestRingRecorderMemory(t *testing.T) {
+	r := NewRingRecorder(&RingOptions{PreRoll: time.Hour, MaxBytes: 40})
+	feedRing(t, r, 0, 10, 20, 30, 40)
+	if n, _, bytes := r.Buffered(); n != 3 || bytes != 36 {
+		t.Errorf("buffered %d frames in %d bytes, want 3 in 36", n, bytes)
+	}
+	r.Close()
+
+	// JPEG keeps the frames in a fraction of the memory and hands them
+	// on with the image, for recorders that pass it through.
+	r = NewRingRecorder(&RingOptions{JPEGQuality: 90})
+	defer r.Close()
+	frame := colorFrame(32, 32)
+	frame.Timestamp = time.Unix(7, 0)
+	if err := r.WriteFrame(frame); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, bytes := r.Buffered(); bytes >= int64(len(frame.Data))/4 {
+		t.Errorf("JPEG frame uses %d bytes of %d", bytes, len(frame.Data))
+	}
+	var sink frameSink
+	waitEvent(t, r.Trigger(&sink))
+	if len(sink.frames) != 1 {
+		t.Fatalf("%d frames recorded", len(sink.frames))
+	}
+	got := sink.frames[0]
+	if got.JPEG == nil || got.Width != 32 || !got.Timestamp.Equal(frame.Timestamp) {
+		t.Fatalf("frame %dx%d at %v, JPEG %v", got.Width, got.Height, got.Timestamp, got.JPEG != nil)
+	}
+	for i := range frame.Data {
+		if d := int(got.Data[i]) - int(frame.Data[i]); d < -6 || d > 6 {
+			t.Fatalf("sample %d is %d, want about %d", i, got.Data[i], frame.Data[i])
+		}
+	}
+}
+
+// gateWriter blocks every write until its gate is closed, and fails after
+// failAfter frames when positive.
+type gateWriter struct {
+	frameSink
+	gate      chan struct{}
+	failAfter int
+}
+
+func (g *gateWriter) WriteFrame(frame Frame) error {
+	<-g.gate
+	if g.failAfter > 0 && len(g.frames) == g.failAfter {
+		return errors.New("disk full")
+	}
+	return g.frameSink.WriteFrame(frame)
+}
+
+func TestRingRecorderSlowWriter(t *testing.T) {
+	r := NewRingRecorder(&RingOptions{PreRoll: time.Second, PostRoll: time.Second})
+	feedRing(t, r, 0, 100)
+	w := &gateWriter{gate: make(chan struct{}), failAfter: 3}
+	ev := r.Trigger(w)
+
+	// The stream goes on while the recorder is stuck.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for ms := 200; ms <= 500; ms += 100 {
+			if err := r.WriteFrame(flatFrame(0, ms)); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("WriteFrame blocked on a slow event recorder")
+	}
+
+	close(w.gate)
+	r.Close()
+	waitEvent(t, ev)
+	if ev.Err() == nil || len(w.frames) != 3 || !w.closed {
+		t.Errorf("err %v after %d frames, closed %v", ev.Err(), len(w.frames), w.closed)
+	}
+}
+
+func TestTee(t *testing.T) {
+	in := make(chan Frame)
+	outs := Tee(in, 2)
+
+	released := make(chan struct{})
+	frame := flatFrame(7, 0)
+	frame.JPEG = []byte{0xff, 0xd8}
+	frame.release = newFrameRelease(func() { close(released) })
+	in <- frame
+	a, b := <-outs[0], <-outs[1]
+	if &a.Data[0] == &b.Data[0] || &a.Data[0] == &frame.Data[0] || &a.JPEG[0] == &b.JPEG[0] {
+		t.Error("outputs share frame memory")
+	}
+	if !reflect.DeepEqual(a.Data, frame.Data) || !reflect.DeepEqual(b.JPEG, frame.JPEG) {
+		t.Error("copies differ from the frame")
+	}
+	select {
+	case <-released:
+	case <-time.After(2 * time.Second):
+		t.Error("input frame not released")
+	}
+
+	// A consumer that stops reading keeps only the latest frame and does
+	// not hold up the others.
+	for ms := 100; ms <= 300; ms += 100 {
+		in <- flatFrame(0, ms)
+		if f := <-outs[0]; f.Sequence != uint64(ms) {
+			t.Errorf("fast consumer got frame %d, want %d", f.Sequence, ms)
+		}
+	}
+	close(in)
+	if f := <-outs[1]; f.Sequence != 300 {
+		t.Errorf("slow consumer got frame %d, want 300", f.Sequence)
+	}
+	for i, out := range outs {
+		if _, ok := <-out; ok {
+			t.Errorf("output %d not closed", i)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Tee with no outputs did not panic")
+		}
+	}()
+	Tee(in, 0)
+}
+
+func TestRingRecorderOnTee(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := OpenStream(ctx, WithDevice("test://counter?w=32&h=20&fps=200"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	r := NewRingRecorder(nil)
+	defer r.Close()
+	outs := Tee(s.Frames(), 2)
+	recorded := make(chan error, 1)
+	go func() { recorded <- Record(ctx, outs[0], r) }()
+
+	// The other consumer reads the stream as usual.
+	for i := 0; i < 5; i++ {
+		select {
+		case <-outs[1]:
+		case <-time.After(2 * time.Second):
+			t.Fatal("no frame on the second output")
+		}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for n, _, _ := r.Buffered(); n == 0; n, _, _ = r.Buffered() {
+		if time.Now().After(deadline) {
+			t.Fatal("ring buffered no frames")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-recorded; err != nil {
+		t.Error(err)
+	}
+}
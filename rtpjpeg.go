@@ -0,0 +1,207 @@
+package gocam
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// RTP/JPEG (RFC 2435) sends only the entropy-coded scan of a baseline
+// image; the receiver rebuilds the headers from the image type, the size
+// and the quantization tables, and assumes the standard Huffman tables.
+
+const (
+	rtpJPEGPayloadType = 26
+	rtpJPEGClock       = 90000
+	// rtpJPEGDynamicQ marks images whose quantization tables travel in
+	// the first packet.
+	rtpJPEGDynamicQ = 255
+	// rtpJPEGRestartType is added to the type of images with restart
+	// intervals.
+	rtpJPEGRestartType = 64
+	// rtpJPEGMaxSize is the largest width or height the header can carry.
+	rtpJPEGMaxSize = 2040
+)
+
+// rtpJPEG is a JPEG image split into the parts RFC 2435 carries.
+type rtpJPEG struct {
+	typ           byte // 0 for 4:2:2, 1 for 4:2:0, plus 64 with restart intervals
+	width, height int  // in 8-pixel blocks
+	restart       uint16
+	qtables       []byte // luma then chroma, 64 bytes each in zigzag order
+	scan          []byte
+}
+
+// standardHuffman maps the class and id byte of each table in defaultDHT
+// to its counts and values.
+var standardHuffman = parseDHT(defaultDHT[4:])
+
+// parseDHT returns the tables of a DHT segment body keyed by class and id,
+// or nil if it is malformed.
+func parseDHT(b []byte) map[byte]string {
+	tables := make(map[byte]string)
+	for len(b) > 0 {
+		if len(b) < 17 {
+			return nil
+		}
+		n := 17
+		for _, c := range b[1:17] {
+			n += int(c)
+		}
+		if len(b) < n {
+			return nil
+		}
+		tables[b[0]] = string(b[1:n])
+		b = b[n:]
+	}
+	return tables
+}
+
+// parseRTPJPEG splits a baseline JPEG image for RTP/JPEG. It fails for
+// images RFC 2435 cannot describe: other than three-component 4:2:2 or
+// 4:2:0, progressive, with 16-bit quantization tables or non-standard
+// Huffman tables, or larger than 2040 pixels.
+func parseRTPJPEG(jpg []byte) (*rtpJPEG, error) {
+	if len(jpg) < 4 || jpg[0] != 0xFF || jpg[1] != 0xD8 {
+		return nil, errors.New("gocam: not a JPEG image")
+	}
+	var (
+		j      rtpJPEG
+		tables [4][]byte
+		lumaQ  = -1
+		chromQ = -1
+	)
+	i := 2
+	for {
+		if i+4 > len(jpg) || jpg[i] != 0xFF {
+			return nil, errors.New("gocam: truncated JPEG image")
+		}
+		m := jpg[i+1]
+		if m == 0xFF {
+			i++
+			continue
+		}
+		n := int(binary.BigEndian.Uint16(jpg[i+2:]))
+		if n < 2 || i+2+n > len(jpg) {
+			return nil, errors.New("gocam: truncated JPEG image")
+		}
+		seg := jpg[i+4 : i+2+n]
+		switch m {
+		case 0xDB: // DQT
+			for len(seg) > 0 {
+				if seg[0]>>4 != 0 {
+					return nil, errors.New("gocam: RTP/JPEG needs 8-bit quantization tables")
+				}
+				if len(seg) < 65 {
+					return nil, errors.New("gocam: malformed JPEG quantization table")
+				}
+				tables[seg[0]&3] = seg[1:65]
+				seg = seg[65:]
+			}
+		case 0xC4: // DHT
+			dht := parseDHT(seg)
+			if dht == nil {
+				return nil, errors.New("gocam: malformed JPEG Huffman table")
+			}
+			for id, t := range dht {
+				if standardHuffman[id] != t {
+					return nil, errors.New("gocam: RTP/JPEG needs the standard Huffman tables")
+				}
+			}
+		case 0xDD: // DRI
+			if len(seg) < 2 {
+				return nil, errors.New("gocam: malformed JPEG restart interval")
+			}
+			j.restart = binary.BigEndian.Uint16(seg)
+		case 0xC0: // SOF0, baseline
+			if len(seg) < 15 || seg[0] != 8 || seg[5] != 3 {
+				return nil, errors.New("gocam: RTP/JPEG needs an 8-bit three-component image")
+			}
+			h := int(binary.BigEndian.Uint16(seg[1:]))
+			w := int(binary.BigEndian.Uint16(seg[3:]))
+			if w == 0 || h == 0 || w > rtpJPEGMaxSize || h > rtpJPEGMaxSize {
+				return nil, fmt.Errorf("gocam: RTP/JPEG cannot carry %dx%d images", w, h)
+			}
+			j.width, j.height = (w+7)/8, (h+7)/8
+			luma, cb, cr := seg[6:9], seg[9:12], seg[12:15]
+			switch {
+			case cb[1] != 0x11 || cr[1] != 0x11 || cb[2] != cr[2]:
+				return nil, errors.New("gocam: unsupported JPEG chroma layout for RTP/JPEG")
+			case luma[1] == 0x21:
+				j.typ = 0
+			case luma[1] == 0x22:
+				j.typ = 1
+			default:
+				return nil, errors.New("gocam: RTP/JPEG needs 4:2:2 or 4:2:0 chroma")
+			}
+			lumaQ, chromQ = int(luma[2]&3), int(cb[2]&3)
+		case 0xC1, 0xC2, 0xC3, 0xC5, 0xC6, 0xC7, 0xC9, 0xCA, 0xCB, 0xCD, 0xCE, 0xCF:
+			return nil, errors.New("gocam: RTP/JPEG needs a baseline JPEG image")
+		case 0xDA: // SOS
+			if lumaQ < 0 {
+				return nil, errors.New("gocam: JPEG scan before the frame header")
+			}
+			if tables[lumaQ] == nil || tables[chromQ] == nil {
+				return nil, errors.New("gocam: missing JPEG quantization table")
+			}
+			j.qtables = make([]byte, 0, 128)
+			j.qtables = append(j.qtables, tables[lumaQ]...)
+			j.qtables = append(j.qtables, tables[chromQ]...)
+			scan := jpg[i+2+n:]
+			if end := bytes.LastIndex(scan, []byte{0xFF, 0xD9}); end >= 0 {
+				scan = scan[:end]
+			}
+			j.scan = scan
+			if j.restart != 0 {
+				j.typ += rtpJPEGRestartType
+			}
+			return &j, nil
+		}
+		i += 2 + n
+	}
+}
+
+// rtpJPEGCompatible reports whether a camera JPEG can be sent as it is.
+func rtpJPEGCompatible(jpg []byte) bool {
+	_, err := parseRTPJPEG(jpg)
+	return err == nil
+}
+
+// payloads splits the image into RTP payloads of at most size bytes and
+// calls fn for each; last is set for the final one, whose packet carries
+// the marker bit.
+func (j *rtpJPEG) payloads(size int, fn func(payload []byte, last bool) error) error {
+	var hdr []byte
+	buf := make([]byte, 0, size)
+	for off := 0; off < len(j.scan) || off == 0; {
+		hdr = hdr[:0]
+		hdr = append(hdr, 0, byte(off>>16), byte(off>>8), byte(off))
+		hdr = append(hdr, j.typ, rtpJPEGDynamicQ, byte(j.width), byte(j.height))
+		if j.typ >= rtpJPEGRestartType {
+			// F and L set with a count of 0x3FFF: packets need not
+			// align with restart intervals.
+			hdr = binary.BigEndian.AppendUint16(hdr, j.restart)
+			hdr = append(hdr, 0xFF, 0xFF)
+		}
+		if off == 0 {
+			hdr = append(hdr, 0, 0) // MBZ, precision: 8-bit tables
+			hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(j.qtables)))
+			hdr = append(hdr, j.qtables...)
+		}
+		room := size - len(hdr)
+		if room <= 0 {
+			return errors.New("gocam: RTP packet size too small")
+		}
+		n := min(room, len(j.scan)-off)
+		buf = append(append(buf[:0], hdr...), j.scan[off:off+n]...)
+		off += n
+		if err := fn(buf, off >= len(j.scan)); err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package gocam
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+// rebuildRTPJPEG reassembles the RTP/JPEG payloads of one image into a
+// JPEG file, as a receiver does.
+func rebuildRTPJPEG(t *testing.T, payloads [][]byte) []byte {
+	t.Helper()
+	var (
+		scan    []byte
+		qtables []byte
+		typ     byte
+		w, h    int
+		restart uint16
+	)
+	for i, p := range payloads {
+		if len(p) < 8 {
+			t.Fatalf("payload %d: %d bytes", i, len(p))
+		}
+		off := int(p[1])<<16 | int(p[2])<<8 | int(p[3])
+		typ, w, h = p[4], int(p[6])*8, int(p[7])*8
+		if p[5] != rtpJPEGDynamicQ {
+			t.Fatalf("payload %d: Q %d, want dynamic tables", i, p[5])
+		}
+		p = p[8:]
+		if typ >= rtpJPEGRestartType {
+			restart = binary.BigEndian.Uint16(p)
+			p = p[4:]
+		}
+		if off == 0 {
+			n := int(binary.BigEndian.Uint16(p[2:]))
+			qtables, p = p[4:4+n], p[4+n:]
+		}
+		if off != len(scan) {
+			t.Fatalf("payload %d: offset %d, want %d", i, off, len(scan))
+		}
+		scan = append(scan, p...)
+	}
+
+	out := []byte{0xFF, 0xD8}
+	out = append(out, 0xFF, 0xDB, 0, 2+2*65, 0)
+	out = append(out, qtables[:64]...)
+	out = append(out, 1)
+	out = append(out, qtables[64:128]...)
+	luma := byte(0x21)
+	if typ&^rtpJPEGRestartType == 1 {
+		luma = 0x22
+	}
+	out = append(out, 0xFF, 0xC0, 0, 17, 8, byte(h>>8), byte(h), byte(w>>8), byte(w), 3,
+		1, luma, 0, 2, 0x11, 1, 3, 0x11, 1)
+	out = append(out, defaultDHT...)
+	if restart != 0 {
+		out = append(out, 0xFF, 0xDD, 0, 4, byte(restart>>8), byte(restart))
+	}
+	out = append(out, 0xFF, 0xDA, 0, 12, 3, 1, 0x00, 2, 0x11, 3, 0x11, 0, 63, 0)
+	out = append(out, scan...)
+	return append(out, 0xFF, 0xD9)
+}
+
+func decodeJPEGBytes(t *testing.T, jpg []byte) image.Image {
+	t.Helper()
+	img, err := jpeg.Decode(bytes.NewReader(jpg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestRTPJPEGRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := EncodeJPEG(&buf, pixelFrame(32, 16), 75); err != nil {
+		t.Fatal(err)
+	}
+	j, err := parseRTPJPEG(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.typ != 1 || j.width != 4 || j.height != 2 {
+		t.Errorf("type %d, %dx%d blocks; want type 1, 4x2", j.typ, j.width, j.height)
+	}
+
+	var payloads [][]byte
+	var lasts []bool
+	err = j.payloads(160, func(p []byte, last bool) error {
+		if len(p) > 160 {
+			t.Errorf("payload of %d bytes exceeds 160", len(p))
+		}
+		payloads = append(payloads, append([]byte(nil), p...))
+		lasts = append(lasts, last)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payloads) < 2 {
+		t.Fatalf("%d payloads, want the image split", len(payloads))
+	}
+	for i, last := range lasts {
+		if last != (i == len(lasts)-1) {
+			t.Errorf("payload %d: last = %v", i, last)
+		}
+	}
+
+	want := decodeJPEGBytes(t, buf.Bytes())
+	got := decodeJPEGBytes(t, rebuildRTPJPEG(t, payloads))
+	if got.Bounds() != want.Bounds() {
+		t.Fatalf("bounds %v, want %v", got.Bounds(), want.Bounds())
+	}
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 32; x++ {
+			if got.At(x, y) != want.At(x, y) {
+				t.Fatalf("pixel (%d,%d) differs after RTP/JPEG", x, y)
+			}
+		}
+	}
+}
+
+func TestRTPJPEGRestartInterval(t *testing.T) {
+	var buf bytes.Buffer
+	if err := EncodeJPEG(&buf, colorFrame(16, 16), 75); err != nil {
+		t.Fatal(err)
+	}
+	// A DRI segment is enough for the type; the scan is not checked.
+	jpg := append([]byte{0xFF, 0xD8, 0xFF, 0xDD, 0, 4, 0, 2}, buf.Bytes()[2:]...)
+	j, err := parseRTPJPEG(jpg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.typ != 1+rtpJPEGRestartType || j.restart != 2 {
+		t.Errorf("type %d, restart interval %d; want %d, 2", j.typ, j.restart, 1+rtpJPEGRestartType)
+	}
+	err = j.payloads(1000, func(p []byte, last bool) error {
+		if got := binary.BigEndian.Uint32(p[8:]); got != 0x0002FFFF {
+			t.Errorf("restart header %08x, want 0002ffff", got)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseRTPJPEGRejects(t *testing.T) {
+	var buf bytes.Buffer
+	if err := EncodeJPEG(&buf, colorFrame(16, 16), 75); err != nil {
+		t.Fatal(err)
+	}
+	base := buf.Bytes()
+	sof := bytes.Index(base, []byte{0xFF, 0xC0})
+	dht := bytes.Index(base, []byte{0xFF, 0xC4})
+
+	progressive := append([]byte(nil), base...)
+	progressive[sof+1] = 0xC2
+	chroma444 := append([]byte(nil), base...)
+	chroma444[sof+11] = 0x11
+	huffman := append([]byte(nil), base...)
+	huffman[dht+6]++ // first count of the first table
+
+	for name, jpg := range map[string][]byte{
+		"not jpeg":    []byte("hello, world"),
+		"truncated":   base[:sof+4],
+		"progressive": progressive,
+		"4:4:4":       chroma444,
+		"huffman":     huffman,
+	} {
+		if _, err := parseRTPJPEG(jpg); err == nil {
+			t.Errorf("%s: parsed without error", name)
+		}
+	}
+}
@@ -0,0 +1,589 @@
+package gocam
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRTPPacketSize is used when RTSPOptions.PacketSize is zero. It keeps
+// packets within a typical Ethernet MTU after IP and UDP headers.
+const DefaultRTPPacketSize = 1400
+
+// rtspSessionTimeout is announced to clients, which send keep-alives
+// within it. Sessions end with their RTSP connection rather than by
+// timing out.
+const rtspSessionTimeout = 60
+
+// rtspWriteTimeout bounds each write to the RTSP connection, so a client
+// that stops reading cannot block its sender forever.
+const rtspWriteTimeout = 5 * time.Second
+
+// ErrServerClosed is returned by RTSPServer.Serve after Close.
+var ErrServerClosed = errors.New("gocam: server closed")
+
+// RTSPOptions configures an RTSPServer. The zero value (or a nil pointer)
+// streams every frame at its own size with DefaultJPEGQuality.
+type RTSPOptions struct {
+	// Quality, MaxFPS, Width and Height work as in MJPEGOptions. Encoded
+	// frames are cropped to multiples of 8 pixels, as RTP/JPEG requires.
+	Quality       int
+	MaxFPS        float64
+	Width, Height int
+	// PacketSize bounds the size of RTP packets, headers included; zero
+	// means DefaultRTPPacketSize.
+	PacketSize int
+}
+
+// RTSPServer streams a frame channel to RTSP clients such as VLC, ffmpeg
+// and network video recorders as RTP/JPEG (RFC 2435). It implements
+// OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN and GET_PARAMETER (as a
+// keep-alive) for a single video track at any URL path, with RTP over UDP
+// or interleaved in the RTSP connection.
+//
+// Frames are shared with MJPEGServer semantics: each is encoded once, and
+// a slow client skips frames without holding back the others. Camera JPEGs
+// are passed through when RTP/JPEG can carry them. A session ends when its
+// client sends TEARDOWN or closes the RTSP connection.
+type RTSPServer struct {
+	opts RTSPOptions
+	hub  *jpegHub
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[*rtspConn]struct{}
+	closed    bool
+}
+
+// NewRTSPServer prepares a server for frames from the channel, such as
+// Stream.Frames. Start it with Serve or ListenAndServe. Once the channel
+// closes, playing sessions end.
+func NewRTSPServer(frames <-chan Frame, opts *RTSPOptions) *RTSPServer {
+	s := &RTSPServer{
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[*rtspConn]struct{}),
+	}
+	if opts != nil {
+		s.opts = *opts
+	}
+	if s.opts.PacketSize <= 0 {
+		s.opts.PacketSize = DefaultRTPPacketSize
+	}
+	s.hub = newJPEGHub(s.opts.Quality, s.opts.MaxFPS, s.opts.Width, s.opts.Height)
+	s.hub.align = 8
+	s.hub.passThrough = rtpJPEGCompatible
+	go s.hub.run(frames)
+	return s
+}
+
+// ListenAndServe listens on the TCP address addr, such as ":8554", and
+// calls Serve.
+func (s *RTSPServer) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts RTSP connections on l until Close is called, and then
+// returns ErrServerClosed.
+func (s *RTSPServer) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		c := &rtspConn{srv: s, conn: nc, rd: bufio.NewReader(nc)}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			nc.Close()
+			return ErrServerClosed
+		}
+		s.conns[c] = struct{}{}
+		s.mu.Unlock()
+		go c.serve()
+	}
+}
+
+// Close stops the listeners and ends all connections and sessions.
+func (s *RTSPServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	var err error
+	for l := range s.listeners {
+		if cerr := l.Close(); err == nil {
+			err = cerr
+		}
+	}
+	for c := range s.conns {
+		c.conn.Close()
+	}
+	return err
+}
+
+// Sessions returns the number of clients receiving the stream.
+func (s *RTSPServer) Sessions() int {
+	return s.hub.subscribers()
+}
+
+// Done is closed when the frame channel has closed.
+func (s *RTSPServer) Done() <-chan struct{} {
+	return s.hub.done
+}
+
+// rtspConn is one RTSP control connection. It holds at most one session.
+type rtspConn struct {
+	srv  *RTSPServer
+	conn net.Conn
+	rd   *bufio.Reader
+
+	// wmu serializes responses and interleaved packets.
+	wmu  sync.Mutex
+	sess *rtspSession
+}
+
+// rtspSession is the RTP state of a client.
+type rtspSession struct {
+	id   string
+	ssrc uint32
+	// seqBase is the sequence number of the first packet; send counts
+	// from it on its own goroutine.
+	seqBase uint16
+	// tsBase offsets the RTP timestamps, which count from the first image.
+	tsBase uint32
+
+	// tcp sessions send on the RTSP connection with the given channel;
+	// others send from rtp to dest.
+	tcp     bool
+	channel byte
+	rtp     *net.UDPConn
+	rtcp    *net.UDPConn
+	dest    *net.UDPAddr
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// rtspRequest is a parsed request.
+type rtspRequest struct {
+	method string
+	url    string
+	header textproto.MIMEHeader
+}
+
+func (c *rtspConn) serve() {
+	defer func() {
+		c.endSession()
+		c.conn.Close()
+		c.srv.mu.Lock()
+		delete(c.srv.conns, c)
+		c.srv.mu.Unlock()
+	}()
+	tp := textproto.NewReader(c.rd)
+	for {
+		// Clients may send RTCP interleaved with the requests.
+		if b, err := c.rd.Peek(1); err != nil {
+			return
+		} else if b[0] == '$' {
+			var hdr [4]byte
+			if _, err := io.ReadFull(c.rd, hdr[:]); err != nil {
+				return
+			}
+			if _, err := c.rd.Discard(int(binary.BigEndian.Uint16(hdr[2:]))); err != nil {
+				return
+			}
+			continue
+		}
+
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		if line == "" {
+			continue
+		}
+		method, rest, ok1 := strings.Cut(line, " ")
+		url, proto, ok2 := strings.Cut(rest, " ")
+		if !ok1 || !ok2 || !strings.HasPrefix(proto, "RTSP/1.") {
+			c.respond("", 400, "Bad Request", nil, "")
+			return
+		}
+		header, err := tp.ReadMIMEHeader()
+		if err != nil {
+			return
+		}
+		if n, _ := strconv.Atoi(header.Get("Content-Length")); n > 0 {
+			if _, err := c.rd.Discard(n); err != nil {
+				return
+			}
+		}
+		if !c.handle(&rtspRequest{method: method, url: url, header: header}) {
+			return
+		}
+	}
+}
+
+// handle answers a request and reports whether the connection stays open.
+func (c *rtspConn) handle(req *rtspRequest) bool {
+	cseq := req.header.Get("CSeq")
+	if req.method == "PLAY" || req.method == "TEARDOWN" {
+		if c.sess == nil || sessionID(req.header.Get("Session")) != c.sess.id {
+			c.respond(cseq, 454, "Session Not Found", nil, "")
+			return true
+		}
+	}
+
+	switch req.method {
+	case "OPTIONS":
+		c.respond(cseq, 200, "OK", []string{
+			"Public: OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN, GET_PARAMETER",
+		}, "")
+	case "DESCRIBE":
+		base := req.url
+		if !strings.HasSuffix(base, "/") {
+			base += "/"
+		}
+		c.respond(cseq, 200, "OK", []string{
+			"Content-Base: " + base,
+			"Content-Type: application/sdp",
+		}, c.sdp())
+	case "SETUP":
+		c.setup(cseq, req)
+	case "PLAY":
+		c.play(cseq, req)
+	case "GET_PARAMETER":
+		var header []string
+		if c.sess != nil {
+			header = append(header, c.sessionHeader())
+		}
+		c.respond(cseq, 200, "OK", header, "")
+	case "TEARDOWN":
+		c.respond(cseq, 200, "OK", []string{"Session: " + c.sess.id}, "")
+		c.endSession()
+		return req.header.Get("Connection") != "close"
+	default:
+		c.respond(cseq, 501, "Not Implemented", nil, "")
+	}
+	return true
+}
+
+// sessionID strips the parameters from a Session header.
+func sessionID(h string) string {
+	id, _, _ := strings.Cut(h, ";")
+	return strings.TrimSpace(id)
+}
+
+func (c *rtspConn) sessionHeader() string {
+	return fmt.Sprintf("Session: %s;timeout=%d", c.sess.id, rtspSessionTimeout)
+}
+
+// sdp describes the single RTP/JPEG track.
+func (c *rtspConn) sdp() string {
+	host := "0.0.0.0"
+	if addr, ok := c.conn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() != nil {
+		host = addr.IP.String()
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "v=0\r\n")
+	fmt.Fprintf(&b, "o=- %d 1 IN IP4 %s\r\n", time.Now().Unix(), host)
+	fmt.Fprintf(&b, "s=gocam\r\n")
+	fmt.Fprintf(&b, "c=IN IP4 0.0.0.0\r\n")
+	fmt.Fprintf(&b, "t=0 0\r\n")
+	fmt.Fprintf(&b, "a=control:*\r\n")
+	fmt.Fprintf(&b, "a=range:npt=0-\r\n")
+	fmt.Fprintf(&b, "m=video 0 RTP/AVP %d\r\n", rtpJPEGPayloadType)
+	fmt.Fprintf(&b, "a=rtpmap:%d JPEG/%d\r\n", rtpJPEGPayloadType, rtpJPEGClock)
+	if c.srv.opts.MaxFPS > 0 {
+		fmt.Fprintf(&b, "a=framerate:%g\r\n", c.srv.opts.MaxFPS)
+	}
+	fmt.Fprintf(&b, "a=control:trackID=0\r\n")
+	return b.String()
+}
+
+// setup creates the session for the first transport in the request the
+// server supports.
+func (c *rtspConn) setup(cseq string, req *rtspRequest) {
+	if c.sess != nil {
+		if id := sessionID(req.header.Get("Session")); id != "" && id != c.sess.id {
+			c.respond(cseq, 454, "Session Not Found", nil, "")
+			return
+		}
+		if c.sess.stop != nil {
+			c.respond(cseq, 455, "Method Not Valid in This State", nil, "")
+			return
+		}
+		c.endSession()
+	}
+
+	sess := &rtspSession{id: randomHex(8)}
+	var r [10]byte
+	rand.Read(r[:])
+	sess.ssrc = binary.BigEndian.Uint32(r[0:])
+	sess.tsBase = binary.BigEndian.Uint32(r[4:])
+	sess.seqBase = binary.BigEndian.Uint16(r[8:])
+
+	var transport string
+	for _, spec := range strings.Split(req.header.Get("Transport"), ",") {
+		t, err := c.transport(sess, strings.TrimSpace(spec))
+		if err == nil {
+			transport = t
+			break
+		}
+	}
+	if transport == "" {
+		c.respond(cseq, 461, "Unsupported Transport", nil, "")
+		return
+	}
+	c.sess = sess
+	c.respond(cseq, 200, "OK", []string{"Transport: " + transport, c.sessionHeader()}, "")
+}
+
+// transport configures sess for one Transport header entry and returns
+// the server's answer.
+func (c *rtspConn) transport(sess *rtspSession, spec string) (string, error) {
+	parts := strings.Split(spec, ";")
+	profile := strings.ToUpper(parts[0])
+	params := make(map[string]string)
+	for _, p := range parts[1:] {
+		k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+		params[strings.ToLower(k)] = v
+	}
+	if _, ok := params["multicast"]; ok {
+		return "", errors.New("multicast")
+	}
+	ssrc := fmt.Sprintf("ssrc=%08X", sess.ssrc)
+
+	switch profile {
+	case "RTP/AVP/TCP":
+		rtp, rtcp := 0, 1
+		if v, ok := params["interleaved"]; ok {
+			var err error
+			if rtp, rtcp, err = portRange(v); err != nil || rtp > 255 || rtcp > 255 {
+				return "", errors.New("bad interleaved channels")
+			}
+		}
+		sess.tcp, sess.channel = true, byte(rtp)
+		return fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d;%s", rtp, rtcp, ssrc), nil
+	case "RTP/AVP", "RTP/AVP/UDP":
+		rtpPort, rtcpPort, err := portRange(params["client_port"])
+		if err != nil {
+			return "", err
+		}
+		remote, ok := c.conn.RemoteAddr().(*net.TCPAddr)
+		if !ok {
+			return "", errors.New("no client address")
+		}
+		local, _ := c.conn.LocalAddr().(*net.TCPAddr)
+		if sess.rtp, sess.rtcp, err = listenUDPPair(local); err != nil {
+			return "", err
+		}
+		sess.dest = &net.UDPAddr{IP: remote.IP, Port: rtpPort, Zone: remote.Zone}
+		return fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d;server_port=%d-%d;%s",
+			rtpPort, rtcpPort,
+			sess.rtp.LocalAddr().(*net.UDPAddr).Port, sess.rtcp.LocalAddr().(*net.UDPAddr).Port,
+			ssrc), nil
+	}
+	return "", errors.New("unsupported profile")
+}
+
+// portRange parses "a-b" or "a", in which case b is a+1.
+func portRange(v string) (a, b int, err error) {
+	first, second, ok := strings.Cut(v, "-")
+	if a, err = strconv.Atoi(first); err != nil || a < 0 || a > 65535 {
+		return 0, 0, errors.New("bad port range")
+	}
+	b = a + 1
+	if ok {
+		if b, err = strconv.Atoi(second); err != nil || b < 0 || b > 65535 {
+			return 0, 0, errors.New("bad port range")
+		}
+	}
+	return a, b, nil
+}
+
+// listenUDPPair opens RTP and RTCP sockets on consecutive ports, the
+// first one even, on the address of local.
+func listenUDPPair(local *net.TCPAddr) (rtp, rtcp *net.UDPConn, err error) {
+	addr := &net.UDPAddr{}
+	if local != nil {
+		addr.IP, addr.Zone = local.IP, local.Zone
+	}
+	for attempt := 0; attempt < 16; attempt++ {
+		rtp, err = net.ListenUDP("udp", addr)
+		if err != nil {
+			return nil, nil, err
+		}
+		port := rtp.LocalAddr().(*net.UDPAddr).Port
+		if port%2 == 0 {
+			next := *addr
+			next.Port = port + 1
+			if rtcp, err = net.ListenUDP("udp", &next); err == nil {
+				return rtp, rtcp, nil
+			}
+		}
+		rtp.Close()
+	}
+	return nil, nil, errors.New("gocam: no free RTP port pair")
+}
+
+// play starts sending images to the session.
+func (c *rtspConn) play(cseq string, req *rtspRequest) {
+	sess := c.sess
+	info := fmt.Sprintf("RTP-Info: url=%s;seq=%d;rtptime=%d", req.url, sess.seqBase, sess.tsBase)
+	if sess.stop == nil {
+		ch := c.srv.hub.subscribe(false)
+		if ch == nil {
+			c.respond(cseq, 503, "Service Unavailable", nil, "")
+			return
+		}
+		sess.stop = make(chan struct{})
+		sess.stopped = make(chan struct{})
+		go c.send(sess, ch)
+	}
+	c.respond(cseq, 200, "OK", []string{
+		c.sessionHeader(),
+		"Range: npt=0.000-",
+		info,
+	}, "")
+}
+
+// send packetizes the images for the session until it stops. When the
+// frame channel closes, the connection is closed so the client notices.
+func (c *rtspConn) send(sess *rtspSession, ch chan jpegImage) {
+	defer close(sess.stopped)
+	defer c.srv.hub.unsubscribe(ch)
+
+	var start time.Time
+	seq := sess.seqBase
+	pkt := make([]byte, 0, 4+12+c.srv.opts.PacketSize)
+	for {
+		select {
+		case <-sess.stop:
+			return
+		case img, ok := <-ch:
+			if !ok {
+				c.conn.Close()
+				return
+			}
+			j, err := parseRTPJPEG(img.data)
+			if err != nil {
+				continue
+			}
+			if start.IsZero() {
+				start = img.time
+			}
+			ts := sess.tsBase + uint32(img.time.Sub(start).Seconds()*rtpJPEGClock)
+			err = j.payloads(c.srv.opts.PacketSize-12, func(payload []byte, last bool) error {
+				pkt = pkt[:0]
+				if sess.tcp {
+					pkt = append(pkt, '$', sess.channel, 0, 0)
+				}
+				pt := byte(rtpJPEGPayloadType)
+				if last {
+					pt |= 0x80
+				}
+				pkt = append(pkt, 0x80, pt)
+				pkt = binary.BigEndian.AppendUint16(pkt, seq)
+				pkt = binary.BigEndian.AppendUint32(pkt, ts)
+				pkt = binary.BigEndian.AppendUint32(pkt, sess.ssrc)
+				pkt = append(pkt, payload...)
+				seq++
+				if sess.tcp {
+					binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)-4))
+					return c.write(pkt)
+				}
+				_, err := sess.rtp.WriteToUDP(pkt, sess.dest)
+				return err
+			})
+			if err != nil && sess.tcp {
+				c.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// endSession stops and forgets the session, if any.
+func (c *rtspConn) endSession() {
+	sess := c.sess
+	if sess == nil {
+		return
+	}
+	c.sess = nil
+	if sess.stop != nil {
+		close(sess.stop)
+		<-sess.stopped
+	}
+	if sess.rtp != nil {
+		sess.rtp.Close()
+		sess.rtcp.Close()
+	}
+}
+
+// respond writes a response with the given extra header lines and body.
+func (c *rtspConn) respond(cseq string, code int, reason string, header []string, body string) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "RTSP/1.0 %d %s\r\n", code, reason)
+	if cseq != "" {
+		fmt.Fprintf(&b, "CSeq: %s\r\n", cseq)
+	}
+	b.WriteString("Server: gocam\r\n")
+	for _, h := range header {
+		b.WriteString(h + "\r\n")
+	}
+	if body != "" {
+		fmt.Fprintf(&b, "Content-Length: %d\r\n", len(body))
+	}
+	b.WriteString("\r\n")
+	b.WriteString(body)
+	c.write([]byte(b.String()))
+}
+
+// write sends data on the RTSP connection within rtspWriteTimeout.
+func (c *rtspConn) write(data []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(rtspWriteTimeout))
+	_, err := c.conn.Write(data)
+	return err
+}
+
+// randomHex returns n random bytes in hexadecimal.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
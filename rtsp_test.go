@@ -0,0 +1,304 @@
+package gocam
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rtspClient is a minimal RTSP client for the loopback tests.
+type rtspClient struct {
+	t    *testing.T
+	conn net.Conn
+	rd   *bufio.Reader
+	cseq int
+	url  string
+}
+
+// rtspResponse is a parsed response.
+type rtspResponse struct {
+	code   int
+	header textproto.MIMEHeader
+	body   string
+}
+
+// startRTSP serves frames on a loopback port and connects a client.
+func startRTSP(t *testing.T, frames <-chan Frame, opts *RTSPOptions) (*RTSPServer, *rtspClient) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewRTSPServer(frames, opts)
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(l) }()
+	t.Cleanup(func() {
+		s.Close()
+		if err := <-done; err != ErrServerClosed {
+			t.Errorf("Serve returned %v, want ErrServerClosed", err)
+		}
+	})
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return s, &rtspClient{t: t, conn: conn, rd: bufio.NewReader(conn), url: "rtsp://" + l.Addr().String() + "/cam"}
+}
+
+// do sends a request and reads the response, skipping interleaved data.
+func (c *rtspClient) do(method, url string, header ...string) rtspResponse {
+	c.t.Helper()
+	c.cseq++
+	req := fmt.Sprintf("%s %s RTSP/1.0\r\nCSeq: %d\r\n", method, url, c.cseq)
+	for _, h := range header {
+		req += h + "\r\n"
+	}
+	if _, err := io.WriteString(c.conn, req+"\r\n"); err != nil {
+		c.t.Fatal(err)
+	}
+
+	for {
+		b, err := c.rd.Peek(1)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		if b[0] != '$' {
+			break
+		}
+		c.readInterleaved()
+	}
+	tp := textproto.NewReader(c.rd)
+	line, err := tp.ReadLine()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) < 2 || fields[0] != "RTSP/1.0" {
+		c.t.Fatalf("bad status line %q", line)
+	}
+	var resp rtspResponse
+	resp.code, _ = strconv.Atoi(fields[1])
+	if resp.header, err = tp.ReadMIMEHeader(); err != nil {
+		c.t.Fatal(err)
+	}
+	if got := resp.header.Get("CSeq"); got != strconv.Itoa(c.cseq) {
+		c.t.Errorf("%s: CSeq %q, want %d", method, got, c.cseq)
+	}
+	if n, _ := strconv.Atoi(resp.header.Get("Content-Length")); n > 0 {
+		body := make([]byte, n)
+		if _, err := io.ReadFull(c.rd, body); err != nil {
+			c.t.Fatal(err)
+		}
+		resp.body = string(body)
+	}
+	return resp
+}
+
+// readInterleaved returns the next interleaved packet and its channel.
+func (c *rtspClient) readInterleaved() (byte, []byte) {
+	c.t.Helper()
+	var hdr [4]byte
+	if _, err := io.ReadFull(c.rd, hdr[:]); err != nil {
+		c.t.Fatal(err)
+	}
+	if hdr[0] != '$' {
+		c.t.Fatalf("expected interleaved data, got %q", hdr[0])
+	}
+	pkt := make([]byte, binary.BigEndian.Uint16(hdr[2:]))
+	if _, err := io.ReadFull(c.rd, pkt); err != nil {
+		c.t.Fatal(err)
+	}
+	return hdr[1], pkt
+}
+
+// collectImage gathers RTP packets from next until a complete image has
+// arrived and returns its reassembled JPEG. Packets before the first
+// image start are skipped.
+func collectImage(t *testing.T, next func() []byte) []byte {
+	t.Helper()
+	var payloads [][]byte
+	var ts uint32
+	var seq uint16
+	for {
+		pkt := next()
+		if len(pkt) < 12 || pkt[0] != 0x80 || pkt[1]&0x7F != rtpJPEGPayloadType {
+			t.Fatalf("bad RTP header % x", pkt[:min(len(pkt), 12)])
+		}
+		payload := pkt[12:]
+		off := int(payload[1])<<16 | int(payload[2])<<8 | int(payload[3])
+		if len(payloads) == 0 && off != 0 {
+			continue
+		}
+		pseq, pts := binary.BigEndian.Uint16(pkt[2:]), binary.BigEndian.Uint32(pkt[4:])
+		if len(payloads) > 0 && (pts != ts || pseq != seq+1) {
+			t.Fatalf("packet seq %d ts %d follows seq %d ts %d", pseq, pts, seq, ts)
+		}
+		ts, seq = pts, pseq
+		payloads = append(payloads, payload)
+		if pkt[1]&0x80 != 0 {
+			return rebuildRTPJPEG(t, payloads)
+		}
+	}
+}
+
+// feedFrames sends frames until stop is closed.
+func feedFrames(frames chan<- Frame, frame Frame, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case frames <- frame:
+			time.Sleep(2 * time.Millisecond)
+		}
+	}
+}
+
+func TestRTSPServerInterleaved(t *testing.T) {
+	frames := make(chan Frame)
+	stop := make(chan struct{})
+	defer close(stop)
+	go feedFrames(frames, pixelFrame(36, 20), stop)
+	s, c := startRTSP(t, frames, &RTSPOptions{PacketSize: 300})
+
+	resp := c.do("OPTIONS", c.url)
+	if resp.code != 200 || !strings.Contains(resp.header.Get("Public"), "PLAY") {
+		t.Fatalf("OPTIONS: %d, Public %q", resp.code, resp.header.Get("Public"))
+	}
+	resp = c.do("DESCRIBE", c.url, "Accept: application/sdp")
+	if resp.code != 200 || resp.header.Get("Content-Base") != c.url+"/" {
+		t.Fatalf("DESCRIBE: %d, Content-Base %q", resp.code, resp.header.Get("Content-Base"))
+	}
+	for _, line := range []string{"m=video 0 RTP/AVP 26", "a=rtpmap:26 JPEG/90000", "a=control:trackID=0"} {
+		if !strings.Contains(resp.body, line+"\r\n") {
+			t.Errorf("SDP lacks %q:\n%s", line, resp.body)
+		}
+	}
+
+	resp = c.do("SETUP", c.url+"/trackID=0", "Transport: RTP/AVP/TCP;unicast;interleaved=2-3")
+	if resp.code != 200 || !strings.HasPrefix(resp.header.Get("Transport"), "RTP/AVP/TCP;unicast;interleaved=2-3") {
+		t.Fatalf("SETUP: %d, Transport %q", resp.code, resp.header.Get("Transport"))
+	}
+	session := sessionID(resp.header.Get("Session"))
+	if session == "" {
+		t.Fatal("SETUP: no session")
+	}
+	resp = c.do("PLAY", c.url, "Session: "+session)
+	if resp.code != 200 || !strings.Contains(resp.header.Get("RTP-Info"), "seq=") {
+		t.Fatalf("PLAY: %d, RTP-Info %q", resp.code, resp.header.Get("RTP-Info"))
+	}
+
+	jpg := collectImage(t, func() []byte {
+		ch, pkt := c.readInterleaved()
+		if ch != 2 {
+			t.Fatalf("packet on channel %d, want 2", ch)
+		}
+		return pkt
+	})
+	// The frame is cropped to a multiple of 8 pixels.
+	if b := decodeJPEGBytes(t, jpg).Bounds(); b.Dx() != 32 || b.Dy() != 16 {
+		t.Errorf("image is %dx%d, want 32x16", b.Dx(), b.Dy())
+	}
+	if n := s.Sessions(); n != 1 {
+		t.Errorf("Sessions() = %d, want 1", n)
+	}
+
+	if resp := c.do("TEARDOWN", c.url, "Session: "+session); resp.code != 200 {
+		t.Fatalf("TEARDOWN: %d", resp.code)
+	}
+	if n := s.Sessions(); n != 0 {
+		t.Errorf("Sessions() = %d after TEARDOWN, want 0", n)
+	}
+}
+
+func TestRTSPServerUDP(t *testing.T) {
+	frames := make(chan Frame)
+	stop := make(chan struct{})
+	defer close(stop)
+	go feedFrames(frames, pixelFrame(32, 16), stop)
+	_, c := startRTSP(t, frames, nil)
+
+	rtp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rtp.Close()
+	rtp.SetDeadline(time.Now().Add(10 * time.Second))
+	port := rtp.LocalAddr().(*net.UDPAddr).Port
+
+	resp := c.do("SETUP", c.url+"/trackID=0", fmt.Sprintf("Transport: RTP/AVP;unicast;client_port=%d-%d", port, port+1))
+	if resp.code != 200 || !strings.Contains(resp.header.Get("Transport"), "server_port=") {
+		t.Fatalf("SETUP: %d, Transport %q", resp.code, resp.header.Get("Transport"))
+	}
+	session := sessionID(resp.header.Get("Session"))
+	resp = c.do("PLAY", c.url, "Session: "+session)
+	if resp.code != 200 {
+		t.Fatalf("PLAY: %d", resp.code)
+	}
+	info := resp.header.Get("RTP-Info")
+
+	buf := make([]byte, 2048)
+	first := true
+	jpg := collectImage(t, func() []byte {
+		n, _, err := rtp.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first {
+			if seq := fmt.Sprintf(";seq=%d;", binary.BigEndian.Uint16(buf[2:])); !strings.Contains(info, seq) {
+				t.Errorf("first packet has %s, RTP-Info %q", seq, info)
+			}
+			first = false
+		}
+		return append([]byte(nil), buf[:n]...)
+	})
+	if b := decodeJPEGBytes(t, jpg).Bounds(); b.Dx() != 32 || b.Dy() != 16 {
+		t.Errorf("image is %dx%d, want 32x16", b.Dx(), b.Dy())
+	}
+	// PLAY while playing reports the same starting point as the sender
+	// moves on.
+	if resp := c.do("PLAY", c.url, "Session: "+session); resp.code != 200 || resp.header.Get("RTP-Info") != info {
+		t.Errorf("second PLAY: %d, RTP-Info %q, want %q", resp.code, resp.header.Get("RTP-Info"), info)
+	}
+	if resp := c.do("GET_PARAMETER", c.url, "Session: "+session); resp.code != 200 {
+		t.Errorf("GET_PARAMETER: %d", resp.code)
+	}
+}
+
+func TestRTSPServerErrors(t *testing.T) {
+	frames := make(chan Frame)
+	_, c := startRTSP(t, frames, nil)
+
+	if resp := c.do("PLAY", c.url, "Session: 1234"); resp.code != 454 {
+		t.Errorf("PLAY without session: %d, want 454", resp.code)
+	}
+	if resp := c.do("RECORD", c.url); resp.code != 501 {
+		t.Errorf("RECORD: %d, want 501", resp.code)
+	}
+	if resp := c.do("SETUP", c.url, "Transport: RTP/AVP;multicast"); resp.code != 461 {
+		t.Errorf("SETUP multicast: %d, want 461", resp.code)
+	}
+	resp := c.do("SETUP", c.url, "Transport: RTP/AVP;multicast, RTP/AVP/TCP;unicast")
+	if resp.code != 200 || !strings.HasPrefix(resp.header.Get("Transport"), "RTP/AVP/TCP;unicast;interleaved=0-1") {
+		t.Errorf("SETUP with fallback: %d, Transport %q", resp.code, resp.header.Get("Transport"))
+	}
+
+	// Once the frames end, a playing session's connection is closed.
+	session := sessionID(resp.header.Get("Session"))
+	if resp := c.do("PLAY", c.url, "Session: "+session); resp.code != 200 {
+		t.Fatalf("PLAY: %d", resp.code)
+	}
+	close(frames)
+	if _, err := io.Copy(io.Discard, c.rd); err != nil {
+		t.Errorf("connection ended with %v, want EOF", err)
+	}
+}
@@ -0,0 +1,479 @@
+//go:build linux
+// +build linux
+
+package gocam
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/svanichkin/gocam/pixconv"
+)
+
+// A shared-memory ring is one file, in /dev/shm or a memfd, holding a ring
+// header followed by Slots slots. Each slot is a slot header and room for
+// one frame. All fields are in native byte order and 8-byte aligned:
+//
+//	ring header (64 bytes)
+//	0   8  magic "GOCAMSHM"
+//	8   4  version (1)
+//	12  4  ring header size
+//	16  4  slot count
+//	20  4  slot header size
+//	24  8  slot size, header included
+//	32  8  frames published so far
+//	40  4  futex word: low 32 bits of the frames published
+//	44  4  1 once the publisher has closed
+//
+//	slot header (64 bytes)
+//	0   8  seqlock counter, odd while the slot is being written
+//	8   4  width
+//	12  4  height
+//	16  4  pixel format (pixconv.Format)
+//	24  8  capture time in nanoseconds since the Unix epoch, 0 if unknown
+//	32  8  sequence number
+//	40  8  payload length
+//
+// Frame n goes to slot n % slots. The publisher never waits for readers:
+// it bumps the slot's counter to odd, writes, bumps it to even, and then
+// publishes the new frame count and wakes readers blocked on the futex
+// word. Readers take the newest slot and check the counter around their
+// reads, the usual seqlock protocol.
+
+const (
+	shmMagic          = "GOCAMSHM"
+	shmVersion        = 1
+	shmRingHeaderSize = 64
+	shmSlotHeaderSize = 64
+	shmDir            = "/dev/shm"
+)
+
+// Offsets in the ring header.
+const (
+	shmOffWritten = 32
+	shmOffFutex   = 40
+	shmOffClosed  = 44
+)
+
+// Offsets in a slot header.
+const (
+	shmOffSeq       = 0
+	shmOffWidth     = 8
+	shmOffHeight    = 12
+	shmOffFormat    = 16
+	shmOffTimestamp = 24
+	shmOffSequence  = 32
+	shmOffLength    = 40
+)
+
+// ShmOptions configures a ShmPublisher. The zero value (or a nil pointer)
+// makes four slots for YCbCr444 frames up to 1920x1080.
+type ShmOptions struct {
+	// Slots is the ring length; a reader's frame stays intact until the
+	// publisher has written Slots more frames. At least 2; zero means 4.
+	Slots int
+	// MaxWidth and MaxHeight size the slots; larger frames are rejected.
+	// Zero means 1920x1080.
+	MaxWidth, MaxHeight int
+	// Format is the pixel layout frames are converted to, such as
+	// pixconv.RGB24 for inference code. Zero means pixconv.YCbCr444.
+	Format pixconv.Format
+}
+
+// ShmPublisher writes frames into a shared-memory ring that other
+// processes read with ShmSubscriber, so a process holding the camera can
+// share it. It implements FrameWriter, so Record can drive it. Writing
+// never waits for readers.
+type ShmPublisher struct {
+	fd       int
+	path     string // "" for a memfd
+	mem      []byte
+	slots    int
+	slotSize int
+	format   pixconv.Format
+	written  uint64
+}
+
+// shmPath returns the file of a named ring: names without a slash live in
+// /dev/shm.
+func shmPath(name string) string {
+	if strings.ContainsRune(name, '/') {
+		return name
+	}
+	return filepath.Join(shmDir, name)
+}
+
+// NewShmPublisher creates a ring. A non-empty name creates the file
+// /dev/shm/name, or the path itself if name contains a slash, replacing
+// an existing one; Close removes it. An empty name creates an anonymous
+// memfd instead, which readers open through Fd, for example after
+// receiving it over a Unix socket or via /proc/<pid>/fd/<fd>.
+func NewShmPublisher(name string, opts *ShmOptions) (*ShmPublisher, error) {
+	var o ShmOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.Slots == 0 {
+		o.Slots = 4
+	}
+	if o.MaxWidth == 0 && o.MaxHeight == 0 {
+		o.MaxWidth, o.MaxHeight = 1920, 1080
+	}
+	if o.Slots < 2 || o.MaxWidth <= 0 || o.MaxHeight <= 0 {
+		return nil, errors.New("gocam: invalid shared-memory ring options")
+	}
+	if o.Format.PlaneCount() == 0 {
+		return nil, fmt.Errorf("gocam: unknown pixel format %v", o.Format)
+	}
+	payload := o.Format.Size(o.MaxWidth, o.MaxHeight)
+	slotSize := (shmSlotHeaderSize + payload + 63) &^ 63
+	size := shmRingHeaderSize + o.Slots*slotSize
+
+	p := &ShmPublisher{slots: o.Slots, slotSize: slotSize, format: o.Format}
+	var err error
+	if name == "" {
+		p.fd, err = memfdCreate("gocam-ring")
+	} else {
+		p.path = shmPath(name)
+		p.fd, err = syscall.Open(p.path, syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC|syscall.O_CLOEXEC, 0o600)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("gocam: create shared-memory ring: %w", err)
+	}
+	fail := func(err error) (*ShmPublisher, error) {
+		syscall.Close(p.fd)
+		if p.path != "" {
+			os.Remove(p.path)
+		}
+		return nil, err
+	}
+	if err := syscall.Ftruncate(p.fd, int64(size)); err != nil {
+		return fail(fmt.Errorf("gocam: size shared-memory ring: %w", err))
+	}
+	if p.mem, err = syscall.Mmap(p.fd, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED); err != nil {
+		return fail(fmt.Errorf("gocam: map shared-memory ring: %w", err))
+	}
+
+	copy(p.mem, shmMagic)
+	*p.u32(8) = shmVersion
+	*p.u32(12) = shmRingHeaderSize
+	*p.u32(16) = uint32(o.Slots)
+	*p.u32(20) = shmSlotHeaderSize
+	*p.u64(24) = uint64(slotSize)
+	return p, nil
+}
+
+func (p *ShmPublisher) u32(off int) *uint32 { return (*uint32)(unsafe.Pointer(&p.mem[off])) }
+func (p *ShmPublisher) u64(off int) *uint64 { return (*uint64)(unsafe.Pointer(&p.mem[off])) }
+
+// Fd returns the descriptor of the ring file, valid until Close.
+func (p *ShmPublisher) Fd() int {
+	return p.fd
+}
+
+// Path returns the file of a named ring, or "" for a memfd.
+func (p *ShmPublisher) Path() string {
+	return p.path
+}
+
+// WriteFrame converts the frame into the next slot and publishes it. The
+// frame is not released.
+func (p *ShmPublisher) WriteFrame(frame Frame) error {
+	if p.mem == nil {
+		return errors.New("gocam: shared-memory ring closed")
+	}
+	if err := checkFrame(frame); err != nil {
+		return err
+	}
+	size := p.format.Size(frame.Width, frame.Height)
+	if shmSlotHeaderSize+size > p.slotSize {
+		return fmt.Errorf("gocam: %dx%d frame does not fit the shared-memory ring", frame.Width, frame.Height)
+	}
+	src, err := pixconv.Wrap(pixconv.YCbCr444, frame.Width, frame.Height, frame.Data, 0)
+	if err != nil {
+		return err
+	}
+
+	base := shmRingHeaderSize + int(p.written%uint64(p.slots))*p.slotSize
+	seq := p.u64(base + shmOffSeq)
+	start := atomic.LoadUint64(seq)
+	atomic.StoreUint64(seq, start+1)
+
+	payload := p.mem[base+shmSlotHeaderSize : base+shmSlotHeaderSize+size]
+	if p.format == pixconv.YCbCr444 {
+		copy(payload, frame.Data)
+	} else {
+		dst, err := pixconv.Wrap(p.format, frame.Width, frame.Height, payload, 0)
+		if err == nil {
+			err = pixconv.Convert(dst, src, pixconv.JFIF)
+		}
+		if err != nil {
+			// Leave the slot consistent; readers skip empty payloads.
+			*p.u64(base + shmOffLength) = 0
+			atomic.StoreUint64(seq, start+2)
+			return err
+		}
+	}
+	var ts int64
+	if !frame.Timestamp.IsZero() {
+		ts = frame.Timestamp.UnixNano()
+	}
+	*p.u32(base + shmOffWidth) = uint32(frame.Width)
+	*p.u32(base + shmOffHeight) = uint32(frame.Height)
+	*p.u32(base + shmOffFormat) = uint32(p.format)
+	*p.u64(base + shmOffTimestamp) = uint64(ts)
+	*p.u64(base + shmOffSequence) = frame.Sequence
+	*p.u64(base + shmOffLength) = uint64(size)
+	atomic.StoreUint64(seq, start+2)
+
+	p.written++
+	atomic.StoreUint64(p.u64(shmOffWritten), p.written)
+	atomic.StoreUint32(p.u32(shmOffFutex), uint32(p.written))
+	futexWake(p.u32(shmOffFutex))
+	return nil
+}
+
+// Close marks the ring finished, so readers get io.EOF once they have the
+// last frame, and releases it. A named ring's file is removed; readers
+// that already mapped it keep their mapping.
+func (p *ShmPublisher) Close() error {
+	if p.mem == nil {
+		return nil
+	}
+	atomic.StoreUint32(p.u32(shmOffClosed), 1)
+	atomic.AddUint32(p.u32(shmOffFutex), 1)
+	futexWake(p.u32(shmOffFutex))
+	err := syscall.Munmap(p.mem)
+	p.mem = nil
+	if cerr := syscall.Close(p.fd); err == nil {
+		err = cerr
+	}
+	if p.path != "" {
+		if rerr := os.Remove(p.path); err == nil && !errors.Is(rerr, os.ErrNotExist) {
+			err = rerr
+		}
+	}
+	return err
+}
+
+// ShmSubscriber reads the frames of a ShmPublisher from another process.
+type ShmSubscriber struct {
+	mem      []byte
+	slots    int
+	slotSize int
+	// next is the frame count the next frame must exceed.
+	next uint64
+}
+
+// ShmFrame is a frame read from a shared-memory ring. Data points into the
+// shared mapping: it must not be modified, and it stays intact only until
+// the publisher reuses the slot, after writing Slots more frames. Check
+// Valid after using Data to know whether it was overwritten meanwhile, or
+// copy what must be kept. Data is in Format, which is the publisher's
+// ShmOptions.Format.
+type ShmFrame struct {
+	Frame
+	Format pixconv.Format
+
+	seq  *uint64
+	want uint64
+}
+
+// Valid reports whether the frame's slot still holds this frame, so
+// everything read from Data so far was consistent.
+func (f ShmFrame) Valid() bool {
+	return f.seq != nil && atomic.LoadUint64(f.seq) == f.want
+}
+
+// OpenShmSubscriber maps the named ring created by NewShmPublisher.
+func OpenShmSubscriber(name string) (*ShmSubscriber, error) {
+	fd, err := syscall.Open(shmPath(name), syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("gocam: open shared-memory ring: %w", err)
+	}
+	defer syscall.Close(fd)
+	return NewShmSubscriberFd(fd)
+}
+
+// NewShmSubscriberFd maps the ring open at fd, such as a publisher's memfd
+// received from another process. The descriptor may be closed afterwards.
+func NewShmSubscriberFd(fd int) (*ShmSubscriber, error) {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return nil, err
+	}
+	if st.Size < shmRingHeaderSize {
+		return nil, errors.New("gocam: not a shared-memory frame ring")
+	}
+	// Waiting on the futex word only reads it, so the mapping can be
+	// read-only.
+	mem, err := syscall.Mmap(fd, 0, int(st.Size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("gocam: map shared-memory ring: %w", err)
+	}
+	u32 := func(off int) uint32 { return *(*uint32)(unsafe.Pointer(&mem[off])) }
+	slots := int(u32(16))
+	slotSize := int(*(*uint64)(unsafe.Pointer(&mem[24])))
+	if string(mem[:8]) != shmMagic || u32(8) != shmVersion || u32(12) != shmRingHeaderSize ||
+		u32(20) != shmSlotHeaderSize || slots < 1 || slotSize < shmSlotHeaderSize ||
+		int64(shmRingHeaderSize)+int64(slots)*int64(slotSize) > st.Size {
+		syscall.Munmap(mem)
+		return nil, errors.New("gocam: not a shared-memory frame ring")
+	}
+	return &ShmSubscriber{mem: mem, slots: slots, slotSize: slotSize}, nil
+}
+
+func (s *ShmSubscriber) u32(off int) *uint32 { return (*uint32)(unsafe.Pointer(&s.mem[off])) }
+func (s *ShmSubscriber) u64(off int) *uint64 { return (*uint64)(unsafe.Pointer(&s.mem[off])) }
+
+// Next waits for a frame newer than the last one returned and returns the
+// newest; frames published in between are skipped. It returns io.EOF once
+// the publisher has closed and the newest frame was returned.
+func (s *ShmSubscriber) Next(ctx context.Context) (ShmFrame, error) {
+	if s.mem == nil {
+		return ShmFrame{}, errors.New("gocam: shared-memory ring closed")
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return ShmFrame{}, err
+		}
+		futex := atomic.LoadUint32(s.u32(shmOffFutex))
+		written := atomic.LoadUint64(s.u64(shmOffWritten))
+		if written > s.next {
+			if f, ok := s.read(written - 1); ok {
+				s.next = written
+				return f, nil
+			}
+			if written-1 < s.next+uint64(s.slots) {
+				// Being rewritten or empty: wait for the next frame.
+				runtime.Gosched()
+				continue
+			}
+		}
+		if atomic.LoadUint32(s.u32(shmOffClosed)) != 0 && atomic.LoadUint64(s.u64(shmOffWritten)) <= s.next {
+			return ShmFrame{}, io.EOF
+		}
+		futexWait(s.u32(shmOffFutex), futex, 100*time.Millisecond)
+	}
+}
+
+// read returns frame n if its slot holds it consistently.
+func (s *ShmSubscriber) read(n uint64) (ShmFrame, bool) {
+	base := shmRingHeaderSize + int(n%uint64(s.slots))*s.slotSize
+	seq := s.u64(base + shmOffSeq)
+	before := atomic.LoadUint64(seq)
+	if before&1 != 0 {
+		return ShmFrame{}, false
+	}
+	w := int(*s.u32(base + shmOffWidth))
+	h := int(*s.u32(base + shmOffHeight))
+	format := pixconv.Format(*s.u32(base + shmOffFormat))
+	ts := int64(*s.u64(base + shmOffTimestamp))
+	sequence := *s.u64(base + shmOffSequence)
+	length := *s.u64(base + shmOffLength)
+	if atomic.LoadUint64(seq) != before {
+		return ShmFrame{}, false
+	}
+	if length == 0 || length > uint64(s.slotSize-shmSlotHeaderSize) || w <= 0 || h <= 0 ||
+		format.PlaneCount() == 0 || uint64(format.Size(w, h)) != length {
+		return ShmFrame{}, false
+	}
+
+	f := ShmFrame{
+		Frame: Frame{
+			Data:     s.mem[base+shmSlotHeaderSize : base+shmSlotHeaderSize+int(length) : base+shmSlotHeaderSize+int(length)],
+			Width:    w,
+			Height:   h,
+			Sequence: sequence,
+		},
+		Format: format,
+		seq:    seq,
+		want:   before,
+	}
+	if ts != 0 {
+		f.Timestamp = time.Unix(0, ts)
+	}
+	return f, true
+}
+
+// Close unmaps the ring. Data of frames read from it must not be used
+// afterwards.
+func (s *ShmSubscriber) Close() error {
+	if s.mem == nil {
+		return nil
+	}
+	err := syscall.Munmap(s.mem)
+	s.mem = nil
+	return err
+}
+
+const (
+	futexWaitOp = 0
+	futexWakeOp = 1
+)
+
+// futexWait sleeps while *addr == val, at most timeout. The futex is
+// shared, so wakeups cross process boundaries.
+func futexWait(addr *uint32, val uint32, timeout time.Duration) {
+	ts := syscall.NsecToTimespec(int64(timeout))
+	syscall.Syscall6(syscall.SYS_FUTEX, uintptr(unsafe.Pointer(addr)), futexWaitOp, uintptr(val), uintptr(unsafe.Pointer(&ts)), 0, 0)
+}
+
+// futexWake wakes all waiters on addr.
+func futexWake(addr *uint32) {
+	syscall.Syscall6(syscall.SYS_FUTEX, uintptr(unsafe.Pointer(addr)), futexWakeOp, uintptr(1<<31-1), 0, 0, 0)
+}
+
+// memfdCreateTrap holds the memfd_create syscall numbers, which the
+// syscall package lacks on several architectures.
+var memfdCreateTrap = map[string]uintptr{
+	"386":      356,
+	"amd64":    319,
+	"arm":      385,
+	"arm64":    279,
+	"loong64":  279,
+	"mips":     4354,
+	"mipsle":   4354,
+	"mips64":   5314,
+	"mips64le": 5314,
+	"ppc64":    360,
+	"ppc64le":  360,
+	"riscv64":  279,
+	"s390x":    350,
+}
+
+// memfdCreate returns an anonymous shared-memory file. Kernels without
+// memfd_create get an unlinked file in /dev/shm instead.
+func memfdCreate(name string) (int, error) {
+	if trap, ok := memfdCreateTrap[runtime.GOARCH]; ok {
+		p, err := syscall.BytePtrFromString(name)
+		if err != nil {
+			return -1, err
+		}
+		const mfdCloexec = 1
+		fd, _, errno := syscall.Syscall(trap, uintptr(unsafe.Pointer(p)), mfdCloexec, 0)
+		if errno == 0 {
+			return int(fd), nil
+		}
+		if errno != syscall.ENOSYS {
+			return -1, errno
+		}
+	}
+	f, err := os.CreateTemp(shmDir, name+"-*")
+	if err != nil {
+		return -1, err
+	}
+	defer f.Close()
+	os.Remove(f.Name())
+	return syscall.Dup(int(f.Fd()))
+}
@@ -0,0 +1,153 @@
+//go:build linux
+// +build linux
+
+package gocam
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/svanichkin/gocam/pixconv"
+)
+
+// newShmRing creates a ring and a subscriber on it, closed when the test
+// ends. An empty name makes a memfd ring opened through its descriptor.
+func newShmRing(t *testing.T, name string, opts *ShmOptions) (*ShmPublisher, *ShmSubscriber) {
+	t.Helper()
+	p, err := NewShmPublisher(name, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	var s *ShmSubscriber
+	if name == "" {
+		s, err = NewShmSubscriberFd(p.Fd())
+	} else {
+		s, err = OpenShmSubscriber(name)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return p, s
+}
+
+func nextShm(t *testing.T, s *ShmSubscriber) ShmFrame {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	f, err := s.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestShmRing(t *testing.T) {
+	name := "gocam-test-" + t.Name()
+	for _, ring := range []string{name, ""} {
+		p, s := newShmRing(t, ring, &ShmOptions{Slots: 2, MaxWidth: 8, MaxHeight: 8})
+		if ring != "" && p.Path() != "/dev/shm/"+name {
+			t.Errorf("path %q", p.Path())
+		}
+
+		frame := pixelFrame(5, 3)
+		frame.Timestamp = time.Unix(100, 5)
+		if err := p.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+		got := nextShm(t, s)
+		if got.Width != 5 || got.Height != 3 || got.Sequence != 9 || got.Format != pixconv.YCbCr444 ||
+			!got.Timestamp.Equal(frame.Timestamp) || !bytes.Equal(got.Data, frame.Data) {
+			t.Fatalf("ring %q: got %dx%d seq %d %v at %v", ring, got.Width, got.Height, got.Sequence, got.Format, got.Timestamp)
+		}
+		if !got.Valid() {
+			t.Error("fresh frame not valid")
+		}
+
+		// Data aliases the slot, so it goes stale once the ring laps.
+		for i := 0; i < 2; i++ {
+			frame.Sequence++
+			if err := p.WriteFrame(frame); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got.Valid() {
+			t.Error("frame still valid after its slot was rewritten")
+		}
+
+		if err := p.WriteFrame(pixelFrame(9, 9)); err == nil {
+			t.Error("oversized frame accepted")
+		}
+		if err := p.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := os.Stat("/dev/shm/" + name); !os.IsNotExist(err) {
+		t.Errorf("ring file left after Close: %v", err)
+	}
+}
+
+func TestShmRingSkipsAndEOF(t *testing.T) {
+	p, s := newShmRing(t, "", &ShmOptions{MaxWidth: 4, MaxHeight: 4})
+	frame := pixelFrame(4, 4)
+	for i := 1; i <= 10; i++ {
+		frame.Sequence = uint64(i)
+		if err := p.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A slow reader gets the newest frame, not a backlog.
+	if got := nextShm(t, s); got.Sequence != 10 {
+		t.Errorf("sequence %d, want 10", got.Sequence)
+	}
+
+	// Next blocks until the publisher writes.
+	done := make(chan struct{})
+	defer func() { <-done }()
+	go func() {
+		defer close(done)
+		time.Sleep(20 * time.Millisecond)
+		frame.Sequence = 11
+		p.WriteFrame(frame)
+		p.Close()
+	}()
+	if got := nextShm(t, s); got.Sequence != 11 {
+		t.Errorf("sequence %d, want 11", got.Sequence)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := s.Next(ctx); err != io.EOF {
+		t.Errorf("error %v after Close, want io.EOF", err)
+	}
+}
+
+func TestShmRingFormat(t *testing.T) {
+	p, s := newShmRing(t, "", &ShmOptions{MaxWidth: 4, MaxHeight: 4, Format: pixconv.RGB24})
+	frame := colorFrame(4, 2)
+	if err := p.WriteFrame(frame); err != nil {
+		t.Fatal(err)
+	}
+	got := nextShm(t, s)
+	if got.Format != pixconv.RGB24 || len(got.Data) != 4*2*3 {
+		t.Fatalf("%v frame of %d bytes", got.Format, len(got.Data))
+	}
+	src, _ := pixconv.Wrap(pixconv.YCbCr444, 4, 2, frame.Data, 0)
+	want := pixconv.New(pixconv.RGB24, 4, 2)
+	if err := pixconv.Convert(want, src, pixconv.JFIF); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Data, want.Bytes()) {
+		t.Error("RGB24 payload differs from pixconv output")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := s.Next(ctx); err != context.DeadlineExceeded {
+		t.Errorf("error %v without new frames, want a deadline", err)
+	}
+}
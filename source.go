@@ -0,0 +1,260 @@
+package gocam
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Source is anything that produces a stream of frames: the platform camera
+// backends, the built-in test pattern and file replay sources, or sources
+// registered by applications (IP cameras, remote feeds, test doubles).
+// Frames are packed YCbCr444 and the Frames channel follows the same
+// latest-only convention as the built-in sources.
+type Source interface {
+	// Open starts producing frames. The source stops when ctx is canceled
+	// or Close is called.
+	Open(ctx context.Context) error
+	// Frames returns the frame channel; it is nil before Open and is closed
+	// when the source stops.
+	Frames() <-chan Frame
+	// Close stops the source. The built-in sources can then be opened
+	// again, and return nil from Frames until they are.
+	Close() error
+	// Info describes the source.
+	Info() SourceInfo
+	// Controls lists the adjustable device settings, if any.
+	Controls() []Control
+}
+
+// EventSource is implemented by sources that report device events.
+type EventSource interface {
+	Events() <-chan Event
+}
+
+// StatsSource is implemented by sources that keep stream counters.
+type StatsSource interface {
+	Stats() Stats
+}
+
+// SourceInfo describes a source.
+type SourceInfo struct {
+	Backend string // registered scheme, e.g. "v4l2", "test" or "file"
+	Device  string // device path or URI
+	Name    string // human-readable device name, if known
+	Driver  string // driver or framework name, if known
+
+	// Width, Height and FPS describe the frames delivered, when known.
+	Width  int
+	Height int
+	FPS    float64
+}
+
+// Control describes an adjustable device setting such as brightness.
+type Control struct {
+	ID      uint32
+	Name    string
+	Min     int64
+	Max     int64
+	Step    int64
+	Default int64
+}
+
+// SourceFactory creates an unopened Source for a device URI. Options that do
+// not apply to the source are ignored.
+type SourceFactory func(uri string, opts ...StreamOption) (Source, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]SourceFactory{}
+)
+
+// Register makes a source available under a URI scheme, so that
+// WithDevice("scheme://...") and NewSource pick it. It panics if factory is
+// nil or the scheme is already registered.
+func Register(scheme string, factory SourceFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if factory == nil {
+		panic("gocam: Register factory is nil")
+	}
+	if scheme == "" {
+		panic("gocam: Register scheme is empty")
+	}
+	if _, dup := registry[scheme]; dup {
+		panic("gocam: Register called twice for scheme " + scheme)
+	}
+	registry[scheme] = factory
+}
+
+// Schemes returns the registered URI schemes in sorted order.
+func Schemes() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	schemes := make([]string, 0, len(registry))
+	for scheme := range registry {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// NewSource creates the source for a device URI. An empty URI or a plain
+// path selects the platform camera backend.
+func NewSource(uri string, opts ...StreamOption) (Source, error) {
+	scheme := uriScheme(uri)
+	if scheme == "" {
+		scheme = platformScheme
+	}
+
+	registryMu.RLock()
+	factory := registry[scheme]
+	registryMu.RUnlock()
+
+	if factory == nil {
+		return nil, fmt.Errorf("gocam: no source registered for scheme %q", scheme)
+	}
+	return factory(uri, opts...)
+}
+
+func init() {
+	Register(platformScheme, newPlatformSource)
+}
+
+// newPlatformSource wraps the build-tagged openStream of the current
+// platform as a Source.
+func newPlatformSource(uri string, opts ...StreamOption) (Source, error) {
+	cfg := newStreamConfig(opts)
+	device, err := platformDevice(uri)
+	if err != nil {
+		return nil, err
+	}
+	cfg.device = device
+
+	return &streamSource{
+		info: SourceInfo{Backend: platformScheme, Device: device},
+		open: func(ctx context.Context) (*Stream, error) {
+			return openStream(ctx, cfg)
+		},
+	}, nil
+}
+
+// sourceState holds the running stream of a built-in source and provides
+// the channel side of the Source interface.
+type sourceState struct {
+	mu     sync.Mutex
+	stream *Stream
+}
+
+// attach starts a stream with open under a cancelable ctx.
+func (st *sourceState) attach(ctx context.Context, open func(context.Context) (*Stream, error)) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.stream != nil {
+		return fmt.Errorf("gocam: source already open")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	s, err := open(ctx)
+	if err != nil {
+		cancel()
+		return err
+	}
+	s.cancel = cancel
+	st.stream = s
+	// Once the stream stops, the source can be opened again.
+	context.AfterFunc(ctx, func() { st.detach(s) })
+	return nil
+}
+
+// detach forgets s if it is still the running stream.
+func (st *sourceState) detach(s *Stream) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.stream == s {
+		st.stream = nil
+	}
+}
+
+func (st *sourceState) current() *Stream {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.stream
+}
+
+// Frames returns the frame channel, or nil while the source is not open.
+func (st *sourceState) Frames() <-chan Frame {
+	if s := st.current(); s != nil {
+		return s.Frames()
+	}
+	return nil
+}
+
+// Events returns the event channel, or nil while the source is not open.
+func (st *sourceState) Events() <-chan Event {
+	if s := st.current(); s != nil {
+		return s.Events()
+	}
+	return nil
+}
+
+// Stats returns a snapshot of the stream counters.
+func (st *sourceState) Stats() Stats {
+	if s := st.current(); s != nil {
+		return s.Stats()
+	}
+	return Stats{}
+}
+
+// Close stops the source, which may then be opened again.
+func (st *sourceState) Close() error {
+	st.mu.Lock()
+	s := st.stream
+	st.stream = nil
+	st.mu.Unlock()
+	if s != nil {
+		return s.Close()
+	}
+	return nil
+}
+
+// streamSource adapts a function returning a *Stream, as implemented by the
+// platform backends, to the Source interface.
+type streamSource struct {
+	sourceState
+	info SourceInfo
+	open func(context.Context) (*Stream, error)
+}
+
+func (src *streamSource) Open(ctx context.Context) error {
+	return src.attach(ctx, src.open)
+}
+
+func (src *streamSource) Info() SourceInfo {
+	info := src.info
+	if s := src.current(); s != nil {
+		if s.info.Name != "" {
+			info.Name = s.info.Name
+		}
+		if s.info.Driver != "" {
+			info.Driver = s.info.Driver
+		}
+		if s.info.Width > 0 && s.info.Height > 0 {
+			info.Width, info.Height = s.info.Width, s.info.Height
+		}
+		if s.info.FPS > 0 {
+			info.FPS = s.info.FPS
+		}
+	}
+	return info
+}
+
+func (src *streamSource) Controls() []Control {
+	if s := src.current(); s != nil {
+		return s.controls
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package gocam
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubScheme is registered once for the tests below.
+const stubScheme = "gocamstub"
+
+// stubSource is a registered Source that is not built on sourceState, like
+// the sources applications add with Register.
+type stubSource struct {
+	uri    string
+	opts   int
+	frames chan Frame
+	events chan Event
+
+	mu      sync.Mutex
+	opened  bool
+	closed  bool
+	openErr error
+}
+
+func (s *stubSource) Open(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.openErr != nil {
+		return s.openErr
+	}
+	s.opened = true
+	s.frames = make(chan Frame, 1)
+	s.events = make(chan Event, 1)
+	s.frames <- (&TestPatternSource{Pattern: PatternGradient, Width: 4, Height: 2}).Render(0)
+	s.events <- Event{Type: EventEOS}
+	return nil
+}
+
+func (s *stubSource) Frames() <-chan Frame { return s.frames }
+func (s *stubSource) Events() <-chan Event { return s.events }
+func (s *stubSource) Stats() Stats         { return Stats{Frames: 7} }
+func (s *stubSource) Controls() []Control  { return []Control{{ID: 1, Name: "Gain"}} }
+func (s *stubSource) Info() SourceInfo {
+	return SourceInfo{Backend: stubScheme, Device: s.uri, Width: 4, Height: 2}
+}
+
+func (s *stubSource) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *stubSource) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+var (
+	registerStub sync.Once
+	stubMu       sync.Mutex
+	lastStub     *stubSource
+	stubErr      error
+
+	errStubBusy = errors.New("stub: device busy")
+)
+
+// useStub registers the stub scheme and returns a function reporting the
+// most recently created stub.
+func useStub(t *testing.T) func() *stubSource {
+	registerStub.Do(func() {
+		Register(stubScheme, func(uri string, opts ...StreamOption) (Source, error) {
+			stubMu.Lock()
+			defer stubMu.Unlock()
+			if stubErr != nil {
+				return nil, stubErr
+			}
+			lastStub = &stubSource{uri: uri, opts: len(opts)}
+			if uri == stubScheme+"://busy" {
+				lastStub.openErr = errStubBusy
+			}
+			return lastStub, nil
+		})
+	})
+	t.Cleanup(func() {
+		stubMu.Lock()
+		lastStub, stubErr = nil, nil
+		stubMu.Unlock()
+	})
+	return func() *stubSource {
+		stubMu.Lock()
+		defer stubMu.Unlock()
+		return lastStub
+	}
+}
+
+func TestURIScheme(t *testing.T) {
+	for _, tc := range []struct{ uri, want string }{
+		{"", ""},
+		{"/dev/video2", ""},
+		{"video0", ""},
+		{"v4l2:///dev/video2", "v4l2"},
+		{"test://bars", "test"},
+		{"file:///tmp/a.y4m", "file"},
+		{"file:a.y4m", "file"},
+		{"gocamstub://cam", "gocamstub"},
+		// Only file takes the short form; other colons belong to paths.
+		{"cam:1", ""},
+	} {
+		if got := uriScheme(tc.uri); got != tc.want {
+			t.Errorf("uriScheme(%q) = %q, want %q", tc.uri, got, tc.want)
+		}
+	}
+}
+
+func TestSchemes(t *testing.T) {
+	useStub(t)
+	schemes := Schemes()
+	if !sort.StringsAreSorted(schemes) {
+		t.Errorf("schemes not sorted: %v", schemes)
+	}
+	for _, want := range []string{platformScheme, TestPatternScheme, FileScheme, stubScheme} {
+		i := sort.SearchStrings(schemes, want)
+		if i == len(schemes) || schemes[i] != want {
+			t.Errorf("%q missing from %v", want, schemes)
+		}
+	}
+}
+
+func TestRegisterPanics(t *testing.T) {
+	useStub(t)
+	factory := func(string, ...StreamOption) (Source, error) { return nil, nil }
+	for _, tc := range []struct {
+		name    string
+		scheme  string
+		factory SourceFactory
+	}{
+		{"duplicate", stubScheme, factory},
+		{"built-in duplicate", TestPatternScheme, factory},
+		{"empty scheme", "", factory},
+		{"nil factory", "gocamnil", nil},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: no panic", tc.name)
+				}
+			}()
+			Register(tc.scheme, tc.factory)
+		}()
+	}
+}
+
+func TestNewSource(t *testing.T) {
+	last := useStub(t)
+
+	// Empty URIs and plain paths fall back to the platform camera.
+	for _, uri := range []string{"", "/dev/video2", platformScheme + "://"} {
+		src, err := NewSource(uri)
+		if err != nil {
+			t.Errorf("%q: %v", uri, err)
+			continue
+		}
+		if info := src.Info(); info.Backend != platformScheme {
+			t.Errorf("%q: backend %q", uri, info.Backend)
+		}
+	}
+
+	src, err := NewSource("gocamstub://cam?x=1", WithIOMethod(IORead), WithTransform(Rotate90))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stub := last(); src != stub || stub.uri != "gocamstub://cam?x=1" || stub.opts != 2 {
+		t.Errorf("factory got %+v", stub)
+	}
+	if _, ok := src.(*TestPatternSource); ok {
+		t.Error("stub scheme dispatched to the test pattern")
+	}
+	if _, err := NewSource("test://counter"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := NewSource("nosuchscheme://x"); err == nil {
+		t.Error("unknown scheme accepted")
+	}
+
+	stubMu.Lock()
+	stubErr = errors.New("stub: no such camera")
+	stubMu.Unlock()
+	if _, err := NewSource("gocamstub://missing"); err != stubErr {
+		t.Errorf("factory error %v", err)
+	}
+}
+
+func TestOpenStreamRegisteredSource(t *testing.T) {
+	last := useStub(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s, err := OpenStream(ctx, WithDevice("gocamstub://cam"), WithTransform(Rotate90))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := last()
+
+	// Sources that do not transform frames themselves are wrapped.
+	select {
+	case f := <-s.Frames():
+		want := (&TestPatternSource{Pattern: PatternGradient, Width: 4, Height: 2}).Render(0).Transform(Rotate90)
+		if f.Width != 2 || f.Height != 4 || !bytes.Equal(f.Data, want.Data) {
+			t.Errorf("frame %dx%d is not the rotated stub frame", f.Width, f.Height)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no frame")
+	}
+	if ev := <-s.Events(); ev.Type != EventEOS {
+		t.Errorf("event %v", ev.Type)
+	}
+	if info := s.Info(); info.Backend != stubScheme || info.Width != 2 || info.Height != 4 {
+		t.Errorf("info %+v", info)
+	}
+	if st := s.Stats(); st.Frames != 7 {
+		t.Errorf("stats %+v", st)
+	}
+	if c := s.Controls(); len(c) != 1 || c[0].Name != "Gain" {
+		t.Errorf("controls %v", c)
+	}
+
+	s.Close()
+	if !stub.isClosed() {
+		t.Error("Close did not reach the source")
+	}
+
+	stubMu.Lock()
+	stubErr = errors.New("stub: busy")
+	stubMu.Unlock()
+	if _, err := OpenStream(ctx, WithDevice("gocamstub://cam")); err == nil {
+		t.Error("factory error ignored")
+	}
+}
+
+func TestOpenStreamOpenError(t *testing.T) {
+	last := useStub(t)
+	if _, err := OpenStream(context.Background(), WithDevice("gocamstub://busy")); err != errStubBusy {
+		t.Errorf("open error %v", err)
+	}
+	if stub := last(); stub.opened {
+		t.Error("source reported open")
+	}
+}
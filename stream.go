@@ -0,0 +1,257 @@
+package gocam
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// eventQueueSize bounds the number of undelivered events per stream.
+const eventQueueSize = 16
+
+// EventType identifies the kind of an Event.
+type EventType int
+
+const (
+	// EventSourceChange reports that the source changed its format mid-stream.
+	// By the time it is delivered the stream has been renegotiated, and Width
+	// and Height carry the new output size.
+	EventSourceChange EventType = iota + 1
+	// EventEOS reports that the source signalled the end of the stream.
+	EventEOS
+	// EventControl reports that a device control changed its value.
+	EventControl
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventSourceChange:
+		return "source-change"
+	case EventEOS:
+		return "eos"
+	case EventControl:
+		return "control"
+	}
+	return "unknown"
+}
+
+// Event is an asynchronous notification from the capture device.
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	// Width and Height are set for EventSourceChange.
+	Width  int
+	Height int
+
+	// ControlID, Control and Value are set for EventControl.
+	ControlID uint32
+	Control   string
+	Value     int64
+}
+
+// Stats is a snapshot of stream counters, useful for tuning the buffer count
+// between latency and robustness.
+type Stats struct {
+	BuffersRequested int    // capture buffers asked from the driver
+	BuffersGranted   int    // capture buffers the driver actually allocated
+	Frames           uint64 // frames handed to the Frames channel
+	Dropped          uint64 // frames replaced before the consumer read them
+	Underruns        uint64 // times the driver was left without a queued buffer
+	Lost             uint64 // frames skipped by the driver, from sequence gaps
+}
+
+// streamStats holds the live counters behind Stats.
+type streamStats struct {
+	buffersRequested atomic.Int64
+	buffersGranted   atomic.Int64
+	frames           atomic.Uint64
+	dropped          atomic.Uint64
+	underruns        atomic.Uint64
+	lost             atomic.Uint64
+}
+
+// Stream is a running capture session opened with OpenStream.
+type Stream struct {
+	frames <-chan Frame
+	events <-chan Event
+	stats  *streamStats
+	cancel context.CancelFunc
+
+	// info and controls are filled in by backends that know them.
+	info     SourceInfo
+	controls []Control
+	// source is the Source behind the stream.
+	source Source
+	// transformed is set by backends that apply WithTransform themselves;
+	// for other sources OpenStream transforms the frames it forwards, and
+	// transform records that.
+	transformed bool
+	transform   Transform
+}
+
+// OpenStream starts camera capture like StartStream and returns a handle that
+// also exposes device events. The device is chosen with WithDevice: any
+// registered scheme works, and the platform camera is the default. The
+// stream stops when ctx is canceled or Close is called.
+func OpenStream(ctx context.Context, opts ...StreamOption) (*Stream, error) {
+	cfg := newStreamConfig(opts)
+
+	src, err := NewSource(cfg.device, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := src.Open(ctx); err != nil {
+		return nil, err
+	}
+	s := streamOf(src)
+	if cfg.transform != TransformNone && !s.transformed {
+		s.transform = cfg.transform
+		s.frames = transformFrames(s.frames, cfg.transform)
+	}
+	return s, nil
+}
+
+// transformFrames applies t to the frames of a source that does not
+// handle WithTransform itself, keeping only the latest frame.
+func transformFrames(in <-chan Frame, t Transform) <-chan Frame {
+	out := make(chan Frame, 1)
+	go func() {
+		defer close(out)
+		for frame := range in {
+			frame = frame.Transform(t)
+			select {
+			case out <- frame:
+			default:
+				select {
+				case old := <-out:
+					old.Release()
+				default:
+				}
+				out <- frame
+			}
+		}
+	}()
+	return out
+}
+
+// streamOf returns the Stream handle of an opened source. Built-in sources
+// already run on a Stream; other sources are wrapped.
+func streamOf(src Source) *Stream {
+	if internal, ok := src.(interface{ current() *Stream }); ok {
+		if s := internal.current(); s != nil {
+			s.source = src
+			return s
+		}
+	}
+
+	s := &Stream{
+		frames: src.Frames(),
+		source: src,
+		cancel: func() { _ = src.Close() },
+	}
+	if es, ok := src.(EventSource); ok {
+		s.events = es.Events()
+	}
+	return s
+}
+
+// uriScheme returns the scheme of a device URI, or "" for plain paths.
+func uriScheme(device string) string {
+	scheme, _, ok := strings.Cut(device, "://")
+	if !ok {
+		scheme, _, ok = strings.Cut(device, ":")
+		if !ok || scheme != FileScheme {
+			return ""
+		}
+	}
+	return scheme
+}
+
+// Frames returns the frame channel. Only the latest frame is buffered; if the
+// consumer is too slow, older frames are dropped. The channel is closed when
+// the stream ends.
+func (s *Stream) Frames() <-chan Frame {
+	return s.frames
+}
+
+// Events returns the device event channel. Events that do not fit into the
+// queue are dropped so a slow reader never stalls capture. The channel is
+// closed when the stream ends; built-in backends without event support close
+// it without sending anything, and registered sources that do not implement
+// EventSource return nil.
+func (s *Stream) Events() <-chan Event {
+	return s.events
+}
+
+// Stats returns a snapshot of the stream counters. Buffer counts and
+// underruns are only tracked by backends that manage driver buffers (V4L2).
+func (s *Stream) Stats() Stats {
+	if s.stats == nil {
+		if ss, ok := s.source.(StatsSource); ok {
+			return ss.Stats()
+		}
+		return Stats{}
+	}
+	return Stats{
+		BuffersRequested: int(s.stats.buffersRequested.Load()),
+		BuffersGranted:   int(s.stats.buffersGranted.Load()),
+		Frames:           s.stats.frames.Load(),
+		Dropped:          s.stats.dropped.Load(),
+		Underruns:        s.stats.underruns.Load(),
+		Lost:             s.stats.lost.Load(),
+	}
+}
+
+// Info describes the source of the stream.
+func (s *Stream) Info() SourceInfo {
+	info := s.info
+	if s.source != nil {
+		info = s.source.Info()
+	}
+	if s.transform.SwapsAxes() {
+		info.Width, info.Height = info.Height, info.Width
+	}
+	return info
+}
+
+// Controls lists the adjustable settings of the device, if any.
+func (s *Stream) Controls() []Control {
+	if s.source != nil {
+		return s.source.Controls()
+	}
+	return s.controls
+}
+
+// Close stops the stream. Frames and Events are closed once the capture loop
+// has shut down.
+func (s *Stream) Close() error {
+	s.cancel()
+	return nil
+}
+
+// StartStream starts camera capture and returns a channel of frames encoded
+// as tightly packed YCbCr 4:4:4 buffers (3 bytes per pixel: Y, Cb, Cr).
+// The context controls the lifetime; cancel it to stop streaming.
+//
+// Only the latest frame is kept in the buffer. If the consumer is too slow,
+// old frames are dropped in favor of the most recent one.
+func StartStream(ctx context.Context, opts ...StreamOption) (<-chan Frame, error) {
+	s, err := OpenStream(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return s.Frames(), nil
+}
+
+// sendEvent queues ev without blocking; it is dropped if the queue is full.
+func sendEvent(events chan<- Event, ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	select {
+	case events <- ev:
+	default:
+	}
+}
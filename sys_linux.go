@@ -0,0 +1,100 @@
+//go:build linux
+// +build linux
+
+package gocam
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// v4l2Syscalls is the kernel interface of the V4L2 backend. Everything the
+// backend does to a device node goes through v4l2Sys, so tests can replace
+// it with a scripted fake device. mmap maps anonymous memory when fd is -1,
+// as USERPTR buffers are.
+type v4l2Syscalls interface {
+	open(path string) (int, error)
+	close(fd int) error
+	ioctl(fd int, req uintptr, arg unsafe.Pointer) error
+	mmap(fd int, offset int64, length int, prot int) ([]byte, error)
+	munmap(data []byte) error
+	poll(fd int, events int16, timeout time.Duration) (int16, error)
+	read(fd int, p []byte) (int, error)
+	write(fd int, p []byte) (int, error)
+	dup(fd int) (int, error)
+	seek(fd int, offset int64, whence int) (int64, error)
+}
+
+var v4l2Sys v4l2Syscalls = kernelSyscalls{}
+
+// kernelSyscalls talks to real devices.
+type kernelSyscalls struct{}
+
+func (kernelSyscalls) open(path string) (int, error) {
+	return syscall.Open(path, syscall.O_RDWR|syscall.O_NONBLOCK, 0)
+}
+
+func (kernelSyscalls) close(fd int) error {
+	return syscall.Close(fd)
+}
+
+func (kernelSyscalls) ioctl(fd int, req uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (kernelSyscalls) mmap(fd int, offset int64, length int, prot int) ([]byte, error) {
+	if fd < 0 {
+		return syscall.Mmap(-1, 0, length, prot, syscall.MAP_ANONYMOUS|syscall.MAP_PRIVATE)
+	}
+	return syscall.Mmap(fd, offset, length, prot, syscall.MAP_SHARED)
+}
+
+func (kernelSyscalls) munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
+
+// pollFd mirrors struct pollfd.
+type pollFd struct {
+	Fd      int32
+	Events  int16
+	Revents int16
+}
+
+func (kernelSyscalls) poll(fd int, events int16, timeout time.Duration) (int16, error) {
+	fds := [1]pollFd{{Fd: int32(fd), Events: events}}
+	ts := syscall.NsecToTimespec(int64(timeout))
+	n, _, errno := syscall.Syscall6(syscall.SYS_PPOLL, uintptr(unsafe.Pointer(&fds[0])), 1, uintptr(unsafe.Pointer(&ts)), 0, 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return fds[0].Revents, nil
+}
+
+func (kernelSyscalls) read(fd int, p []byte) (int, error) {
+	return syscall.Read(fd, p)
+}
+
+func (kernelSyscalls) write(fd int, p []byte) (int, error) {
+	return syscall.Write(fd, p)
+}
+
+// dup duplicates fd with close-on-exec set, as DMABUFs handed to frames are.
+func (kernelSyscalls) dup(fd int) (int, error) {
+	r, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_DUPFD_CLOEXEC, 0)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(r), nil
+}
+
+func (kernelSyscalls) seek(fd int, offset int64, whence int) (int64, error) {
+	return syscall.Seek(fd, offset, whence)
+}
@@ -0,0 +1,372 @@
+package gocam
+
+import (
+	"context"
+	"fmt"
+	"image/color"
+	"math/rand"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TestPattern selects the image generated by a TestPatternSource.
+type TestPattern int
+
+const (
+	// PatternBars draws 75% color bars (white, yellow, cyan, green, magenta,
+	// red, blue, black).
+	PatternBars TestPattern = iota
+	// PatternGradient draws a luma ramp with chroma gradients that scrolls
+	// by a few pixels every frame, which makes motion and drops visible.
+	PatternGradient
+	// PatternCounter prints the frame sequence number in large digits.
+	PatternCounter
+	// PatternNoise fills every sample with pseudo-random values.
+	PatternNoise
+	// PatternSolid fills the frame with TestPatternSource.Color.
+	PatternSolid
+)
+
+func (p TestPattern) String() string {
+	switch p {
+	case PatternBars:
+		return "bars"
+	case PatternGradient:
+		return "gradient"
+	case PatternCounter:
+		return "counter"
+	case PatternNoise:
+		return "noise"
+	case PatternSolid:
+		return "solid"
+	}
+	return "unknown"
+}
+
+// TestPatternScheme is the device URI scheme of the built-in test pattern
+// source, e.g. "test://bars?w=640&h=480&fps=30".
+const TestPatternScheme = "test"
+
+const (
+	defaultPatternWidth  = 640
+	defaultPatternHeight = 480
+	defaultPatternFPS    = 30
+	// maxPatternFPS bounds the frame rate so the frame interval stays
+	// positive.
+	maxPatternFPS = 1000
+	// maxPatternSize bounds the width and height, so a URI cannot ask for
+	// frames that exhaust memory.
+	maxPatternSize = 8192
+)
+
+// TestPatternSource generates synthetic frames without any camera, so code
+// built on streams can be exercised on machines without video devices. Its
+// frames use the same packed YCbCr444 layout and latest-only channel
+// semantics as the platform backends.
+type TestPatternSource struct {
+	sourceState
+
+	Pattern TestPattern
+	Width   int     // defaults to 640, at most 8192
+	Height  int     // defaults to 480, at most 8192
+	FPS     float64 // defaults to 30, at most 1000
+
+	// Color is the fill color of PatternSolid, full range (JFIF) like every
+	// gocam frame. Note that the zero value is not black; use
+	// color.YCbCr{Cb: 128, Cr: 128}.
+	Color color.YCbCr
+	// Seed makes PatternNoise reproducible.
+	Seed int64
+}
+
+func init() {
+	Register(TestPatternScheme, func(uri string, opts ...StreamOption) (Source, error) {
+		return ParseTestPatternURI(uri)
+	})
+}
+
+// ParseTestPatternURI builds a TestPatternSource from a device URI such as
+// "test://bars?w=640&h=480&fps=30". The host names the pattern; the query
+// accepts w, h (up to 8192), fps (up to 1000), seed and, for "solid", color as an RGB
+// hex triplet ("color=ff8000"). Solid frames default to black.
+func ParseTestPatternURI(uri string) (*TestPatternSource, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("gocam: invalid device URI %q: %w", uri, err)
+	}
+	if u.Scheme != TestPatternScheme {
+		return nil, fmt.Errorf("gocam: not a test pattern URI: %q", uri)
+	}
+
+	src := &TestPatternSource{}
+	switch u.Host {
+	case "", "bars":
+		src.Pattern = PatternBars
+	case "gradient":
+		src.Pattern = PatternGradient
+	case "counter":
+		src.Pattern = PatternCounter
+	case "noise":
+		src.Pattern = PatternNoise
+	case "solid":
+		src.Pattern = PatternSolid
+	default:
+		return nil, fmt.Errorf("gocam: unknown test pattern %q", u.Host)
+	}
+
+	q := u.Query()
+	intParam := func(name string, dst *int) error {
+		v := q.Get(name)
+		if v == "" {
+			return nil
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxPatternSize {
+			return fmt.Errorf("gocam: invalid %s %q in %q", name, v, uri)
+		}
+		*dst = n
+		return nil
+	}
+	if err := intParam("w", &src.Width); err != nil {
+		return nil, err
+	}
+	if err := intParam("h", &src.Height); err != nil {
+		return nil, err
+	}
+	if v := q.Get("fps"); v != "" {
+		fps, err := strconv.ParseFloat(v, 64)
+		if err != nil || fps <= 0 || fps > maxPatternFPS {
+			return nil, fmt.Errorf("gocam: invalid fps %q in %q", v, uri)
+		}
+		src.FPS = fps
+	}
+	if v := q.Get("seed"); v != "" {
+		seed, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("gocam: invalid seed %q in %q", v, uri)
+		}
+		src.Seed = seed
+	}
+
+	src.Color = color.YCbCr{Y: 0, Cb: 128, Cr: 128} // JFIF black
+	if v := q.Get("color"); v != "" {
+		rgb, err := strconv.ParseUint(strings.TrimPrefix(v, "#"), 16, 32)
+		if err != nil || len(strings.TrimPrefix(v, "#")) != 6 {
+			return nil, fmt.Errorf("gocam: invalid color %q in %q", v, uri)
+		}
+		y, cb, cr := color.RGBToYCbCr(uint8(rgb>>16), uint8(rgb>>8), uint8(rgb))
+		src.Color = color.YCbCr{Y: y, Cb: cb, Cr: cr}
+	}
+	return src, nil
+}
+
+// size returns the frame size and rate with defaults applied.
+func (s *TestPatternSource) size() (w, h int, fps float64) {
+	w, h, fps = s.Width, s.Height, s.FPS
+	if w <= 0 {
+		w = defaultPatternWidth
+	}
+	if h <= 0 {
+		h = defaultPatternHeight
+	}
+	w, h = min(w, maxPatternSize), min(h, maxPatternSize)
+	if fps <= 0 {
+		fps = defaultPatternFPS
+	}
+	if fps > maxPatternFPS {
+		fps = maxPatternFPS
+	}
+	return w, h, fps
+}
+
+// Render returns frame number seq of the pattern. It is deterministic for a
+// given source and seq, which makes it usable in tests without streaming.
+func (s *TestPatternSource) Render(seq uint64) Frame {
+	w, h, _ := s.size()
+	data := make([]byte, w*h*3)
+
+	switch s.Pattern {
+	case PatternBars:
+		renderBars(data, w, h)
+	case PatternGradient:
+		renderGradient(data, w, h, int(seq%uint64(w))*4)
+	case PatternCounter:
+		renderCounter(data, w, h, seq)
+	case PatternNoise:
+		rng := rand.New(rand.NewSource(s.Seed + int64(seq)))
+		rng.Read(data)
+	default:
+		fillYCbCr444(data, s.Color.Y, s.Color.Cb, s.Color.Cr)
+	}
+
+	return Frame{Data: data, Width: w, Height: h, Sequence: seq}
+}
+
+// Open starts generating frames at the configured rate. The source stops
+// when ctx is canceled or Close is called.
+func (s *TestPatternSource) Open(ctx context.Context) error {
+	return s.attach(ctx, func(ctx context.Context) (*Stream, error) {
+		return s.start(ctx), nil
+	})
+}
+
+// Info describes the generated frames.
+func (s *TestPatternSource) Info() SourceInfo {
+	w, h, fps := s.size()
+	return SourceInfo{
+		Backend: TestPatternScheme,
+		Device:  TestPatternScheme + "://" + s.Pattern.String(),
+		Name:    "test pattern (" + s.Pattern.String() + ")",
+		Width:   w,
+		Height:  h,
+		FPS:     fps,
+	}
+}
+
+// Controls returns nil; test patterns have no controls.
+func (s *TestPatternSource) Controls() []Control {
+	return nil
+}
+
+// start runs the generator until ctx is done.
+func (s *TestPatternSource) start(ctx context.Context) *Stream {
+	_, _, fps := s.size()
+	frames := make(chan Frame, 1)
+	events := make(chan Event, eventQueueSize)
+	stats := &streamStats{}
+
+	go func() {
+		defer close(frames)
+		defer close(events)
+
+		sendFrame := func(frame Frame) {
+			stats.frames.Add(1)
+			select {
+			case frames <- frame:
+			default:
+				select {
+				case old := <-frames:
+					old.Release()
+					stats.dropped.Add(1)
+				default:
+				}
+				frames <- frame
+			}
+		}
+
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / fps))
+		defer ticker.Stop()
+
+		var seq uint64
+		for {
+			frame := s.Render(seq)
+			frame.Timestamp = time.Now()
+			sendFrame(frame)
+			seq++
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return &Stream{frames: frames, events: events, stats: stats}
+}
+
+func fillYCbCr444(data []byte, y, cb, cr uint8) {
+	for i := 0; i+2 < len(data); i += 3 {
+		data[i] = y
+		data[i+1] = cb
+		data[i+2] = cr
+	}
+}
+
+// colorBars are the 75% bars, converted with the full-range BT.601
+// (JFIF) matrix used throughout gocam.
+var colorBars = func() [8][3]byte {
+	const hi = 191
+	rgb := [8][3]uint8{
+		{hi, hi, hi}, {hi, hi, 0}, {0, hi, hi}, {0, hi, 0},
+		{hi, 0, hi}, {hi, 0, 0}, {0, 0, hi}, {0, 0, 0},
+	}
+	var bars [8][3]byte
+	for i, c := range rgb {
+		y, cb, cr := color.RGBToYCbCr(c[0], c[1], c[2])
+		bars[i] = [3]byte{y, cb, cr}
+	}
+	return bars
+}()
+
+func renderBars(data []byte, w, h int) {
+	row := data[:w*3]
+	for x := 0; x < w; x++ {
+		c := colorBars[x*len(colorBars)/w]
+		copy(row[x*3:], c[:])
+	}
+	for y := 1; y < h; y++ {
+		copy(data[y*w*3:(y+1)*w*3], row)
+	}
+}
+
+// renderGradient draws a horizontal luma ramp shifted by offset pixels, with
+// Cb rising to the right and Cr rising downward.
+func renderGradient(data []byte, w, h, offset int) {
+	for y := 0; y < h; y++ {
+		cr := byte(y * 255 / max(h-1, 1))
+		for x := 0; x < w; x++ {
+			i := (y*w + x) * 3
+			data[i] = byte(((x + offset) % w) * 255 / max(w-1, 1))
+			data[i+1] = byte(x * 255 / max(w-1, 1))
+			data[i+2] = cr
+		}
+	}
+}
+
+// counterGlyphs is a 3x5 bitmap font for the digits 0-9; bit 2 is the left
+// column of a row.
+var counterGlyphs = [10][5]byte{
+	{7, 5, 5, 5, 7}, {2, 6, 2, 2, 7}, {7, 1, 7, 4, 7}, {7, 1, 7, 1, 7}, {5, 5, 7, 1, 1},
+	{7, 4, 7, 1, 7}, {7, 4, 7, 5, 7}, {7, 1, 1, 1, 1}, {7, 5, 7, 5, 7}, {7, 5, 7, 1, 7},
+}
+
+// Counter colors, full range (JFIF) like the bars.
+const (
+	counterBackground = 40  // dark gray
+	counterDigit      = 255 // white
+)
+
+// renderCounter prints seq in white digits centered on a dark gray frame.
+func renderCounter(data []byte, w, h int, seq uint64) {
+	fillYCbCr444(data, counterBackground, 128, 128)
+
+	digits := strconv.FormatUint(seq, 10)
+	// Each glyph is 3 cells wide plus one cell of spacing.
+	cols := len(digits)*4 - 1
+	cell := min(w*8/10/cols, h/2/5)
+	if cell < 1 {
+		return
+	}
+	x0 := (w - cols*cell) / 2
+	y0 := (h - 5*cell) / 2
+
+	for n, d := range digits {
+		glyph := counterGlyphs[d-'0']
+		for gy := 0; gy < 5; gy++ {
+			for gx := 0; gx < 3; gx++ {
+				if glyph[gy]&(4>>gx) == 0 {
+					continue
+				}
+				px := x0 + (n*4+gx)*cell
+				py := y0 + gy*cell
+				for y := py; y < py+cell; y++ {
+					row := data[(y*w+px)*3 : (y*w+px+cell)*3]
+					fillYCbCr444(row, counterDigit, 128, 128)
+				}
+			}
+		}
+	}
+}
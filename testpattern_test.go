@@ -0,0 +1,265 @@
+package gocam
+
+import (
+	"bytes"
+	"context"
+	"image/color"
+	"testing"
+	"time"
+)
+
+func TestParseTestPatternURI(t *testing.T) {
+	black := color.YCbCr{Y: 0, Cb: 128, Cr: 128}
+	orangeY, orangeCb, orangeCr := color.RGBToYCbCr(0xff, 0x80, 0x00)
+	orange := color.YCbCr{Y: orangeY, Cb: orangeCb, Cr: orangeCr}
+
+	tests := []struct {
+		uri     string
+		pattern TestPattern
+		w, h    int
+		fps     float64
+		seed    int64
+		color   color.YCbCr
+	}{
+		{"test://", PatternBars, 0, 0, 0, 0, black},
+		{"test://bars?w=320&h=240&fps=15", PatternBars, 320, 240, 15, 0, black},
+		{"test://gradient?fps=29.97", PatternGradient, 0, 0, 29.97, 0, black},
+		{"test://counter?w=64", PatternCounter, 64, 0, 0, 0, black},
+		{"test://noise?seed=-7", PatternNoise, 0, 0, 0, -7, black},
+		{"test://solid", PatternSolid, 0, 0, 0, 0, black},
+		{"test://solid?color=ff8000", PatternSolid, 0, 0, 0, 0, orange},
+		{"test://solid?color=%23FF8000", PatternSolid, 0, 0, 0, 0, orange},
+		{"test://bars?fps=1000", PatternBars, 0, 0, 1000, 0, black},
+	}
+	for _, tc := range tests {
+		src, err := ParseTestPatternURI(tc.uri)
+		if err != nil {
+			t.Errorf("%s: %v", tc.uri, err)
+			continue
+		}
+		if src.Pattern != tc.pattern || src.Width != tc.w || src.Height != tc.h ||
+			src.FPS != tc.fps || src.Seed != tc.seed || src.Color != tc.color {
+			t.Errorf("%s: %v %dx%d@%v seed %d color %v", tc.uri, src.Pattern,
+				src.Width, src.Height, src.FPS, src.Seed, src.Color)
+		}
+	}
+
+	for _, uri := range []string{
+		"file:///tmp/a.y4m",
+		"test://stripes",
+		"test://bars?w=0",
+		"test://bars?h=-4",
+		"test://bars?w=wide",
+		"test://bars?w=100000&h=100000",
+		"test://bars?h=8193",
+		"test://bars?fps=0",
+		"test://bars?fps=-1",
+		"test://bars?fps=1e12",
+		"test://bars?fps=fast",
+		"test://noise?seed=1.5",
+		"test://solid?color=fff",
+		"test://solid?color=zzzzzz",
+		"test://solid?color=ff80001",
+	} {
+		if _, err := ParseTestPatternURI(uri); err == nil {
+			t.Errorf("%s: accepted", uri)
+		}
+	}
+}
+
+// pixelAt returns the YCbCr sample at x, y of a packed YCbCr444 frame.
+func pixelAt(f Frame, x, y int) [3]byte {
+	i := (y*f.Width + x) * 3
+	return [3]byte{f.Data[i], f.Data[i+1], f.Data[i+2]}
+}
+
+func TestTestPatternDefaults(t *testing.T) {
+	src := &TestPatternSource{FPS: 1e12}
+	info := src.Info()
+	if info.Width != 640 || info.Height != 480 || info.FPS != maxPatternFPS {
+		t.Errorf("Info %dx%d@%v", info.Width, info.Height, info.FPS)
+	}
+	if f := src.Render(0); f.Width != 640 || f.Height != 480 || len(f.Data) != 640*480*3 {
+		t.Errorf("frame %dx%d with %d bytes", f.Width, f.Height, len(f.Data))
+	}
+
+	src = &TestPatternSource{Width: 1 << 20, Height: 2}
+	if info := src.Info(); info.Width != maxPatternSize || info.Height != 2 {
+		t.Errorf("oversized Info %dx%d", info.Width, info.Height)
+	}
+}
+
+func TestRenderBars(t *testing.T) {
+	f := (&TestPatternSource{Pattern: PatternBars, Width: 16, Height: 2}).Render(0)
+	white := [3]byte{191, 128, 128}
+	redY, redCb, redCr := color.RGBToYCbCr(191, 0, 0)
+	for _, tc := range []struct {
+		x    int
+		want [3]byte
+	}{
+		{0, white},
+		{1, white},
+		{10, [3]byte{redY, redCb, redCr}},
+		{15, [3]byte{0, 128, 128}},
+	} {
+		for y := 0; y < 2; y++ {
+			if got := pixelAt(f, tc.x, y); got != tc.want {
+				t.Errorf("pixel %d,%d = %v, want %v", tc.x, y, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestRenderGradient(t *testing.T) {
+	src := &TestPatternSource{Pattern: PatternGradient, Width: 5, Height: 3}
+	f := src.Render(0)
+	for _, tc := range []struct {
+		x, y int
+		want [3]byte
+	}{
+		{0, 0, [3]byte{0, 0, 0}},
+		{4, 0, [3]byte{255, 255, 0}},
+		{2, 1, [3]byte{127, 127, 127}},
+		{4, 2, [3]byte{255, 255, 255}},
+	} {
+		if got := pixelAt(f, tc.x, tc.y); got != tc.want {
+			t.Errorf("frame 0 pixel %d,%d = %v, want %v", tc.x, tc.y, got, tc.want)
+		}
+	}
+
+	// The luma ramp scrolls by four pixels per frame; chroma stays put.
+	f = src.Render(1)
+	if got := pixelAt(f, 0, 0); got != [3]byte{255, 0, 0} {
+		t.Errorf("frame 1 pixel 0,0 = %v", got)
+	}
+	if got := pixelAt(f, 1, 0); got != [3]byte{0, 63, 0} {
+		t.Errorf("frame 1 pixel 1,0 = %v", got)
+	}
+}
+
+func TestRenderCounter(t *testing.T) {
+	// On 32x20 a digit is drawn with 2x2 cells starting at 13,5.
+	f := (&TestPatternSource{Pattern: PatternCounter, Width: 32, Height: 20}).Render(8)
+	digit := [3]byte{255, 128, 128}
+	background := [3]byte{40, 128, 128}
+	for _, tc := range []struct {
+		x, y int
+		want [3]byte
+	}{
+		{0, 0, background},
+		{13, 5, digit},
+		{18, 14, digit},
+		{15, 7, background}, // the holes of the 8
+		{15, 11, background},
+		{12, 5, background},
+		{19, 5, background},
+	} {
+		if got := pixelAt(f, tc.x, tc.y); got != tc.want {
+			t.Errorf("pixel %d,%d = %v, want %v", tc.x, tc.y, got, tc.want)
+		}
+	}
+
+	// Frames too small for the digits stay blank.
+	f = (&TestPatternSource{Pattern: PatternCounter, Width: 4, Height: 4}).Render(123)
+	if !bytes.Equal(f.Data, (&TestPatternSource{Width: 4, Height: 4, Color: color.YCbCr{Y: 40, Cb: 128, Cr: 128}, Pattern: PatternSolid}).Render(0).Data) {
+		t.Error("digits drawn on a 4x4 frame")
+	}
+}
+
+func TestRenderNoise(t *testing.T) {
+	src := &TestPatternSource{Pattern: PatternNoise, Width: 8, Height: 8, Seed: 42}
+	a, b := src.Render(3), src.Render(3)
+	if !bytes.Equal(a.Data, b.Data) {
+		t.Error("same seed and frame rendered differently")
+	}
+	if bytes.Equal(a.Data, src.Render(4).Data) {
+		t.Error("consecutive frames are identical")
+	}
+	other := &TestPatternSource{Pattern: PatternNoise, Width: 8, Height: 8, Seed: 43}
+	if bytes.Equal(a.Data, other.Render(3).Data) {
+		t.Error("seed has no effect")
+	}
+}
+
+func TestRenderSolid(t *testing.T) {
+	src, err := ParseTestPatternURI("test://solid?w=3&h=2&color=0000ff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	y, cb, cr := color.RGBToYCbCr(0, 0, 0xff)
+	f := src.Render(0)
+	for i := 0; i < len(f.Data); i += 3 {
+		if f.Data[i] != y || f.Data[i+1] != cb || f.Data[i+2] != cr {
+			t.Fatalf("sample %d = %v", i/3, f.Data[i:i+3])
+		}
+	}
+}
+
+func TestOpenStreamTestPattern(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := OpenStream(ctx, WithDevice("test://bars?fps=1e12")); err == nil {
+		t.Fatal("opened a pattern at 1e12 fps")
+	}
+
+	// A source configured directly is clamped instead.
+	src := &TestPatternSource{Pattern: PatternCounter, Width: 32, Height: 20, FPS: 1e12}
+	if err := src.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	for i := 0; i < 3; i++ {
+		select {
+		case f := <-src.Frames():
+			if f.Width != 32 || f.Height != 20 {
+				t.Fatalf("frame %dx%d", f.Width, f.Height)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("no frame")
+		}
+	}
+}
+
+func TestTestPatternReopen(t *testing.T) {
+	src := &TestPatternSource{Width: 4, Height: 2, FPS: 1000}
+	first := func() {
+		t.Helper()
+		select {
+		case f, ok := <-src.Frames():
+			if !ok || f.Width != 4 {
+				t.Fatalf("frame %dx%d, ok %v", f.Width, f.Height, ok)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("no frame")
+		}
+	}
+
+	if err := src.Open(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Open(context.Background()); err == nil {
+		t.Fatal("opened twice")
+	}
+	first()
+	src.Close()
+	if src.Frames() != nil {
+		t.Error("frame channel kept after Close")
+	}
+
+	// Reopening after Close and after the context ends starts a new stream.
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := src.Open(ctx); err != nil {
+		t.Fatalf("reopen after Close: %v", err)
+	}
+	first()
+	cancel()
+	deadline := time.Now().Add(2 * time.Second)
+	for src.Open(context.Background()) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("source still open after its context ended")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	first()
+	src.Close()
+}
@@ -0,0 +1,148 @@
+package gocam
+
+import (
+	"errors"
+	"time"
+)
+
+// DefaultTimeLapseFPS is the playback rate of a time-lapse when
+// TimeLapseOptions.FPS is zero.
+const DefaultTimeLapseFPS = 25
+
+// TimeLapseOptions configures a TimeLapse.
+type TimeLapseOptions struct {
+	// Interval is the capture time condensed into each output frame.
+	Interval time.Duration
+	// Average outputs the mean of all frames of an interval instead of
+	// its first frame, which smooths noise and blurs passing motion.
+	Average bool
+	// FPS is the playback rate: output frames are stamped 1/FPS apart,
+	// which is how GIFWriter and AVIWriter time them. Zero means
+	// DefaultTimeLapseFPS.
+	FPS float64
+}
+
+// TimeLapse is a FrameWriter that condenses a stream into one frame per
+// interval and passes those to another FrameWriter, such as a GIFWriter,
+// AVIWriter or ImageSequenceWriter. Intervals are measured on the frame
+// timestamps (the arrival time for frames without one) from the first
+// frame. Output frames are numbered from zero and restamped at the
+// playback rate from the first frame's time.
+type TimeLapse struct {
+	fw   FrameWriter
+	opts TimeLapseOptions
+
+	start    time.Time
+	interval int64 // index of the interval being collected, -1 before any
+	out      uint64
+
+	// Average mode: the sums of the interval's frames.
+	sum           []uint32
+	count         int
+	width, height int
+}
+
+// NewTimeLapse returns a time-lapse writing to fw. Close closes fw.
+func NewTimeLapse(fw FrameWriter, opts *TimeLapseOptions) (*TimeLapse, error) {
+	tl := &TimeLapse{fw: fw, interval: -1}
+	if opts != nil {
+		tl.opts = *opts
+	}
+	if tl.opts.Interval <= 0 {
+		return nil, errors.New("gocam: time-lapse interval must be positive")
+	}
+	if tl.opts.FPS <= 0 {
+		tl.opts.FPS = DefaultTimeLapseFPS
+	}
+	return tl, nil
+}
+
+// WriteFrame takes a frame from the stream. It writes to the underlying
+// writer when the frame starts a new interval: the frame itself, or in
+// Average mode the mean of the previous interval.
+func (tl *TimeLapse) WriteFrame(frame Frame) error {
+	if err := checkFrame(frame); err != nil {
+		return err
+	}
+	t := frame.Timestamp
+	if t.IsZero() {
+		t = time.Now()
+	}
+	if tl.start.IsZero() {
+		tl.start = t
+	}
+	interval := int64(t.Sub(tl.start) / tl.opts.Interval)
+
+	if !tl.opts.Average {
+		if interval <= tl.interval {
+			return nil
+		}
+		tl.interval = interval
+		return tl.emit(frame)
+	}
+
+	if interval > tl.interval || frame.Width != tl.width || frame.Height != tl.height {
+		if err := tl.flush(); err != nil {
+			return err
+		}
+		tl.interval = interval
+	}
+	if tl.count == 0 {
+		tl.width, tl.height = frame.Width, frame.Height
+		n := frame.Width * frame.Height * 3
+		if cap(tl.sum) < n {
+			tl.sum = make([]uint32, n)
+		}
+		tl.sum = tl.sum[:n]
+		clear(tl.sum)
+	}
+	for i, v := range frame.Data[:len(tl.sum)] {
+		tl.sum[i] += uint32(v)
+	}
+	tl.count++
+	return nil
+}
+
+// flush writes the mean of the collected frames, if any.
+func (tl *TimeLapse) flush() error {
+	if tl.count == 0 {
+		return nil
+	}
+	data := make([]byte, len(tl.sum))
+	half := uint32(tl.count / 2)
+	for i, s := range tl.sum {
+		data[i] = byte((s + half) / uint32(tl.count))
+	}
+	tl.count = 0
+	return tl.emit(Frame{Data: data, Width: tl.width, Height: tl.height})
+}
+
+// emit restamps a frame onto the playback timeline and writes it.
+func (tl *TimeLapse) emit(frame Frame) error {
+	out := Frame{
+		Data:      frame.Data,
+		Width:     frame.Width,
+		Height:    frame.Height,
+		Field:     frame.Field,
+		JPEG:      frame.JPEG,
+		Sequence:  tl.out,
+		Timestamp: tl.start.Add(time.Duration(float64(tl.out) * float64(time.Second) / tl.opts.FPS)),
+	}
+	tl.out++
+	return tl.fw.WriteFrame(out)
+}
+
+// Frames returns the number of frames written to the underlying writer.
+func (tl *TimeLapse) Frames() int {
+	return int(tl.out)
+}
+
+// Close writes the mean of the last interval in Average mode and closes
+// the underlying writer.
+func (tl *TimeLapse) Close() error {
+	err := tl.flush()
+	if cerr := tl.fw.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
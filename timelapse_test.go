@@ -0,0 +1,112 @@
+package gocam
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// frameSink collects the frames written to it.
+type frameSink struct {
+	frames []Frame
+	closed bool
+}
+
+func (s *frameSink) WriteFrame(frame Frame) error {
+	frame.Data = append([]byte(nil), frame.Data...)
+	s.frames = append(s.frames, frame)
+	return nil
+}
+
+func (s *frameSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+// flatFrame returns a 2x2 frame with every sample set to v, captured at ms
+// milliseconds.
+func flatFrame(v byte, ms int) Frame {
+	data := make([]byte, 2*2*3)
+	for i := range data {
+		data[i] = v
+	}
+	return Frame{Data: data, Width: 2, Height: 2, Sequence: uint64(ms), Timestamp: time.Unix(50, 0).Add(time.Duration(ms) * time.Millisecond)}
+}
+
+func TestTimeLapse(t *testing.T) {
+	input := []Frame{
+		flatFrame(10, 0), flatFrame(20, 400), flatFrame(31, 900), // interval 0
+		flatFrame(40, 1000), flatFrame(50, 1500), // interval 1
+		flatFrame(60, 3200), // interval 3
+	}
+	for _, tc := range []struct {
+		average bool
+		want    []byte
+	}{
+		{false, []byte{10, 40, 60}},
+		{true, []byte{20, 45, 60}},
+	} {
+		var sink frameSink
+		tl, err := NewTimeLapse(&sink, &TimeLapseOptions{Interval: time.Second, Average: tc.average, FPS: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range input {
+			if err := tl.WriteFrame(f); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tl.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !sink.closed || tl.Frames() != len(tc.want) || len(sink.frames) != len(tc.want) {
+			t.Fatalf("average %v: %d frames, closed %v", tc.average, len(sink.frames), sink.closed)
+		}
+		for i, f := range sink.frames {
+			wantTime := time.Unix(50, 0).Add(time.Duration(i) * 100 * time.Millisecond)
+			if f.Data[0] != tc.want[i] || f.Data[11] != tc.want[i] || f.Sequence != uint64(i) || !f.Timestamp.Equal(wantTime) {
+				t.Errorf("average %v: frame %d is %d, seq %d at %v", tc.average, i, f.Data[0], f.Sequence, f.Timestamp)
+			}
+		}
+	}
+
+	if _, err := NewTimeLapse(&frameSink{}, nil); err == nil {
+		t.Error("zero interval accepted")
+	}
+}
+
+func TestTimeLapseImageSequence(t *testing.T) {
+	dir := t.TempDir()
+	sw, err := NewImageSequenceWriter(filepath.Join(dir, "lapse-%03d.png"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl, err := NewTimeLapse(sw, &TimeLapseOptions{Interval: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ms := 0; ms < 500; ms += 40 {
+		if err := tl.WriteFrame(flatFrame(byte(ms/4), ms)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tl.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if sw.Frames() != 5 {
+		t.Errorf("%d images, want 5", sw.Frames())
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := os.Stat(filepath.Join(dir, fmt.Sprintf("lapse-%03d.png", i))); err != nil {
+			t.Error(err)
+		}
+	}
+
+	for _, bad := range []string{"frame.png", "frame-%d-%d.png", "frame-%03d.xyz"} {
+		if _, err := NewImageSequenceWriter(filepath.Join(dir, bad), nil); err == nil {
+			t.Errorf("pattern %q accepted", bad)
+		}
+	}
+}
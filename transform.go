@@ -0,0 +1,145 @@
+package gocam
+
+// Transform rotates or mirrors frames, e.g. for cameras mounted upside down
+// or sideways, or for a mirrored self view.
+type Transform int
+
+const (
+	// TransformNone leaves frames unchanged.
+	TransformNone Transform = iota
+	// Rotate90 rotates clockwise by 90 degrees.
+	Rotate90
+	// Rotate180 rotates by 180 degrees, for cameras mounted upside down.
+	Rotate180
+	// Rotate270 rotates clockwise by 270 degrees (90 counterclockwise).
+	Rotate270
+	// FlipHorizontal mirrors left and right, as in a video call preview.
+	FlipHorizontal
+	// FlipVertical mirrors top and bottom.
+	FlipVertical
+	// Transpose mirrors along the main diagonal, swapping rows and columns.
+	Transpose
+)
+
+func (t Transform) String() string {
+	switch t {
+	case TransformNone:
+		return "none"
+	case Rotate90:
+		return "rotate90"
+	case Rotate180:
+		return "rotate180"
+	case Rotate270:
+		return "rotate270"
+	case FlipHorizontal:
+		return "hflip"
+	case FlipVertical:
+		return "vflip"
+	case Transpose:
+		return "transpose"
+	}
+	return "unknown"
+}
+
+// SwapsAxes reports whether t exchanges the width and height of a frame.
+func (t Transform) SwapsAxes() bool {
+	_, _, transpose := t.parts()
+	return transpose
+}
+
+// parts decomposes t into mirroring of the source followed by an optional
+// transposition. Rotations become a flip plus a transpose, which lets
+// drivers with flip controls take over the flip.
+func (t Transform) parts() (hflip, vflip, transpose bool) {
+	switch t {
+	case Rotate90:
+		return false, true, true
+	case Rotate180:
+		return true, true, false
+	case Rotate270:
+		return true, false, true
+	case FlipHorizontal:
+		return true, false, false
+	case FlipVertical:
+		return false, true, false
+	case Transpose:
+		return false, false, true
+	}
+	return false, false, false
+}
+
+// transformOf is the inverse of parts. Flipping both ways and transposing
+// has no Transform of its own and is never produced by removing parts of
+// one.
+func transformOf(hflip, vflip, transpose bool) Transform {
+	for _, t := range []Transform{TransformNone, Rotate90, Rotate180, Rotate270, FlipHorizontal, FlipVertical, Transpose} {
+		if h, v, tr := t.parts(); h == hflip && v == vflip && tr == transpose {
+			return t
+		}
+	}
+	return TransformNone
+}
+
+// Transform returns the frame with t applied to a copy of its data; width
+// and height are swapped for 90 and 270 degree rotations and Transpose. The
+// frame's metadata, DMABUF descriptors and Release are shared with f, while
+// JPEG is dropped as it no longer matches. Frames whose Data is too short
+// for their size are returned unchanged.
+func (f Frame) Transform(t Transform) Frame {
+	if t == TransformNone || f.Width <= 0 || f.Height <= 0 || len(f.Data) < f.Width*f.Height*3 {
+		return f
+	}
+	f.Data = transformYCbCr444(f.Data, f.Width, f.Height, t)
+	f.JPEG = nil
+	if t.SwapsAxes() {
+		f.Width, f.Height = f.Height, f.Width
+	}
+	return f
+}
+
+// transformYCbCr444 applies t to a packed YCbCr444 buffer of w x h pixels.
+func transformYCbCr444(src []byte, w, h int, t Transform) []byte {
+	hflip, vflip, transpose := t.parts()
+	dst := make([]byte, w*h*3)
+	rowBytes := w * 3
+
+	if !transpose {
+		for y := 0; y < h; y++ {
+			sy := y
+			if vflip {
+				sy = h - 1 - y
+			}
+			in := src[sy*rowBytes : (sy+1)*rowBytes]
+			out := dst[y*rowBytes : (y+1)*rowBytes]
+			if !hflip {
+				copy(out, in)
+				continue
+			}
+			for len(out) >= 3 && len(in) >= 3 {
+				p := in[len(in)-3:]
+				out[0], out[1], out[2] = p[0], p[1], p[2]
+				out, in = out[3:], in[:len(in)-3]
+			}
+		}
+		return dst
+	}
+
+	// Output row y is source column x = y (before flipping), read top to
+	// bottom.
+	for y := 0; y < w; y++ {
+		sx := y
+		if hflip {
+			sx = w - 1 - sx
+		}
+		out := dst[y*h*3 : (y+1)*h*3]
+		for x := 0; x < h; x++ {
+			sy := x
+			if vflip {
+				sy = h - 1 - sy
+			}
+			i := sy*rowBytes + sx*3
+			out[x*3], out[x*3+1], out[x*3+2] = src[i], src[i+1], src[i+2]
+		}
+	}
+	return dst
+}
@@ -0,0 +1,54 @@
+//go:build linux
+// +build linux
+
+package gocam
+
+import "unsafe"
+
+const (
+	v4l2CidHFlip = 0x00980914 // V4L2_CID_HFLIP
+	v4l2CidVFlip = 0x00980915 // V4L2_CID_VFLIP
+)
+
+// applyTransform hands the mirroring part of t to the driver's HFLIP and
+// VFLIP controls where it has them and returns the transform left to do in
+// software. The previous control values are restored when the device is
+// closed.
+func (d *v4l2Device) applyTransform(t Transform) Transform {
+	hflip, vflip, transpose := t.parts()
+	if hflip && d.setFlip(v4l2CidHFlip) {
+		hflip = false
+	}
+	if vflip && d.setFlip(v4l2CidVFlip) {
+		vflip = false
+	}
+	return transformOf(hflip, vflip, transpose)
+}
+
+// setFlip turns on a flip control and reports whether the driver took it.
+func (d *v4l2Device) setFlip(id uint32) bool {
+	if d.controlName(id) == "" {
+		return false
+	}
+	ctrl := v4l2Control{ID: id}
+	if err := ioctl(d.fd, vidiocGCtrl, unsafe.Pointer(&ctrl)); err != nil {
+		return false
+	}
+	prev := ctrl
+	ctrl.Value = 1
+	if err := ioctl(d.fd, vidiocSCtrl, unsafe.Pointer(&ctrl)); err != nil {
+		return false
+	}
+	if prev.Value != 1 {
+		d.restore = append(d.restore, prev)
+	}
+	return true
+}
+
+// restoreControls resets the controls changed by applyTransform.
+func (d *v4l2Device) restoreControls() {
+	for i := range d.restore {
+		_ = ioctl(d.fd, vidiocSCtrl, unsafe.Pointer(&d.restore[i]))
+	}
+	d.restore = nil
+}
@@ -0,0 +1,134 @@
+package gocam
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+var allTransforms = []Transform{TransformNone, Rotate90, Rotate180, Rotate270, FlipHorizontal, FlipVertical, Transpose}
+
+// pixelFrame returns a w x h frame whose pixel (x, y) is {x, y, 7}.
+func pixelFrame(w, h int) Frame {
+	data := make([]byte, 0, w*h*3)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			data = append(data, byte(x), byte(y), 7)
+		}
+	}
+	return Frame{Data: data, Width: w, Height: h, Sequence: 9}
+}
+
+func TestFrameTransform(t *testing.T) {
+	const w, h = 5, 3
+	// source returns the source pixel shown at (x, y) of the output.
+	tests := map[Transform]func(x, y int) (int, int){
+		TransformNone:  func(x, y int) (int, int) { return x, y },
+		Rotate90:       func(x, y int) (int, int) { return y, h - 1 - x },
+		Rotate180:      func(x, y int) (int, int) { return w - 1 - x, h - 1 - y },
+		Rotate270:      func(x, y int) (int, int) { return w - 1 - y, x },
+		FlipHorizontal: func(x, y int) (int, int) { return w - 1 - x, y },
+		FlipVertical:   func(x, y int) (int, int) { return x, h - 1 - y },
+		Transpose:      func(x, y int) (int, int) { return y, x },
+	}
+	for tr, source := range tests {
+		f := pixelFrame(w, h).Transform(tr)
+		wantW, wantH := w, h
+		if tr.SwapsAxes() {
+			wantW, wantH = h, w
+		}
+		if f.Width != wantW || f.Height != wantH || f.Sequence != 9 {
+			t.Fatalf("%v: frame %dx%d seq %d", tr, f.Width, f.Height, f.Sequence)
+		}
+		for y := 0; y < f.Height; y++ {
+			for x := 0; x < f.Width; x++ {
+				sx, sy := source(x, y)
+				p := f.Data[(y*f.Width+x)*3:]
+				if int(p[0]) != sx || int(p[1]) != sy || p[2] != 7 {
+					t.Fatalf("%v: pixel (%d,%d) = (%d,%d), want (%d,%d)", tr, x, y, p[0], p[1], sx, sy)
+				}
+			}
+		}
+	}
+}
+
+func TestTransformCompositions(t *testing.T) {
+	src := pixelFrame(4, 7)
+	apply := func(f Frame, ts ...Transform) Frame {
+		for _, tr := range ts {
+			f = f.Transform(tr)
+		}
+		return f
+	}
+	same := func(a, b Frame) bool {
+		return a.Width == b.Width && a.Height == b.Height && bytes.Equal(a.Data, b.Data)
+	}
+
+	if !same(apply(src, Rotate90, Rotate90, Rotate90, Rotate90), src) {
+		t.Error("four 90 degree rotations are not the identity")
+	}
+	if !same(apply(src, Rotate90, Rotate270), src) {
+		t.Error("Rotate270 does not undo Rotate90")
+	}
+	if !same(apply(src, Rotate90, Rotate90), apply(src, Rotate180)) {
+		t.Error("two 90 degree rotations differ from Rotate180")
+	}
+	if !same(apply(src, FlipHorizontal, FlipVertical), apply(src, Rotate180)) {
+		t.Error("both flips differ from Rotate180")
+	}
+	for _, tr := range []Transform{FlipHorizontal, FlipVertical, Transpose, Rotate180} {
+		if !same(apply(src, tr, tr), src) {
+			t.Errorf("%v is not its own inverse", tr)
+		}
+	}
+	for _, tr := range allTransforms {
+		if got := transformOf(tr.parts()); got != tr {
+			t.Errorf("transformOf(%v.parts()) = %v", tr, got)
+		}
+		h, v, tp := tr.parts()
+		flipped := src
+		if h {
+			flipped = flipped.Transform(FlipHorizontal)
+		}
+		if v {
+			flipped = flipped.Transform(FlipVertical)
+		}
+		if tp {
+			flipped = flipped.Transform(Transpose)
+		}
+		if !same(flipped, src.Transform(tr)) {
+			t.Errorf("%v differs from its flips and transpose", tr)
+		}
+	}
+}
+
+func TestFrameTransformShortData(t *testing.T) {
+	f := Frame{Data: make([]byte, 5), Width: 4, Height: 4}
+	if got := f.Transform(Rotate90); got.Width != 4 || len(got.Data) != 5 {
+		t.Errorf("short frame was transformed")
+	}
+}
+
+func TestOpenStreamWithTransform(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := OpenStream(ctx, WithDevice("test://gradient?w=64&h=32&fps=100"), WithTransform(Rotate270))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if info := s.Info(); info.Width != 32 || info.Height != 64 {
+		t.Errorf("Info size %dx%d, want 32x64", info.Width, info.Height)
+	}
+	select {
+	case f := <-s.Frames():
+		want := (&TestPatternSource{Pattern: PatternGradient, Width: 64, Height: 32}).Render(f.Sequence).Transform(Rotate270)
+		if f.Width != 32 || f.Height != 64 || !bytes.Equal(f.Data, want.Data) {
+			t.Errorf("frame %dx%d is not the rotated pattern", f.Width, f.Height)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no frame")
+	}
+}
@@ -0,0 +1,212 @@
+// Package wsclient receives frames from a gocam WSServer and decodes them
+// back into gocam Frames.
+//
+//	conn, err := wsclient.Dial(ctx, "ws://camera:8080/frames", &wsclient.Options{
+//		Format: gocam.WSI420,
+//		FPS:    10,
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	defer conn.Close()
+//	for {
+//		frame, err := conn.ReadFrame()
+//		if err != nil {
+//			return err
+//		}
+//		// frame.Data is YCbCr444, as from gocam.StartStream.
+//	}
+package wsclient
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	gocam "github.com/svanichkin/gocam"
+	"github.com/svanichkin/gocam/internal/websocket"
+	"github.com/svanichkin/gocam/pixconv"
+)
+
+// messageLimit bounds the size of frame messages, enough for 8K RGBA.
+const messageLimit = 256 << 20
+
+// Options selects the initial stream settings. Zero fields keep the
+// server's defaults.
+type Options struct {
+	Format   gocam.WSFormat
+	FPS      float64
+	Compress bool
+	// Header is sent with the handshake request, e.g. for authorization.
+	Header http.Header
+}
+
+// Conn is a connection to a WSServer. ReadFrame and ReadRaw must be called
+// from one goroutine; the setters may be called from any.
+type Conn struct {
+	ws       *websocket.Conn
+	inflate  io.ReadCloser
+	zbuf     bytes.Reader
+	settings gocam.WSControl
+}
+
+// Dial connects to the ws:// or wss:// URL of a WSServer and sends the
+// settings from opts, if any.
+func Dial(ctx context.Context, url string, opts *Options) (*Conn, error) {
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	ws, err := websocket.Dial(ctx, url, o.Header, messageLimit)
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{ws: ws}
+
+	var ctl gocam.WSControl
+	if o.Format != 0 {
+		ctl.Format = &o.Format
+	}
+	if o.FPS != 0 {
+		ctl.FPS = &o.FPS
+	}
+	if o.Compress {
+		ctl.Compress = &o.Compress
+	}
+	if ctl != (gocam.WSControl{}) {
+		if err := c.Control(ctl); err != nil {
+			ws.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Control sends a control message. The server applies it to the frames
+// that follow; an invalid message makes the next read fail.
+func (c *Conn) Control(ctl gocam.WSControl) error {
+	msg, err := json.Marshal(ctl)
+	if err != nil {
+		return err
+	}
+	return c.ws.WriteMessage(websocket.TextMessage, msg)
+}
+
+// SetFPS caps the frame rate; 0 receives every frame.
+func (c *Conn) SetFPS(fps float64) error {
+	return c.Control(gocam.WSControl{FPS: &fps})
+}
+
+// SetFormat selects the pixel format of the payloads.
+func (c *Conn) SetFormat(f gocam.WSFormat) error {
+	return c.Control(gocam.WSControl{Format: &f})
+}
+
+// SetCompress turns DEFLATE compression of the payloads on or off.
+func (c *Conn) SetCompress(on bool) error {
+	return c.Control(gocam.WSControl{Compress: &on})
+}
+
+// Settings returns the settings the server last confirmed. Fields are nil
+// until the first answer has been read.
+func (c *Conn) Settings() gocam.WSControl {
+	return c.settings
+}
+
+// ReadRaw returns the next frame as sent: its header and the decompressed
+// payload in the header's format. Answers to control messages are consumed
+// on the way; an error answer is returned as an error.
+func (c *Conn) ReadRaw() (gocam.WSHeader, []byte, error) {
+	for {
+		typ, msg, err := c.ws.ReadMessage()
+		if err != nil {
+			if errors.Is(err, websocket.ErrClosed) {
+				err = io.EOF
+			}
+			return gocam.WSHeader{}, nil, err
+		}
+		if typ == websocket.TextMessage {
+			var ctl gocam.WSControl
+			if err := json.Unmarshal(msg, &ctl); err != nil {
+				return gocam.WSHeader{}, nil, fmt.Errorf("wsclient: bad control answer: %w", err)
+			}
+			if ctl.Error != "" {
+				return gocam.WSHeader{}, nil, fmt.Errorf("wsclient: server rejected control message: %s", ctl.Error)
+			}
+			c.settings = ctl
+			continue
+		}
+
+		h, payload, err := gocam.ParseWSMessage(msg)
+		if err != nil {
+			return gocam.WSHeader{}, nil, err
+		}
+		if h.Compressed {
+			if payload, err = c.decompress(payload); err != nil {
+				return gocam.WSHeader{}, nil, err
+			}
+			h.Compressed = false
+		}
+		return h, payload, nil
+	}
+}
+
+func (c *Conn) decompress(payload []byte) ([]byte, error) {
+	c.zbuf.Reset(payload)
+	if c.inflate == nil {
+		c.inflate = flate.NewReader(&c.zbuf)
+	} else if err := c.inflate.(flate.Resetter).Reset(&c.zbuf, nil); err != nil {
+		return nil, err
+	}
+	out, err := io.ReadAll(c.inflate)
+	if err != nil {
+		return nil, fmt.Errorf("wsclient: bad compressed payload: %w", err)
+	}
+	return out, nil
+}
+
+// ReadFrame returns the next frame converted to YCbCr444, the layout of
+// gocam frames. Frames sent as YCbCr444 are returned without conversion;
+// RGBA payloads are converted back with the JFIF matrix.
+func (c *Conn) ReadFrame() (gocam.Frame, error) {
+	h, payload, err := c.ReadRaw()
+	if err != nil {
+		return gocam.Frame{}, err
+	}
+	pf, err := h.Format.PixelFormat()
+	if err != nil {
+		return gocam.Frame{}, err
+	}
+	src, err := pixconv.Wrap(pf, h.Width, h.Height, payload, 0)
+	if err != nil {
+		return gocam.Frame{}, err
+	}
+	if len(payload) != pf.Size(h.Width, h.Height) {
+		return gocam.Frame{}, fmt.Errorf("wsclient: %d byte payload for a %dx%d %v frame", len(payload), h.Width, h.Height, h.Format)
+	}
+	data := payload
+	if pf != pixconv.YCbCr444 {
+		dst := pixconv.New(pixconv.YCbCr444, h.Width, h.Height)
+		if err := pixconv.Convert(dst, src, pixconv.JFIF); err != nil {
+			return gocam.Frame{}, err
+		}
+		data = dst.Bytes()
+	}
+	return gocam.Frame{
+		Data:      data,
+		Width:     h.Width,
+		Height:    h.Height,
+		Timestamp: h.Timestamp,
+		Sequence:  h.Sequence,
+	}, nil
+}
+
+// Close closes the connection.
+func (c *Conn) Close() error {
+	return c.ws.Close()
+}
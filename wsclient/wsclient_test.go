@@ -0,0 +1,173 @@
+package wsclient
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	gocam "github.com/svanichkin/gocam"
+)
+
+// gradient returns a frame whose samples vary smoothly, so 4:2:0 and RGB
+// round trips stay close to it.
+func gradient(w, h int) gocam.Frame {
+	data := make([]byte, 0, w*h*3)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			data = append(data, byte(64+x*4), 128, byte(96+y*4))
+		}
+	}
+	return gocam.Frame{Data: data, Width: w, Height: h, Sequence: 5, Timestamp: time.Unix(10, 0)}
+}
+
+// serve starts a WSServer fed with frame until the test ends, or until
+// the returned stop function is called.
+func serve(t *testing.T, frame gocam.Frame) (url string, stop func()) {
+	t.Helper()
+	frames := make(chan gocam.Frame)
+	done := make(chan struct{})
+	s := gocam.NewWSServer(frames, nil)
+	go func() {
+		defer close(frames)
+		for {
+			select {
+			case <-done:
+				return
+			case frames <- frame:
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+	srv := httptest.NewServer(s)
+	var stopped bool
+	stop = func() {
+		if !stopped {
+			stopped = true
+			close(done)
+			<-s.Done()
+		}
+	}
+	t.Cleanup(func() {
+		stop()
+		srv.Close()
+	})
+	return "ws" + strings.TrimPrefix(srv.URL, "http"), stop
+}
+
+func dial(t *testing.T, url string, opts *Options) *Conn {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := Dial(ctx, url, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// nextOfFormat reads until a frame of the given format arrives, since
+// frames sent before a control message took effect may still be queued.
+func nextOfFormat(t *testing.T, c *Conn, f gocam.WSFormat) (gocam.WSHeader, []byte) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		h, payload, err := c.ReadRaw()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Format == f {
+			return h, payload
+		}
+	}
+	t.Fatalf("no %v frame received", f)
+	return gocam.WSHeader{}, nil
+}
+
+func TestReadFrameFormats(t *testing.T) {
+	want := gradient(16, 10)
+	url, _ := serve(t, want)
+
+	for _, tc := range []struct {
+		opts      Options
+		tolerance int
+	}{
+		{Options{}, 0},
+		{Options{Format: gocam.WSI420, Compress: true}, 8},
+		{Options{Format: gocam.WSRGBA, FPS: 100}, 3},
+	} {
+		c := dial(t, url, &tc.opts)
+		var frame gocam.Frame
+		for i := 0; i < 100; i++ {
+			f, err := c.ReadFrame()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Settings().Format != nil || tc.opts.Format == 0 {
+				frame = f
+				break
+			}
+		}
+		if frame.Width != 16 || frame.Height != 10 || frame.Sequence != 5 || !frame.Timestamp.Equal(want.Timestamp) {
+			t.Fatalf("%+v: frame %dx%d seq %d at %v", tc.opts, frame.Width, frame.Height, frame.Sequence, frame.Timestamp)
+		}
+		for i := range want.Data {
+			if d := int(frame.Data[i]) - int(want.Data[i]); d < -tc.tolerance || d > tc.tolerance {
+				t.Fatalf("%+v: sample %d is %d, want %d", tc.opts, i, frame.Data[i], want.Data[i])
+			}
+		}
+	}
+}
+
+func TestControlMessages(t *testing.T) {
+	url, _ := serve(t, gradient(8, 8))
+	c := dial(t, url, nil)
+
+	if h, _ := nextOfFormat(t, c, gocam.WSYCbCr444); h.Compressed {
+		t.Error("payload reported compressed after decompression")
+	}
+	if err := c.SetFormat(gocam.WSRGBA); err != nil {
+		t.Fatal(err)
+	}
+	if _, payload := nextOfFormat(t, c, gocam.WSRGBA); len(payload) != 8*8*4 {
+		t.Errorf("RGBA payload of %d bytes", len(payload))
+	}
+	if s := c.Settings(); s.Format == nil || *s.Format != gocam.WSRGBA || s.FPS == nil || *s.FPS != 0 {
+		t.Errorf("settings %+v", s)
+	}
+
+	// An invalid message is reported by the next read.
+	if err := c.ws.WriteMessage(1, []byte(`{"format": "h264"}`)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		if _, _, err := c.ReadRaw(); err != nil {
+			if !strings.Contains(err.Error(), "rejected") {
+				t.Errorf("error %v, want a rejected control message", err)
+			}
+			break
+		}
+		if i == 100 {
+			t.Fatal("invalid control message not reported")
+		}
+	}
+}
+
+func TestReadFrameEOF(t *testing.T) {
+	url, stop := serve(t, gradient(4, 4))
+	c := dial(t, url, nil)
+	if _, err := c.ReadFrame(); err != nil {
+		t.Fatal(err)
+	}
+	stop()
+	for {
+		if _, err := c.ReadFrame(); err != nil {
+			if err != io.EOF {
+				t.Errorf("error %v after the stream ended, want io.EOF", err)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,490 @@
+package gocam
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/svanichkin/gocam/internal/websocket"
+	"github.com/svanichkin/gocam/pixconv"
+)
+
+// A WSServer sends every frame as one binary WebSocket message: a
+// WSHeaderSize-byte header followed by the pixels. All fields are
+// big-endian:
+//
+//	offset size
+//	0      4    magic "GCFR"
+//	4      1    version (WSVersion)
+//	5      1    pixel format (WSFormat)
+//	6      1    flags: bit 0 set if the payload is DEFLATE-compressed (RFC 1951)
+//	7      1    header size; the payload starts here
+//	8      4    width
+//	12     4    height
+//	16     8    capture time in nanoseconds since the Unix epoch, 0 if unknown
+//	24     8    sequence number
+//
+// Clients steer the stream with JSON text messages holding any fields of
+// WSControl, e.g. {"fps": 10, "format": "rgba", "compress": true}. The
+// server answers each with the resulting settings, or with {"error": "..."}
+// if the message was invalid.
+
+const (
+	// WSMagic starts every frame message.
+	WSMagic = "GCFR"
+	// WSVersion is the protocol version written by WSServer.
+	WSVersion = 1
+	// WSHeaderSize is the size of the version 1 frame header.
+	WSHeaderSize = 32
+)
+
+// wsFlagDeflate marks compressed payloads.
+const wsFlagDeflate = 1
+
+// wsControlLimit bounds the size of client messages.
+const wsControlLimit = 64 << 10
+
+// WSFormat is the pixel layout of WebSocket frame payloads. The values are
+// part of the wire format.
+type WSFormat uint8
+
+const (
+	// WSYCbCr444 is packed Y, Cb, Cr, the layout of Frame.Data.
+	WSYCbCr444 WSFormat = iota + 1
+	// WSI420 is planar 4:2:0, half the size of WSYCbCr444.
+	WSI420
+	// WSRGBA is packed R, G, B, A with opaque alpha, ready for a canvas
+	// ImageData.
+	WSRGBA
+)
+
+func (f WSFormat) String() string {
+	switch f {
+	case WSYCbCr444:
+		return "ycbcr444"
+	case WSI420:
+		return "i420"
+	case WSRGBA:
+		return "rgba"
+	}
+	return "unknown"
+}
+
+// PixelFormat returns the pixconv layout of the format.
+func (f WSFormat) PixelFormat() (pixconv.Format, error) {
+	switch f {
+	case WSYCbCr444:
+		return pixconv.YCbCr444, nil
+	case WSI420:
+		return pixconv.I420, nil
+	case WSRGBA:
+		return pixconv.RGBA, nil
+	}
+	return 0, fmt.Errorf("gocam: unknown WebSocket pixel format %d", uint8(f))
+}
+
+// MarshalText encodes the format as its name, as used in control messages.
+func (f WSFormat) MarshalText() ([]byte, error) {
+	if _, err := f.PixelFormat(); err != nil {
+		return nil, err
+	}
+	return []byte(f.String()), nil
+}
+
+// UnmarshalText accepts the names returned by String, in any case.
+func (f *WSFormat) UnmarshalText(b []byte) error {
+	for _, c := range []WSFormat{WSYCbCr444, WSI420, WSRGBA} {
+		if strings.EqualFold(string(b), c.String()) {
+			*f = c
+			return nil
+		}
+	}
+	return fmt.Errorf("gocam: unknown WebSocket pixel format %q", b)
+}
+
+// WSHeader is the header of a frame message.
+type WSHeader struct {
+	Version    uint8
+	Format     WSFormat
+	Compressed bool
+	Width      int
+	Height     int
+	Timestamp  time.Time
+	Sequence   uint64
+}
+
+// AppendBinary appends the encoded header to b. Version 0 is written as
+// WSVersion.
+func (h WSHeader) AppendBinary(b []byte) ([]byte, error) {
+	if h.Width <= 0 || h.Height <= 0 || uint64(h.Width) > math.MaxUint32 || uint64(h.Height) > math.MaxUint32 {
+		return nil, fmt.Errorf("gocam: invalid frame size %dx%d", h.Width, h.Height)
+	}
+	version := h.Version
+	if version == 0 {
+		version = WSVersion
+	}
+	var flags byte
+	if h.Compressed {
+		flags |= wsFlagDeflate
+	}
+	var ts int64
+	if !h.Timestamp.IsZero() {
+		ts = h.Timestamp.UnixNano()
+	}
+	b = append(b, WSMagic...)
+	b = append(b, version, byte(h.Format), flags, WSHeaderSize)
+	b = binary.BigEndian.AppendUint32(b, uint32(h.Width))
+	b = binary.BigEndian.AppendUint32(b, uint32(h.Height))
+	b = binary.BigEndian.AppendUint64(b, uint64(ts))
+	b = binary.BigEndian.AppendUint64(b, h.Sequence)
+	return b, nil
+}
+
+// ParseWSMessage splits a frame message into its header and payload. The
+// payload is returned as sent, compressed if the header says so. Headers
+// of later versions parse as long as they keep the version 1 fields.
+func ParseWSMessage(msg []byte) (WSHeader, []byte, error) {
+	if len(msg) < WSHeaderSize || string(msg[:4]) != WSMagic {
+		return WSHeader{}, nil, errors.New("gocam: not a frame message")
+	}
+	size := int(msg[7])
+	if msg[4] == 0 || size < WSHeaderSize || size > len(msg) {
+		return WSHeader{}, nil, errors.New("gocam: malformed frame header")
+	}
+	h := WSHeader{
+		Version:    msg[4],
+		Format:     WSFormat(msg[5]),
+		Compressed: msg[6]&wsFlagDeflate != 0,
+		Width:      int(binary.BigEndian.Uint32(msg[8:])),
+		Height:     int(binary.BigEndian.Uint32(msg[12:])),
+		Sequence:   binary.BigEndian.Uint64(msg[24:]),
+	}
+	if ts := int64(binary.BigEndian.Uint64(msg[16:])); ts != 0 {
+		h.Timestamp = time.Unix(0, ts)
+	}
+	return h, msg[size:], nil
+}
+
+// WSControl is a control message; clients set only the fields they change.
+// The server answers with all fields set.
+type WSControl struct {
+	// FPS caps the frame rate sent to the client; 0 sends every frame.
+	FPS *float64 `json:"fps,omitempty"`
+	// Format is the pixel layout of the payloads.
+	Format *WSFormat `json:"format,omitempty"`
+	// Compress enables DEFLATE compression of the payloads.
+	Compress *bool `json:"compress,omitempty"`
+	// Error is set in answers to invalid messages, which change nothing.
+	Error string `json:"error,omitempty"`
+}
+
+// WSOptions configures a WSServer. The zero value (or a nil pointer) sends
+// every frame uncompressed in WSYCbCr444 until the client asks otherwise.
+type WSOptions struct {
+	// Format, FPS and Compress are the initial settings of every client.
+	Format   WSFormat
+	FPS      float64
+	Compress bool
+
+	// AllowedOrigins lists the origins, such as "https://example.com",
+	// whose pages may connect besides those served from the WSServer's
+	// own host; "*" allows any. Other cross-origin handshakes are refused,
+	// so a page elsewhere cannot watch the camera through the browser of
+	// someone on the server's network.
+	AllowedOrigins []string
+	// CheckOrigin, if set, decides instead of AllowedOrigins whether a
+	// handshake request may connect.
+	CheckOrigin func(r *http.Request) bool
+}
+
+// WSServer streams raw frames to WebSocket clients, such as a browser
+// canvas renderer or the wsclient package, using the binary protocol
+// described by WSHeader. Each client picks its own pixel format, frame rate
+// and compression through WSControl messages and holds only the latest
+// frame, so a slow client skips frames without holding back the others.
+type WSServer struct {
+	opts WSOptions
+
+	mu      sync.Mutex
+	clients map[chan Frame]struct{}
+	done    chan struct{}
+	closed  bool
+}
+
+// NewWSServer starts serving frames from the channel, such as
+// Stream.Frames. Frames are released once handed to the clients. When the
+// channel closes, the connections are closed and new requests get 503
+// Service Unavailable.
+func NewWSServer(frames <-chan Frame, opts *WSOptions) *WSServer {
+	s := &WSServer{
+		clients: make(map[chan Frame]struct{}),
+		done:    make(chan struct{}),
+	}
+	if opts != nil {
+		s.opts = *opts
+	}
+	if s.opts.Format == 0 {
+		s.opts.Format = WSYCbCr444
+	}
+	go s.run(frames)
+	return s
+}
+
+// Clients returns the number of connected clients.
+func (s *WSServer) Clients() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.clients)
+}
+
+// Done is closed when the frame channel has closed.
+func (s *WSServer) Done() <-chan struct{} {
+	return s.done
+}
+
+// run hands every frame to the clients until the channel closes.
+func (s *WSServer) run(frames <-chan Frame) {
+	for frame := range frames {
+		s.mu.Lock()
+		for ch := range s.clients {
+			select {
+			case ch <- frame:
+			default:
+				select {
+				case <-ch:
+				default:
+				}
+				ch <- frame
+			}
+		}
+		s.mu.Unlock()
+		// The clients only read Data, which stays valid.
+		frame.Release()
+	}
+	s.mu.Lock()
+	s.closed = true
+	for ch := range s.clients {
+		close(ch)
+	}
+	s.mu.Unlock()
+	close(s.done)
+}
+
+// wsSettings are the current choices of one client.
+type wsSettings struct {
+	fps      float64
+	format   WSFormat
+	compress bool
+}
+
+func (st wsSettings) control() WSControl {
+	return WSControl{FPS: &st.fps, Format: &st.format, Compress: &st.compress}
+}
+
+// apply returns st updated by ctl, or an error if ctl is invalid.
+func (st wsSettings) apply(ctl WSControl) (wsSettings, error) {
+	if ctl.FPS != nil {
+		if *ctl.FPS < 0 || math.IsNaN(*ctl.FPS) || math.IsInf(*ctl.FPS, 0) {
+			return st, fmt.Errorf("invalid fps %v", *ctl.FPS)
+		}
+		st.fps = *ctl.FPS
+	}
+	if ctl.Format != nil {
+		if _, err := ctl.Format.PixelFormat(); err != nil {
+			return st, err
+		}
+		st.format = *ctl.Format
+	}
+	if ctl.Compress != nil {
+		st.compress = *ctl.Compress
+	}
+	return st, nil
+}
+
+// checkOrigin applies the origin policy of the options.
+func (s *WSServer) checkOrigin(r *http.Request) bool {
+	if s.opts.CheckOrigin != nil {
+		return s.opts.CheckOrigin(r)
+	}
+	if websocket.SameOrigin(r) {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	for _, allowed := range s.opts.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTP upgrades the request to a WebSocket and streams frames until
+// the client disconnects or the frame channel closes.
+func (s *WSServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+	if closed {
+		http.Error(w, "stream ended", http.StatusServiceUnavailable)
+		return
+	}
+	conn, err := websocket.Upgrade(w, r, wsControlLimit, s.checkOrigin)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	frames := make(chan Frame, 1)
+	s.clients[frames] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, frames)
+		s.mu.Unlock()
+	}()
+
+	// The reader turns control messages into settings.
+	controls := make(chan WSControl, 1)
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		for {
+			typ, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if typ != websocket.TextMessage {
+				conn.CloseWith(websocket.CloseUnsupported)
+				return
+			}
+			var ctl WSControl
+			if err := json.Unmarshal(msg, &ctl); err != nil {
+				ctl = WSControl{Error: err.Error()}
+			}
+			select {
+			case controls <- ctl:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}()
+
+	st := wsSettings{fps: s.opts.FPS, format: s.opts.Format, compress: s.opts.Compress}
+	var enc wsEncoder
+	var last time.Time
+	for {
+		select {
+		case <-readDone:
+			return
+		case ctl := <-controls:
+			var answer WSControl
+			if ctl.Error == "" {
+				var err error
+				if st, err = st.apply(ctl); err != nil {
+					ctl.Error = err.Error()
+				}
+			}
+			if ctl.Error != "" {
+				answer = WSControl{Error: ctl.Error}
+			} else {
+				answer = st.control()
+			}
+			msg, _ := json.Marshal(answer)
+			if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+		case frame, ok := <-frames:
+			if !ok {
+				return
+			}
+			now := time.Now()
+			if st.fps > 0 && !last.IsZero() && now.Sub(last) < time.Duration(float64(time.Second)/st.fps) {
+				continue
+			}
+			msg, err := enc.encode(frame, st.format, st.compress)
+			if err != nil {
+				continue
+			}
+			if err := conn.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+				return
+			}
+			last = now
+		}
+	}
+}
+
+// wsEncoder builds frame messages, reusing its buffers between frames.
+type wsEncoder struct {
+	msg  []byte
+	conv *pixconv.Image
+	zbuf bytes.Buffer
+	zw   *flate.Writer
+}
+
+// encode returns the message for frame; it is valid until the next call.
+func (e *wsEncoder) encode(frame Frame, format WSFormat, compress bool) ([]byte, error) {
+	if err := checkFrame(frame); err != nil {
+		return nil, err
+	}
+	payload := frame.Data
+	if format != WSYCbCr444 {
+		pf, err := format.PixelFormat()
+		if err != nil {
+			return nil, err
+		}
+		if e.conv == nil || e.conv.Format != pf || e.conv.Width != frame.Width || e.conv.Height != frame.Height {
+			e.conv = pixconv.New(pf, frame.Width, frame.Height)
+		}
+		src, err := pixconv.Wrap(pixconv.YCbCr444, frame.Width, frame.Height, frame.Data, 0)
+		if err != nil {
+			return nil, err
+		}
+		if err := pixconv.Convert(e.conv, src, pixconv.JFIF); err != nil {
+			return nil, err
+		}
+		payload = e.conv.Bytes()
+	}
+
+	h := WSHeader{
+		Format:     format,
+		Compressed: compress,
+		Width:      frame.Width,
+		Height:     frame.Height,
+		Timestamp:  frame.Timestamp,
+		Sequence:   frame.Sequence,
+	}
+	msg, err := h.AppendBinary(e.msg[:0])
+	if err != nil {
+		return nil, err
+	}
+	if compress {
+		e.zbuf.Reset()
+		if e.zw == nil {
+			e.zw, _ = flate.NewWriter(&e.zbuf, flate.BestSpeed)
+		} else {
+			e.zw.Reset(&e.zbuf)
+		}
+		if _, err := e.zw.Write(payload); err != nil {
+			return nil, err
+		}
+		if err := e.zw.Close(); err != nil {
+			return nil, err
+		}
+		payload = e.zbuf.Bytes()
+	}
+	e.msg = append(msg, payload...)
+	return e.msg, nil
+}
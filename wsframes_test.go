@@ -0,0 +1,179 @@
+package gocam
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/svanichkin/gocam/internal/websocket"
+)
+
+func TestWSHeaderRoundTrip(t *testing.T) {
+	want := WSHeader{
+		Version:    WSVersion,
+		Format:     WSI420,
+		Compressed: true,
+		Width:      640,
+		Height:     480,
+		Timestamp:  time.Unix(1700000000, 123456789),
+		Sequence:   1<<40 + 7,
+	}
+	msg, err := want.AppendBinary(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg) != WSHeaderSize || string(msg[:4]) != WSMagic {
+		t.Fatalf("header % x", msg)
+	}
+	msg = append(msg, 1, 2, 3)
+
+	got, payload, err := ParseWSMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Timestamp.Equal(want.Timestamp) {
+		t.Errorf("timestamp %v, want %v", got.Timestamp, want.Timestamp)
+	}
+	got.Timestamp = want.Timestamp
+	if got != want {
+		t.Errorf("header %+v, want %+v", got, want)
+	}
+	if !bytes.Equal(payload, []byte{1, 2, 3}) {
+		t.Errorf("payload %v", payload)
+	}
+
+	// Later versions may grow the header.
+	longer := append([]byte(nil), msg[:WSHeaderSize]...)
+	longer[4], longer[7] = 2, WSHeaderSize+4
+	longer = append(longer, 0, 0, 0, 0, 9)
+	if _, payload, err := ParseWSMessage(longer); err != nil || !bytes.Equal(payload, []byte{9}) {
+		t.Errorf("longer header: payload %v, err %v", payload, err)
+	}
+
+	for name, bad := range map[string][]byte{
+		"short":     msg[:WSHeaderSize-1],
+		"magic":     append([]byte("XXXX"), msg[4:]...),
+		"size":      append(append([]byte(nil), msg[:7]...), append([]byte{200}, msg[8:]...)...),
+		"version 0": append(append([]byte(nil), msg[:4]...), append([]byte{0}, msg[5:]...)...),
+	} {
+		if _, _, err := ParseWSMessage(bad); err == nil {
+			t.Errorf("%s: parsed without error", name)
+		}
+	}
+}
+
+func TestWSControlJSON(t *testing.T) {
+	var ctl WSControl
+	if err := json.Unmarshal([]byte(`{"fps": 12.5, "format": "RGBA"}`), &ctl); err != nil {
+		t.Fatal(err)
+	}
+	if ctl.FPS == nil || *ctl.FPS != 12.5 || ctl.Format == nil || *ctl.Format != WSRGBA || ctl.Compress != nil {
+		t.Errorf("parsed %+v", ctl)
+	}
+	if err := json.Unmarshal([]byte(`{"format": "yuyv"}`), &ctl); err == nil {
+		t.Error("unknown format accepted")
+	}
+
+	st, err := wsSettings{format: WSYCbCr444}.apply(ctl)
+	if err != nil || st.fps != 12.5 || st.format != WSRGBA {
+		t.Errorf("applied %+v, %v", st, err)
+	}
+	b, err := json.Marshal(st.control())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"fps":12.5,"format":"rgba","compress":false}`; string(b) != want {
+		t.Errorf("answer %s, want %s", b, want)
+	}
+	neg := -1.0
+	if _, err := st.apply(WSControl{FPS: &neg}); err == nil {
+		t.Error("negative fps accepted")
+	}
+}
+
+func TestWSEncoder(t *testing.T) {
+	frame := pixelFrame(5, 3)
+	frame.Timestamp = time.Unix(0, 42)
+	var enc wsEncoder
+
+	for _, tc := range []struct {
+		format   WSFormat
+		compress bool
+		size     int
+	}{
+		{WSYCbCr444, false, 5 * 3 * 3},
+		{WSI420, false, 5*3 + 2*3*2},
+		{WSRGBA, true, 5 * 3 * 4},
+	} {
+		msg, err := enc.encode(frame, tc.format, tc.compress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, payload, err := ParseWSMessage(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Format != tc.format || h.Compressed != tc.compress || h.Width != 5 || h.Height != 3 ||
+			h.Sequence != frame.Sequence || !h.Timestamp.Equal(frame.Timestamp) {
+			t.Errorf("%v: header %+v", tc.format, h)
+		}
+		if tc.compress {
+			if payload, err = io.ReadAll(flate.NewReader(bytes.NewReader(payload))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(payload) != tc.size {
+			t.Errorf("%v: %d byte payload, want %d", tc.format, len(payload), tc.size)
+		}
+		if tc.format == WSYCbCr444 && !bytes.Equal(payload, frame.Data) {
+			t.Error("YCbCr444 payload differs from the frame data")
+		}
+	}
+}
+
+func TestWSServerOrigin(t *testing.T) {
+	tests := []struct {
+		opts   WSOptions
+		origin string
+		ok     bool
+	}{
+		{WSOptions{}, "", true},
+		{WSOptions{}, "self", true},
+		{WSOptions{}, "https://app.example", false},
+		{WSOptions{AllowedOrigins: []string{"https://app.example"}}, "https://APP.example", true},
+		{WSOptions{AllowedOrigins: []string{"https://app.example"}}, "https://evil.example", false},
+		{WSOptions{AllowedOrigins: []string{"*"}}, "https://evil.example", true},
+		{WSOptions{AllowedOrigins: []string{"*"}, CheckOrigin: func(*http.Request) bool { return false }}, "", false},
+	}
+	for _, tc := range tests {
+		frames := make(chan Frame)
+		opts := tc.opts
+		srv := httptest.NewServer(NewWSServer(frames, &opts))
+		header := http.Header{}
+		switch tc.origin {
+		case "":
+		case "self":
+			header.Set("Origin", srv.URL)
+		default:
+			header.Set("Origin", tc.origin)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		conn, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), header, 1<<20)
+		cancel()
+		if (err == nil) != tc.ok {
+			t.Errorf("origin %q with %d allowed origins: %v", tc.origin, len(tc.opts.AllowedOrigins), err)
+		}
+		if err == nil {
+			conn.Close()
+		}
+		close(frames)
+		srv.Close()
+	}
+}
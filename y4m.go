@@ -0,0 +1,234 @@
+package gocam
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/svanichkin/gocam/pixconv"
+)
+
+// Y4MChroma selects the chroma layout written by Y4MWriter.
+type Y4MChroma int
+
+const (
+	// Y4M444 writes full-resolution chroma, losslessly matching Frame.Data.
+	Y4M444 Y4MChroma = iota
+	// Y4M420 averages chroma over 2x2 blocks (C420jpeg siting), for tools
+	// that only take 4:2:0.
+	Y4M420
+)
+
+func (c Y4MChroma) String() string {
+	switch c {
+	case Y4M444:
+		return "444"
+	case Y4M420:
+		return "420jpeg"
+	}
+	return "unknown"
+}
+
+// Y4MOptions configures a Y4MWriter.
+type Y4MOptions struct {
+	Chroma Y4MChroma
+	// FPS is the frame rate written to the header, usually Stream.Info().FPS.
+	// When zero, the rate is measured from the timestamps of the first two
+	// frames, which delays the header until the second frame.
+	FPS float64
+	// PixelAspect is the pixel aspect ratio as numerator and denominator;
+	// the zero value means square pixels.
+	PixelAspect [2]int
+}
+
+// Y4MWriter writes frames as a YUV4MPEG2 stream, the raw format ffmpeg,
+// x264 and most analysis tools read with "-f yuv4mpegpipe". The header is
+// written with the first frame, which fixes the size; frames of another
+// size are rejected. The header marks the samples as full range
+// (XCOLORRANGE=FULL), as gocam frames are JFIF.
+type Y4MWriter struct {
+	w    io.Writer
+	opts Y4MOptions
+
+	width, height int
+	field         FieldOrder
+	header        bool
+	pending       *Frame // first frame, while the rate is being measured
+
+	buf  []byte
+	i420 *pixconv.Image
+}
+
+// NewY4MWriter returns a writer emitting a YUV4MPEG2 stream to w. opts may
+// be nil for 4:4:4 with a measured frame rate.
+func NewY4MWriter(w io.Writer, opts *Y4MOptions) *Y4MWriter {
+	yw := &Y4MWriter{w: w}
+	if opts != nil {
+		yw.opts = *opts
+	}
+	return yw
+}
+
+// WriteFrame appends a frame to the stream.
+func (yw *Y4MWriter) WriteFrame(frame Frame) error {
+	if err := checkFrame(frame); err != nil {
+		return err
+	}
+	if yw.width == 0 {
+		if yw.opts.Chroma != Y4M444 && yw.opts.Chroma != Y4M420 {
+			return fmt.Errorf("gocam: unsupported Y4M chroma %v", yw.opts.Chroma)
+		}
+		yw.width, yw.height, yw.field = frame.Width, frame.Height, frame.Field
+	} else if frame.Width != yw.width || frame.Height != yw.height {
+		return fmt.Errorf("gocam: Y4M frame size changed from %dx%d to %dx%d", yw.width, yw.height, frame.Width, frame.Height)
+	}
+
+	if !yw.header {
+		if yw.opts.FPS <= 0 {
+			if yw.pending == nil {
+				yw.pending = &frame
+				return nil
+			}
+			yw.opts.FPS = measuredFPS(yw.pending.Timestamp, frame.Timestamp)
+		}
+		if err := yw.writeHeader(); err != nil {
+			return err
+		}
+		if yw.pending != nil {
+			first := *yw.pending
+			yw.pending = nil
+			if err := yw.writeFrame(first); err != nil {
+				return err
+			}
+		}
+	}
+	return yw.writeFrame(frame)
+}
+
+// Close writes a frame still held back for rate measurement. It does not
+// close the underlying writer.
+func (yw *Y4MWriter) Close() error {
+	if yw.header || yw.pending == nil {
+		return nil
+	}
+	if err := yw.writeHeader(); err != nil {
+		return err
+	}
+	first := *yw.pending
+	yw.pending = nil
+	return yw.writeFrame(first)
+}
+
+// defaultY4MFPS is written when the rate is neither given nor measurable.
+const defaultY4MFPS = 25
+
+// measuredFPS returns the rate implied by two consecutive timestamps,
+// snapped to a whole rate when it is within the jitter of one.
+func measuredFPS(a, b time.Time) float64 {
+	if a.IsZero() || b.IsZero() || !b.After(a) {
+		return defaultY4MFPS
+	}
+	fps := float64(time.Second) / float64(b.Sub(a))
+	if r := math.Round(fps); r > 0 && math.Abs(fps-r) < r*0.03 {
+		return r
+	}
+	return fps
+}
+
+func (yw *Y4MWriter) writeHeader() error {
+	fps := yw.opts.FPS
+	if fps <= 0 {
+		fps = defaultY4MFPS
+	}
+	num, den := rateFraction(fps)
+	an, ad := yw.opts.PixelAspect[0], yw.opts.PixelAspect[1]
+	if an <= 0 || ad <= 0 {
+		an, ad = 1, 1
+	}
+	interlace := "p"
+	switch yw.field {
+	case FieldInterlacedTB:
+		interlace = "t"
+	case FieldInterlacedBT:
+		interlace = "b"
+	}
+	_, err := fmt.Fprintf(yw.w, "%s W%d H%d F%d:%d I%s A%d:%d C%s XYSCSS=%s XCOLORRANGE=FULL\n",
+		y4mMagic, yw.width, yw.height, num, den, interlace, an, ad, yw.opts.Chroma, yw.xyscss())
+	yw.header = err == nil
+	return err
+}
+
+// xyscss returns the mjpegtools name of the chroma layout.
+func (yw *Y4MWriter) xyscss() string {
+	if yw.opts.Chroma == Y4M420 {
+		return "420JPEG"
+	}
+	return "444"
+}
+
+func (yw *Y4MWriter) writeFrame(frame Frame) error {
+	w, h := frame.Width, frame.Height
+	n := w * h
+	if yw.opts.Chroma == Y4M420 {
+		if yw.i420 == nil {
+			yw.i420 = pixconv.New(pixconv.I420, w, h)
+			yw.buf = make([]byte, n+2*((w+1)/2)*((h+1)/2))
+		}
+		src, err := pixconv.Wrap(pixconv.YCbCr444, w, h, frame.Data, 0)
+		if err != nil {
+			return err
+		}
+		if err := pixconv.Convert(yw.i420, src, pixconv.JFIF); err != nil {
+			return err
+		}
+		// Y4M planes are tightly packed, whatever the I420 strides.
+		out := yw.buf
+		for p := 0; p < 3; p++ {
+			rowBytes, rows := w, h
+			if p > 0 {
+				rowBytes, rows = (w+1)/2, (h+1)/2
+			}
+			stride := yw.i420.Strides[p]
+			for y := 0; y < rows; y++ {
+				out = out[copy(out, yw.i420.Planes[p][y*stride:y*stride+rowBytes]):]
+			}
+		}
+	} else {
+		if yw.buf == nil {
+			yw.buf = make([]byte, 3*n)
+		}
+		y, cb, cr := yw.buf[:n], yw.buf[n:2*n], yw.buf[2*n:3*n]
+		src := frame.Data[:3*n]
+		for i := range y {
+			p := src[i*3 : i*3+3]
+			y[i], cb[i], cr[i] = p[0], p[1], p[2]
+		}
+	}
+
+	if _, err := io.WriteString(yw.w, "FRAME\n"); err != nil {
+		return err
+	}
+	_, err := yw.w.Write(yw.buf)
+	return err
+}
+
+// rateFraction turns a frame rate into the fraction written to headers,
+// recognizing the NTSC rates such as 30000:1001.
+func rateFraction(fps float64) (num, den int) {
+	if r := math.Round(fps); math.Abs(fps-r) < 0.005 {
+		return int(r), 1
+	}
+	if r := math.Round(fps * 1.001); math.Abs(fps-r/1.001) < 0.005 {
+		return int(r) * 1000, 1001
+	}
+	num, den = int(math.Round(fps*1000)), 1000
+	a, b := num, den
+	for b != 0 {
+		a, b = b, a%b
+	}
+	if a == 0 {
+		return defaultY4MFPS, 1
+	}
+	return num / a, den / a
+}
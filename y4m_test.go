@@ -0,0 +1,151 @@
+package gocam
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readY4M writes frames through a Y4MWriter and reads them back with the
+// file source's Y4M reader.
+func readY4M(t *testing.T, opts *Y4MOptions, frames []Frame) (header string, rd *y4mReader) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "clip.y4m")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := bufio.NewWriter(f)
+	yw := NewY4MWriter(w, opts)
+	for _, frame := range frames {
+		if err := yw.WriteFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := yw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, _, _ = strings.Cut(string(data), "\n")
+
+	f, err = os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	rd, err = newY4MReader(f, bufio.NewReader(f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return header, rd
+}
+
+func TestY4MWriter444RoundTrip(t *testing.T) {
+	frames := []Frame{colorFrame(7, 5), pixelFrame(7, 5)}
+	header, rd := readY4M(t, &Y4MOptions{FPS: 30000.0 / 1001, PixelAspect: [2]int{10, 11}}, frames)
+
+	want := "YUV4MPEG2 W7 H5 F30000:1001 Ip A10:11 C444 XYSCSS=444 XCOLORRANGE=FULL"
+	if header != want {
+		t.Errorf("header %q, want %q", header, want)
+	}
+	for i, frame := range frames {
+		data, w, h, err := rd.next()
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if w != 7 || h != 5 || !bytes.Equal(data, frame.Data) {
+			t.Fatalf("frame %d differs after the round trip", i)
+		}
+	}
+	if _, _, _, err := rd.next(); err == nil {
+		t.Error("extra frame in the stream")
+	}
+}
+
+func TestY4MWriter420(t *testing.T) {
+	// A frame of uniform chroma survives 4:2:0 exactly, odd size included.
+	frame := Frame{Width: 5, Height: 3, Data: make([]byte, 5*3*3)}
+	for i := 0; i < len(frame.Data); i += 3 {
+		frame.Data[i], frame.Data[i+1], frame.Data[i+2] = byte(i), 90, 200
+	}
+	header, rd := readY4M(t, &Y4MOptions{Chroma: Y4M420, FPS: 12.5}, []Frame{frame})
+	if !strings.Contains(header, " F25:2 ") || !strings.Contains(header, " C420jpeg ") {
+		t.Errorf("header %q", header)
+	}
+	data, _, _, err := rd.next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, frame.Data) {
+		t.Fatalf("got %v, want %v", data, frame.Data)
+	}
+}
+
+func TestY4MWriterMeasuresRate(t *testing.T) {
+	start := time.Now()
+	frames := make([]Frame, 3)
+	for i := range frames {
+		frames[i] = colorFrame(4, 2)
+		// Slightly off 15 fps, as real capture timestamps are.
+		frames[i].Timestamp = start.Add(time.Duration(i) * 66 * time.Millisecond)
+	}
+	header, rd := readY4M(t, nil, frames)
+	if !strings.Contains(header, " F15:1 ") {
+		t.Errorf("header %q, want 15 fps", header)
+	}
+	for i := range frames {
+		if _, _, _, err := rd.next(); err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+	}
+
+	// A single frame is written on Close with the default rate.
+	header, rd = readY4M(t, nil, frames[:1])
+	if !strings.Contains(header, " F25:1 ") {
+		t.Errorf("header %q, want the default rate", header)
+	}
+	if _, _, _, err := rd.next(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestY4MWriterRejectsSizeChange(t *testing.T) {
+	yw := NewY4MWriter(&bytes.Buffer{}, &Y4MOptions{FPS: 30})
+	if err := yw.WriteFrame(colorFrame(4, 4)); err != nil {
+		t.Fatal(err)
+	}
+	if err := yw.WriteFrame(colorFrame(8, 4)); err == nil {
+		t.Error("frame of another size accepted")
+	}
+}
+
+func TestRateFraction(t *testing.T) {
+	tests := []struct {
+		fps      float64
+		num, den int
+	}{
+		{30, 30, 1},
+		{29.97, 30000, 1001},
+		{59.94, 60000, 1001},
+		{23.976, 24000, 1001},
+		{12.5, 25, 2},
+		{7.5, 15, 2},
+	}
+	for _, tc := range tests {
+		if num, den := rateFraction(tc.fps); num != tc.num || den != tc.den {
+			t.Errorf("rateFraction(%v) = %d:%d, want %d:%d", tc.fps, num, den, tc.num, tc.den)
+		}
+	}
+}